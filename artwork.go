@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	// image formats we can decode
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+
+	tag "github.com/dhowden/tag"
+	"golang.org/x/image/draw"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Artwork is an image, stored once in the cache however many files use it
+type Artwork struct {
+	ID        uint   `json:"id"`
+	Sha256    string `gorm:"uniqueIndex;size:64" json:"sha256"`
+	MimeType  string `gorm:"size:32" json:"mimeType"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	SizeBytes int64  `json:"sizeBytes"`
+	CachePath string `json:"-"` // cache/artwork/ab/abcdef....jpg
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// FileArtwork links an audio file to an image embedded in it or sitting
+// next to it in the same directory. A cover.jpg that is the same image as
+// the embedded one gets a link of its own.
+type FileArtwork struct {
+	ID            uint    `json:"-"`
+	FileID        uint    `gorm:"uniqueIndex:idx_file_artwork_source" json:"fileId"`
+	ArtworkID     uint    `gorm:"uniqueIndex:idx_file_artwork_source;index" json:"-"`
+	Artwork       Artwork `json:"artwork"`
+	Source        string  `gorm:"size:16" json:"source"`                                          // embedded or sidecar
+	PictureType   string  `gorm:"size:32" json:"pictureType"`                                     // Cover (front), Cover (back)...
+	SidecarFileID uint    `gorm:"uniqueIndex:idx_file_artwork_source;index" json:"sidecarFileId"` // the image file, for sidecars
+	Rank          int     `json:"rank"`                                                           // lower is a better cover
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Create or update the file_artworks table. The unique index used to be
+// file and image only, which left no room for a sidecar of the same image.
+func migrateFileArtwork(db *gorm.DB) {
+	if db.Migrator().HasIndex(&FileArtwork{}, "idx_file_artwork") {
+		db.Migrator().DropIndex(&FileArtwork{}, "idx_file_artwork")
+	}
+
+	db.AutoMigrate(&FileArtwork{})
+}
+
+// Image extensions that can be sidecar artwork
+var imageExtensions = []string{"jpg", "jpeg", "png", "gif", "webp", "bmp"}
+
+var mimeTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"bmp":  "image/bmp",
+}
+
+// Where an image lives in the cache, named by its hash
+func artworkCachePath(sum string, extension string) string {
+	return filepath.Join("cache", "artwork", sum[0:2], sum+"."+extension)
+}
+
+// Where a thumbnail lives in the cache
+func thumbnailCachePath(sum string, size int) string {
+	return filepath.Join("cache", "artwork", "thumbs", strconv.Itoa(size), sum[0:2], sum+".jpg")
+}
+
+// Write a file via a temp file so readers never see half of it
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), ".tmp."+randSeq(16))
+
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Store an image in the cache and the database, unless we already have it
+func storeArtwork(db *gorm.DB, data []byte) (Artwork, error) {
+	sum := sha256.Sum256(data)
+
+	artwork := Artwork{Sha256: hex.EncodeToString(sum[:])}
+
+	if db.Where(&Artwork{Sha256: artwork.Sha256}).First(&artwork).Error == nil {
+		return artwork, nil
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return artwork, err
+	}
+
+	artwork.MimeType = mimeTypes[format]
+	artwork.Width = img.Bounds().Dx()
+	artwork.Height = img.Bounds().Dy()
+	artwork.SizeBytes = int64(len(data))
+	artwork.CachePath = artworkCachePath(artwork.Sha256, format)
+
+	if err := writeFileAtomic(artwork.CachePath, data); err != nil {
+		return artwork, err
+	}
+
+	for _, size := range conf.ArtworkSizes {
+		if err := writeThumbnail(img, artwork.Sha256, size); err != nil {
+			return artwork, err
+		}
+	}
+
+	// another worker may have stored the same image in the meantime
+	db.Clauses(clause.OnConflict{DoNothing: true}).Create(&artwork)
+
+	err = db.Where(&Artwork{Sha256: artwork.Sha256}).First(&artwork).Error
+
+	return artwork, err
+}
+
+// Scale an image down to a width and save it as a jpeg
+func writeThumbnail(img image.Image, sum string, size int) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// never scale up
+	if width > size {
+		height = height * size / width
+		width = size
+	}
+
+	if height < 1 {
+		height = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	// jpeg has no alpha, put transparent images on white
+	draw.Draw(thumb, thumb.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85}); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(thumbnailCachePath(sum, size), buf.Bytes())
+}
+
+// Path to a thumbnail, made now if it isn't in the cache (e.g the sizes
+// changed since the image was stored)
+func getThumbnail(artwork Artwork, size int) (string, error) {
+	path := thumbnailCachePath(artwork.Sha256, size)
+
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	f, err := os.Open(artwork.CachePath)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+
+	if err != nil {
+		return "", err
+	}
+
+	return path, writeThumbnail(img, artwork.Sha256, size)
+}
+
+// Link a file to an image, leaving an existing link alone
+func linkArtwork(db *gorm.DB, link FileArtwork) error {
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&link).Error
+}
+
+// Store the picture embedded in a file's tags
+func parseArtworkToDb(file File, db *gorm.DB) error {
+	f, err := os.Open(file.Base + file.Path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	m, err := tag.ReadFrom(f)
+
+	if errors.Is(err, tag.ErrNoTagsFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// the picture may have changed or gone
+	db.Where(&FileArtwork{FileID: file.ID, Source: "embedded"}).Delete(&FileArtwork{})
+
+	picture := m.Picture()
+
+	if picture == nil || len(picture.Data) == 0 {
+		return nil
+	}
+
+	artwork, err := storeArtwork(db, picture.Data)
+
+	if err != nil {
+		return err
+	}
+
+	rank := 10
+
+	if picture.Type == "Cover (front)" {
+		rank = 0
+	}
+
+	return linkArtwork(db, FileArtwork{
+		FileID:      file.ID,
+		ArtworkID:   artwork.ID,
+		Source:      "embedded",
+		PictureType: picture.Type,
+		Rank:        rank})
+}
+
+// Guess what a sidecar image is and how good a cover it is from its name,
+// cover.jpg beats folder.jpg beats scan_003.jpg
+func sidecarRank(fileName string) (string, int) {
+	name := strings.ToLower(strings.TrimSuffix(fileName, filepath.Ext(fileName)))
+
+	for i, preferred := range conf.ArtworkNames {
+		if name == preferred {
+			return "Cover (front)", 20 + i
+		}
+	}
+
+	if strings.Contains(name, "back") {
+		return "Cover (back)", 60
+	}
+
+	if strings.Contains(name, "cover") || strings.Contains(name, "front") {
+		return "Cover (front)", 40
+	}
+
+	return "Other", 50
+}
+
+// Link loose images to the audio files in the same directory. Images are
+// only read when some audio file there isn't linked to them yet.
+func linkSidecarArtwork(db *gorm.DB, hostName string) {
+	files := make([]File, 0)
+	extensions := make([]string, 0)
+	extensions = append(extensions, imageExtensions...)
+	extensions = append(extensions, audioExtensions...)
+
+	db.Select("id", "path", "base", "file_name", "extension_lower_case").
+		Where(&File{HostName: hostName}).
+		Where("extension_lower_case IN ?", extensions).
+		Find(&files)
+
+	audioByDir := make(map[string][]uint)
+	images := make([]File, 0)
+
+	for _, file := range files {
+		if stringInSlice(file.ExtensionLowerCase, imageExtensions) {
+			images = append(images, file)
+		} else {
+			dir := filepath.Dir(file.Path)
+			audioByDir[dir] = append(audioByDir[dir], file.ID)
+		}
+	}
+
+	// which audio files already have which sidecar, so files added to a
+	// directory later still get its cover
+	links := make([]FileArtwork, 0)
+	db.Select("file_id", "sidecar_file_id").Where("sidecar_file_id > 0").Find(&links)
+
+	linked := make(map[[2]uint]bool)
+
+	for _, link := range links {
+		linked[[2]uint{link.SidecarFileID, link.FileID}] = true
+	}
+
+	for _, sidecar := range images {
+		audio := make([]uint, 0)
+
+		for _, fileID := range audioByDir[filepath.Dir(sidecar.Path)] {
+			if !linked[[2]uint{sidecar.ID, fileID}] {
+				audio = append(audio, fileID)
+			}
+		}
+
+		if len(audio) == 0 {
+			continue
+		}
+
+		sourceHash, err := hashFileImo(sidecar.Base + sidecar.Path)
+
+		if err != nil {
+			recordParseError(db, sidecar, "artwork", "", err)
+			continue
+		}
+
+		// an image that couldn't be read won't read any better until it changes
+		if parseErrorIsCurrent(db, sidecar, "artwork", sourceHash) {
+			continue
+		}
+
+		data, err := os.ReadFile(sidecar.Base + sidecar.Path)
+
+		if err == nil {
+			var artwork Artwork
+
+			artwork, err = storeArtwork(db, data)
+
+			if err == nil {
+				pictureType, rank := sidecarRank(sidecar.FileName)
+
+				for _, fileID := range audio {
+					linkArtwork(db, FileArtwork{
+						FileID:        fileID,
+						ArtworkID:     artwork.ID,
+						Source:        "sidecar",
+						PictureType:   pictureType,
+						SidecarFileID: sidecar.ID,
+						Rank:          rank})
+				}
+			}
+		}
+
+		if err != nil {
+			log.Println("Could not read artwork `" + sidecar.Path + "`: " + err.Error())
+			recordParseError(db, sidecar, "artwork", sourceHash, err)
+			continue
+		}
+
+		clearParseError(db, sidecar, "artwork")
+	}
+}
+
+// Every image linked to a file, best cover first
+func getFileArtwork(db *gorm.DB, fileID uint) []FileArtwork {
+	links := make([]FileArtwork, 0)
+
+	db.Preload("Artwork").Where(&FileArtwork{FileID: fileID}).Order("`rank`, id").Find(&links)
+
+	return links
+}
@@ -0,0 +1,871 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+var (
+	errUnknownContainer = errors.New("unrecognised audio container")
+	errNoAudioStream    = errors.New("no audio stream found")
+)
+
+// flacStreamInfo is the STREAMINFO block every flac file starts with
+type flacStreamInfo struct {
+	MinBlockSize int
+	MaxBlockSize int
+	SampleRate   int
+	Channels     int
+	BitDepth     int
+	TotalSamples int64
+	MD5          [16]byte // md5 of the decoded audio
+}
+
+// Parse the 34 byte STREAMINFO block body
+func parseFLACStreamInfo(b []byte) (flacStreamInfo, error) {
+	info := flacStreamInfo{}
+
+	if len(b) < 34 {
+		return info, errors.New("short flac STREAMINFO")
+	}
+
+	info.MinBlockSize = int(binary.BigEndian.Uint16(b[0:2]))
+	info.MaxBlockSize = int(binary.BigEndian.Uint16(b[2:4]))
+
+	// 20 bits sample rate, 3 bits channels-1, 5 bits bps-1, 36 bits samples
+	packed := binary.BigEndian.Uint64(b[10:18])
+	info.SampleRate = int(packed >> 44)
+	info.Channels = int((packed>>41)&0x07) + 1
+	info.BitDepth = int((packed>>36)&0x1F) + 1
+	info.TotalSamples = int64(packed & 0xFFFFFFFFF)
+
+	copy(info.MD5[:], b[18:34])
+
+	return info, nil
+}
+
+// Read the STREAMINFO block and where the first audio frame starts
+func readFLACStreamInfo(r io.ReadSeeker) (flacStreamInfo, int64, error) {
+	header := make([]byte, 10)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return flacStreamInfo{}, 0, err
+	}
+
+	// Some taggers put ID3 in front of flac
+	offset := id3v2Size(header)
+
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return flacStreamInfo{}, 0, err
+	}
+
+	magic := make([]byte, 4)
+
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "fLaC" {
+		return flacStreamInfo{}, 0, errUnknownContainer
+	}
+
+	offset += 4
+
+	var info flacStreamInfo
+	found := false
+
+	// Walk the metadata blocks, the high bit of the type marks the last one
+	for {
+		blockHeader := make([]byte, 4)
+
+		if _, err := io.ReadFull(r, blockHeader); err != nil {
+			return info, 0, err
+		}
+
+		last := blockHeader[0]&0x80 != 0
+		blockType := blockHeader[0] & 0x7F
+		length := int64(blockHeader[1])<<16 | int64(blockHeader[2])<<8 | int64(blockHeader[3])
+		offset += 4 + length
+
+		if blockType == 0 {
+			body := make([]byte, length)
+
+			if _, err := io.ReadFull(r, body); err != nil {
+				return info, 0, err
+			}
+
+			parsed, err := parseFLACStreamInfo(body)
+
+			if err != nil {
+				return info, 0, err
+			}
+
+			info = parsed
+			found = true
+		} else if _, err := r.Seek(length, io.SeekCurrent); err != nil {
+			return info, 0, err
+		}
+
+		if last {
+			break
+		}
+	}
+
+	if !found {
+		return info, 0, errors.New("flac has no STREAMINFO")
+	}
+
+	return info, offset, nil
+}
+
+func readFLACProperties(f *os.File, size int64) (AudioProperties, error) {
+	props := AudioProperties{Codec: "flac", BitrateMode: "lossless"}
+
+	info, audioStart, err := readFLACStreamInfo(f)
+
+	if err != nil {
+		return props, err
+	}
+
+	props.SampleRate = info.SampleRate
+	props.Channels = info.Channels
+	props.BitDepth = info.BitDepth
+
+	if info.SampleRate > 0 {
+		props.Duration = float64(info.TotalSamples) / float64(info.SampleRate)
+	}
+
+	if props.Duration > 0 {
+		props.Bitrate = int(float64(size-audioStart) * 8 / props.Duration / 1000)
+	}
+
+	return props, nil
+}
+
+// WAVE_FORMAT_* tags, from the fmt chunk of wav and the stream properties of wma
+var waveFormatCodecs = map[uint16]string{
+	0x0001: "pcm",
+	0x0002: "adpcm",
+	0x0003: "pcm_float",
+	0x0006: "alaw",
+	0x0007: "mulaw",
+	0x0011: "ima_adpcm",
+	0x0050: "mp2",
+	0x0055: "mp3",
+	0x0160: "wmav1",
+	0x0161: "wmav2",
+	0x0162: "wmapro",
+	0x0163: "wmalossless",
+	0x2000: "ac3",
+}
+
+// A chunk in a RIFF or IFF file
+type chunkHeader struct {
+	ID   string
+	Size int64
+}
+
+// Walk the chunks of a RIFF/RF64 (little endian) or FORM (big endian) file,
+// calling fn with the reader positioned at the start of each chunk body
+func walkChunks(r io.ReadSeeker, start int64, end int64, order binary.ByteOrder, fn func(chunkHeader) error) error {
+	offset := start
+	header := make([]byte, 8)
+
+	for offset+8 <= end {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil
+		}
+
+		chunk := chunkHeader{ID: string(header[0:4]), Size: int64(order.Uint32(header[4:8]))}
+
+		if err := fn(chunk); err != nil {
+			return err
+		}
+
+		// chunks are padded to an even length
+		offset += 8 + chunk.Size + chunk.Size%2
+	}
+
+	return nil
+}
+
+// fmt and COMM chunks are tens of bytes, a bigger size is corrupt so only
+// this much of it is read
+const maxHeaderChunkSize = 1024
+
+// Read the body of a header chunk, never more than maxHeaderChunkSize
+func readHeaderChunk(r io.Reader, chunk chunkHeader) ([]byte, error) {
+	size := chunk.Size
+
+	if size > maxHeaderChunkSize {
+		size = maxHeaderChunkSize
+	}
+
+	b := make([]byte, size)
+	_, err := io.ReadFull(r, b)
+
+	return b, err
+}
+
+func readWAVProperties(f *os.File, size int64) (AudioProperties, error) {
+	props := AudioProperties{Codec: "pcm", BitrateMode: "lossless"}
+
+	header := make([]byte, 12)
+
+	if _, err := io.ReadFull(f, header); err != nil {
+		return props, err
+	}
+
+	riff := string(header[0:4])
+
+	if (riff != "RIFF" && riff != "RF64") || string(header[8:12]) != "WAVE" {
+		return props, errUnknownContainer
+	}
+
+	var byteRate int
+	var dataSize int64 = -1
+	var ds64DataSize int64 = -1
+
+	err := walkChunks(f, 12, size, binary.LittleEndian, func(chunk chunkHeader) error {
+		switch chunk.ID {
+		case "ds64":
+			// RF64 keeps the real sizes here, the chunk sizes are 0xFFFFFFFF
+			b := make([]byte, 24)
+
+			if _, err := io.ReadFull(f, b); err == nil {
+				ds64DataSize = int64(binary.LittleEndian.Uint64(b[8:16]))
+			}
+		case "fmt ":
+			b, err := readHeaderChunk(f, chunk)
+
+			if err != nil || len(b) < 16 {
+				return errors.New("short wav fmt chunk")
+			}
+
+			formatTag := binary.LittleEndian.Uint16(b[0:2])
+
+			// WAVE_FORMAT_EXTENSIBLE, the real format is at the start of the sub format guid
+			if formatTag == 0xFFFE && len(b) >= 26 {
+				formatTag = binary.LittleEndian.Uint16(b[24:26])
+			}
+
+			if codec, ok := waveFormatCodecs[formatTag]; ok {
+				props.Codec = codec
+			}
+
+			props.Channels = int(binary.LittleEndian.Uint16(b[2:4]))
+			props.SampleRate = int(binary.LittleEndian.Uint32(b[4:8]))
+			byteRate = int(binary.LittleEndian.Uint32(b[8:12]))
+			props.BitDepth = int(binary.LittleEndian.Uint16(b[14:16]))
+		case "data":
+			dataSize = chunk.Size
+
+			if chunk.Size == 0xFFFFFFFF && ds64DataSize >= 0 {
+				dataSize = ds64DataSize
+			}
+
+			// data can be the last chunk and truncated
+			if dataSize > size {
+				dataSize = size
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return props, err
+	}
+
+	if dataSize < 0 || byteRate == 0 {
+		return props, errNoAudioStream
+	}
+
+	props.Duration = float64(dataSize) / float64(byteRate)
+	props.Bitrate = byteRate * 8 / 1000
+
+	if props.Codec != "pcm" && props.Codec != "pcm_float" {
+		props.BitrateMode = "CBR"
+	}
+
+	return props, nil
+}
+
+// Decode an 80 bit IEEE 754 extended float, which AIFF uses for the sample rate
+func float80(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[0:2]) & 0x7FFF)
+	mantissa := binary.BigEndian.Uint64(b[2:10])
+	sign := 1.0
+
+	if b[0]&0x80 != 0 {
+		sign = -1
+	}
+
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+
+	return sign * float64(mantissa) * math.Pow(2, float64(exponent-16383-63))
+}
+
+// AIFC compression types that are still uncompressed audio
+var aiffPCMTypes = map[string]string{
+	"NONE": "pcm",
+	"sowt": "pcm",
+	"twos": "pcm",
+	"raw ": "pcm",
+	"fl32": "pcm_float",
+	"FL32": "pcm_float",
+	"fl64": "pcm_float",
+	"FL64": "pcm_float",
+}
+
+func readAIFFProperties(f *os.File, size int64) (AudioProperties, error) {
+	props := AudioProperties{Codec: "pcm", BitrateMode: "lossless"}
+
+	header := make([]byte, 12)
+
+	if _, err := io.ReadFull(f, header); err != nil {
+		return props, err
+	}
+
+	form := string(header[8:12])
+
+	if string(header[0:4]) != "FORM" || (form != "AIFF" && form != "AIFC") {
+		return props, errUnknownContainer
+	}
+
+	var frames int64 = -1
+
+	err := walkChunks(f, 12, size, binary.BigEndian, func(chunk chunkHeader) error {
+		if chunk.ID != "COMM" {
+			return nil
+		}
+
+		b, err := readHeaderChunk(f, chunk)
+
+		if err != nil || len(b) < 18 {
+			return errors.New("short aiff COMM chunk")
+		}
+
+		props.Channels = int(binary.BigEndian.Uint16(b[0:2]))
+		frames = int64(binary.BigEndian.Uint32(b[2:6]))
+		props.BitDepth = int(binary.BigEndian.Uint16(b[6:8]))
+		props.SampleRate = int(math.Round(float80(b[8:18])))
+
+		if form == "AIFC" && len(b) >= 22 {
+			compression := string(b[18:22])
+
+			if codec, ok := aiffPCMTypes[compression]; ok {
+				props.Codec = codec
+			} else {
+				props.Codec = strings.ToLower(strings.TrimSpace(compression))
+				props.BitrateMode = "CBR"
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return props, err
+	}
+
+	if frames < 0 || props.SampleRate == 0 {
+		return props, errNoAudioStream
+	}
+
+	props.Duration = float64(frames) / float64(props.SampleRate)
+	props.Bitrate = props.SampleRate * props.Channels * props.BitDepth / 1000
+
+	return props, nil
+}
+
+// An MP4 box (atom)
+type mp4Box struct {
+	Type   string
+	Start  int64 // offset of the body
+	Size   int64 // size of the body
+	Header int64
+}
+
+// List the boxes between start and end
+func readMP4Boxes(r io.ReaderAt, start int64, end int64) []mp4Box {
+	boxes := make([]mp4Box, 0)
+	header := make([]byte, 16)
+	offset := start
+
+	for offset+8 <= end {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			break
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		box := mp4Box{Type: string(header[4:8]), Header: 8}
+
+		switch size {
+		case 0:
+			// runs to the end of the file
+			size = end - offset
+		case 1:
+			// 64 bit size follows the type
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return boxes
+			}
+
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			box.Header = 16
+		}
+
+		if size < box.Header || offset+size > end {
+			break
+		}
+
+		box.Start = offset + box.Header
+		box.Size = size - box.Header
+		boxes = append(boxes, box)
+
+		offset += size
+	}
+
+	return boxes
+}
+
+// Find a box by path, e.g moov/trak
+func findMP4Box(r io.ReaderAt, boxes []mp4Box, path ...string) []mp4Box {
+	found := make([]mp4Box, 0)
+
+	for _, box := range boxes {
+		if box.Type != path[0] {
+			continue
+		}
+
+		if len(path) == 1 {
+			found = append(found, box)
+			continue
+		}
+
+		found = append(found, findMP4Box(r, readMP4Boxes(r, box.Start, box.Start+box.Size), path[1:]...)...)
+	}
+
+	return found
+}
+
+// Read a box body into memory
+func readMP4BoxBody(r io.ReaderAt, box mp4Box) []byte {
+	b := make([]byte, box.Size)
+
+	if _, err := r.ReadAt(b, box.Start); err != nil && err != io.EOF {
+		return nil
+	}
+
+	return b
+}
+
+// Timescale and duration from an mvhd or mdhd box
+func mp4Duration(b []byte) (float64, bool) {
+	if len(b) < 24 {
+		return 0, false
+	}
+
+	var timescale, duration uint64
+
+	if b[0] == 1 {
+		if len(b) < 36 {
+			return 0, false
+		}
+
+		timescale = uint64(binary.BigEndian.Uint32(b[20:24]))
+		duration = binary.BigEndian.Uint64(b[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(b[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(b[16:20]))
+	}
+
+	if timescale == 0 {
+		return 0, false
+	}
+
+	return float64(duration) / float64(timescale), true
+}
+
+func readMP4Properties(f *os.File, size int64) (AudioProperties, error) {
+	props := AudioProperties{}
+
+	top := readMP4Boxes(f, 0, size)
+
+	if len(top) == 0 || top[0].Type != "ftyp" {
+		return props, errUnknownContainer
+	}
+
+	for _, trak := range findMP4Box(f, top, "moov", "trak") {
+		children := readMP4Boxes(f, trak.Start, trak.Start+trak.Size)
+
+		// Only sound tracks
+		hdlr := findMP4Box(f, children, "mdia", "hdlr")
+
+		if len(hdlr) == 0 {
+			continue
+		}
+
+		handler := readMP4BoxBody(f, hdlr[0])
+
+		if len(handler) < 12 || string(handler[8:12]) != "soun" {
+			continue
+		}
+
+		if mdhd := findMP4Box(f, children, "mdia", "mdhd"); len(mdhd) > 0 {
+			props.Duration, _ = mp4Duration(readMP4BoxBody(f, mdhd[0]))
+		}
+
+		stsd := findMP4Box(f, children, "mdia", "minf", "stbl", "stsd")
+
+		if len(stsd) == 0 {
+			continue
+		}
+
+		// full box header (4) + entry count (4), then the first sample entry
+		entries := readMP4Boxes(f, stsd[0].Start+8, stsd[0].Start+stsd[0].Size)
+
+		if len(entries) == 0 {
+			continue
+		}
+
+		entry := entries[0]
+		body := readMP4BoxBody(f, entry)
+
+		// reserved (6) + data ref (2) + version/revision/vendor (8) + channels (2)
+		// + sample size (2) + compression id (2) + packet size (2) + rate (4, 16.16)
+		if len(body) < 28 {
+			continue
+		}
+
+		props.Channels = int(binary.BigEndian.Uint16(body[16:18]))
+		props.BitDepth = int(binary.BigEndian.Uint16(body[18:20]))
+		props.SampleRate = int(binary.BigEndian.Uint32(body[24:28]) >> 16)
+
+		children = readMP4Boxes(f, entry.Start+28, entry.Start+entry.Size)
+
+		switch entry.Type {
+		case "alac":
+			props.Codec = "alac"
+			props.BitrateMode = "lossless"
+
+			// The magic cookie has the real values
+			if alac := findMP4Box(f, children, "alac"); len(alac) > 0 {
+				cookie := readMP4BoxBody(f, alac[0])
+
+				if len(cookie) >= 28 {
+					props.BitDepth = int(cookie[9])
+					props.Channels = int(cookie[13])
+					props.SampleRate = int(binary.BigEndian.Uint32(cookie[24:28]))
+				}
+			}
+		case "mp4a":
+			props.Codec = "aac"
+			props.BitrateMode = "VBR"
+
+			// AAC is always decoded to floats, the sample size is meaningless
+			props.BitDepth = 0
+
+			if esds := findMP4Box(f, children, "esds"); len(esds) > 0 {
+				if max, avg := mp4ESDSBitrates(readMP4BoxBody(f, esds[0])); max > 0 && max == avg {
+					props.BitrateMode = "CBR"
+				}
+			}
+		default:
+			props.Codec = strings.TrimSpace(entry.Type)
+		}
+
+		break
+	}
+
+	if len(props.Codec) == 0 {
+		return props, errNoAudioStream
+	}
+
+	if props.Duration == 0 {
+		if mvhd := findMP4Box(f, top, "moov", "mvhd"); len(mvhd) > 0 {
+			props.Duration, _ = mp4Duration(readMP4BoxBody(f, mvhd[0]))
+		}
+	}
+
+	// Work the bitrate out from the audio data
+	if props.Duration > 0 {
+		var audioBytes int64
+
+		for _, mdat := range findMP4Box(f, top, "mdat") {
+			audioBytes += mdat.Size
+		}
+
+		props.Bitrate = int(float64(audioBytes) * 8 / props.Duration / 1000)
+	}
+
+	return props, nil
+}
+
+// Max and average bitrate from the DecoderConfigDescriptor in an esds box
+func mp4ESDSBitrates(b []byte) (int, int) {
+	// skip the full box header then look for the DecoderConfigDescriptor tag
+	for i := 4; i+18 <= len(b); i++ {
+		if b[i] != 0x04 {
+			continue
+		}
+
+		// descriptor length is 1-4 bytes with the high bit as a continuation flag
+		j := i + 1
+		for j < i+5 && b[j]&0x80 != 0 {
+			j++
+		}
+		j++
+
+		if j+13 > len(b) {
+			break
+		}
+
+		// object type (1) + stream type (1) + buffer size (3), then max and avg bitrate
+		max := int(binary.BigEndian.Uint32(b[j+5 : j+9]))
+		avg := int(binary.BigEndian.Uint32(b[j+9 : j+13]))
+
+		return max, avg
+	}
+
+	return 0, 0
+}
+
+// An ogg page header
+type oggPage struct {
+	HeaderType byte
+	Granule    int64
+	Serial     uint32
+	Segments   []byte
+}
+
+// Read the first packet of an ogg stream
+func readOggFirstPacket(r io.Reader) (oggPage, []byte, error) {
+	header := make([]byte, 27)
+
+	if _, err := io.ReadFull(r, header); err != nil || string(header[0:4]) != "OggS" {
+		return oggPage{}, nil, errUnknownContainer
+	}
+
+	page := oggPage{
+		HeaderType: header[5],
+		Granule:    int64(binary.LittleEndian.Uint64(header[6:14])),
+		Serial:     binary.LittleEndian.Uint32(header[14:18])}
+
+	page.Segments = make([]byte, header[26])
+
+	if _, err := io.ReadFull(r, page.Segments); err != nil {
+		return page, nil, err
+	}
+
+	// the first packet ends at the first segment shorter than 255
+	length := 0
+
+	for _, segment := range page.Segments {
+		length += int(segment)
+
+		if segment < 255 {
+			break
+		}
+	}
+
+	packet := make([]byte, length)
+
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return page, nil, err
+	}
+
+	return page, packet, nil
+}
+
+// Granule position of the last page in a stream, read from the end of the file
+func lastOggGranule(f *os.File, size int64, serial uint32) int64 {
+	readSize := int64(64 * 1024)
+
+	if readSize > size {
+		readSize = size
+	}
+
+	b := make([]byte, readSize)
+
+	if _, err := f.ReadAt(b, size-readSize); err != nil && err != io.EOF {
+		return -1
+	}
+
+	for i := len(b) - 27; i >= 0; i-- {
+		if string(b[i:i+4]) != "OggS" {
+			continue
+		}
+
+		if binary.LittleEndian.Uint32(b[i+14:i+18]) != serial {
+			continue
+		}
+
+		return int64(binary.LittleEndian.Uint64(b[i+6 : i+14]))
+	}
+
+	return -1
+}
+
+func readOggProperties(f *os.File, size int64) (AudioProperties, error) {
+	props := AudioProperties{}
+
+	page, packet, err := readOggFirstPacket(f)
+
+	if err != nil {
+		return props, err
+	}
+
+	var samplesPerSecond float64
+	var preSkip int64
+
+	switch {
+	case len(packet) >= 30 && bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		props.Codec = "vorbis"
+		props.BitrateMode = "VBR"
+		props.Channels = int(packet[11])
+		props.SampleRate = int(binary.LittleEndian.Uint32(packet[12:16]))
+		samplesPerSecond = float64(props.SampleRate)
+
+		maximum := int32(binary.LittleEndian.Uint32(packet[16:20]))
+		nominal := int32(binary.LittleEndian.Uint32(packet[20:24]))
+		minimum := int32(binary.LittleEndian.Uint32(packet[24:28]))
+
+		if nominal > 0 && maximum == nominal && minimum == nominal {
+			props.BitrateMode = "CBR"
+		}
+	case len(packet) >= 19 && bytes.HasPrefix(packet, []byte("OpusHead")):
+		props.Codec = "opus"
+		props.BitrateMode = "VBR"
+		props.Channels = int(packet[9])
+		preSkip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+		// the rate the source had, opus itself always runs at 48kHz
+		props.SampleRate = int(binary.LittleEndian.Uint32(packet[12:16]))
+		samplesPerSecond = 48000
+
+		if props.SampleRate == 0 {
+			props.SampleRate = 48000
+		}
+	case len(packet) >= 51 && bytes.HasPrefix(packet, []byte("\x7fFLAC")):
+		// mapping header (9) + "fLaC" (4) + block header (4) + STREAMINFO
+		info, err := parseFLACStreamInfo(packet[17:])
+
+		if err != nil {
+			return props, err
+		}
+
+		props.Codec = "flac"
+		props.BitrateMode = "lossless"
+		props.Channels = info.Channels
+		props.SampleRate = info.SampleRate
+		props.BitDepth = info.BitDepth
+		samplesPerSecond = float64(info.SampleRate)
+	default:
+		return props, errNoAudioStream
+	}
+
+	granule := lastOggGranule(f, size, page.Serial)
+
+	if granule > preSkip && samplesPerSecond > 0 {
+		props.Duration = float64(granule-preSkip) / samplesPerSecond
+		props.Bitrate = int(float64(size) * 8 / props.Duration / 1000)
+	}
+
+	return props, nil
+}
+
+// ASF object GUIDs, as they appear on disk
+var (
+	asfHeaderGUID           = []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11, 0xA6, 0xD9, 0x00, 0xAA, 0x00, 0x62, 0xCE, 0x6C}
+	asfFilePropertiesGUID   = []byte{0xA1, 0xDC, 0xAB, 0x8C, 0x47, 0xA9, 0xCF, 0x11, 0x8E, 0xE4, 0x00, 0xC0, 0x0C, 0x20, 0x53, 0x65}
+	asfStreamPropertiesGUID = []byte{0x91, 0x07, 0xDC, 0xB7, 0xB7, 0xA9, 0xCF, 0x11, 0x8E, 0xE6, 0x00, 0xC0, 0x0C, 0x20, 0x53, 0x65}
+	asfAudioMediaGUID       = []byte{0x40, 0x9E, 0x69, 0xF8, 0x4D, 0x5B, 0xCF, 0x11, 0xA8, 0xFD, 0x00, 0x80, 0x5F, 0x5C, 0x44, 0x2B}
+)
+
+func readASFProperties(f *os.File, size int64) (AudioProperties, error) {
+	props := AudioProperties{BitrateMode: "CBR"}
+
+	header := make([]byte, 30)
+
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.Equal(header[0:16], asfHeaderGUID) {
+		return props, errUnknownContainer
+	}
+
+	headerSize := int64(binary.LittleEndian.Uint64(header[16:24]))
+	count := int(binary.LittleEndian.Uint32(header[24:28]))
+
+	if headerSize > size || headerSize < 30 {
+		return props, errUnknownContainer
+	}
+
+	body := make([]byte, headerSize-30)
+
+	if _, err := io.ReadFull(f, body); err != nil {
+		return props, err
+	}
+
+	offset := 0
+	found := false
+
+	for i := 0; i < count && offset+24 <= len(body); i++ {
+		guid := body[offset : offset+16]
+		objectSize := int(binary.LittleEndian.Uint64(body[offset+16 : offset+24]))
+
+		if objectSize < 24 || offset+objectSize > len(body) {
+			break
+		}
+
+		object := body[offset+24 : offset+objectSize]
+
+		switch {
+		case bytes.Equal(guid, asfFilePropertiesGUID) && len(object) >= 80:
+			// play duration is in 100ns units and includes the preroll in ms
+			playDuration := binary.LittleEndian.Uint64(object[40:48])
+			preroll := binary.LittleEndian.Uint64(object[56:64])
+			props.Duration = float64(playDuration)/1e7 - float64(preroll)/1000
+		case bytes.Equal(guid, asfStreamPropertiesGUID) && len(object) >= 54 && bytes.Equal(object[0:16], asfAudioMediaGUID) && !found:
+			// type specific data is a WAVEFORMATEX
+			wf := object[54:]
+
+			if len(wf) < 16 {
+				break
+			}
+
+			formatTag := binary.LittleEndian.Uint16(wf[0:2])
+			props.Codec = "wma"
+
+			if codec, ok := waveFormatCodecs[formatTag]; ok {
+				props.Codec = codec
+			}
+
+			if formatTag == 0x0163 {
+				props.BitrateMode = "lossless"
+			}
+
+			props.Channels = int(binary.LittleEndian.Uint16(wf[2:4]))
+			props.SampleRate = int(binary.LittleEndian.Uint32(wf[4:8]))
+			props.Bitrate = int(binary.LittleEndian.Uint32(wf[8:12])) * 8 / 1000
+			props.BitDepth = int(binary.LittleEndian.Uint16(wf[14:16]))
+			found = true
+		}
+
+		offset += objectSize
+	}
+
+	if !found {
+		return props, errNoAudioStream
+	}
+
+	if props.Duration < 0 {
+		props.Duration = 0
+	}
+
+	return props, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AudioProperties is what the container headers say about the audio stream
+type AudioProperties struct {
+	ID          uint
+	FileID      uint    `gorm:"uniqueIndex" json:"fileId"`
+	Codec       string  `gorm:"index;size:32" json:"codec"`      // mp3, flac, aac, alac, vorbis, opus, pcm, wmav2...
+	Duration    float64 `gorm:"index" json:"duration"`           // seconds
+	Bitrate     int     `gorm:"index" json:"bitrate"`            // kbps, average for VBR
+	BitrateMode string  `gorm:"index;size:8" json:"bitrateMode"` // CBR, VBR, ABR or lossless
+	SampleRate  int     `gorm:"index" json:"sampleRate"`
+	BitDepth    int     `json:"bitDepth"` // 0 for lossy codecs
+	Channels    int     `json:"channels"`
+	Encoder     string  `json:"encoder"` // from the LAME tag, e.g LAME3.100
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Extensions we know how to read, everything else is skipped
+var audioExtensions = []string{"mp3", "mp2", "flac", "wav", "aif", "aiff", "aifc", "m4a", "mp4", "ogg", "oga", "opus", "wma"}
+
+// Read the stream properties from the headers of an audio file
+func readAudioProperties(path string, extension string) (AudioProperties, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return AudioProperties{}, err
+	}
+
+	defer f.Close()
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		return AudioProperties{}, err
+	}
+
+	size := stat.Size()
+
+	switch strings.ToLower(extension) {
+	case "mp3", "mp2":
+		return readMP3Properties(f, size)
+	case "flac":
+		return readFLACProperties(f, size)
+	case "wav":
+		return readWAVProperties(f, size)
+	case "aif", "aiff", "aifc":
+		return readAIFFProperties(f, size)
+	case "m4a", "mp4":
+		return readMP4Properties(f, size)
+	case "ogg", "oga", "opus":
+		return readOggProperties(f, size)
+	case "wma":
+		return readASFProperties(f, size)
+	}
+
+	return AudioProperties{}, errUnknownContainer
+}
+
+// Parse a file's stream properties and insert or update its row
+func parseAudioPropertiesToDb(file File, db *gorm.DB) error {
+	if !stringInSlice(file.ExtensionLowerCase, audioExtensions) {
+		return nil
+	}
+
+	props, err := readAudioProperties(file.Base+file.Path, file.ExtensionLowerCase)
+
+	if err != nil {
+		return err
+	}
+
+	props.FileID = file.ID
+
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}},
+		UpdateAll: true}).Create(&props).Error
+}
+
+// Audio properties joined to their file path
+type audioPropertiesRow struct {
+	AudioProperties
+	Path string `json:"path"`
+}
+
+// Query stream properties, filtered by codec, bitrate mode and path
+func findAudioProperties(db *gorm.DB, codec string, mode string, path string, limit int, offset int) []audioPropertiesRow {
+	rows := make([]audioPropertiesRow, 0)
+
+	query := db.Table("audio_properties").
+		Select("audio_properties.*, files.path").
+		Joins("JOIN files ON files.id = audio_properties.file_id")
+
+	if len(codec) > 0 {
+		query = query.Where("audio_properties.codec = ?", codec)
+	}
+
+	if len(mode) > 0 {
+		query = query.Where("audio_properties.bitrate_mode = ?", mode)
+	}
+
+	if len(path) > 0 {
+		query = query.Where("files.path LIKE ?", "%"+path+"%")
+	}
+
+	if limit > 0 {
+		query = query.Limit(limit).Offset(offset)
+	}
+
+	query.Order("files.path").Scan(&rows)
+
+	return rows
+}
+
+// Format seconds as m:ss
+func formatDuration(seconds float64) string {
+	total := int(seconds + 0.5)
+
+	return fmt.Sprintf("%d:%02d", total/60, total%60)
+}
+
+// List stream properties, optionally only for paths containing a filter
+func listAudioProperties(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&AudioProperties{})
+
+	filter := ""
+
+	if len(args) > 0 {
+		filter = args[0]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tCODEC\tDURATION\tBITRATE\tMODE\tRATE\tBITS\tCHANNELS\tPATH")
+
+	for _, row := range findAudioProperties(db, "", "", filter, 0, 0) {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%d\t%d\t%d\t%s\n",
+			row.FileID,
+			row.Codec,
+			formatDuration(row.Duration),
+			row.Bitrate,
+			row.BitrateMode,
+			row.SampleRate,
+			row.BitDepth,
+			row.Channels,
+			row.Path)
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// BPMKey is the tempo and key worked out from the audio of a file, the
+// tagged ones are in Tag
+type BPMKey struct {
+	ID            uint      `json:"id"`
+	FileID        uint      `gorm:"uniqueIndex" json:"fileId"`
+	SourceHash    string    `gorm:"size:32" json:"-"` // imohash of the file when it was analysed
+	BPM           float64   `gorm:"index" json:"bpm"`
+	BPMConfidence float64   `json:"bpmConfidence"`               // 0 to 1
+	Key           string    `gorm:"index;size:8" json:"key"`     // e.g Am, F#, Bbm
+	Camelot       string    `gorm:"index;size:4" json:"camelot"` // e.g 8A
+	KeyConfidence float64   `json:"keyConfidence"`               // 0 to 1
+	CreatedAt     time.Time `json:"-"`
+	UpdatedAt     time.Time `json:"-"`
+}
+
+// Tempos looked for, half or double time outside it is picked instead
+const minBPM = 60.0
+const maxBPM = 200.0
+
+// Most dance music sits around here, used to pick between half and double
+const likelyBPM = 120.0
+
+// A DJ mix can be hours long, the first ten minutes say enough
+const bpmKeySeconds = 600
+
+var pitchClasses = []string{"C", "Db", "D", "Eb", "E", "F", "F#", "G", "Ab", "A", "Bb", "B"}
+
+// Krumhansl-Kessler key profiles, starting at the tonic
+var majorProfile = []float64{6.35, 2.23, 3.48, 2.33, 4.38, 4.09, 2.52, 5.19, 2.39, 3.66, 2.29, 2.88}
+var minorProfile = []float64{6.33, 2.68, 3.52, 5.38, 2.60, 3.53, 2.54, 4.75, 3.98, 2.69, 3.34, 3.17}
+
+// Camelot wheel position of a key, C major is 8B and A minor 8A
+func camelot(pitchClass int, minor bool) string {
+	if minor {
+		return strconv.Itoa((7*((pitchClass+3)%12)+7)%12+1) + "A"
+	}
+
+	return strconv.Itoa((7*pitchClass+7)%12+1) + "B"
+}
+
+var noteNames = map[string]int{
+	"c": 0, "c#": 1, "db": 1, "d": 2, "d#": 3, "eb": 3, "e": 4, "fb": 4, "e#": 5, "f": 5, "f#": 6, "gb": 6,
+	"g": 7, "g#": 8, "ab": 8, "a": 9, "a#": 10, "bb": 10, "b": 11, "cb": 11, "b#": 0,
+}
+
+var camelotPattern = regexp.MustCompile(`^(1[0-2]|0?[1-9])([ab])$`)
+var openKeyPattern = regexp.MustCompile(`^(1[0-2]|0?[1-9])([dm])$`)
+var keyPattern = regexp.MustCompile(`^([a-g][#b♯♭]?)\s*(m|min|minor|maj|major)?$`)
+
+// Camelot notation of a tagged key, e.g "Am", "F# minor", "Bbmaj", "8A" or
+// open key "1m". Empty if it can't be read.
+func camelotFromKey(key string) string {
+	key = strings.ToLower(strings.TrimSpace(key))
+
+	if m := camelotPattern.FindStringSubmatch(key); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return strconv.Itoa(n) + strings.ToUpper(m[2])
+	}
+
+	// open key 1d is C major, 1m is A minor, 7 places round from camelot
+	if m := openKeyPattern.FindStringSubmatch(key); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		letter := "B"
+
+		if m[2] == "m" {
+			letter = "A"
+		}
+
+		return strconv.Itoa((n+6)%12+1) + letter
+	}
+
+	if m := keyPattern.FindStringSubmatch(key); m != nil {
+		note := strings.NewReplacer("♯", "#", "♭", "b").Replace(m[1])
+		pitchClass, ok := noteNames[note]
+
+		if !ok {
+			return ""
+		}
+
+		return camelot(pitchClass, m[2] == "m" || m[2] == "min" || m[2] == "minor")
+	}
+
+	return ""
+}
+
+// Keys that mix well with a camelot key: itself, its relative major or
+// minor, and one step either way round the wheel
+func camelotCompatible(key string) []string {
+	m := camelotPattern.FindStringSubmatch(strings.ToLower(key))
+
+	if m == nil {
+		return []string{}
+	}
+
+	n, _ := strconv.Atoi(m[1])
+	letter := strings.ToUpper(m[2])
+	other := "A"
+
+	if letter == "A" {
+		other = "B"
+	}
+
+	return []string{
+		strconv.Itoa(n) + letter,
+		strconv.Itoa(n) + other,
+		strconv.Itoa((n+10)%12+1) + letter,
+		strconv.Itoa(n%12+1) + letter}
+}
+
+// Smallest power of two at least n
+func nextPowerOfTwo(n int) int {
+	size := 1
+
+	for size < n {
+		size <<= 1
+	}
+
+	return size
+}
+
+// Tempo from an onset envelope sampled rate times a second: autocorrelate
+// it, weight each lag by how close it is to a likely tempo and by the
+// lag twice as long, then interpolate the peak
+func estimateBPM(onsets []float64, rate float64) (float64, float64) {
+	if len(onsets) < int(rate*10) {
+		return 0, 0
+	}
+
+	mean := meanOf(onsets)
+	envelope := make([]float64, len(onsets))
+
+	for i, onset := range onsets {
+		envelope[i] = onset - mean
+	}
+
+	minLag := int(math.Floor(60 * rate / maxBPM))
+	maxLag := int(math.Ceil(60 * rate / minBPM))
+	correlation := make([]float64, 2*maxLag+2)
+
+	for lag := range correlation {
+		sum := 0.0
+
+		for i := lag; i < len(envelope); i++ {
+			sum += envelope[i] * envelope[i-lag]
+		}
+
+		correlation[lag] = sum
+	}
+
+	if correlation[0] <= 0 {
+		return 0, 0
+	}
+
+	best := 0
+	bestScore := math.Inf(-1)
+
+	for lag := minLag; lag <= maxLag; lag++ {
+		bpm := 60 * rate / float64(lag)
+		prior := math.Exp(-0.5 * math.Pow(math.Log2(bpm/likelyBPM), 2))
+		score := (correlation[lag] + 0.5*correlation[2*lag]) * prior
+
+		if score > bestScore {
+			bestScore = score
+			best = lag
+		}
+	}
+
+	// parabola through the peak and its neighbours
+	lag := float64(best)
+	a, b, c := correlation[best-1], correlation[best], correlation[best+1]
+
+	if denominator := a - 2*b + c; denominator != 0 {
+		lag += 0.5 * (a - c) / denominator
+	}
+
+	return math.Round(600*rate/lag) / 10, roundTo(clamp01(correlation[best]/correlation[0]), 2)
+}
+
+// Key from a pitch class profile, the best match of the 24 major and minor
+// profiles. Confidence is how far ahead of the runner up it is.
+func estimateKey(chroma [12]float64) (string, string, float64) {
+	best, second := -2.0, -2.0
+	key, camelotKey := "", ""
+
+	for tonic := 0; tonic < 12; tonic++ {
+		for _, minor := range []bool{false, true} {
+			profile := majorProfile
+
+			if minor {
+				profile = minorProfile
+			}
+
+			rotated := make([]float64, 12)
+
+			for i := range rotated {
+				rotated[(tonic+i)%12] = profile[i]
+			}
+
+			r := correlate(chroma[:], rotated)
+
+			if r > best {
+				second = best
+				best = r
+				key = pitchClasses[tonic]
+				camelotKey = camelot(tonic, minor)
+
+				if minor {
+					key += "m"
+				}
+			} else if r > second {
+				second = r
+			}
+		}
+	}
+
+	if best <= -2 {
+		return "", "", 0
+	}
+
+	return key, camelotKey, roundTo(clamp01((best-second)*10), 2)
+}
+
+// Pearson correlation
+func correlate(a []float64, b []float64) float64 {
+	meanA, meanB := meanOf(a), meanOf(b)
+	var sum, sumA, sumB float64
+
+	for i := range a {
+		sum += (a[i] - meanA) * (b[i] - meanB)
+		sumA += (a[i] - meanA) * (a[i] - meanA)
+		sumB += (b[i] - meanB) * (b[i] - meanB)
+	}
+
+	if sumA == 0 || sumB == 0 {
+		return -2
+	}
+
+	return sum / math.Sqrt(sumA*sumB)
+}
+
+// Decode a file and estimate its tempo and key
+func analyseBPMKey(path string, extension string) (BPMKey, error) {
+	result := BPMKey{}
+
+	reader, err := openPCM(path, extension)
+
+	if err != nil {
+		return result, err
+	}
+
+	defer reader.Close()
+
+	sampleRate := reader.Format().SampleRate
+
+	// onsets from frames of about 46ms every 12ms
+	onsetSize := nextPowerOfTwo(sampleRate * 46 / 1000)
+	onsetHop := onsetSize / 4
+	onsetWindow := hannWindow(onsetSize)
+	onsetPower := make([]float64, onsetSize/2+1)
+	previous := make([]float64, onsetSize/2+1)
+	onsets := make([]float64, 0)
+
+	onsetFramer := newFramer(onsetSize, onsetHop, func(frame []float64) {
+		powerSpectrum(frame, onsetWindow, onsetPower)
+
+		// spectral flux of the log magnitude, only where it gets louder
+		flux := 0.0
+
+		for i, power := range onsetPower {
+			magnitude := math.Log1p(1000 * math.Sqrt(power))
+			flux += math.Max(0, magnitude-previous[i])
+			previous[i] = magnitude
+		}
+
+		onsets = append(onsets, flux)
+	})
+
+	// chroma from frames of about 190ms, fine enough to split low notes
+	keySize := nextPowerOfTwo(sampleRate * 190 / 1000)
+	keyWindow := hannWindow(keySize)
+	keyPower := make([]float64, keySize/2+1)
+	notes := make([]int, keySize/2+1)
+	binHz := float64(sampleRate) / float64(keySize)
+
+	for i := range notes {
+		notes[i] = -1
+
+		if freq := float64(i) * binHz; freq >= 55 && freq <= 2000 {
+			notes[i] = ((int(math.Round(12*math.Log2(freq/440)))+9)%12 + 12) % 12
+		}
+	}
+
+	var chroma [12]float64
+
+	keyFramer := newFramer(keySize, keySize/2, func(frame []float64) {
+		powerSpectrum(frame, keyWindow, keyPower)
+
+		var features [12]float64
+		total := 0.0
+
+		for i, power := range keyPower {
+			if notes[i] >= 0 {
+				features[notes[i]] += math.Sqrt(power)
+				total += math.Sqrt(power)
+			}
+		}
+
+		// every frame counts the same however loud it is
+		if total > 0 {
+			for c := range chroma {
+				chroma[c] += features[c] / total
+			}
+		}
+	})
+
+	limit := sampleRate * bpmKeySeconds
+	read := 0
+
+	err = readMono(reader, func(block []float64) error {
+		onsetFramer.push(block)
+		keyFramer.push(block)
+		read += len(block)
+
+		if read >= limit {
+			return errEnoughAudio
+		}
+
+		return nil
+	})
+
+	if err != nil && err != errEnoughAudio {
+		return result, err
+	}
+
+	if len(onsets) == 0 {
+		return result, errors.New("too short to analyse")
+	}
+
+	result.BPM, result.BPMConfidence = estimateBPM(onsets, float64(sampleRate)/float64(onsetHop))
+	result.Key, result.Camelot, result.KeyConfidence = estimateKey(chroma)
+
+	return result, nil
+}
+
+// Analyse every audio file on this host that is new or has changed
+func analyseBPMKeys(db *gorm.DB, hostName string, path string, rescan bool) {
+	jobs := make(chan File)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for file := range jobs {
+				sourceHash, err := hashFileImo(file.Base + file.Path)
+
+				if err != nil {
+					log.Println("Could not read `" + file.Path + "`: " + err.Error())
+					recordParseError(db, file, "read", "", err)
+					continue
+				}
+
+				var count int64
+				db.Model(&BPMKey{}).Where(&BPMKey{FileID: file.ID, SourceHash: sourceHash}).Count(&count)
+
+				if count > 0 && !rescan {
+					continue
+				}
+
+				analysis, err := analyseBPMKey(file.Base+file.Path, file.ExtensionLowerCase)
+
+				if err != nil {
+					log.Println("Could not analyse `" + file.Path + "`: " + err.Error())
+					recordParseError(db, file, "bpmkey", sourceHash, err)
+					continue
+				}
+
+				clearParseError(db, file, "bpmkey")
+
+				analysis.FileID = file.ID
+				analysis.SourceHash = sourceHash
+
+				db.Clauses(clause.OnConflict{
+					Columns:   []clause.Column{{Name: "file_id"}},
+					UpdateAll: true}).Create(&analysis)
+			}
+		}()
+	}
+
+	query := db.Where(&File{HostName: hostName}).Where("extension_lower_case IN ?", audioExtensions)
+
+	if len(path) > 0 {
+		query = query.Where("path LIKE ?", "%"+path+"%")
+	}
+
+	batch := make([]File, 0)
+
+	query.FindInBatches(&batch, 500, func(tx *gorm.DB, n int) error {
+		for _, file := range batch {
+			jobs <- file
+		}
+
+		return nil
+	})
+
+	close(jobs)
+	wg.Wait()
+}
+
+// Detected tempo and key next to the tagged ones
+type bpmKeyRow struct {
+	BPMKey
+	Path       string  `json:"path"`
+	Artist     string  `json:"artist"`
+	Title      string  `json:"title"`
+	TagBPM     float64 `json:"tagBpm"`
+	TagKey     string  `json:"tagKey"`
+	TagCamelot string  `json:"tagCamelot"`
+}
+
+// Parse a tempo filter, "128" or "120-130"
+func parseBPMRange(value string) (float64, float64, error) {
+	if len(value) == 0 {
+		return 0, 0, nil
+	}
+
+	parts := strings.SplitN(value, "-", 2)
+	low, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+
+	if err != nil {
+		return 0, 0, errors.New("`" + value + "` isn't a bpm or a range of them")
+	}
+
+	high := low
+
+	if len(parts) == 2 {
+		if high, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil {
+			return 0, 0, errors.New("`" + value + "` isn't a bpm or a range of them")
+		}
+	}
+
+	return low, high, nil
+}
+
+// Files by detected tempo and camelot key. Keys can be several, e.g the
+// ones compatible with a track.
+func findBPMKeys(db *gorm.DB, path string, low float64, high float64, keys []string) []bpmKeyRow {
+	rows := make([]bpmKeyRow, 0)
+
+	query := db.Table("bpm_keys").
+		Select("bpm_keys.*, files.path, tags.artist, tags.title, tags.bpm AS tag_bpm, tags.key AS tag_key").
+		Joins("JOIN files ON files.id = bpm_keys.file_id").
+		Joins("LEFT JOIN tags ON tags.file_id = files.id")
+
+	if len(path) > 0 {
+		query = query.Where("files.path LIKE ?", "%"+path+"%")
+	}
+
+	if high > 0 {
+		query = query.Where("bpm_keys.bpm BETWEEN ? AND ?", low, high)
+	}
+
+	if len(keys) > 0 {
+		query = query.Where("bpm_keys.camelot IN ?", keys)
+	}
+
+	query.Order("bpm_keys.bpm, files.path").Scan(&rows)
+
+	for i := range rows {
+		rows[i].TagCamelot = camelotFromKey(rows[i].TagKey)
+	}
+
+	return rows
+}
+
+// bpmkey scan [--path] [--rescan], or list files by tempo and key
+func bpmKey(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&BPMKey{})
+	db.AutoMigrate(&ParseError{})
+
+	if len(args) > 0 && args[0] == "scan" {
+		flags := flag.NewFlagSet("bpmkey scan", flag.ExitOnError)
+		path := flags.String("path", "", "only files with paths containing this")
+		rescan := flags.Bool("rescan", false, "analyse files that haven't changed too")
+		flags.Parse(args[1:])
+
+		hostName, err := os.Hostname()
+
+		if err != nil {
+			panic(err) // could not get local hostname
+		}
+
+		analyseBPMKeys(db, hostName, *path, *rescan)
+
+		return
+	}
+
+	flags := flag.NewFlagSet("bpmkey", flag.ExitOnError)
+	path := flags.String("path", "", "only files with paths containing this")
+	bpm := flags.String("bpm", "", "tempo, e.g 128 or 120-130")
+	key := flags.String("key", "", "key, e.g 8A, Am or F# minor")
+	compatible := flags.Bool("compatible", false, "keys that mix with --key too")
+	flags.Parse(args)
+
+	low, high, err := parseBPMRange(*bpm)
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	keys := make([]string, 0)
+
+	if len(*key) > 0 {
+		camelotKey := camelotFromKey(*key)
+
+		if len(camelotKey) == 0 {
+			fmt.Println("`" + *key + "` isn't a key")
+			os.Exit(1)
+		}
+
+		keys = append(keys, camelotKey)
+
+		if *compatible {
+			keys = camelotCompatible(camelotKey)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tBPM\tKEY\tCAMELOT\tTAG BPM\tTAG KEY\tARTIST\tTITLE\tPATH")
+
+	for _, row := range findBPMKeys(db, *path, low, high, keys) {
+		fmt.Fprintf(w, "%d\t%.1f\t%s\t%s\t%.1f\t%s\t%s\t%s\t%s\n",
+			row.FileID,
+			row.BPM,
+			row.Key,
+			row.Camelot,
+			row.TagBPM,
+			row.TagKey,
+			row.Artist,
+			row.Title,
+			row.Path)
+	}
+
+	w.Flush()
+}
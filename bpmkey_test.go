@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCamelotFromKey(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "C", want: "8B"},
+		{in: "Am", want: "8A"},
+		{in: "A minor", want: "8A"},
+		{in: "G", want: "9B"},
+		{in: "Em", want: "9A"},
+		{in: "F# minor", want: "11A"},
+		{in: "Gbm", want: "11A"},
+		{in: "Bbmaj", want: "6B"},
+		{in: "C♯m", want: "12A"},
+		{in: "8a", want: "8A"},
+		{in: "08B", want: "8B"},
+		{in: "1d", want: "8B"},
+		{in: "1m", want: "8A"},
+		{in: "6m", want: "1A"},
+		{in: "13A", want: ""},
+		{in: "H", want: ""},
+		{in: "", want: ""},
+	}
+
+	for _, test := range tests {
+		if got := camelotFromKey(test.in); got != test.want {
+			t.Errorf("camelotFromKey(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestCamelotCompatible(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{in: "8A", want: []string{"8A", "8B", "7A", "9A"}},
+		{in: "1B", want: []string{"1B", "1A", "12B", "2B"}},
+		{in: "12a", want: []string{"12A", "12B", "11A", "1A"}},
+		{in: "nope", want: []string{}},
+	}
+
+	for _, test := range tests {
+		if got := camelotCompatible(test.in); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("camelotCompatible(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
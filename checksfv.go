@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"gorm.io/gorm"
+)
+
+// Manifest formats and the extensions they are found by
+var checksumManifestExtensions = []string{"sfv", "md5"}
+
+// Files that sit next to a release but are never listed in its manifest
+var checksumIgnoredExtensions = []string{
+	"sfv", "md5", "nfo", "diz", "m3u", "m3u8", "cue", "log", "txt", "accurip",
+	"jpg", "jpeg", "png", "gif", "db", "ds_store"}
+
+// A line of a manifest, one file and the checksum it should have
+type checksumEntry struct {
+	Name  string // relative to the manifest, forward slashes
+	Crc32 int64  // sfv
+	Md5   string // md5
+}
+
+// The result for one file of a release
+type checksumResult struct {
+	Status   string // ok, missing, mismatch or unlisted
+	Manifest string
+	Path     string
+	Expected string
+	Actual   string
+}
+
+// BSD style md5 lines, MD5 (name) = hash
+var bsdMd5Line = regexp.MustCompile(`^MD5 \((.+)\) = ([0-9a-fA-F]{32})$`)
+
+// Parse an sfv, "name crc32" per line and ; for comments. The name can have
+// spaces in it so the crc is whatever is after the last one.
+func parseSFV(text string) []checksumEntry {
+	entries := make([]checksumEntry, 0)
+	scanner := bufio.NewScanner(strings.NewReader(text))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		split := strings.LastIndexAny(line, " \t")
+
+		if split < 0 {
+			continue
+		}
+
+		crc, err := strconv.ParseUint(line[split+1:], 16, 32)
+
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, checksumEntry{
+			Name:  checksumEntryName(line[:split]),
+			Crc32: int64(crc)})
+	}
+
+	return entries
+}
+
+// Parse an md5sum file, "hash  name" or "hash *name", or BSD style
+func parseMd5Manifest(text string) []checksumEntry {
+	entries := make([]checksumEntry, 0)
+	scanner := bufio.NewScanner(strings.NewReader(text))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if match := bsdMd5Line.FindStringSubmatch(line); match != nil {
+			entries = append(entries, checksumEntry{
+				Name: checksumEntryName(match[1]),
+				Md5:  strings.ToLower(match[2])})
+
+			continue
+		}
+
+		if len(line) < 34 || !isHex(line[:32]) {
+			continue
+		}
+
+		entries = append(entries, checksumEntry{
+			Name: checksumEntryName(strings.TrimPrefix(strings.TrimLeft(line[32:], " \t"), "*")),
+			Md5:  strings.ToLower(line[:32])})
+	}
+
+	return entries
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Windows tools write backslashes and ./
+func checksumEntryName(name string) string {
+	name = strings.ReplaceAll(strings.TrimSpace(name), "\\", "/")
+
+	return strings.TrimPrefix(name, "./")
+}
+
+// Read the entries of a manifest file
+func readChecksumManifest(manifest File) ([]checksumEntry, error) {
+	b, err := os.ReadFile(manifest.Base + manifest.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	text := decodeLegacyText(b)
+
+	if manifest.ExtensionLowerCase == "md5" {
+		return parseMd5Manifest(text), nil
+	}
+
+	return parseSFV(text), nil
+}
+
+// Check a file against an entry using the stored checksums. Files that
+// haven't been synced yet have no stored md5 so it is worked out here.
+func checkChecksumEntry(entry checksumEntry, file File) (bool, string, string) {
+	if entry.Md5 == "" {
+		return file.Crc32 == entry.Crc32, fmt.Sprintf("%08X", entry.Crc32), fmt.Sprintf("%08X", file.Crc32)
+	}
+
+	actual := file.Md5
+
+	if len(actual) == 0 {
+		md5, err := hashFileMd5(file.Base + file.Path)
+
+		if err != nil {
+			return false, entry.Md5, "unreadable: " + err.Error()
+		}
+
+		actual = md5
+	}
+
+	return strings.EqualFold(actual, entry.Md5), entry.Md5, actual
+}
+
+// Check every manifest in one release directory
+func checkRelease(db *gorm.DB, dir string, manifests []File) []checksumResult {
+	results := make([]checksumResult, 0)
+
+	// everything under the release, sfvs can list files in sub directories
+	files := make([]File, 0)
+
+	db.Where(&File{HostName: manifests[0].HostName, Base: manifests[0].Base}).
+		Where("path LIKE ?", pathsUnder(dir)).
+		Find(&files)
+
+	byName := make(map[string]File)
+
+	for _, file := range files {
+		relative, err := filepath.Rel(dir, file.Path)
+
+		if err != nil {
+			continue
+		}
+
+		byName[strings.ToLower(relative)] = file
+	}
+
+	listed := make(map[uint]bool)
+
+	for _, manifest := range manifests {
+		entries, err := readChecksumManifest(manifest)
+
+		if err != nil {
+			results = append(results, checksumResult{Status: "unreadable", Manifest: manifest.FileName, Actual: err.Error()})
+			continue
+		}
+
+		for _, entry := range entries {
+			file, ok := byName[strings.ToLower(entry.Name)]
+
+			if !ok {
+				expected := entry.Md5
+
+				if expected == "" {
+					expected = fmt.Sprintf("%08X", entry.Crc32)
+				}
+
+				results = append(results, checksumResult{Status: "missing", Manifest: manifest.FileName, Path: entry.Name, Expected: expected})
+				continue
+			}
+
+			listed[file.ID] = true
+
+			match, expected, actual := checkChecksumEntry(entry, file)
+			status := "ok"
+
+			if !match {
+				status = "mismatch"
+			}
+
+			results = append(results, checksumResult{Status: status, Manifest: manifest.FileName, Path: entry.Name, Expected: expected, Actual: actual})
+		}
+	}
+
+	// only the release directory itself, a sub directory with its own
+	// manifest is its own release
+	for _, file := range files {
+		if filepath.Dir(file.Path) != dir || listed[file.ID] || stringInSlice(file.ExtensionLowerCase, checksumIgnoredExtensions) {
+			continue
+		}
+
+		results = append(results, checksumResult{Status: "unlisted", Path: file.FileName, Actual: fmt.Sprintf("%08X", file.Crc32)})
+	}
+
+	return results
+}
+
+// Verify every sfv and md5 manifest on this host against the files table
+func checkSFV(args []string) {
+	flags := flag.NewFlagSet("checksfv", flag.ExitOnError)
+	all := flags.Bool("all", false, "show files that are ok too")
+	path := flags.String("path", "", "only releases with paths containing this")
+	flags.Parse(args)
+
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	hostName, err := os.Hostname()
+
+	if err != nil {
+		panic(err) // could not get local hostname
+	}
+
+	manifests := make([]File, 0)
+	query := db.Where(&File{HostName: hostName}).Where("extension_lower_case IN ?", checksumManifestExtensions)
+
+	if len(*path) > 0 {
+		query = query.Where("path LIKE ?", "%"+*path+"%")
+	}
+
+	query.Order("path").Find(&manifests)
+
+	releases := make(map[string][]File)
+
+	for _, manifest := range manifests {
+		dir := filepath.Dir(manifest.Path)
+		releases[dir] = append(releases[dir], manifest)
+	}
+
+	dirs := make([]string, 0, len(releases))
+
+	for dir := range releases {
+		dirs = append(dirs, dir)
+	}
+
+	sort.Strings(dirs)
+
+	counts := make(map[string]int)
+	broken := 0
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RELEASE\tSTATUS\tMANIFEST\tFILE\tEXPECTED\tACTUAL")
+
+	for _, dir := range dirs {
+		ok := true
+
+		for _, result := range checkRelease(db, dir, releases[dir]) {
+			counts[result.Status]++
+
+			if result.Status != "ok" {
+				ok = false
+			} else if !*all {
+				continue
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				dir,
+				result.Status,
+				result.Manifest,
+				result.Path,
+				result.Expected,
+				result.Actual)
+		}
+
+		if !ok {
+			broken++
+		}
+	}
+
+	w.Flush()
+
+	fmt.Printf("\n%d releases, %d with problems: %d ok, %d missing, %d mismatched, %d unlisted, %d unreadable manifests\n",
+		len(dirs),
+		broken,
+		counts["ok"],
+		counts["missing"],
+		counts["mismatch"],
+		counts["unlisted"],
+		counts["unreadable"])
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSFV(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []checksumEntry
+	}{
+		{
+			name: "names with spaces",
+			in: `; Generated by WIN-SFV32
+01 - Hells Bells.flac 1A2B3C4D
+02 - Shoot To Thrill.flac	deadbeef
+`,
+			want: []checksumEntry{
+				{Name: "01 - Hells Bells.flac", Crc32: 0x1A2B3C4D},
+				{Name: "02 - Shoot To Thrill.flac", Crc32: 0xDEADBEEF},
+			},
+		},
+		{
+			name: "windows paths",
+			in:   ".\\CD1\\01.flac 00000001\r\n",
+			want: []checksumEntry{{Name: "CD1/01.flac", Crc32: 1}},
+		},
+		{
+			name: "bad lines are skipped",
+			in:   "nocrc\n01.flac nothex\n01.flac 1FFFFFFFF\n",
+			want: []checksumEntry{},
+		},
+	}
+
+	for _, test := range tests {
+		if got := parseSFV(test.in); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseMd5Manifest(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []checksumEntry
+	}{
+		{
+			name: "md5sum text and binary",
+			in: `d41d8cd98f00b204e9800998ecf8427e  01 - Hells Bells.flac
+D41D8CD98F00B204E9800998ECF8427E *02.flac
+`,
+			want: []checksumEntry{
+				{Name: "01 - Hells Bells.flac", Md5: "d41d8cd98f00b204e9800998ecf8427e"},
+				{Name: "02.flac", Md5: "d41d8cd98f00b204e9800998ecf8427e"},
+			},
+		},
+		{
+			name: "bsd style",
+			in:   "MD5 (CD1/01.flac) = d41d8cd98f00b204e9800998ecf8427e\n",
+			want: []checksumEntry{{Name: "CD1/01.flac", Md5: "d41d8cd98f00b204e9800998ecf8427e"}},
+		},
+		{
+			name: "comments and junk",
+			in:   "# comment\n; comment\nnot a hash line at all, not at all\n",
+			want: []checksumEntry{},
+		},
+	}
+
+	for _, test := range tests {
+		if got := parseMd5Manifest(test.in); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -103,14 +102,14 @@ func hashFileMD5Remote(path string) (string, error) {
 
 	output, err := remoteRun(command, session)
 
-	if len(output) == 0 {
-		return "", errors.New("md5 length is zero")
-	}
-
 	if err != nil {
 		return "", err
 	}
 
+	if len(output) == 0 {
+		return "", errEmptyChecksum
+	}
+
 	// get first 32 chars
 	md5sum := output[0:32]
 
@@ -127,16 +126,40 @@ func hashFileSHA1Remote(path string) (string, error) {
 
 	output, err := remoteRun(command, session)
 
-	if len(output) == 0 {
-		return "", errors.New("sha length is zero")
-	}
-
 	if err != nil {
 		return "", err
 	}
 
+	if len(output) == 0 {
+		return "", errEmptyChecksum
+	}
+
 	// get first 32 chars
 	sha1sum := output[0:39]
 
 	return sha1sum, nil
 }
+
+// hashFileSHA256Remote gets the sha256 hash of a file on the other end of an ssh connection
+func hashFileSHA256Remote(path string) (string, error) {
+	session := getSSHSession()
+
+	defer session.Close()
+
+	command := "/usr/bin/sha256sum -z " + shellescape.Quote(path)
+
+	output, err := remoteRun(command, session)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(output) < 64 {
+		return "", errEmptyChecksum
+	}
+
+	// get first 64 chars
+	sha256sum := output[0:64]
+
+	return sha256sum, nil
+}
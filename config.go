@@ -2,24 +2,47 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 // Create private data struct to hold config options.
 type config struct {
-	MysqlDatabase   string `yaml:"mysqlDatabase"`
-	MysqlHost       string `yaml:"mysqlHost"`
-	MysqlUser       string `yaml:"mysqlUser"`
-	MysqlPass       string `yaml:"mysqlPass"`
-	SearchDirectory string `yaml:"searchDirectory"`
-	SSHServer       string `yaml:"sshServer"`
-	SSHPort         string `yaml:"sshPort"`
-	SSHUser         string `yaml:"sshUser"`
-	SSHKey          string `yaml:"sshKey"`
-	SSHHostKey      string `yaml:"SSHHostKey"`
-	RemotePath      string `yaml:"remotePath"`
-	RemoteOldPath   string `yaml:"remoteOldPath"`
+	MysqlDatabase      string                 `yaml:"mysqlDatabase"`
+	MysqlHost          string                 `yaml:"mysqlHost"`
+	MysqlUser          string                 `yaml:"mysqlUser"`
+	MysqlPass          string                 `yaml:"mysqlPass"`
+	SearchDirectory    string                 `yaml:"searchDirectory"`
+	SSHServer          string                 `yaml:"sshServer"`
+	SSHPort            string                 `yaml:"sshPort"`
+	SSHUser            string                 `yaml:"sshUser"`
+	SSHKey             string                 `yaml:"sshKey"`
+	SSHHostKey         string                 `yaml:"SSHHostKey"`
+	SSHKeyPassphrase   string                 `yaml:"sshKeyPassphrase"`
+	SSHPassword        string                 `yaml:"sshPassword"`
+	SSHKnownHosts      string                 `yaml:"sshKnownHosts"`
+	SSHHashKnownHosts  bool                   `yaml:"sshHashKnownHosts"`
+	SSHConfigFile      string                 `yaml:"sshConfigFile"`
+	SSHJumpHosts       []sshServerConfig      `yaml:"sshJumpHosts"`
+	SyncProfile        string                 `yaml:"syncProfile"`
+	SyncProfiles       map[string]syncProfile `yaml:"syncProfiles"`
+	EncryptRemote      bool                   `yaml:"encryptRemote"`
+	EncryptPassphrase  string                 `yaml:"encryptPassphrase"`
+	EncryptKeyFile     string                 `yaml:"encryptKeyFile"`
+	EncryptFileNames   bool                   `yaml:"encryptFileNames"`
+	SyncPlaylistFormat string                 `yaml:"syncPlaylistFormat"`
+	SyncPlaylistPaths  string                 `yaml:"syncPlaylistPaths"`
+	RemotePath         string                 `yaml:"remotePath"`
+	RemoteOldPath      string                 `yaml:"remoteOldPath"`
+	SyncMaxAttempts    int                    `yaml:"syncMaxAttempts"`
+	RetryBaseDelay     time.Duration          `yaml:"retryBaseDelay"`
+	RetryMaxDelay      time.Duration          `yaml:"retryMaxDelay"`
+	ArtworkSizes       []int                  `yaml:"artworkSizes"`
+	ArtworkNames       []string               `yaml:"artworkNames"`
+	TagID3Version      int                    `yaml:"tagID3Version"`
+	OrganiseTemplate   string                 `yaml:"organiseTemplate"`
+	HTTPTagEdit        bool                   `yaml:"httpTagEdit"`
 }
 
 // Create a new config instance.
@@ -54,6 +77,53 @@ func getConf() *config {
 	conf.RemotePath = appendTrailingSlashIfNotExist(conf.RemotePath)
 	conf.RemoteOldPath = appendTrailingSlashIfNotExist(conf.RemoteOldPath)
 
+	if len(conf.SSHKnownHosts) == 0 {
+		conf.SSHKnownHosts = "~/.ssh/known_hosts"
+	}
+
+	if len(conf.SSHConfigFile) == 0 {
+		conf.SSHConfigFile = "~/.ssh/config"
+	}
+
+	// Give up on a file after this many failed syncs
+	if conf.SyncMaxAttempts == 0 {
+		conf.SyncMaxAttempts = 5
+	}
+
+	// Backoff between retries, e.g "10s", "10m"
+	if conf.RetryBaseDelay == 0 {
+		conf.RetryBaseDelay = 10 * time.Second
+	}
+
+	if conf.RetryMaxDelay == 0 {
+		conf.RetryMaxDelay = 10 * time.Minute
+	}
+
+	// Synced playlists point at files relative to themselves, or "absolute"
+	if len(conf.SyncPlaylistPaths) == 0 {
+		conf.SyncPlaylistPaths = "relative"
+	}
+
+	// Thumbnail widths in pixels
+	if len(conf.ArtworkSizes) == 0 {
+		conf.ArtworkSizes = []int{150, 300, 600}
+	}
+
+	// Sidecar image names, best first
+	if len(conf.ArtworkNames) == 0 {
+		conf.ArtworkNames = []string{"cover", "folder", "front", "album", "albumart"}
+	}
+
+	// ID3v2 version for files that don't have a tag yet, 3 or 4
+	if conf.TagID3Version == 0 {
+		conf.TagID3Version = 3
+	}
+
+	// Where organise moves files, relative to searchDirectory
+	if len(conf.OrganiseTemplate) == 0 {
+		conf.OrganiseTemplate = "{albumartist}/{year} - {album}/{disc}{track:02} {title}.{ext}"
+	}
+
 	return conf
 }
 
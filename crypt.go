@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"gorm.io/gorm"
+)
+
+// Encrypted files are a header followed by chunks of ChaCha20-Poly1305:
+//
+//	"AURLENC1" | library salt (16) | file nonce (16) | chunk | chunk | ...
+//
+// Every chunk is 64KiB of plaintext plus a 16 byte tag, except the last which
+// can be shorter. Chunk nonces are a counter plus a flag set on the last
+// chunk, so chunks can't be reordered, dropped or the file truncated. The
+// header is authenticated as additional data on every chunk.
+const (
+	encryptMagic     = "AURLENC1"
+	encryptSaltSize  = 16
+	encryptChunkSize = 64 * 1024
+	encryptHeaderLen = len(encryptMagic) + encryptSaltSize*2
+)
+
+var (
+	// Master key for this run, derived once
+	encryptionMasterKey []byte
+
+	errNotEncrypted    = errors.New("not an auralist encrypted file")
+	errDecryptFailed   = errors.New("decryption failed, wrong key or corrupt file")
+	errWrongLibraryKey = errors.New("passphrase or key file does not match the one this library was encrypted with")
+)
+
+// EncryptionKey holds the salt the master key is derived with, and a check
+// value so a changed passphrase is caught before anything is uploaded with it
+type EncryptionKey struct {
+	ID        uint
+	Salt      string `gorm:"size:32"` // hex
+	Check     string `gorm:"size:64"` // hex hmac of a fixed string with the master key
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// EncryptedFile maps a File to its encrypted copy on the remote server
+type EncryptedFile struct {
+	ID           uint
+	FileID       uint   `gorm:"uniqueIndex"`
+	RemoteName   string // path under remotePath, an hmac of the real path when names are encrypted
+	PlainMd5     string `gorm:"size:32"` // md5 of what was encrypted, the file or its transcode
+	CipherSha256 string `gorm:"index;size:64"`
+	CipherSize   int64
+	VerifiedAt   time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// Derive the master key from the key file or the passphrase
+func deriveMasterKey(salt []byte) ([]byte, error) {
+	if len(conf.EncryptKeyFile) > 0 {
+		secret, err := ioutil.ReadFile(expandHome(conf.EncryptKeyFile))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return hkdfKey(secret, salt, "auralist master key")
+	}
+
+	if len(conf.EncryptPassphrase) == 0 {
+		return nil, errors.New("set encryptPassphrase or encryptKeyFile in config.yml")
+	}
+
+	return scrypt.Key([]byte(conf.EncryptPassphrase), salt, 1<<15, 8, 1, chacha20poly1305.KeySize)
+}
+
+// Expand a secret into a 32 byte key for a single purpose
+func hkdfKey(secret []byte, salt []byte, info string) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Hex hmac proving which master key is in use, without storing it
+func masterKeyCheck(master []byte) string {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("auralist key check"))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Get the master key for this library, creating the salt on first use
+func getEncryptionKey(db *gorm.DB) ([]byte, error) {
+	if encryptionMasterKey != nil {
+		return encryptionMasterKey, nil
+	}
+
+	db.AutoMigrate(&EncryptionKey{})
+
+	setting := EncryptionKey{}
+	db.First(&setting)
+
+	if setting.ID == 0 {
+		salt := make([]byte, encryptSaltSize)
+
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+
+		master, err := deriveMasterKey(salt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		setting.Salt = hex.EncodeToString(salt)
+		setting.Check = masterKeyCheck(master)
+		db.Create(&setting)
+
+		encryptionMasterKey = master
+
+		return master, nil
+	}
+
+	salt, err := hex.DecodeString(setting.Salt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	master, err := deriveMasterKey(salt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal([]byte(masterKeyCheck(master)), []byte(setting.Check)) {
+		return nil, errWrongLibraryKey
+	}
+
+	encryptionMasterKey = master
+
+	return master, nil
+}
+
+// Nonce for chunk n, 12 bytes: 3 zero bytes, an 8 byte big endian counter,
+// then a last chunk flag byte that is 1 on the last chunk and 0 otherwise
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+// Encrypt a stream with a fresh random file key
+func encryptStream(r io.Reader, w io.Writer, master []byte, salt []byte) error {
+	fileNonce := make([]byte, encryptSaltSize)
+
+	if _, err := rand.Read(fileNonce); err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, encryptHeaderLen)
+	header = append(header, encryptMagic...)
+	header = append(header, salt...)
+	header = append(header, fileNonce...)
+
+	fileKey, err := hkdfKey(master, fileNonce, "auralist file key")
+
+	if err != nil {
+		return err
+	}
+
+	aead, err := chacha20poly1305.New(fileKey)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	cur := make([]byte, encryptChunkSize)
+	next := make([]byte, encryptChunkSize)
+
+	n, readErr := io.ReadFull(r, cur)
+
+	for counter := uint64(0); ; counter++ {
+		last := false
+		nextN := 0
+		var nextErr error
+
+		// Read ahead so we know whether this is the last chunk
+		switch readErr {
+		case nil:
+			nextN, nextErr = io.ReadFull(r, next)
+			last = nextErr == io.EOF
+		case io.EOF, io.ErrUnexpectedEOF:
+			last = true
+		default:
+			return readErr
+		}
+
+		if _, err := w.Write(aead.Seal(nil, chunkNonce(counter, last), cur[:n], header)); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+
+		cur, next = next, cur
+		n, readErr = nextN, nextErr
+	}
+}
+
+// Decrypt a stream written by encryptStream
+func decryptStream(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, encryptHeaderLen)
+
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(encryptMagic)]) != encryptMagic {
+		return errNotEncrypted
+	}
+
+	salt := header[len(encryptMagic) : len(encryptMagic)+encryptSaltSize]
+	fileNonce := header[len(encryptMagic)+encryptSaltSize:]
+
+	master, err := deriveMasterKey(salt)
+
+	if err != nil {
+		return err
+	}
+
+	fileKey, err := hkdfKey(master, fileNonce, "auralist file key")
+
+	if err != nil {
+		return err
+	}
+
+	aead, err := chacha20poly1305.New(fileKey)
+
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, encryptChunkSize+aead.Overhead())
+
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(br, chunk)
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			// Ran out before a chunk marked as last
+			return errDecryptFailed
+		}
+
+		last := err == io.ErrUnexpectedEOF
+
+		if !last {
+			if _, peekErr := br.Peek(1); peekErr == io.EOF {
+				last = true
+			}
+		}
+
+		plain, err := aead.Open(nil, chunkNonce(counter, last), chunk[:n], header)
+
+		if err != nil {
+			return errDecryptFailed
+		}
+
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// Encrypt a local file to another local file, returning the sha256 and
+// size of the ciphertext
+func encryptFileTo(db *gorm.DB, source string, destination string) (string, int64, error) {
+	master, err := getEncryptionKey(db)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	setting := EncryptionKey{}
+	db.First(&setting)
+
+	salt, err := hex.DecodeString(setting.Salt)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	in, err := os.Open(source)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return "", 0, err
+	}
+
+	out, err := os.Create(destination)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	defer out.Close()
+
+	sum := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, sum)}
+
+	if err := encryptStream(in, counter, master, salt); err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), counter.n, nil
+}
+
+// Counts bytes on their way through
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// Name of a file on the remote server. With encryptFileNames the real path
+// is replaced by an hmac of it, e.g "3f/3fq2....enc", and the only record of
+// which file it is lives in the encrypted_files table.
+func encryptedRemoteName(db *gorm.DB, relPath string) (string, error) {
+	if !conf.EncryptFileNames {
+		return relPath + ".enc", nil
+	}
+
+	master, err := getEncryptionKey(db)
+
+	if err != nil {
+		return "", err
+	}
+
+	nameKey, err := hkdfKey(master, nil, "auralist file names")
+
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, nameKey)
+	mac.Write([]byte(relPath))
+
+	name := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(mac.Sum(nil)[:20]))
+
+	return name[0:2] + "/" + name + ".enc", nil
+}
+
+// Encrypt and upload a file, unless the remote already holds the
+// ciphertext we uploaded last time for exactly this plaintext. Returns the
+// full remote path.
+func syncEncrypted(db *gorm.DB, file File, localPath string, relPath string, plainMd5 string) (string, error) {
+	encrypted := EncryptedFile{}
+	db.Where(&EncryptedFile{FileID: file.ID}).FirstOrInit(&encrypted)
+
+	remoteName, err := encryptedRemoteName(db, relPath)
+
+	if err != nil {
+		return "", &SyncError{Op: "encrypt", Path: localPath, Err: err}
+	}
+
+	remoteFullPath := conf.RemotePath + remoteName
+
+	log.Println("S: " + localPath)
+	log.Println("D: " + remoteFullPath)
+
+	// Same plaintext as last time, is the ciphertext still there?
+	if encrypted.PlainMd5 == plainMd5 && encrypted.RemoteName == remoteName && len(encrypted.CipherSha256) > 0 {
+		match, err := remoteFileMatchesSha256(remoteFullPath, encrypted.CipherSha256)
+
+		if err != nil {
+			return "", &SyncError{Op: "match", Path: localPath, Err: err}
+		}
+
+		if match {
+			log.Println("Skipping file that already exists.")
+
+			encrypted.VerifiedAt = time.Now()
+			db.Save(&encrypted)
+
+			return remoteFullPath, nil
+		}
+	}
+
+	tmp := filepath.Join("cache", "encrypt", randSeq(32)+".enc")
+	defer os.Remove(tmp)
+
+	cipherSha256, size, err := encryptFileTo(db, localPath, tmp)
+
+	if err != nil {
+		return "", &SyncError{Op: "encrypt", Path: localPath, Err: err}
+	}
+
+	if err := uploadPath(tmp, remoteFullPath, size); err != nil {
+		return "", &SyncError{Op: "upload", Path: localPath, Err: err}
+	}
+
+	match, err := remoteFileMatchesSha256(remoteFullPath, cipherSha256)
+
+	if err != nil {
+		return "", &SyncError{Op: "verify", Path: localPath, Err: err}
+	}
+
+	if !match {
+		return "", &SyncError{Op: "verify", Path: localPath, Err: errChecksumMismatch}
+	}
+
+	encrypted.FileID = file.ID
+	encrypted.RemoteName = remoteName
+	encrypted.PlainMd5 = plainMd5
+	encrypted.CipherSha256 = cipherSha256
+	encrypted.CipherSize = size
+	encrypted.VerifiedAt = time.Now()
+	db.Save(&encrypted)
+
+	return remoteFullPath, nil
+}
+
+// Sync a file in encrypted form
+func syncEncryptedFile(file File, db *gorm.DB) error {
+	localFullPath := file.Base + file.Path
+
+	sourceMd5, err := hashFileMd5(localFullPath)
+
+	if err != nil {
+		return &SyncError{Op: "hash", Path: localFullPath, Err: err}
+	}
+
+	if _, err := syncEncrypted(db, file, localFullPath, file.Path, sourceMd5); err != nil {
+		return err
+	}
+
+	file.Md5 = sourceMd5
+	file.VerifiedAt = time.Now()
+	db.Save(&file)
+
+	return nil
+}
+
+// Does the file on the remote server exist and have this sha256
+func remoteFileMatchesSha256(remoteFullPath string, sha256sum string) (bool, error) {
+	exists, err := fileExistsOnRemoteServer(remoteFullPath)
+
+	if err != nil || !exists {
+		return false, err
+	}
+
+	remoteSha256, err := hashFileSHA256Remote(remoteFullPath)
+
+	if err != nil {
+		return false, err
+	}
+
+	return remoteSha256 == sha256sum, nil
+}
+
+// decrypt <input> <output> - decrypt a file fetched from the remote server
+func decryptFile(args []string) {
+	if len(args) < 2 {
+		fmt.Printf("Usage: decrypt <input.enc> <output>\n")
+		return
+	}
+
+	in, err := os.Open(args[0])
+
+	if err != nil {
+		panic(err) // could not open encrypted file
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(args[1])
+
+	if err != nil {
+		panic(err) // could not create output
+	}
+
+	defer out.Close()
+
+	if err := decryptStream(in, out); err != nil {
+		os.Remove(args[1])
+		panic(err) // could not decrypt
+	}
+}
+
+// verifyencrypted - check every encrypted file on the remote server still
+// has the ciphertext hash recorded when it was uploaded
+func verifyEncrypted() {
+	// check db is ready
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	// migrate
+	db.AutoMigrate(&File{})
+	db.AutoMigrate(&EncryptedFile{})
+
+	var encrypted EncryptedFile
+
+	rows, e := db.Model(&EncryptedFile{}).Rows()
+
+	if e != nil {
+		panic(e) // could not create database model...
+	}
+
+	defer rows.Close()
+
+	bad := 0
+
+	for rows.Next() {
+		db.ScanRows(rows, &encrypted)
+
+		match, err := remoteFileMatchesSha256(conf.RemotePath+encrypted.RemoteName, encrypted.CipherSha256)
+
+		if err != nil {
+			panic(err) // lost the connection
+		}
+
+		if !match {
+			file := File{}
+			db.First(&file, encrypted.FileID)
+
+			log.Printf("Mismatch: %s (%s)\n", encrypted.RemoteName, file.Path)
+			bad++
+
+			// Clear the sync state so syncFiles uploads it again
+			file.Md5 = ""
+			db.Save(&file)
+
+			continue
+		}
+
+		db.Model(&EncryptedFile{}).Where("id = ?", encrypted.ID).Update("verified_at", time.Now())
+	}
+
+	fmt.Printf("%d encrypted files did not match.\n", bad)
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CueSheet is a parsed .cue file
+type CueSheet struct {
+	ID         uint      `json:"id"`
+	FileID     uint      `gorm:"uniqueIndex" json:"fileId"` // the .cue file
+	SourceHash string    `gorm:"size:32" json:"-"`          // imohash of the .cue when it was parsed
+	Title      string    `json:"title"`
+	Performer  string    `json:"performer"`
+	Genre      string    `json:"genre"`
+	Date       string    `gorm:"size:16" json:"date"`
+	DiscID     string    `gorm:"size:16" json:"discId"`
+	Catalog    string    `gorm:"size:16" json:"catalog"`
+	TrackCount int       `json:"trackCount"`
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+// CueTrack is a virtual track, a time range of an audio file
+type CueTrack struct {
+	ID          uint      `json:"id"`
+	CueSheetID  uint      `gorm:"uniqueIndex:idx_cue_track_sheet_number" json:"cueSheetId"`
+	Number      int       `gorm:"uniqueIndex:idx_cue_track_sheet_number" json:"number"`
+	AudioFileID uint      `gorm:"index" json:"audioFileId"` // 0 if the audio file couldn't be found
+	FileName    string    `json:"fileName"`                 // as written in the sheet
+	Title       string    `gorm:"index" json:"title"`
+	Performer   string    `gorm:"index" json:"performer"`
+	Songwriter  string    `json:"songwriter"`
+	ISRC        string    `gorm:"size:12" json:"isrc"`
+	Pregap      float64   `json:"pregap"`   // seconds between INDEX 00 and INDEX 01
+	Start       float64   `json:"start"`    // seconds into the audio file, INDEX 01
+	End         float64   `json:"end"`      // 0 runs to the end of the audio file
+	Duration    float64   `json:"duration"` // 0 if the audio file length isn't known
+	CreatedAt   time.Time `json:"-"`
+	UpdatedAt   time.Time `json:"-"`
+}
+
+// What a sheet says before it is matched up with files in the database
+type cueSheetText struct {
+	Title     string
+	Performer string
+	Genre     string
+	Date      string
+	DiscID    string
+	Catalog   string
+	Tracks    []cueTrackText
+}
+
+type cueTrackText struct {
+	Number     int
+	FileName   string
+	Title      string
+	Performer  string
+	Songwriter string
+	ISRC       string
+	Index00    float64
+	Index01    float64
+	HasIndex00 bool
+	HasIndex01 bool
+}
+
+// CD frames per second, cue times are mm:ss:ff
+const cueFramesPerSecond = 75
+
+// Parse an mm:ss:ff time, minutes can go past 59
+func parseCueTime(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+
+	if len(parts) != 3 {
+		return 0, errors.New("bad cue time `" + s + "`")
+	}
+
+	values := make([]int, 3)
+
+	for i, part := range parts {
+		value, err := strconv.Atoi(part)
+
+		if err != nil || value < 0 {
+			return 0, errors.New("bad cue time `" + s + "`")
+		}
+
+		values[i] = value
+	}
+
+	if values[1] > 59 || values[2] >= cueFramesPerSecond {
+		return 0, errors.New("bad cue time `" + s + "`")
+	}
+
+	return float64(values[0]*60+values[1]) + float64(values[2])/cueFramesPerSecond, nil
+}
+
+// Split a cue line into its command and arguments, quoted arguments keep
+// their spaces
+func splitCueLine(line string) []string {
+	fields := make([]string, 0, 4)
+	field := strings.Builder{}
+	quoted := false
+	started := false
+
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			started = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if started {
+				fields = append(fields, field.String())
+				field.Reset()
+				started = false
+			}
+		default:
+			field.WriteRune(r)
+			started = true
+		}
+	}
+
+	if started {
+		fields = append(fields, field.String())
+	}
+
+	return fields
+}
+
+// Cue sheets and sfvs are often Windows-1252 rather than UTF-8, read anything that
+// isn't valid UTF-8 as Latin-1
+func decodeLegacyText(b []byte) string {
+	b = bytes.TrimPrefix(b, []byte{0xEF, 0xBB, 0xBF})
+
+	if utf8.Valid(b) {
+		return string(b)
+	}
+
+	runes := make([]rune, len(b))
+
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+
+	return string(runes)
+}
+
+func parseCueSheet(b []byte) (cueSheetText, error) {
+	sheet := cueSheetText{}
+	fileName := ""
+	var track *cueTrackText
+
+	// TITLE and PERFORMER after the first TRACK belong to a track, never the
+	// sheet, even when that track is a data track we skip
+	inTracks := false
+
+	scanner := bufio.NewScanner(strings.NewReader(decodeLegacyText(b)))
+
+	for scanner.Scan() {
+		fields := splitCueLine(strings.TrimSpace(scanner.Text()))
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		command := strings.ToUpper(fields[0])
+		value := ""
+
+		if len(fields) > 1 {
+			value = fields[1]
+		}
+
+		switch command {
+		case "FILE":
+			fileName = value
+		case "TRACK":
+			number, err := strconv.Atoi(value)
+
+			if err != nil {
+				return sheet, errors.New("bad track number `" + value + "`")
+			}
+
+			if len(fileName) == 0 {
+				return sheet, errors.New("track " + value + " comes before any FILE")
+			}
+
+			inTracks = true
+
+			// data tracks on enhanced CDs have no audio to point at
+			if len(fields) > 2 && strings.ToUpper(fields[2]) != "AUDIO" {
+				track = nil
+				continue
+			}
+
+			sheet.Tracks = append(sheet.Tracks, cueTrackText{Number: number, FileName: fileName})
+			track = &sheet.Tracks[len(sheet.Tracks)-1]
+		case "INDEX":
+			if track == nil || len(fields) < 3 {
+				continue
+			}
+
+			at, err := parseCueTime(fields[2])
+
+			if err != nil {
+				return sheet, err
+			}
+
+			switch value {
+			case "00", "0":
+				track.Index00, track.HasIndex00 = at, true
+			case "01", "1":
+				// pregap at the end of the previous FILE, this track starts in the new one
+				if track.FileName != fileName {
+					track.HasIndex00 = false
+				}
+
+				track.Index01, track.HasIndex01 = at, true
+			}
+
+			track.FileName = fileName
+		case "TITLE":
+			if track != nil {
+				track.Title = value
+			} else if !inTracks {
+				sheet.Title = value
+			}
+		case "PERFORMER":
+			if track != nil {
+				track.Performer = value
+			} else if !inTracks {
+				sheet.Performer = value
+			}
+		case "SONGWRITER":
+			if track != nil {
+				track.Songwriter = value
+			}
+		case "ISRC":
+			if track != nil {
+				track.ISRC = value
+			}
+		case "CATALOG":
+			sheet.Catalog = value
+		case "REM":
+			if len(fields) < 3 {
+				continue
+			}
+
+			remValue := strings.Join(fields[2:], " ")
+
+			switch strings.ToUpper(value) {
+			case "GENRE":
+				sheet.Genre = remValue
+			case "DATE":
+				sheet.Date = remValue
+			case "DISCID":
+				sheet.DiscID = remValue
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return sheet, err
+	}
+
+	if len(sheet.Tracks) == 0 {
+		return sheet, errors.New("no audio tracks in cue sheet")
+	}
+
+	for _, t := range sheet.Tracks {
+		if !t.HasIndex01 {
+			return sheet, fmt.Errorf("track %d has no INDEX 01", t.Number)
+		}
+	}
+
+	return sheet, nil
+}
+
+// LIKE pattern for every path under a relative directory, filepath.Dir
+// gives "." for files at the top of the base
+func pathsUnder(dir string) string {
+	if dir == "." || len(dir) == 0 {
+		return "%"
+	}
+
+	return escapeLike(strings.TrimSuffix(dir, "/")) + "/%"
+}
+
+// Find the audio file a sheet's FILE line points at. Rips get re-encoded
+// without the sheet being updated, so "album.wav" also matches "album.flac",
+// and a sheet with a single FILE falls back to the only audio file next to it.
+func findCueAudioFile(db *gorm.DB, cue File, fileName string, singleFile bool) (File, bool) {
+	dir := filepath.Dir(cue.Path)
+	neighbours := make([]File, 0)
+
+	db.Where(&File{HostName: cue.HostName, Base: cue.Base}).
+		Where("path LIKE ?", pathsUnder(dir)).
+		Find(&neighbours)
+
+	audio := make([]File, 0)
+
+	for _, file := range neighbours {
+		if filepath.Dir(file.Path) == dir && file.ID != cue.ID {
+			audio = append(audio, file)
+		}
+	}
+
+	// windows rippers write backslashes
+	name := filepath.Base(strings.ReplaceAll(fileName, "\\", "/"))
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+
+	for _, file := range audio {
+		if strings.EqualFold(file.FileName, name) {
+			return file, true
+		}
+	}
+
+	for _, file := range audio {
+		fileStem := strings.TrimSuffix(file.FileName, filepath.Ext(file.FileName))
+
+		if strings.EqualFold(fileStem, stem) && cueAudioExtension(file.ExtensionLowerCase) {
+			return file, true
+		}
+	}
+
+	if singleFile {
+		found := make([]File, 0, 1)
+
+		for _, file := range audio {
+			if cueAudioExtension(file.ExtensionLowerCase) {
+				found = append(found, file)
+			}
+		}
+
+		if len(found) == 1 {
+			return found[0], true
+		}
+	}
+
+	return File{}, false
+}
+
+// Audio a cue sheet can point at, ape and wavpack aren't parsed for
+// properties but ffmpeg can still stream them
+func cueAudioExtension(extension string) bool {
+	return stringInSlice(extension, audioExtensions) || stringInSlice(extension, []string{"ape", "wv", "tta"})
+}
+
+// Parse a .cue file and store its virtual tracks
+func parseCueToDb(file File, sourceHash string, db *gorm.DB) error {
+	b, err := os.ReadFile(file.Base + file.Path)
+
+	if err != nil {
+		return err
+	}
+
+	text, err := parseCueSheet(b)
+
+	if err != nil {
+		return err
+	}
+
+	fileNames := make([]string, 0)
+
+	for _, t := range text.Tracks {
+		fileNames = append(fileNames, t.FileName)
+	}
+
+	singleFile := len(uniqueStrings(fileNames)) == 1
+
+	sheet := CueSheet{FileID: file.ID}
+	db.Where(&CueSheet{FileID: file.ID}).FirstOrInit(&sheet)
+
+	sheet.SourceHash = sourceHash
+	sheet.Title = text.Title
+	sheet.Performer = text.Performer
+	sheet.Genre = text.Genre
+	sheet.Date = text.Date
+	sheet.DiscID = text.DiscID
+	sheet.Catalog = text.Catalog
+	sheet.TrackCount = len(text.Tracks)
+	db.Save(&sheet)
+
+	audioFiles := make(map[string]File)
+	missing := make([]string, 0)
+
+	for _, name := range uniqueStrings(fileNames) {
+		if audio, ok := findCueAudioFile(db, file, name, singleFile); ok {
+			audioFiles[name] = audio
+		} else {
+			missing = append(missing, name)
+		}
+	}
+
+	numbers := make([]int, 0, len(text.Tracks))
+
+	for i, t := range text.Tracks {
+		track := CueTrack{
+			CueSheetID: sheet.ID,
+			Number:     t.Number,
+			FileName:   t.FileName,
+			Title:      t.Title,
+			Performer:  t.Performer,
+			Songwriter: t.Songwriter,
+			ISRC:       t.ISRC,
+			Start:      t.Index01}
+
+		if len(track.Performer) == 0 {
+			track.Performer = text.Performer
+		}
+
+		if t.HasIndex00 && t.Index00 < t.Index01 {
+			track.Pregap = t.Index01 - t.Index00
+		}
+
+		audio, ok := audioFiles[t.FileName]
+
+		if ok {
+			track.AudioFileID = audio.ID
+		}
+
+		// runs until the next track's pregap, or the end of the file
+		if i+1 < len(text.Tracks) && text.Tracks[i+1].FileName == t.FileName {
+			next := text.Tracks[i+1]
+			track.End = next.Index01
+
+			if next.HasIndex00 && next.Index00 < next.Index01 {
+				track.End = next.Index00
+			}
+
+			track.Duration = track.End - track.Start
+		} else if ok {
+			props := AudioProperties{}
+
+			if db.Where(&AudioProperties{FileID: audio.ID}).First(&props).Error == nil && props.Duration > track.Start {
+				track.Duration = props.Duration - track.Start
+			}
+		}
+
+		db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "cue_sheet_id"}, {Name: "number"}},
+			UpdateAll: true}).Create(&track)
+
+		numbers = append(numbers, t.Number)
+	}
+
+	db.Where(&CueTrack{CueSheetID: sheet.ID}).Where("number NOT IN ?", numbers).Delete(&CueTrack{})
+
+	if len(missing) > 0 {
+		return errors.New("could not find audio file `" + strings.Join(missing, "`, `") + "`")
+	}
+
+	return nil
+}
+
+// Parse every .cue file on this host that is new or has changed
+func parseCueSheets(db *gorm.DB, hostName string) {
+	files := make([]File, 0)
+	db.Where(&File{HostName: hostName, ExtensionLowerCase: "cue"}).Find(&files)
+
+	for _, file := range files {
+		sourceHash, err := hashFileImo(file.Base + file.Path)
+
+		if err != nil {
+			log.Println("Could not read `" + file.Path + "`: " + err.Error())
+			recordParseError(db, file, "read", "", err)
+			continue
+		}
+
+		var count int64
+		db.Model(&CueSheet{}).Where(&CueSheet{FileID: file.ID, SourceHash: sourceHash}).Count(&count)
+
+		// unchanged, unless the audio it points at wasn't there last time
+		if count > 0 {
+			var failed int64
+			db.Model(&ParseError{}).Where(&ParseError{FileID: file.ID, Stage: "cue"}).Count(&failed)
+
+			if failed == 0 {
+				continue
+			}
+		}
+
+		if err := parseCueToDb(file, sourceHash, db); err != nil {
+			log.Println("Could not parse cue sheet `" + file.Path + "`: " + err.Error())
+			recordParseError(db, file, "cue", sourceHash, err)
+		} else {
+			clearParseError(db, file, "cue")
+		}
+	}
+
+	// sheets whose .cue has gone
+	db.Where("file_id NOT IN (?)", db.Model(&File{}).Select("id")).Delete(&CueSheet{})
+	db.Where("cue_sheet_id NOT IN (?)", db.Model(&CueSheet{}).Select("id")).Delete(&CueTrack{})
+}
+
+// A virtual track with the sheet and audio file it belongs to
+type cueTrackRow struct {
+	CueTrack
+	Album     string `json:"album"`
+	AudioPath string `json:"audioPath"`
+	CuePath   string `json:"cuePath"`
+}
+
+// Search virtual tracks by title, performer or album
+func findCueTracks(db *gorm.DB, search string, limit int, offset int) []cueTrackRow {
+	rows := make([]cueTrackRow, 0)
+
+	query := db.Table("cue_tracks").
+		Select("cue_tracks.*, cue_sheets.title AS album, audio.path AS audio_path, cue.path AS cue_path").
+		Joins("JOIN cue_sheets ON cue_sheets.id = cue_tracks.cue_sheet_id").
+		Joins("JOIN files cue ON cue.id = cue_sheets.file_id").
+		Joins("LEFT JOIN files audio ON audio.id = cue_tracks.audio_file_id")
+
+	if len(search) > 0 {
+		like := "%" + escapeLike(search) + "%"
+		query = query.Where("cue_tracks.title LIKE ? OR cue_tracks.performer LIKE ? OR cue_sheets.title LIKE ?", like, like, like)
+	}
+
+	if limit > 0 {
+		query = query.Limit(limit).Offset(offset)
+	}
+
+	query.Order("cue.path, cue_tracks.number").Scan(&rows)
+
+	return rows
+}
+
+// List virtual tracks, optionally only those matching a search
+func listCueTracks(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&CueSheet{})
+	db.AutoMigrate(&CueTrack{})
+
+	search := ""
+
+	if len(args) > 0 {
+		search = strings.Join(args, " ")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNO\tSTART\tLENGTH\tPERFORMER\tTITLE\tALBUM\tAUDIO")
+
+	for _, row := range findCueTracks(db, search, 0, 0) {
+		audio := row.AudioPath
+
+		if row.AudioFileID == 0 {
+			audio = "missing: " + row.FileName
+		}
+
+		fmt.Fprintf(w, "%d\t%02d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			row.ID,
+			row.Number,
+			formatDuration(row.Start),
+			formatDuration(row.Duration),
+			row.Performer,
+			row.Title,
+			row.Album,
+			audio)
+	}
+
+	w.Flush()
+}
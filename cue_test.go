@@ -0,0 +1,175 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCueTime(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{in: "00:00:00", want: 0},
+		{in: "01:02:00", want: 62},
+		{in: "00:00:75", wantErr: true},
+		{in: "00:60:00", wantErr: true},
+		{in: "74:59:74", want: 74*60 + 59 + 74.0/75},
+		{in: "1:2", wantErr: true},
+		{in: "aa:00:00", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseCueTime(test.in)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseCueTime(%q) error = %v, want error %v", test.in, err, test.wantErr)
+			continue
+		}
+
+		if !test.wantErr && got != test.want {
+			t.Errorf("parseCueTime(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestSplitCueLine(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{in: `TITLE "Back In Black"`, want: []string{"TITLE", "Back In Black"}},
+		{in: `FILE "a b.wav" WAVE`, want: []string{"FILE", "a b.wav", "WAVE"}},
+		{in: "INDEX 01\t00:00:00", want: []string{"INDEX", "01", "00:00:00"}},
+		{in: `TITLE ""`, want: []string{"TITLE", ""}},
+		{in: "", want: []string{}},
+	}
+
+	for _, test := range tests {
+		if got := splitCueLine(test.in); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitCueLine(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseCueSheet(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    cueSheetText
+		wantErr bool
+	}{
+		{
+			name: "single file",
+			in: `REM GENRE Rock
+REM DATE 1980
+PERFORMER "AC/DC"
+TITLE "Back In Black"
+FILE "album.wav" WAVE
+  TRACK 01 AUDIO
+    TITLE "Hells Bells"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Shoot To Thrill"
+    PERFORMER "Bon"
+    INDEX 00 05:10:00
+    INDEX 01 05:12:00
+`,
+			want: cueSheetText{
+				Title:     "Back In Black",
+				Performer: "AC/DC",
+				Genre:     "Rock",
+				Date:      "1980",
+				Tracks: []cueTrackText{
+					{Number: 1, FileName: "album.wav", Title: "Hells Bells", HasIndex01: true},
+					{Number: 2, FileName: "album.wav", Title: "Shoot To Thrill", Performer: "Bon",
+						Index00: 310, HasIndex00: true, Index01: 312, HasIndex01: true},
+				},
+			},
+		},
+		{
+			name: "pregap in the previous file",
+			in: `FILE "01.wav" WAVE
+TRACK 01 AUDIO
+INDEX 01 00:00:00
+TRACK 02 AUDIO
+INDEX 00 03:00:00
+FILE "02.wav" WAVE
+INDEX 01 00:00:00
+`,
+			want: cueSheetText{
+				Tracks: []cueTrackText{
+					{Number: 1, FileName: "01.wav", HasIndex01: true},
+					{Number: 2, FileName: "02.wav", Index00: 180, HasIndex01: true},
+				},
+			},
+		},
+		{
+			name: "data track title stays off the sheet",
+			in: `TITLE "Enhanced"
+FILE "album.wav" WAVE
+TRACK 01 AUDIO
+INDEX 01 00:00:00
+FILE "data.bin" BINARY
+TRACK 02 MODE1/2352
+TITLE "Video"
+PERFORMER "Data"
+INDEX 01 00:00:00
+`,
+			want: cueSheetText{
+				Title: "Enhanced",
+				Tracks: []cueTrackText{
+					{Number: 1, FileName: "album.wav", HasIndex01: true},
+				},
+			},
+		},
+		{
+			name:    "track before file",
+			in:      "TRACK 01 AUDIO\nINDEX 01 00:00:00\n",
+			wantErr: true,
+		},
+		{
+			name:    "no index 01",
+			in:      "FILE \"a.wav\" WAVE\nTRACK 01 AUDIO\nINDEX 00 00:00:00\n",
+			wantErr: true,
+		},
+		{
+			name:    "no audio tracks",
+			in:      "TITLE \"Nothing\"\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseCueSheet([]byte(test.in))
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got  %+v\n want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPathsUnder(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: ".", want: "%"},
+		{in: "", want: "%"},
+		{in: "Artist/Album", want: "Artist/Album/%"},
+		{in: "Artist/Album/", want: "Artist/Album/%"},
+		{in: "100%_Hits", want: `100\%\_Hits/%`},
+	}
+
+	for _, test := range tests {
+		if got := pathsUnder(test.in); got != test.want {
+			t.Errorf("pathsUnder(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
@@ -54,7 +54,3 @@ func createFileRows(db *gorm.DB, files []File) error {
 func deleteAllFiles(db *gorm.DB) {
 	db.Where("true").Delete(&File{})
 }
-
-func deleteAllTags(db *gorm.DB) {
-	db.Where("true").Delete(&Tag{})
-}
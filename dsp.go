@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io"
+	"math"
+	"math/cmplx"
+)
+
+// In place radix-2 fft, len(x) must be a power of two
+func fft(x []complex128) {
+	n := len(x)
+
+	// bit reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+
+		j |= bit
+
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+
+			for k := 0; k < size/2; k++ {
+				even := x[start+k]
+				odd := w * x[start+k+size/2]
+				x[start+k] = even + odd
+				x[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
+
+// Hann window of n points
+func hannWindow(n int) []float64 {
+	window := make([]float64, n)
+
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	}
+
+	return window
+}
+
+// Hamming window of n points
+func hammingWindow(n int) []float64 {
+	window := make([]float64, n)
+
+	for i := range window {
+		window[i] = 0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	}
+
+	return window
+}
+
+// Power spectrum of a windowed block, bins 0 to n/2
+func powerSpectrum(samples []float64, window []float64, out []float64) {
+	x := make([]complex128, len(samples))
+
+	for i, sample := range samples {
+		x[i] = complex(sample*window[i], 0)
+	}
+
+	fft(x)
+
+	for i := range out {
+		re, im := real(x[i]), imag(x[i])
+		out[i] = re*re + im*im
+	}
+}
+
+// Decode a file to mono, -1 to 1, and hand it out in blocks
+func readMono(reader pcmReader, fn func([]float64) error) error {
+	format := reader.Format()
+	scale := 1 / float64(int64(1)<<(format.BitDepth-1)) / float64(format.Channels)
+
+	for {
+		block, err := reader.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		mono := make([]float64, len(block[0]))
+
+		for _, channel := range block {
+			for i, sample := range channel {
+				mono[i] += float64(sample) * scale
+			}
+		}
+
+		if err := fn(mono); err != nil {
+			return err
+		}
+	}
+}
+
+// Root mean square of a block
+func rms(samples []float64) float64 {
+	sum := 0.0
+
+	for _, sample := range samples {
+		sum += sample * sample
+	}
+
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+// Change the sample rate with a windowed sinc, filtering out what would
+// alias when going down
+func resample(samples []float64, from int, to int) []float64 {
+	if from == to {
+		return samples
+	}
+
+	ratio := float64(from) / float64(to)
+	cutoff := math.Min(1, 1/ratio)
+	half := int(math.Ceil(8 / cutoff))
+	out := make([]float64, int(float64(len(samples))/ratio))
+
+	for n := range out {
+		t := float64(n) * ratio
+		center := int(t)
+		sum := 0.0
+
+		for k := center - half + 1; k <= center+half; k++ {
+			if k < 0 || k >= len(samples) {
+				continue
+			}
+
+			x := t - float64(k)
+			weight := cutoff
+
+			if x != 0 {
+				weight = math.Sin(math.Pi*cutoff*x) / (math.Pi * x)
+			}
+
+			// hann window over the taps
+			weight *= 0.5 + 0.5*math.Cos(math.Pi*x/float64(half))
+			sum += samples[k] * weight
+		}
+
+		out[n] = sum
+	}
+
+	return out
+}
+
+// Cuts a stream of samples into overlapping frames
+type framer struct {
+	size   int
+	hop    int
+	buffer []float64
+	fn     func(frame []float64)
+}
+
+func newFramer(size int, hop int, fn func(frame []float64)) *framer {
+	return &framer{size: size, hop: hop, buffer: make([]float64, 0, size*2), fn: fn}
+}
+
+func (f *framer) push(samples []float64) {
+	f.buffer = append(f.buffer, samples...)
+
+	for len(f.buffer) >= f.size {
+		f.fn(f.buffer[:f.size])
+		f.buffer = f.buffer[:copy(f.buffer, f.buffer[f.hop:])]
+	}
+}
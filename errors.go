@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// The file on the remote server does not match the local one after upload
+	errChecksumMismatch = errors.New("remote checksum does not match local file")
+	// md5sum/sha1sum on the remote server returned nothing
+	errEmptyChecksum = errors.New("remote checksum is empty")
+)
+
+// ConnectionError means the ssh connection was lost or could not be used.
+// The file itself is probably fine and should be retried once we reconnect.
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return "ssh connection: " + e.Err.Error()
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// RemoteCommandError means a command ran on the remote server but exited non-zero
+type RemoteCommandError struct {
+	Command string
+	Status  int
+	Output  string
+}
+
+func (e *RemoteCommandError) Error() string {
+	return fmt.Sprintf("remote command `%s` exited with status %d", e.Command, e.Status)
+}
+
+// UnknownHostError means the server's host key is not in known_hosts yet
+type UnknownHostError struct {
+	Host string
+	Key  ssh.PublicKey
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf("unknown host %s (%s %s), run `trusthost` to check and trust it",
+		e.Host, e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+}
+
+// SyncError is a failure to sync a single file, with the step it failed on
+type SyncError struct {
+	Op   string // match, touch, copy, upload, verify
+	Path string // local path of the file
+	Err  error
+}
+
+func (e *SyncError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+// Is this error caused by a dropped or unusable ssh connection
+func isConnectionError(err error) bool {
+	var ce *ConnectionError
+
+	return errors.As(err, &ce)
+}
+
+// Is this error a remote command that ran and exited non-zero
+func isRemoteCommandError(err error) bool {
+	var rce *RemoteCommandError
+
+	return errors.As(err, &rce)
+}
+
+// Turn an error from an ssh session into one of our typed errors
+func classifySSHError(command string, output string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// The command ran, it just didn't succeed
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return &RemoteCommandError{Command: command, Status: exitErr.ExitStatus(), Output: output}
+	}
+
+	// Anything below here means the connection is no good
+	var netErr net.Error
+	var missingErr *ssh.ExitMissingError
+
+	if errors.Is(err, io.EOF) ||
+		errors.As(err, &netErr) ||
+		errors.As(err, &missingErr) ||
+		strings.Contains(err.Error(), "use of closed network connection") {
+		return &ConnectionError{Err: err}
+	}
+
+	return err
+}
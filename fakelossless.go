@@ -0,0 +1,438 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SpectrumAnalysis is where the spectrum of a lossless file stops, and how
+// sure we are that the stop is a lossy encoder's lowpass
+type SpectrumAnalysis struct {
+	ID           uint      `json:"id"`
+	FileID       uint      `gorm:"uniqueIndex" json:"fileId"`
+	SourceHash   string    `gorm:"size:32" json:"-"` // imohash of the file when it was analysed
+	SampleRate   int       `json:"sampleRate"`
+	Cutoff       int       `json:"cutoff"`                       // Hz, the steepest drop in the top of the spectrum
+	Drop         float64   `json:"drop"`                         // dB across the cutoff
+	Floor        float64   `json:"floor"`                        // dB above the cutoff, relative to the midrange
+	Confidence   float64   `gorm:"index" json:"confidence"`      // 0 to 1 that it came from a lossy source
+	Verdict      string    `gorm:"index;size:16" json:"verdict"` // clean, suspect, lossy or silent
+	LikelySource string    `gorm:"size:64" json:"likelySource"`  // what usually cuts off there
+	Windows      int       `json:"windows"`                      // blocks that were loud enough to use
+	CreatedAt    time.Time `json:"-"`
+	UpdatedAt    time.Time `json:"-"`
+}
+
+// fft size, about 10Hz per bin at 44.1kHz
+const spectrumSize = 4096
+
+// Blocks skipped between each one analysed, a quarter of the file is plenty
+const spectrumSkip = 3
+
+// Lowpass frequencies lossy encoders are known for
+var lossyCutoffs = []struct {
+	From   int
+	To     int
+	Source string
+}{
+	{10500, 11500, "mp3 64kbps or lower"},
+	{14500, 16500, "mp3 128kbps, aac 128kbps"},
+	{16500, 17500, "mp3 160kbps, aac"},
+	{17500, 18500, "mp3 V4 / 160kbps"},
+	{18500, 19700, "mp3 192kbps or V2, aac 192kbps"},
+	{19700, 20600, "mp3 320kbps or V0, aac 256kbps"},
+}
+
+// Average power of a run of bins, in dB
+func bandLevel(spectrum []float64, binHz float64, from float64, to float64) float64 {
+	first := int(from / binHz)
+	last := int(to / binHz)
+
+	if first < 1 {
+		first = 1
+	}
+
+	if last >= len(spectrum) {
+		last = len(spectrum) - 1
+	}
+
+	if last < first {
+		return -200
+	}
+
+	sum := 0.0
+
+	for i := first; i <= last; i++ {
+		sum += spectrum[i]
+	}
+
+	return 10 * math.Log10(sum/float64(last-first+1)+1e-20)
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// Decode a file and look for a lowpass in its average spectrum
+func analyseSpectrum(path string, extension string) (SpectrumAnalysis, error) {
+	analysis := SpectrumAnalysis{Verdict: "silent"}
+
+	reader, err := openPCM(path, extension)
+
+	if err != nil {
+		return analysis, err
+	}
+
+	defer reader.Close()
+
+	analysis.SampleRate = reader.Format().SampleRate
+	window := hannWindow(spectrumSize)
+	power := make([]float64, spectrumSize/2+1)
+	block := make([]float64, spectrumSize/2+1)
+	buffer := make([]float64, 0, spectrumSize)
+	skip := 0
+
+	err = readMono(reader, func(samples []float64) error {
+		for _, sample := range samples {
+			if skip > 0 {
+				skip--
+				continue
+			}
+
+			buffer = append(buffer, sample)
+
+			if len(buffer) < spectrumSize {
+				continue
+			}
+
+			// quiet passages have nothing up top to look at
+			if rms(buffer) > 0.01 {
+				powerSpectrum(buffer, window, block)
+
+				for i, p := range block {
+					power[i] += p
+				}
+
+				analysis.Windows++
+			}
+
+			buffer = buffer[:0]
+			skip = spectrumSize * spectrumSkip
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return analysis, err
+	}
+
+	if analysis.Windows == 0 {
+		return analysis, nil
+	}
+
+	binHz := float64(analysis.SampleRate) / spectrumSize
+	nyquist := float64(analysis.SampleRate) / 2
+	reference := bandLevel(power, binHz, 1000, 6000)
+
+	// the steepest drop between 10kHz and just under nyquist, comparing
+	// the 1kHz either side and leaving a gap for the slope of the filter
+	bestDrop := 0.0
+	bestCutoff := 0.0
+
+	for f := 10000.0; f < nyquist-600; f += binHz {
+		below := bandLevel(power, binHz, f-1000, f-150)
+		above := bandLevel(power, binHz, f+150, math.Min(f+1000, nyquist))
+
+		if drop := below - above; drop > bestDrop {
+			bestDrop = drop
+			bestCutoff = f
+		}
+	}
+
+	analysis.Cutoff = int(bestCutoff)
+	analysis.Drop = math.Round(bestDrop*10) / 10
+	analysis.Floor = math.Round((bandLevel(power, binHz, bestCutoff+150, nyquist)-reference)*10) / 10
+
+	// a cliff rather than a slope, with next to nothing above it
+	steep := clamp01((bestDrop - 15) / 25)
+	quiet := clamp01((-analysis.Floor - 45) / 30)
+	analysis.Confidence = math.Round(math.Sqrt(steep*quiet)*100) / 100
+
+	// cutting off just under nyquist is the format's own filter
+	if bestCutoff > nyquist-1500 && nyquist <= 24000 {
+		analysis.Confidence = 0
+	}
+
+	if nyquist > 24000 && bestCutoff <= 24000 && analysis.Confidence > 0 {
+		analysis.LikelySource = "upsampled from 44.1/48kHz"
+	}
+
+	for _, cutoff := range lossyCutoffs {
+		if analysis.Confidence > 0 && analysis.Cutoff >= cutoff.From && analysis.Cutoff < cutoff.To {
+			analysis.LikelySource = cutoff.Source
+		}
+	}
+
+	switch {
+	case analysis.Confidence >= 0.7:
+		analysis.Verdict = "lossy"
+	case analysis.Confidence >= 0.4:
+		analysis.Verdict = "suspect"
+	default:
+		analysis.Verdict = "clean"
+	}
+
+	return analysis, nil
+}
+
+// Analyse every lossless file on this host that is new or has changed
+func analyseSpectrums(db *gorm.DB, hostName string, path string, rescan bool) {
+	jobs := make(chan File)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for file := range jobs {
+				sourceHash, err := hashFileImo(file.Base + file.Path)
+
+				if err != nil {
+					log.Println("Could not read `" + file.Path + "`: " + err.Error())
+					recordParseError(db, file, "read", "", err)
+					continue
+				}
+
+				var count int64
+				db.Model(&SpectrumAnalysis{}).Where(&SpectrumAnalysis{FileID: file.ID, SourceHash: sourceHash}).Count(&count)
+
+				if count > 0 && !rescan {
+					continue
+				}
+
+				analysis, err := analyseSpectrum(file.Base+file.Path, file.ExtensionLowerCase)
+
+				if err != nil {
+					log.Println("Could not analyse `" + file.Path + "`: " + err.Error())
+					recordParseError(db, file, "spectrum", sourceHash, err)
+					continue
+				}
+
+				clearParseError(db, file, "spectrum")
+
+				analysis.FileID = file.ID
+				analysis.SourceHash = sourceHash
+
+				db.Clauses(clause.OnConflict{
+					Columns:   []clause.Column{{Name: "file_id"}},
+					UpdateAll: true}).Create(&analysis)
+			}
+		}()
+	}
+
+	query := db.Where(&File{HostName: hostName}).Where("extension_lower_case IN ?", pcmExtensions)
+
+	if len(path) > 0 {
+		query = query.Where("path LIKE ?", "%"+path+"%")
+	}
+
+	batch := make([]File, 0)
+
+	query.FindInBatches(&batch, 500, func(tx *gorm.DB, n int) error {
+		for _, file := range batch {
+			jobs <- file
+		}
+
+		return nil
+	})
+
+	close(jobs)
+	wg.Wait()
+}
+
+// An analysis with where its file lives on the library
+type spectrumRow struct {
+	SpectrumAnalysis
+	Path    string `json:"path"`
+	AlbumID uint   `json:"albumId"`
+	Album   string `json:"album"`
+	Artist  string `json:"artist"`
+}
+
+// Suspected fake lossless albums, most suspicious first
+type fakeLosslessAlbum struct {
+	AlbumID      uint    `json:"albumId"`
+	Artist       string  `json:"artist"`
+	Album        string  `json:"album"`
+	Directory    string  `json:"directory"`
+	Tracks       int     `json:"tracks"`
+	Suspect      int     `json:"suspect"` // suspect or lossy
+	Confidence   float64 `json:"confidence"`
+	MedianCutoff int     `json:"medianCutoff"`
+	LikelySource string  `json:"likelySource"`
+}
+
+func findSpectrumRows(db *gorm.DB, path string) []spectrumRow {
+	rows := make([]spectrumRow, 0)
+
+	query := db.Table("spectrum_analyses").
+		Select("spectrum_analyses.*, files.path, albums.id AS album_id, albums.title AS album, artists.name AS artist").
+		Joins("JOIN files ON files.id = spectrum_analyses.file_id").
+		Joins("LEFT JOIN tracks ON tracks.file_id = files.id").
+		Joins("LEFT JOIN albums ON albums.id = tracks.album_id").
+		Joins("LEFT JOIN artists ON artists.id = albums.artist_id")
+
+	if len(path) > 0 {
+		query = query.Where("files.path LIKE ?", "%"+path+"%")
+	}
+
+	query.Order("files.path").Scan(&rows)
+
+	return rows
+}
+
+// Roll the file results up into albums, only albums with at least one
+// suspect track unless all is set. Files that aren't in the library yet
+// are grouped by their album directory.
+func fakeLosslessAlbums(db *gorm.DB, path string, all bool) []fakeLosslessAlbum {
+	albums := make(map[string]*fakeLosslessAlbum)
+	cutoffs := make(map[string][]int)
+	sources := make(map[string][]string)
+
+	for _, row := range findSpectrumRows(db, path) {
+		key := "album:" + strconv.FormatUint(uint64(row.AlbumID), 10)
+
+		if row.AlbumID == 0 {
+			key = "dir:" + albumDirectory(row.Path)
+		}
+
+		album, ok := albums[key]
+
+		if !ok {
+			album = &fakeLosslessAlbum{AlbumID: row.AlbumID, Artist: row.Artist, Album: row.Album, Directory: albumDirectory(row.Path)}
+			albums[key] = album
+		}
+
+		album.Tracks++
+
+		if row.Verdict == "suspect" || row.Verdict == "lossy" {
+			album.Suspect++
+			sources[key] = append(sources[key], row.LikelySource)
+		}
+
+		album.Confidence += row.Confidence
+		cutoffs[key] = append(cutoffs[key], row.Cutoff)
+	}
+
+	results := make([]fakeLosslessAlbum, 0, len(albums))
+
+	for key, album := range albums {
+		if album.Suspect == 0 && !all {
+			continue
+		}
+
+		sort.Ints(cutoffs[key])
+		album.MedianCutoff = cutoffs[key][len(cutoffs[key])/2]
+		album.Confidence = math.Round(album.Confidence/float64(album.Tracks)*100) / 100
+		album.LikelySource = mostCommon(sources[key])
+		results = append(results, *album)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Confidence > results[j].Confidence
+	})
+
+	return results
+}
+
+// fakelossless scan [--path] [--rescan], or report suspect albums or files
+func fakeLossless(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&SpectrumAnalysis{})
+	db.AutoMigrate(&ParseError{})
+
+	if len(args) > 0 && args[0] == "scan" {
+		flags := flag.NewFlagSet("fakelossless scan", flag.ExitOnError)
+		path := flags.String("path", "", "only files with paths containing this")
+		rescan := flags.Bool("rescan", false, "analyse files that haven't changed too")
+		flags.Parse(args[1:])
+
+		hostName, err := os.Hostname()
+
+		if err != nil {
+			panic(err) // could not get local hostname
+		}
+
+		analyseSpectrums(db, hostName, *path, *rescan)
+
+		return
+	}
+
+	flags := flag.NewFlagSet("fakelossless", flag.ExitOnError)
+	path := flags.String("path", "", "only files with paths containing this")
+	files := flags.Bool("files", false, "list files rather than albums")
+	all := flags.Bool("all", false, "include clean albums and files")
+	flags.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	if *files {
+		fmt.Fprintln(w, "FILE\tVERDICT\tCONFIDENCE\tCUTOFF\tDROP\tLIKELY SOURCE\tPATH")
+
+		for _, row := range findSpectrumRows(db, *path) {
+			if row.Verdict == "clean" && !*all {
+				continue
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%.2f\t%d\t%.1f\t%s\t%s\n",
+				row.FileID,
+				row.Verdict,
+				row.Confidence,
+				row.Cutoff,
+				row.Drop,
+				row.LikelySource,
+				row.Path)
+		}
+
+		w.Flush()
+
+		return
+	}
+
+	fmt.Fprintln(w, "ARTIST\tALBUM\tSUSPECT\tCONFIDENCE\tCUTOFF\tLIKELY SOURCE\tDIRECTORY")
+
+	for _, album := range fakeLosslessAlbums(db, *path, *all) {
+		fmt.Fprintf(w, "%s\t%s\t%d/%d\t%.2f\t%d\t%s\t%s\n",
+			album.Artist,
+			album.Album,
+			album.Suspect,
+			album.Tracks,
+			album.Confidence,
+			album.MedianCutoff,
+			album.LikelySource,
+			album.Directory)
+	}
+
+	w.Flush()
+}
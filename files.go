@@ -28,6 +28,9 @@ type File struct {
 	UpdatedAt          time.Time
 	Md5                string `gorm:"index;size:32"`
 	VerifiedAt         time.Time
+	AudioMd5           string    `gorm:"size:32"`       // md5 of the decoded audio, from flac STREAMINFO
+	AudioStatus        string    `gorm:"index;size:16"` // ok, mismatch, undecodable or unset
+	AudioVerifiedAt    time.Time // when the audio was last decoded and checked
 }
 
 // Handles paths inputted into it. Rudimentary queue system
@@ -0,0 +1,806 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Fingerprint is the chromaprint of the first two minutes of a file. Raw is
+// the little endian sub-fingerprints, Chromaprint is the compressed form
+// fpcalc prints and AcoustID takes.
+type Fingerprint struct {
+	ID          uint      `json:"id"`
+	FileID      uint      `gorm:"uniqueIndex" json:"fileId"`
+	SourceHash  string    `gorm:"size:32" json:"-"` // imohash of the file when it was fingerprinted
+	Duration    float64   `gorm:"index" json:"duration"`
+	Raw         []byte    `json:"-"`
+	Chromaprint string    `gorm:"type:text" json:"chromaprint"`
+	CreatedAt   time.Time `json:"-"`
+	UpdatedAt   time.Time `json:"-"`
+}
+
+// FingerprintHash is one sub-fingerprint of a file, used to find candidates
+// before comparing whole fingerprints
+type FingerprintHash struct {
+	ID     uint
+	FileID uint   `gorm:"index"`
+	Hash   uint32 `gorm:"index"`
+}
+
+// Chromaprint's default algorithm (TEST2): 11025Hz mono, 4096 point frames
+// two thirds overlapped, chroma between 28Hz and 3520Hz
+const chromaprintSampleRate = 11025
+const chromaprintFrameSize = 4096
+const chromaprintFrameStep = chromaprintFrameSize / 3
+const chromaprintMinFreq = 28
+const chromaprintMaxFreq = 3520
+const chromaprintAlgorithm = 1
+
+// fpcalc's default, enough to tell recordings apart
+const fingerprintSeconds = 120
+
+// Two fingerprints are the same recording above this similarity
+const fingerprintMatchThreshold = 0.8
+
+// Only sub-fingerprints where hash%8 == 0 are indexed. Which ones get
+// picked depends on the audio not the position, so an offset doesn't matter.
+const fingerprintHashSampling = 8
+
+// Candidates need this many indexed sub-fingerprints in common
+const fingerprintMinCommonHashes = 3
+
+// Duplicates are within this many seconds of each other's length
+const fingerprintDuplicateSeconds = 10
+
+var chromaFilterCoefficients = []float64{0.25, 0.75, 1.0, 0.75, 0.25}
+
+// A box filter over the chroma image compared against its neighbour, then
+// quantized to 2 bits
+type chromaprintClassifier struct {
+	Type       int
+	Y          int // first chroma band
+	Height     int // chroma bands
+	Width      int // frames
+	Thresholds [3]float64
+}
+
+var chromaprintClassifiers = []chromaprintClassifier{
+	{0, 4, 3, 15, [3]float64{1.98215, 2.35817, 2.63523}},
+	{4, 4, 6, 15, [3]float64{-1.03809, -0.651211, -0.282167}},
+	{1, 0, 4, 16, [3]float64{-0.298702, 0.119262, 0.558497}},
+	{3, 8, 2, 12, [3]float64{-0.105439, 0.0153946, 0.135898}},
+	{3, 4, 4, 8, [3]float64{-0.142891, 0.0258736, 0.200632}},
+	{4, 0, 3, 5, [3]float64{-0.826319, -0.590612, -0.368214}},
+	{1, 2, 2, 9, [3]float64{-0.557409, -0.233035, 0.0534525}},
+	{2, 7, 3, 4, [3]float64{-0.0646826, 0.00620476, 0.0784847}},
+	{2, 6, 2, 16, [3]float64{-0.192387, -0.029699, 0.215855}},
+	{2, 1, 3, 2, [3]float64{-0.0397818, -0.00568076, 0.0292026}},
+	{5, 10, 1, 15, [3]float64{-0.53823, -0.369934, -0.190235}},
+	{3, 6, 2, 10, [3]float64{-0.124877, 0.0296483, 0.139239}},
+	{2, 1, 1, 14, [3]float64{-0.101475, 0.0225617, 0.231971}},
+	{3, 5, 6, 4, [3]float64{-0.0799915, -0.00729616, 0.063262}},
+	{1, 9, 2, 12, [3]float64{-0.272556, 0.019424, 0.301921}},
+	{3, 4, 2, 14, [3]float64{-0.164292, -0.0321188, 0.0846339}},
+}
+
+// Widest classifier, sub-fingerprints start once there are this many frames
+const chromaprintMaxFilterWidth = 16
+
+var errEnoughAudio = errors.New("enough audio")
+
+// Summed area table of the chroma image, rows are frames
+type integralImage struct {
+	rows [][12]float64
+}
+
+func newIntegralImage(image [][12]float64) integralImage {
+	rows := make([][12]float64, len(image)+1)
+
+	for r, features := range image {
+		for c := 0; c < 12; c++ {
+			rows[r+1][c] = features[c] + rows[r][c]
+
+			if c > 0 {
+				rows[r+1][c] += rows[r+1][c-1] - rows[r][c-1]
+			}
+		}
+	}
+
+	return integralImage{rows: rows}
+}
+
+// Sum of frames r1 to r2 and bands c1 to c2, ends exclusive
+func (i integralImage) area(r1 int, c1 int, r2 int, c2 int) float64 {
+	at := func(r int, c int) float64 {
+		if c == 0 {
+			return 0
+		}
+
+		return i.rows[r][c-1]
+	}
+
+	return at(r2, c2) - at(r1, c2) - at(r2, c1) + at(r1, c1)
+}
+
+func (c chromaprintClassifier) classify(image integralImage, x int) uint32 {
+	y, w, h := c.Y, c.Width, c.Height
+	var a, b float64
+
+	switch c.Type {
+	case 0:
+		a = image.area(x, y, x+w, y+h)
+	case 1:
+		a = image.area(x, y+h/2, x+w, y+h)
+		b = image.area(x, y, x+w, y+h/2)
+	case 2:
+		a = image.area(x+w/2, y, x+w, y+h)
+		b = image.area(x, y, x+w/2, y+h)
+	case 3:
+		a = image.area(x, y+h/2, x+w/2, y+h) + image.area(x+w/2, y, x+w, y+h/2)
+		b = image.area(x, y, x+w/2, y+h/2) + image.area(x+w/2, y+h/2, x+w, y+h)
+	case 4:
+		a = image.area(x, y+h/3, x+w, y+2*h/3)
+		b = image.area(x, y, x+w, y+h/3) + image.area(x, y+2*h/3, x+w, y+h)
+	case 5:
+		a = image.area(x+w/3, y, x+2*w/3, y+h)
+		b = image.area(x, y, x+w/3, y+h) + image.area(x+2*w/3, y, x+w, y+h)
+	}
+
+	value := math.Log(1+a) - math.Log(1+b)
+
+	// 2 bit gray code
+	switch {
+	case value < c.Thresholds[0]:
+		return 0
+	case value < c.Thresholds[1]:
+		return 1
+	case value < c.Thresholds[2]:
+		return 3
+	}
+
+	return 2
+}
+
+// Sub-fingerprints of a chroma image, one per frame once there are enough
+func chromaprintImage(image [][12]float64) []uint32 {
+	integral := newIntegralImage(image)
+	fingerprint := make([]uint32, 0)
+
+	for x := 0; x+chromaprintMaxFilterWidth <= len(image); x++ {
+		var value uint32
+
+		for _, classifier := range chromaprintClassifiers {
+			value = value<<2 | classifier.classify(integral, x)
+		}
+
+		fingerprint = append(fingerprint, value)
+	}
+
+	return fingerprint
+}
+
+// Chroma of 11025Hz mono audio, smoothed over time and normalised
+func chromaprintChroma(samples []float64) [][12]float64 {
+	minIndex := int(math.Round(chromaprintFrameSize * chromaprintMinFreq / float64(chromaprintSampleRate)))
+	maxIndex := int(math.Round(chromaprintFrameSize * chromaprintMaxFreq / float64(chromaprintSampleRate)))
+
+	notes := make([]int, maxIndex)
+
+	for i := minIndex; i < maxIndex; i++ {
+		freq := float64(i) * chromaprintSampleRate / chromaprintFrameSize
+		octave := math.Log2(freq / (440.0 / 16))
+		notes[i] = int(12 * (octave - math.Floor(octave)))
+	}
+
+	window := hammingWindow(chromaprintFrameSize)
+	power := make([]float64, chromaprintFrameSize/2+1)
+	frames := make([][12]float64, 0)
+
+	for start := 0; start+chromaprintFrameSize <= len(samples); start += chromaprintFrameStep {
+		powerSpectrum(samples[start:start+chromaprintFrameSize], window, power)
+
+		var features [12]float64
+
+		for i := minIndex; i < maxIndex; i++ {
+			features[notes[i]] += power[i]
+		}
+
+		frames = append(frames, features)
+	}
+
+	image := make([][12]float64, 0)
+
+	for start := 0; start+len(chromaFilterCoefficients) <= len(frames); start++ {
+		var features [12]float64
+
+		for j, coefficient := range chromaFilterCoefficients {
+			for c := range features {
+				features[c] += frames[start+j][c] * coefficient
+			}
+		}
+
+		norm := 0.0
+
+		for _, feature := range features {
+			norm += feature * feature
+		}
+
+		norm = math.Sqrt(norm)
+
+		for c := range features {
+			if norm < 0.01 {
+				features[c] = 0
+			} else {
+				features[c] /= norm
+			}
+		}
+
+		image = append(image, features)
+	}
+
+	return image
+}
+
+// Fingerprint the first two minutes of a file
+func chromaprintFile(path string, extension string) ([]uint32, error) {
+	reader, err := openPCM(path, extension)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	sampleRate := reader.Format().SampleRate
+	limit := sampleRate * fingerprintSeconds
+	samples := make([]float64, 0, limit)
+
+	err = readMono(reader, func(block []float64) error {
+		samples = append(samples, block...)
+
+		if len(samples) >= limit {
+			samples = samples[:limit]
+			return errEnoughAudio
+		}
+
+		return nil
+	})
+
+	if err != nil && err != errEnoughAudio {
+		return nil, err
+	}
+
+	samples = resample(samples, sampleRate, chromaprintSampleRate)
+
+	return chromaprintImage(chromaprintChroma(samples)), nil
+}
+
+// Compress a fingerprint the way chromaprint does, each sub-fingerprint xor
+// the one before as the gaps between set bits, 3 bits each with the big
+// ones continued in 5 bits, then URL safe base64
+func encodeChromaprint(fingerprint []uint32) string {
+	normal := make([]uint32, 0, len(fingerprint)*8)
+	exceptional := make([]uint32, 0)
+
+	var previous uint32
+
+	for _, value := range fingerprint {
+		changed := value ^ previous
+		previous = value
+		last := uint32(0)
+
+		for bit := uint32(1); changed != 0; bit, changed = bit+1, changed>>1 {
+			if changed&1 == 1 {
+				normal = append(normal, bit-last)
+				last = bit
+			}
+		}
+
+		normal = append(normal, 0)
+	}
+
+	for i, gap := range normal {
+		if gap >= 7 {
+			exceptional = append(exceptional, gap-7)
+			normal[i] = 7
+		}
+	}
+
+	size := len(fingerprint)
+	out := []byte{chromaprintAlgorithm, byte(size >> 16), byte(size >> 8), byte(size)}
+	out = append(out, packBits(normal, 3)...)
+	out = append(out, packBits(exceptional, 5)...)
+
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// Pack values of width bits each, least significant bit first
+func packBits(values []uint32, width uint) []byte {
+	out := make([]byte, (len(values)*int(width)+7)/8)
+	position := 0
+
+	for _, value := range values {
+		for b := uint(0); b < width; b++ {
+			if value>>b&1 == 1 {
+				out[position/8] |= 1 << (position % 8)
+			}
+
+			position++
+		}
+	}
+
+	return out
+}
+
+func fingerprintToBytes(fingerprint []uint32) []byte {
+	out := make([]byte, len(fingerprint)*4)
+
+	for i, value := range fingerprint {
+		binary.LittleEndian.PutUint32(out[i*4:], value)
+	}
+
+	return out
+}
+
+func fingerprintFromBytes(b []byte) []uint32 {
+	fingerprint := make([]uint32, len(b)/4)
+
+	for i := range fingerprint {
+		fingerprint[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+
+	return fingerprint
+}
+
+// What silence fingerprints as, it would match every quiet intro
+var silentSubFingerprint = chromaprintImage(make([][12]float64, chromaprintMaxFilterWidth))[0]
+
+// The sub-fingerprints worth indexing, once each
+func fingerprintHashes(fingerprint []uint32) []uint32 {
+	seen := make(map[uint32]bool)
+	hashes := make([]uint32, 0)
+
+	for _, value := range fingerprint {
+		if value%fingerprintHashSampling != 0 || value == silentSubFingerprint || seen[value] {
+			continue
+		}
+
+		seen[value] = true
+		hashes = append(hashes, value)
+	}
+
+	return hashes
+}
+
+// How alike two fingerprints are, 1 minus the share of bits that differ,
+// at the offset where they line up best. Tries the offsets most common
+// among identical sub-fingerprints, and no offset at all.
+func compareFingerprints(a []uint32, b []uint32) (float64, int) {
+	positions := make(map[uint32][]int)
+
+	for i, value := range a {
+		positions[value] = append(positions[value], i)
+	}
+
+	offsets := make(map[int]int)
+
+	for j, value := range b {
+		for _, i := range positions[value] {
+			offsets[i-j]++
+		}
+	}
+
+	candidates := []int{0}
+
+	for offset := range offsets {
+		candidates = append(candidates, offset)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return offsets[candidates[i]] > offsets[candidates[j]]
+	})
+
+	if len(candidates) > 5 {
+		candidates = candidates[:5]
+	}
+
+	best := 0.0
+	bestOffset := 0
+
+	for _, offset := range candidates {
+		errors := 0
+		overlap := 0
+
+		for j := range b {
+			i := j + offset
+
+			if i < 0 || i >= len(a) {
+				continue
+			}
+
+			errors += bits.OnesCount32(a[i] ^ b[j])
+			overlap++
+		}
+
+		// a few seconds in common isn't enough to say anything
+		if overlap < 40 {
+			continue
+		}
+
+		if similarity := 1 - float64(errors)/float64(overlap*32); similarity > best {
+			best = similarity
+			bestOffset = offset
+		}
+	}
+
+	return math.Round(best*1000) / 1000, bestOffset
+}
+
+// Fingerprint one file and store it with its index
+func fingerprintToDb(db *gorm.DB, file File, sourceHash string) error {
+	fingerprint, err := chromaprintFile(file.Base+file.Path, file.ExtensionLowerCase)
+
+	if err != nil {
+		return err
+	}
+
+	properties := AudioProperties{}
+	db.Where(&AudioProperties{FileID: file.ID}).First(&properties)
+
+	row := Fingerprint{
+		FileID:      file.ID,
+		SourceHash:  sourceHash,
+		Duration:    properties.Duration,
+		Raw:         fingerprintToBytes(fingerprint),
+		Chromaprint: encodeChromaprint(fingerprint)}
+
+	db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}},
+		UpdateAll: true}).Create(&row)
+
+	db.Where(&FingerprintHash{FileID: file.ID}).Delete(&FingerprintHash{})
+
+	hashes := make([]FingerprintHash, 0)
+
+	for _, hash := range fingerprintHashes(fingerprint) {
+		hashes = append(hashes, FingerprintHash{FileID: file.ID, Hash: hash})
+	}
+
+	if len(hashes) > 0 {
+		db.CreateInBatches(&hashes, 500)
+	}
+
+	return nil
+}
+
+// Fingerprint every audio file on this host that is new or has changed
+func fingerprintFiles(db *gorm.DB, hostName string, path string, rescan bool) {
+	jobs := make(chan File)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for file := range jobs {
+				sourceHash, err := hashFileImo(file.Base + file.Path)
+
+				if err != nil {
+					log.Println("Could not read `" + file.Path + "`: " + err.Error())
+					recordParseError(db, file, "read", "", err)
+					continue
+				}
+
+				var count int64
+				db.Model(&Fingerprint{}).Where(&Fingerprint{FileID: file.ID, SourceHash: sourceHash}).Count(&count)
+
+				if count > 0 && !rescan {
+					continue
+				}
+
+				if err := fingerprintToDb(db, file, sourceHash); err != nil {
+					log.Println("Could not fingerprint `" + file.Path + "`: " + err.Error())
+					recordParseError(db, file, "fingerprint", sourceHash, err)
+					continue
+				}
+
+				clearParseError(db, file, "fingerprint")
+			}
+		}()
+	}
+
+	query := db.Where(&File{HostName: hostName}).Where("extension_lower_case IN ?", audioExtensions)
+
+	if len(path) > 0 {
+		query = query.Where("path LIKE ?", "%"+path+"%")
+	}
+
+	batch := make([]File, 0)
+
+	query.FindInBatches(&batch, 500, func(tx *gorm.DB, n int) error {
+		for _, file := range batch {
+			jobs <- file
+		}
+
+		return nil
+	})
+
+	close(jobs)
+	wg.Wait()
+}
+
+// A file that sounds like another
+type similarRecording struct {
+	FileID     uint    `json:"fileId"`
+	HostName   string  `json:"hostName"`
+	Base       string  `json:"-"`
+	Path       string  `json:"path"`
+	Similarity float64 `json:"similarity"`
+	Offset     float64 `json:"offset"` // seconds the match starts later in this file
+}
+
+// Seconds per sub-fingerprint
+const fingerprintItemSeconds = float64(chromaprintFrameStep) / chromaprintSampleRate
+
+// Files that are the same recording as a file, best first. Only files on
+// hostName unless it's empty.
+func findSimilarRecordings(db *gorm.DB, fileID uint, hostName string, min float64) []similarRecording {
+	results := make([]similarRecording, 0)
+
+	source := Fingerprint{}
+
+	if db.Where(&Fingerprint{FileID: fileID}).First(&source).Error != nil {
+		return results
+	}
+
+	candidates := make([]uint, 0)
+
+	query := db.Model(&FingerprintHash{}).
+		Select("fingerprint_hashes.file_id").
+		Joins("JOIN files ON files.id = fingerprint_hashes.file_id").
+		Where("fingerprint_hashes.hash IN (?)", db.Model(&FingerprintHash{}).Select("hash").Where(&FingerprintHash{FileID: fileID})).
+		Where("fingerprint_hashes.file_id <> ?", fileID)
+
+	if len(hostName) > 0 {
+		query = query.Where("files.host_name = ?", hostName)
+	}
+
+	query.Group("fingerprint_hashes.file_id").
+		Having("count(*) >= ?", fingerprintMinCommonHashes).
+		Pluck("fingerprint_hashes.file_id", &candidates)
+
+	if len(candidates) == 0 {
+		return results
+	}
+
+	sourceFingerprint := fingerprintFromBytes(source.Raw)
+
+	fingerprints := make([]Fingerprint, 0)
+	db.Where("file_id IN ?", candidates).Find(&fingerprints)
+
+	for _, fingerprint := range fingerprints {
+		similarity, offset := compareFingerprints(fingerprintFromBytes(fingerprint.Raw), sourceFingerprint)
+
+		if similarity < min {
+			continue
+		}
+
+		file := File{}
+		db.First(&file, fingerprint.FileID)
+
+		results = append(results, similarRecording{
+			FileID:     file.ID,
+			HostName:   file.HostName,
+			Base:       file.Base,
+			Path:       file.Path,
+			Similarity: similarity,
+			Offset:     math.Round(float64(offset)*fingerprintItemSeconds*10) / 10})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Similarity > results[j].Similarity
+	})
+
+	return results
+}
+
+// Groups of files on this host that are the same recording, in different
+// formats or not. Only files of about the same length are compared, so the
+// hashes of the whole library aren't joined against each other.
+func findDuplicateRecordings(db *gorm.DB, hostName string, path string, min float64) [][]similarRecording {
+	pairs := make([]struct {
+		A uint
+		B uint
+	}, 0)
+
+	files := db.Model(&File{}).Select("id").Where("host_name = ?", hostName)
+	sources := files
+
+	// each pair once, or both ways round when only one side has to be under path
+	pairing := "fb.file_id > fa.file_id"
+
+	if len(path) > 0 {
+		sources = db.Model(&File{}).Select("id").Where("host_name = ?", hostName).Where("path LIKE ?", "%"+escapeLike(path)+"%")
+		pairing = "fb.file_id <> fa.file_id"
+	}
+
+	db.Table("fingerprints AS fa").
+		Select("fa.file_id AS a, fb.file_id AS b").
+		Joins("JOIN fingerprints AS fb ON fb.duration BETWEEN fa.duration - ? AND fa.duration + ? AND "+pairing, fingerprintDuplicateSeconds, fingerprintDuplicateSeconds).
+		Joins("JOIN fingerprint_hashes AS a ON a.file_id = fa.file_id").
+		Joins("JOIN fingerprint_hashes AS b ON b.file_id = fb.file_id AND b.hash = a.hash").
+		Where("fa.file_id IN (?)", sources).
+		Where("fb.file_id IN (?)", files).
+		Group("fa.file_id, fb.file_id").
+		Having("count(*) >= ?", fingerprintMinCommonHashes).
+		Scan(&pairs)
+
+	fingerprints := make(map[uint][]uint32)
+
+	load := func(id uint) []uint32 {
+		if fingerprint, ok := fingerprints[id]; ok {
+			return fingerprint
+		}
+
+		row := Fingerprint{}
+		db.Where(&Fingerprint{FileID: id}).First(&row)
+		fingerprints[id] = fingerprintFromBytes(row.Raw)
+
+		return fingerprints[id]
+	}
+
+	// union find, each group ends up under one file
+	parent := make(map[uint]uint)
+
+	var find func(id uint) uint
+
+	find = func(id uint) uint {
+		if p, ok := parent[id]; ok && p != id {
+			parent[id] = find(p)
+			return parent[id]
+		}
+
+		parent[id] = id
+
+		return id
+	}
+
+	similarities := make(map[uint]float64)
+
+	for _, pair := range pairs {
+		similarity, _ := compareFingerprints(load(pair.A), load(pair.B))
+
+		if similarity < min {
+			continue
+		}
+
+		parent[find(pair.B)] = find(pair.A)
+		similarities[pair.A] = math.Max(similarities[pair.A], similarity)
+		similarities[pair.B] = math.Max(similarities[pair.B], similarity)
+	}
+
+	members := make(map[uint][]similarRecording)
+
+	for id := range similarities {
+		file := File{}
+		db.First(&file, id)
+
+		root := find(id)
+		members[root] = append(members[root], similarRecording{FileID: id, HostName: file.HostName, Path: file.Path, Similarity: similarities[id]})
+	}
+
+	groups := make([][]similarRecording, 0, len(members))
+
+	for _, group := range members {
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].Path < group[j].Path
+		})
+
+		groups = append(groups, group)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i][0].Path < groups[j][0].Path
+	})
+
+	return groups
+}
+
+// fingerprint scan [--path] [--rescan], fingerprint similar <file id>, or
+// fingerprint duplicates
+func fingerprint(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&Fingerprint{})
+	db.AutoMigrate(&FingerprintHash{})
+	db.AutoMigrate(&ParseError{})
+
+	hostName, err := os.Hostname()
+
+	if err != nil {
+		panic(err) // could not get local hostname
+	}
+
+	if len(args) == 0 {
+		fmt.Println("fingerprint scan|similar <file id>|duplicates")
+		os.Exit(1)
+	}
+
+	flags := flag.NewFlagSet("fingerprint "+args[0], flag.ExitOnError)
+	path := flags.String("path", "", "only files with paths containing this")
+	rescan := flags.Bool("rescan", false, "fingerprint files that haven't changed too")
+	min := flags.Float64("min", fingerprintMatchThreshold, "similarity from 0 to 1 to count as the same recording")
+	allHosts := flags.Bool("all-hosts", false, "look for similar files on every host")
+
+	// similar takes the file id first
+	fileID := ""
+
+	if args[0] == "similar" && len(args) > 1 {
+		fileID = args[1]
+		flags.Parse(args[2:])
+	} else {
+		flags.Parse(args[1:])
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	switch args[0] {
+	case "scan":
+		fingerprintFiles(db, hostName, *path, *rescan)
+	case "similar":
+		id, err := strconv.Atoi(fileID)
+
+		if err != nil {
+			fmt.Println("`" + fileID + "` isn't a file id")
+			os.Exit(1)
+		}
+
+		host := hostName
+
+		if *allHosts {
+			host = ""
+		}
+
+		fmt.Fprintln(w, "FILE\tSIMILARITY\tOFFSET\tHOST\tPATH")
+
+		for _, match := range findSimilarRecordings(db, uint(id), host, *min) {
+			fmt.Fprintf(w, "%d\t%.3f\t%.1fs\t%s\t%s\n", match.FileID, match.Similarity, match.Offset, match.HostName, match.Path)
+		}
+	case "duplicates":
+		fmt.Fprintln(w, "GROUP\tFILE\tSIMILARITY\tPATH")
+
+		for i, group := range findDuplicateRecordings(db, hostName, *path, *min) {
+			for _, match := range group {
+				fmt.Fprintf(w, "%d\t%d\t%.3f\t%s\n", i+1, match.FileID, match.Similarity, match.Path)
+			}
+		}
+	default:
+		fmt.Println("fingerprint scan|similar <file id>|duplicates")
+		os.Exit(1)
+	}
+
+	w.Flush()
+}
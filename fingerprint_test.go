@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeChromaprint(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []uint32
+		want []byte
+	}{
+		{name: "empty", in: []uint32{}, want: []byte{1, 0, 0, 0}},
+		{name: "one bit", in: []uint32{1}, want: []byte{1, 0, 0, 1, 0x01}},
+		{name: "exceptional gap", in: []uint32{0x80000000}, want: []byte{1, 0, 0, 1, 0x07, 0x19}},
+		{name: "unchanged", in: []uint32{3, 3}, want: []byte{1, 0, 0, 2, 0x09, 0x00}},
+	}
+
+	for _, test := range tests {
+		if got := encodeChromaprint(test.in); got != base64.RawURLEncoding.EncodeToString(test.want) {
+			got, _ := base64.RawURLEncoding.DecodeString(got)
+			t.Errorf("%s: got % x, want % x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPackBits(t *testing.T) {
+	tests := []struct {
+		values []uint32
+		width  uint
+		want   []byte
+	}{
+		{values: []uint32{}, width: 3, want: []byte{}},
+		{values: []uint32{7, 7, 7}, width: 3, want: []byte{0xff, 0x01}},
+		{values: []uint32{1, 2}, width: 5, want: []byte{0x41, 0x00}},
+	}
+
+	for _, test := range tests {
+		if got := packBits(test.values, test.width); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("packBits(%v, %d) = % x, want % x", test.values, test.width, got, test.want)
+		}
+	}
+}
+
+func TestFingerprintBytes(t *testing.T) {
+	fingerprint := []uint32{0, 1, 0xdeadbeef, 0xffffffff}
+
+	if got := fingerprintFromBytes(fingerprintToBytes(fingerprint)); !reflect.DeepEqual(got, fingerprint) {
+		t.Errorf("round trip = %x, want %x", got, fingerprint)
+	}
+}
+
+func TestCompareFingerprints(t *testing.T) {
+	a := make([]uint32, 100)
+
+	for i := range a {
+		a[i] = uint32(i) * 2654435761
+	}
+
+	tests := []struct {
+		name           string
+		b              []uint32
+		wantSimilarity float64
+		wantOffset     int
+	}{
+		{name: "identical", b: a, wantSimilarity: 1, wantOffset: 0},
+		{name: "starts later", b: a[10:], wantSimilarity: 1, wantOffset: 10},
+		{name: "too short", b: a[:20], wantSimilarity: 0, wantOffset: 0},
+	}
+
+	for _, test := range tests {
+		similarity, offset := compareFingerprints(a, test.b)
+
+		if similarity != test.wantSimilarity || offset != test.wantOffset {
+			t.Errorf("%s: got %v at %d, want %v at %d", test.name, similarity, offset, test.wantSimilarity, test.wantOffset)
+		}
+	}
+}
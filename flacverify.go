@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mewkiz/flac"
+	"gorm.io/gorm"
+)
+
+// Decode a flac and compare its audio with the md5 in STREAMINFO. Returns
+// the status, the md5 from STREAMINFO and why it failed.
+func verifyFLACAudio(path string) (string, string, error) {
+	stream, err := flac.Open(path)
+
+	if err != nil {
+		return "undecodable", "", err
+	}
+
+	reader := &flacPCM{stream: stream}
+	defer reader.Close()
+
+	expected := fmt.Sprintf("%x", stream.Info.MD5sum)
+	unset := stream.Info.MD5sum == [md5.Size]byte{}
+
+	// samples are hashed little endian, in as many bytes as the bit depth needs
+	width := (int(stream.Info.BitsPerSample) + 7) / 8
+	hash := md5.New()
+
+	for {
+		block, err := reader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return "undecodable", expected, err
+		}
+
+		// the encoder couldn't work one out, still worth knowing it decodes
+		if unset {
+			continue
+		}
+
+		buffer := make([]byte, 0, len(block)*len(block[0])*width)
+
+		for i := range block[0] {
+			for c := range block {
+				sample := block[c][i]
+
+				for b := 0; b < width; b++ {
+					buffer = append(buffer, byte(sample>>(8*b)))
+				}
+			}
+		}
+
+		hash.Write(buffer)
+	}
+
+	if unset {
+		return "unset", "", nil
+	}
+
+	if actual := fmt.Sprintf("%x", hash.Sum(nil)); actual != expected {
+		return "mismatch", expected, errors.New("decoded audio md5 is " + actual)
+	}
+
+	return "ok", expected, nil
+}
+
+// Verify one file and store the result on its row
+func verifyFLACFile(db *gorm.DB, file File) {
+	status, audioMd5, err := verifyFLACAudio(file.Base + file.Path)
+
+	if err != nil {
+		log.Println("Audio of `" + file.Path + "` is " + status + ": " + err.Error())
+		recordParseError(db, file, "audio", "", err)
+	} else {
+		clearParseError(db, file, "audio")
+	}
+
+	db.Model(&file).Updates(map[string]interface{}{
+		"audio_md5":         audioMd5,
+		"audio_status":      status,
+		"audio_verified_at": time.Now()})
+}
+
+// Decode every flac on this host and check it against its STREAMINFO md5,
+// only those that have never been checked unless --all is set
+func verifyFLAC(args []string) {
+	flags := flag.NewFlagSet("verifyflac", flag.ExitOnError)
+	all := flags.Bool("all", false, "check files that have been checked before too")
+	path := flags.String("path", "", "only files with paths containing this")
+	flags.Parse(args)
+
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&File{})
+	db.AutoMigrate(&ParseError{})
+
+	hostName, err := os.Hostname()
+
+	if err != nil {
+		panic(err) // could not get local hostname
+	}
+
+	jobs := make(chan File)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for file := range jobs {
+				verifyFLACFile(db, file)
+			}
+		}()
+	}
+
+	query := db.Where(&File{HostName: hostName, ExtensionLowerCase: "flac"})
+
+	if !*all {
+		query = query.Where("audio_status IS NULL OR audio_status = ''")
+	}
+
+	if len(*path) > 0 {
+		query = query.Where("path LIKE ?", "%"+*path+"%")
+	}
+
+	batch := make([]File, 0)
+
+	query.FindInBatches(&batch, 500, func(tx *gorm.DB, n int) error {
+		for _, file := range batch {
+			jobs <- file
+		}
+
+		return nil
+	})
+
+	close(jobs)
+	wg.Wait()
+
+	printFLACFailures(db, hostName)
+}
+
+// Print every flac whose audio didn't check out
+func printFLACFailures(db *gorm.DB, hostName string) {
+	files := make([]File, 0)
+
+	db.Where(&File{HostName: hostName, ExtensionLowerCase: "flac"}).
+		Where("audio_status IN ?", []string{"mismatch", "undecodable"}).
+		Order("path").
+		Find(&files)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSTATUS\tCHECKED AT\tPATH\tERROR")
+
+	for _, file := range files {
+		parseError := ParseError{}
+		db.Where(&ParseError{FileID: file.ID, Stage: "audio"}).First(&parseError)
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+			file.ID,
+			file.AudioStatus,
+			file.AudioVerifiedAt.Format("2006-01-02 15:04"),
+			file.Path,
+			parseError.Error)
+	}
+
+	w.Flush()
+
+	counts := make([]struct {
+		AudioStatus string
+		Count       int
+	}, 0)
+
+	db.Model(&File{}).
+		Select("audio_status, count(*) AS count").
+		Where(&File{HostName: hostName, ExtensionLowerCase: "flac"}).
+		Group("audio_status").
+		Scan(&counts)
+
+	for _, count := range counts {
+		status := count.AudioStatus
+
+		if len(status) == 0 {
+			status = "not checked"
+		}
+
+		fmt.Printf("%s: %d\n", status, count.Count)
+	}
+}
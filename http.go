@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
 // Article - Our struct for all articles
@@ -27,9 +29,391 @@ func returnAllArticles(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(getAllArticles())
 }
 
-func handleRequests() {
+// Write a value as json
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Read an integer query parameter, or the fallback
+func queryInt(r *http.Request, key string, fallback int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(key))
+
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// Read a float query parameter, or the fallback
+func queryFloat(r *http.Request, key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(r.URL.Query().Get(key), 64)
+
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// Stream properties of a single file
+func fileProperties(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		props := AudioProperties{}
+
+		if err := db.Where("file_id = ?", mux.Vars(r)["id"]).First(&props).Error; err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, props)
+	}
+}
+
+// Stream properties of every file, e.g /properties?codec=mp3&mode=CBR&path=donk&limit=50
+func allProperties(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		writeJSON(w, http.StatusOK, findAudioProperties(db,
+			q.Get("codec"),
+			q.Get("mode"),
+			q.Get("path"),
+			queryInt(r, "limit", 100),
+			queryInt(r, "offset", 0)))
+	}
+}
+
+// Send an image from the cache, or one of its thumbnails with ?size=300
+func serveArtwork(w http.ResponseWriter, r *http.Request, artwork Artwork) {
+	path := artwork.CachePath
+	contentType := artwork.MimeType
+
+	if size := queryInt(r, "size", 0); size > 0 {
+		if !intInSlice(size, conf.ArtworkSizes) {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "unknown size", "sizes": conf.ArtworkSizes})
+			return
+		}
+
+		thumbnail, err := getThumbnail(artwork, size)
+
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		path = thumbnail
+		contentType = "image/jpeg"
+	}
+
+	// named by hash, so it never changes
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+artwork.Sha256+`"`)
+	http.ServeFile(w, r, path)
+}
+
+// Every image linked to a file
+func fileArtwork(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		writeJSON(w, http.StatusOK, getFileArtwork(db, uint(id)))
+	}
+}
+
+// The best cover of a file
+func fileCover(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		links := getFileArtwork(db, uint(id))
+
+		if len(links) == 0 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		serveArtwork(w, r, links[0].Artwork)
+	}
+}
+
+// An image by its sha256
+func artworkImage(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		artwork := Artwork{}
+
+		if err := db.Where(&Artwork{Sha256: mux.Vars(r)["sha256"]}).First(&artwork).Error; err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		serveArtwork(w, r, artwork)
+	}
+}
+
+// The tag edit endpoints write to files on disk, so they are off unless
+// httpTagEdit is set in config.yml
+func tagEditAllowed(w http.ResponseWriter) bool {
+	if !conf.HTTPTagEdit {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "tag editing over http is off, set httpTagEdit in config.yml"})
+		return false
+	}
+
+	return true
+}
+
+// Change tags, POST a tagEditRequest
+func tagEditHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tagEditAllowed(w) {
+			return
+		}
+
+		req := tagEditRequest{}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		result, err := runTagEdit(db, req)
+
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// Undo a tagedit batch
+func tagEditUndoHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tagEditAllowed(w) {
+			return
+		}
+
+		result, err := undoTagEdit(db, mux.Vars(r)["batch"])
+
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// Albums with missing tracks, mixed formats etc, ?all=1 for every album
+func completenessHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, completenessReport(db, queryInt(r, "all", 0) == 1))
+	}
+}
+
+// Part of a file, /files/1/stream?start=30&end=90&format=mp3
+func fileStream(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file := File{}
+
+		if err := db.First(&file, mux.Vars(r)["id"]).Error; err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		streamAudioRange(w, r, file.Base+file.Path, queryFloat(r, "start", 0), queryFloat(r, "end", 0))
+	}
+}
+
+// Search virtual tracks from cue sheets, /cuetracks?q=donk&limit=50
+func cueTracks(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, findCueTracks(db,
+			r.URL.Query().Get("q"),
+			queryInt(r, "limit", 100),
+			queryInt(r, "offset", 0)))
+	}
+}
+
+// A single virtual track
+func cueTrack(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		track := CueTrack{}
+
+		if err := db.First(&track, mux.Vars(r)["id"]).Error; err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, track)
+	}
+}
+
+// The audio of a virtual track, cut from its file
+func cueTrackStream(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		track := CueTrack{}
+		file := File{}
+
+		if err := db.First(&track, mux.Vars(r)["id"]).Error; err != nil || track.AudioFileID == 0 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		if err := db.First(&file, track.AudioFileID).Error; err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "audio file not found"})
+			return
+		}
+
+		streamAudioRange(w, r, file.Base+file.Path, track.Start, track.End)
+	}
+}
+
+// Rip quality per release, poorly ripped ones unless ?all=1
+func ripLogsHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, findRipLogs(db, queryInt(r, "all", 0) == 1, r.URL.Query().Get("path")))
+	}
+}
+
+// Files that are the same recording as a file, e.g /files/12/similar?min=0.9
+func similarRecordingsHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		writeJSON(w, http.StatusOK, findSimilarRecordings(db, uint(id), r.URL.Query().Get("host"), queryFloat(r, "min", fingerprintMatchThreshold)))
+	}
+}
+
+// Imported playlists, ?unresolved=1 for ones with entries that weren't found
+func playlistsHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, findPlaylists(db, r.URL.Query().Get("path"), queryInt(r, "unresolved", 0) == 1))
+	}
+}
+
+// The entries of a playlist and the files they resolved to
+func playlistItemsHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		writeJSON(w, http.StatusOK, findPlaylistItems(db, uint(id)))
+	}
+}
+
+// Files matching a query, /search?q=genre=techno AND bpm 124..128&limit=50,
+// &output=csv for csv
+func searchHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseQuery(r.URL.Query().Get("q"))
+
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		// ?limit and ?offset page through, over what the query says
+		q.Limit = queryInt(r, "limit", q.Limit)
+		q.Offset = queryInt(r, "offset", q.Offset)
+
+		if q.Limit == 0 {
+			q.Limit = 100
+		}
+
+		rows := runQuery(db, q)
+
+		if r.URL.Query().Get("output") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			writeQueryCSV(w, rows)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, rows)
+	}
+}
+
+// Saved smart playlists, or POST {"name": "", "query": ""} to save one
+func smartPlaylistsHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			playlists := make([]SmartPlaylist, 0)
+			db.Order("name").Find(&playlists)
+
+			writeJSON(w, http.StatusOK, playlists)
+			return
+		}
+
+		req := SmartPlaylist{}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Name) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expected a name and a query"})
+			return
+		}
+
+		playlist, rows, err := saveSmartPlaylist(db, req.Name, req.Query)
+
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"playlist": playlist, "files": rows})
+	}
+}
+
+// A smart playlist's files from its last evaluation. POST or ?refresh=1
+// evaluates it again first.
+func smartPlaylistHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		playlist, err := findSmartPlaylist(db, mux.Vars(r)["id"])
+
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		if r.Method != http.MethodPost && queryInt(r, "refresh", 0) != 1 {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"playlist": playlist, "files": findSmartPlaylistItems(db, playlist.ID)})
+			return
+		}
+
+		rows, err := evaluateSmartPlaylist(db, &playlist)
+
+		if err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"playlist": playlist, "files": rows})
+	}
+}
+
+func handleRequests(db *gorm.DB) {
 	myRouter := mux.NewRouter().StrictSlash(true)
 	myRouter.HandleFunc("/", homePage)
+	myRouter.HandleFunc("/files/{id:[0-9]+}/properties", fileProperties(db))
+	myRouter.HandleFunc("/properties", allProperties(db))
+	myRouter.HandleFunc("/files/{id:[0-9]+}/artwork", fileArtwork(db))
+	myRouter.HandleFunc("/files/{id:[0-9]+}/cover", fileCover(db))
+	myRouter.HandleFunc("/artwork/{sha256:[0-9a-f]{64}}", artworkImage(db))
+	myRouter.HandleFunc("/files/{id:[0-9]+}/stream", fileStream(db))
+	myRouter.HandleFunc("/cuetracks", cueTracks(db))
+	myRouter.HandleFunc("/cuetracks/{id:[0-9]+}", cueTrack(db))
+	myRouter.HandleFunc("/cuetracks/{id:[0-9]+}/stream", cueTrackStream(db))
+	myRouter.HandleFunc("/riplogs", ripLogsHandler(db))
+	myRouter.HandleFunc("/files/{id:[0-9]+}/similar", similarRecordingsHandler(db))
+	myRouter.HandleFunc("/playlists", playlistsHandler(db))
+	myRouter.HandleFunc("/playlists/{id:[0-9]+}", playlistItemsHandler(db))
+	myRouter.HandleFunc("/search", searchHandler(db))
+	myRouter.HandleFunc("/smartplaylists", smartPlaylistsHandler(db))
+	myRouter.HandleFunc("/smartplaylists/{id:[0-9]+}", smartPlaylistHandler(db))
+	myRouter.HandleFunc("/completeness", completenessHandler(db))
+	myRouter.HandleFunc("/tagedit", tagEditHandler(db)).Methods(http.MethodPost)
+	myRouter.HandleFunc("/tagedit/{batch}/undo", tagEditUndoHandler(db)).Methods(http.MethodPost)
 	log.Fatal(http.ListenAndServe(":10000", myRouter))
 }
 
@@ -43,5 +427,31 @@ func getAllArticles() []Article {
 }
 
 func server() {
-	handleRequests()
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&AudioProperties{})
+	db.AutoMigrate(&ParseError{})
+	db.AutoMigrate(&Artwork{})
+	migrateFileArtwork(db)
+	db.AutoMigrate(&TagEdit{})
+	db.AutoMigrate(&Artist{})
+	db.AutoMigrate(&Album{})
+	db.AutoMigrate(&Track{})
+	db.AutoMigrate(&CueSheet{})
+	db.AutoMigrate(&CueTrack{})
+	db.AutoMigrate(&RipLog{})
+	db.AutoMigrate(&RipLogTrack{})
+	db.AutoMigrate(&Fingerprint{})
+	db.AutoMigrate(&FingerprintHash{})
+	db.AutoMigrate(&Playlist{})
+	db.AutoMigrate(&PlaylistItem{})
+	migrateQueryTables(db)
+	db.AutoMigrate(&SmartPlaylist{})
+	db.AutoMigrate(&SmartPlaylistItem{})
+
+	handleRequests(db)
 }
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+var errID3v22 = errors.New("ID3v2.2 tags can't be written, convert the file to ID3v2.3 first")
+
+// id3Frame is a frame as it sits in the tag, frames we don't touch are
+// written back exactly as they were read
+type id3Frame struct {
+	ID    string
+	Flags [2]byte
+	Data  []byte
+}
+
+// id3Tag is an ID3v2.3 or 2.4 tag
+type id3Tag struct {
+	Version byte  // 3 or 4
+	Size    int64 // bytes the tag took up in the file, 0 if there wasn't one
+	Frames  []id3Frame
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func putSyncsafe(b []byte, n int) {
+	b[0] = byte(n>>21) & 0x7f
+	b[1] = byte(n>>14) & 0x7f
+	b[2] = byte(n>>7) & 0x7f
+	b[3] = byte(n) & 0x7f
+}
+
+// Undo unsynchronisation, FF 00 -> FF
+func removeUnsync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+
+		if b[i] == 0xFF && i+1 < len(b) && b[i+1] == 0x00 {
+			i++
+		}
+	}
+
+	return out
+}
+
+// Read the ID3v2 tag at the start of a file, or an empty one to add
+func readID3Tag(f *os.File) (id3Tag, error) {
+	t := id3Tag{Version: byte(conf.TagID3Version)}
+
+	header := make([]byte, 10)
+
+	if _, err := io.ReadFull(f, header); err != nil || string(header[0:3]) != "ID3" {
+		return t, nil
+	}
+
+	t.Version = header[3]
+
+	if t.Version == 2 {
+		return t, errID3v22
+	}
+
+	if t.Version != 3 && t.Version != 4 {
+		return t, errors.New("unknown ID3v2 version")
+	}
+
+	flags := header[5]
+	size := syncsafe(header[6:10])
+	t.Size = int64(size) + 10
+
+	if flags&0x10 != 0 {
+		t.Size += 10
+	}
+
+	body := make([]byte, size)
+
+	if _, err := io.ReadFull(f, body); err != nil {
+		return t, err
+	}
+
+	if flags&0x80 != 0 && t.Version == 3 {
+		body = removeUnsync(body)
+	}
+
+	pos := 0
+
+	// extended header, dropped when the tag is written again
+	if flags&0x40 != 0 && len(body) >= 4 {
+		if t.Version == 3 {
+			pos = 4 + int(binary.BigEndian.Uint32(body[0:4]))
+		} else {
+			pos = syncsafe(body[0:4])
+		}
+	}
+
+	for pos+10 <= len(body) {
+		// padding
+		if body[pos] == 0 {
+			break
+		}
+
+		frame := id3Frame{ID: string(body[pos : pos+4])}
+		copy(frame.Flags[:], body[pos+8:pos+10])
+
+		frameSize := int(binary.BigEndian.Uint32(body[pos+4 : pos+8]))
+
+		if t.Version == 4 {
+			frameSize = syncsafe(body[pos+4 : pos+8])
+		}
+
+		if frameSize < 0 || pos+10+frameSize > len(body) {
+			return t, errors.New("ID3v2 frame runs past the end of the tag")
+		}
+
+		frame.Data = body[pos+10 : pos+10+frameSize]
+		t.Frames = append(t.Frames, frame)
+
+		pos += 10 + frameSize
+	}
+
+	return t, nil
+}
+
+// Frame data without any 2.4 per frame unsynchronisation or length indicator
+func (frame id3Frame) content(version byte) []byte {
+	data := frame.Data
+
+	if version != 4 {
+		return data
+	}
+
+	if frame.Flags[1]&0x01 != 0 && len(data) >= 4 {
+		data = data[4:]
+	}
+
+	if frame.Flags[1]&0x02 != 0 {
+		data = removeUnsync(data)
+	}
+
+	return data
+}
+
+// Decode a string in one of the ID3 text encodings
+func decodeID3Text(encoding byte, b []byte) string {
+	switch encoding {
+	case 0:
+		runes := make([]rune, len(b))
+
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+
+		return string(runes)
+	case 1, 2:
+		bigEndian := encoding == 2
+
+		if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+			bigEndian = true
+			b = b[2:]
+		} else if len(b) >= 2 && b[0] == 0xFF && b[1] == 0xFE {
+			bigEndian = false
+			b = b[2:]
+		}
+
+		units := make([]uint16, len(b)/2)
+
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(b[i*2:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(b[i*2:])
+			}
+		}
+
+		return string(utf16.Decode(units))
+	}
+
+	return string(b)
+}
+
+// Split at the first terminator for the encoding, one zero byte or two
+// aligned zero bytes for UTF-16
+func splitID3Text(encoding byte, b []byte) ([]byte, []byte) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:]
+			}
+		}
+
+		return b, nil
+	}
+
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+
+	return b, nil
+}
+
+// Encode strings for a frame, all in the same encoding. 2.4 is always
+// UTF-8, 2.3 uses latin1 when it can and UTF-16 when it can't.
+func encodeID3Text(version byte, values ...string) (byte, [][]byte, []byte) {
+	encoded := make([][]byte, len(values))
+
+	if version == 4 {
+		for i, value := range values {
+			encoded[i] = []byte(value)
+		}
+
+		return 3, encoded, []byte{0}
+	}
+
+	latin1 := true
+
+	for _, value := range values {
+		for _, r := range value {
+			if r > 0xFF {
+				latin1 = false
+			}
+		}
+	}
+
+	for i, value := range values {
+		if latin1 {
+			for _, r := range value {
+				encoded[i] = append(encoded[i], byte(r))
+			}
+
+			continue
+		}
+
+		encoded[i] = []byte{0xFF, 0xFE}
+
+		for _, u := range utf16.Encode([]rune(value)) {
+			encoded[i] = append(encoded[i], byte(u), byte(u>>8))
+		}
+	}
+
+	if latin1 {
+		return 0, encoded, []byte{0}
+	}
+
+	return 1, encoded, []byte{0, 0}
+}
+
+// Description of a TXXX/COMM frame or the owner of a UFID frame
+func (frame id3Frame) description(version byte) string {
+	data := frame.content(version)
+
+	switch frame.ID {
+	case "TXXX":
+		if len(data) < 1 {
+			return ""
+		}
+
+		desc, _ := splitID3Text(data[0], data[1:])
+
+		return decodeID3Text(data[0], desc)
+	case "COMM":
+		if len(data) < 4 {
+			return ""
+		}
+
+		desc, _ := splitID3Text(data[0], data[4:])
+
+		return decodeID3Text(data[0], desc)
+	case "UFID":
+		owner, _ := splitID3Text(0, data)
+
+		return string(owner)
+	}
+
+	return ""
+}
+
+// Value of a text, TXXX, COMM or UFID frame
+func (frame id3Frame) text(version byte) string {
+	data := frame.content(version)
+
+	if frame.ID == "UFID" {
+		_, identifier := splitID3Text(0, data)
+
+		return string(identifier)
+	}
+
+	if len(data) < 1 {
+		return ""
+	}
+
+	encoding := data[0]
+	data = data[1:]
+
+	switch frame.ID {
+	case "TXXX":
+		_, data = splitID3Text(encoding, data)
+	case "COMM":
+		if len(data) < 3 {
+			return ""
+		}
+
+		_, data = splitID3Text(encoding, data[3:])
+	}
+
+	// 2.4 separates multiple values with a zero, show them the 2.3 way
+	value := strings.TrimRight(decodeID3Text(encoding, data), "\x00")
+
+	return strings.ReplaceAll(value, "\x00", "/")
+}
+
+// Does a frame hold this field. Year is TYER in 2.3 and TDRC in 2.4, both
+// are matched so changing version doesn't leave a stale one behind.
+func (frame id3Frame) matches(version byte, field tagField) bool {
+	id, desc := field.ID3, ""
+
+	if i := strings.Index(id, ":"); i > 0 {
+		id, desc = id[:i], id[i+1:]
+	}
+
+	switch {
+	case field.Name == "year":
+		return frame.ID == "TDRC" || frame.ID == "TYER"
+	case frame.ID != id:
+		return false
+	case id == "TXXX", id == "UFID":
+		return strings.EqualFold(frame.description(version), desc)
+	case id == "COMM":
+		// leave iTunNORM and friends alone
+		return frame.description(version) == ""
+	}
+
+	return true
+}
+
+// Build the frame for a field
+func newID3Frame(version byte, field tagField, value string) id3Frame {
+	id, desc := field.ID3, ""
+
+	if i := strings.Index(id, ":"); i > 0 {
+		id, desc = id[:i], id[i+1:]
+	}
+
+	if field.Name == "year" && version == 3 {
+		id = "TYER"
+	}
+
+	frame := id3Frame{ID: id}
+
+	switch id {
+	case "UFID":
+		frame.Data = append(append([]byte(desc), 0), []byte(value)...)
+	case "TXXX":
+		encoding, text, term := encodeID3Text(version, desc, value)
+		frame.Data = append(append(append([]byte{encoding}, text[0]...), term...), text[1]...)
+	case "COMM":
+		// language, then an empty description
+		encoding, text, term := encodeID3Text(version, "", value)
+		frame.Data = append(append(append([]byte{encoding, 'e', 'n', 'g'}, text[0]...), term...), text[1]...)
+	default:
+		encoding, text, _ := encodeID3Text(version, value)
+		frame.Data = append([]byte{encoding}, text[0]...)
+	}
+
+	return frame
+}
+
+// Serialise the tag with some padding so small edits by other taggers can
+// be done in place
+func (t id3Tag) bytes() []byte {
+	var body bytes.Buffer
+
+	for _, frame := range t.Frames {
+		header := make([]byte, 10)
+		copy(header[0:4], frame.ID)
+
+		if t.Version == 4 {
+			putSyncsafe(header[4:8], len(frame.Data))
+		} else {
+			binary.BigEndian.PutUint32(header[4:8], uint32(len(frame.Data)))
+		}
+
+		copy(header[8:10], frame.Flags[:])
+
+		body.Write(header)
+		body.Write(frame.Data)
+	}
+
+	body.Write(make([]byte, 1024))
+
+	header := []byte{'I', 'D', '3', t.Version, 0, 0, 0, 0, 0, 0}
+	putSyncsafe(header[6:10], body.Len())
+
+	return append(header, body.Bytes()...)
+}
+
+func readID3Fields(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	t, err := readID3Tag(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+
+	for _, field := range tagFields {
+		for _, frame := range t.Frames {
+			if frame.matches(t.Version, field) {
+				values[field.Name] = frame.text(t.Version)
+				break
+			}
+		}
+	}
+
+	return values, nil
+}
+
+func writeID3Fields(path string, changes []tagChange) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	t, err := readID3Tag(f)
+
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		field, ok := getTagField(change.Field)
+
+		if !ok {
+			return errors.New("unknown tag field `" + change.Field + "`")
+		}
+
+		frames := make([]id3Frame, 0, len(t.Frames))
+
+		for _, frame := range t.Frames {
+			if !frame.matches(t.Version, field) {
+				frames = append(frames, frame)
+			}
+		}
+
+		if !change.Clear {
+			frames = append(frames, newID3Frame(t.Version, field, change.Value))
+		}
+
+		t.Frames = frames
+	}
+
+	return rewriteFile(path, func(w io.Writer) error {
+		if _, err := w.Write(t.bytes()); err != nil {
+			return err
+		}
+
+		return copyFrom(w, f, t.Size)
+	})
+}
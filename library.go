@@ -0,0 +1,488 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Artist is an album artist or track artist, one row per name
+type Artist struct {
+	ID                  uint   `json:"id"`
+	NameKey             string `gorm:"uniqueIndex;size:255" json:"-"` // lower case, single spaced
+	Name                string `json:"name"`
+	MusicBrainzArtistID string `gorm:"index;size:36" json:"musicBrainzArtistId"`
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
+
+// Album is a release, grouped by MusicBrainz release id when there is one
+// and by directory and album tag when there isn't
+type Album struct {
+	ID                   uint   `json:"id"`
+	AlbumKey             string `gorm:"uniqueIndex;size:32" json:"-"` // md5 of what it was grouped by
+	HostName             string `gorm:"index;size:256" json:"hostName"`
+	ArtistID             uint   `gorm:"index" json:"artistId"`
+	Title                string `json:"title"`
+	Year                 string `gorm:"size:16" json:"year"`
+	Directory            string `json:"directory"`
+	MusicBrainzReleaseID string `gorm:"index;size:36" json:"musicBrainzReleaseId"`
+	TrackCount           int    `json:"trackCount"`
+	DiscCount            int    `json:"discCount"`
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
+// Track is an audio file's place on an album, with the tag and stream
+// values the completeness checks compare
+type Track struct {
+	ID          uint    `json:"id"`
+	FileID      uint    `gorm:"uniqueIndex" json:"fileId"`
+	AlbumID     uint    `gorm:"index" json:"albumId"`
+	ArtistID    uint    `gorm:"index" json:"artistId"`
+	Title       string  `json:"title"`
+	AlbumArtist string  `json:"albumArtist"`
+	Year        string  `gorm:"size:16" json:"year"`
+	DiscNumber  int     `json:"discNumber"`
+	DiscTotal   int     `json:"discTotal"`
+	TrackNumber int     `json:"trackNumber"`
+	TrackTotal  int     `json:"trackTotal"`
+	Codec       string  `gorm:"size:32" json:"codec"`
+	Bitrate     int     `json:"bitrate"`
+	BitrateMode string  `gorm:"size:8" json:"bitrateMode"`
+	Duration    float64 `json:"duration"`
+	Build       string  `gorm:"index;size:16" json:"-"` // the buildLibrary run that last saw it
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// A file with its tags and stream properties, what the library is built from
+type libraryRow struct {
+	File            File
+	Tag             Tag
+	AudioProperties AudioProperties
+}
+
+// Disc sub directories, "CD1", "Disc 2"... belong to the album above them
+var discDirectory = regexp.MustCompile(`(?i)^(cd|dis[ck])\s*[-_]?\s*\d+$`)
+
+// Normalise a name for matching
+func nameKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// The directory an album lives in, above any disc directories
+func albumDirectory(path string) string {
+	dir := filepath.Dir(path)
+
+	if discDirectory.MatchString(filepath.Base(dir)) {
+		return filepath.Dir(dir)
+	}
+
+	return dir
+}
+
+// What a file is grouped into an album by. Each host has its own albums,
+// even for the same MusicBrainz release.
+func albumKey(row libraryRow) string {
+	if len(row.Tag.MusicBrainzReleaseID) > 0 {
+		return HashStringMd5(row.File.HostName + "|mb:" + strings.ToLower(row.Tag.MusicBrainzReleaseID))
+	}
+
+	return HashStringMd5(row.File.HostName + "|" + albumDirectory(row.File.Path) + "|" + nameKey(row.Tag.Album))
+}
+
+// Most common non-empty value, ties go to the first seen
+func mostCommon(values []string) string {
+	counts := make(map[string]int)
+	best := ""
+
+	for _, value := range values {
+		if len(value) == 0 {
+			continue
+		}
+
+		counts[value]++
+
+		if counts[value] > counts[best] {
+			best = value
+		}
+	}
+
+	return best
+}
+
+// Get or create an artist by name
+func getArtist(db *gorm.DB, name string, musicBrainzID string) Artist {
+	artist := Artist{NameKey: nameKey(name), Name: name, MusicBrainzArtistID: musicBrainzID}
+
+	db.Clauses(clause.OnConflict{DoNothing: true}).Create(&artist)
+	db.Where(&Artist{NameKey: artist.NameKey}).First(&artist)
+
+	if len(artist.MusicBrainzArtistID) == 0 && len(musicBrainzID) > 0 {
+		artist.MusicBrainzArtistID = musicBrainzID
+		db.Save(&artist)
+	}
+
+	return artist
+}
+
+// Rebuild the artists, albums and tracks tables for this host from the tags
+func buildLibrary(db *gorm.DB, hostName string) {
+	localFiles := db.Model(&File{}).Select("id").Where(&File{HostName: hostName})
+
+	files := make([]File, 0)
+	db.Where("id IN (?)", localFiles).Find(&files)
+
+	tags := make([]Tag, 0)
+	db.Where("file_id IN (?)", localFiles).Find(&tags)
+
+	properties := make([]AudioProperties, 0)
+	db.Where("file_id IN (?)", localFiles).Find(&properties)
+
+	tagsByFile := make(map[uint]Tag)
+
+	for _, t := range tags {
+		tagsByFile[t.FileID] = t
+	}
+
+	propertiesByFile := make(map[uint]AudioProperties)
+
+	for _, props := range properties {
+		propertiesByFile[props.FileID] = props
+	}
+
+	// only files that have been tag parsed
+	rows := make([]libraryRow, 0, len(tags))
+
+	for _, file := range files {
+		if t, ok := tagsByFile[file.ID]; ok {
+			rows = append(rows, libraryRow{File: file, Tag: t, AudioProperties: propertiesByFile[file.ID]})
+		}
+	}
+
+	groups := make(map[string][]libraryRow)
+
+	for _, row := range rows {
+		key := albumKey(row)
+		groups[key] = append(groups[key], row)
+	}
+
+	build := randSeq(12)
+
+	for key, group := range groups {
+		albumArtists := make([]string, 0, len(group))
+		artists := make([]string, 0, len(group))
+		titles := make([]string, 0, len(group))
+		years := make([]string, 0, len(group))
+		artistIDs := make([]string, 0, len(group))
+		discs := make(map[int]bool)
+
+		for _, row := range group {
+			albumArtists = append(albumArtists, row.Tag.AlbumArtist)
+			artists = append(artists, row.Tag.Artist)
+			titles = append(titles, row.Tag.Album)
+			years = append(years, row.Tag.Year)
+			artistIDs = append(artistIDs, row.Tag.MusicBrainzAlbumArtistID)
+			discs[row.Tag.DiscNumber] = true
+		}
+
+		artistName := mostCommon(albumArtists)
+
+		if len(artistName) == 0 {
+			artistName = mostCommon(artists)
+
+			// several track artists and no album artist
+			if len(artistName) > 0 && len(group) > 1 && len(uniqueStrings(artists)) > len(group)/2 {
+				artistName = "Various Artists"
+			}
+		}
+
+		if len(artistName) == 0 {
+			artistName = "Unknown Artist"
+		}
+
+		title := mostCommon(titles)
+
+		if len(title) == 0 {
+			title = filepath.Base(albumDirectory(group[0].File.Path))
+		}
+
+		artist := getArtist(db, artistName, mostCommon(artistIDs))
+
+		album := Album{AlbumKey: key}
+		db.Where(&Album{AlbumKey: key}).FirstOrInit(&album)
+
+		album.HostName = hostName
+		album.ArtistID = artist.ID
+		album.Title = title
+		album.Year = mostCommon(years)
+		album.Directory = albumDirectory(group[0].File.Path)
+		album.MusicBrainzReleaseID = group[0].Tag.MusicBrainzReleaseID
+		album.TrackCount = len(group)
+		album.DiscCount = len(discs)
+		db.Save(&album)
+
+		for _, row := range group {
+			trackArtist := artist
+
+			if len(row.Tag.Artist) > 0 && nameKey(row.Tag.Artist) != artist.NameKey {
+				trackArtist = getArtist(db, row.Tag.Artist, row.Tag.MusicBrainzArtistID)
+			}
+
+			track := Track{FileID: row.File.ID}
+			db.Where(&Track{FileID: row.File.ID}).FirstOrInit(&track)
+
+			track.AlbumID = album.ID
+			track.ArtistID = trackArtist.ID
+			track.Title = row.Tag.Title
+			track.AlbumArtist = row.Tag.AlbumArtist
+			track.Year = row.Tag.Year
+			track.DiscNumber = row.Tag.DiscNumber
+			track.DiscTotal = row.Tag.DiscTotal
+			track.TrackNumber = row.Tag.TrackNumber
+			track.TrackTotal = row.Tag.TrackTotal
+			track.Codec = row.AudioProperties.Codec
+			track.Bitrate = row.AudioProperties.Bitrate
+			track.BitrateMode = row.AudioProperties.BitrateMode
+			track.Duration = row.AudioProperties.Duration
+			track.Build = build
+			db.Save(&track)
+		}
+	}
+
+	// Drop tracks this run didn't see, their files are gone or untagged
+	localAlbums := db.Model(&Album{}).Select("id").Where(&Album{HostName: hostName})
+
+	db.Where("build <> ?", build).
+		Where(db.Where("file_id IN (?)", localFiles).Or("album_id IN (?)", localAlbums)).
+		Delete(&Track{})
+
+	db.Where("id NOT IN (?)", db.Model(&Track{}).Distinct().Select("album_id")).Delete(&Album{})
+}
+
+// Distinct non-empty values, sorted
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0)
+
+	for _, value := range values {
+		if len(value) > 0 && !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+
+	sort.Strings(unique)
+
+	return unique
+}
+
+// Everything that looks wrong with an album
+func albumIssues(tracks []Track) []string {
+	issues := make([]string, 0)
+
+	codecs := make([]string, 0, len(tracks))
+	modes := make([]string, 0, len(tracks))
+	albumArtists := make([]string, 0, len(tracks))
+	years := make([]string, 0, len(tracks))
+	cbrBitrates := make([]string, 0, len(tracks))
+	byDisc := make(map[int][]Track)
+
+	for _, track := range tracks {
+		codecs = append(codecs, track.Codec)
+		modes = append(modes, track.BitrateMode)
+		albumArtists = append(albumArtists, track.AlbumArtist)
+
+		if len(track.Year) >= 4 {
+			years = append(years, track.Year[:4])
+		}
+
+		if track.BitrateMode == "CBR" {
+			cbrBitrates = append(cbrBitrates, strconv.Itoa(track.Bitrate))
+		}
+
+		byDisc[track.DiscNumber] = append(byDisc[track.DiscNumber], track)
+	}
+
+	if unique := uniqueStrings(codecs); len(unique) > 1 {
+		issues = append(issues, "mixed formats: "+strings.Join(unique, ", "))
+	}
+
+	// VBR bitrates always differ, only mixed modes or mixed CBR rates count
+	if unique := uniqueStrings(modes); len(unique) > 1 {
+		issues = append(issues, "mixed bitrate modes: "+strings.Join(unique, ", "))
+	}
+
+	if unique := uniqueStrings(cbrBitrates); len(unique) > 1 {
+		issues = append(issues, "mixed bitrates: "+strings.Join(unique, ", ")+" kbps")
+	}
+
+	if unique := uniqueStrings(albumArtists); len(unique) > 1 {
+		issues = append(issues, "inconsistent album artist: "+strings.Join(unique, ", "))
+	}
+
+	if unique := uniqueStrings(years); len(unique) > 1 {
+		issues = append(issues, "inconsistent year: "+strings.Join(unique, ", "))
+	}
+
+	discNumbers := make([]int, 0, len(byDisc))
+
+	for disc := range byDisc {
+		discNumbers = append(discNumbers, disc)
+	}
+
+	sort.Ints(discNumbers)
+
+	for _, disc := range discNumbers {
+		discTracks := byDisc[disc]
+		prefix := ""
+
+		if len(byDisc) > 1 {
+			prefix = "disc " + strconv.Itoa(disc) + ": "
+		}
+
+		numbers := make(map[int]int)
+		highest, total, unnumbered := 0, 0, 0
+
+		for _, track := range discTracks {
+			if track.TrackNumber <= 0 {
+				unnumbered++
+				continue
+			}
+
+			numbers[track.TrackNumber]++
+
+			if track.TrackNumber > highest {
+				highest = track.TrackNumber
+			}
+
+			if track.TrackTotal > total {
+				total = track.TrackTotal
+			}
+		}
+
+		if unnumbered > 0 {
+			issues = append(issues, prefix+strconv.Itoa(unnumbered)+" tracks without a track number")
+		}
+
+		expected := highest
+
+		if total > expected {
+			expected = total
+		}
+
+		missing := make([]string, 0)
+		duplicated := make([]string, 0)
+
+		for n := 1; n <= expected; n++ {
+			if numbers[n] == 0 {
+				missing = append(missing, strconv.Itoa(n))
+			} else if numbers[n] > 1 {
+				duplicated = append(duplicated, strconv.Itoa(n))
+			}
+		}
+
+		if len(missing) > 0 {
+			issues = append(issues, prefix+"missing tracks "+strings.Join(missing, ", "))
+		}
+
+		if len(duplicated) > 0 {
+			issues = append(issues, prefix+"duplicate tracks "+strings.Join(duplicated, ", "))
+		}
+
+		if total > 0 && len(discTracks) != total {
+			issues = append(issues, fmt.Sprintf("%s%d tracks but TRACKTOTAL is %d", prefix, len(discTracks), total))
+		}
+	}
+
+	return issues
+}
+
+// An album with its problems
+type albumReport struct {
+	Album  Album    `json:"album"`
+	Artist string   `json:"artist"`
+	Issues []string `json:"issues"`
+}
+
+// Albums with issues, or every album
+func completenessReport(db *gorm.DB, all bool) []albumReport {
+	reports := make([]albumReport, 0)
+
+	albums := make([]Album, 0)
+	db.Order("directory").Find(&albums)
+
+	tracks := make([]Track, 0)
+	db.Find(&tracks)
+
+	byAlbum := make(map[uint][]Track)
+
+	for _, track := range tracks {
+		byAlbum[track.AlbumID] = append(byAlbum[track.AlbumID], track)
+	}
+
+	artists := make(map[uint]string)
+	artistRows := make([]Artist, 0)
+	db.Find(&artistRows)
+
+	for _, artist := range artistRows {
+		artists[artist.ID] = artist.Name
+	}
+
+	for _, album := range albums {
+		issues := albumIssues(byAlbum[album.ID])
+
+		if len(issues) > 0 || all {
+			reports = append(reports, albumReport{Album: album, Artist: artists[album.ArtistID], Issues: issues})
+		}
+	}
+
+	return reports
+}
+
+// completeness command
+func completeness(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&Artist{})
+	db.AutoMigrate(&Album{})
+	db.AutoMigrate(&Track{})
+
+	hostName, err := os.Hostname()
+
+	if err != nil {
+		panic(err) // could not get local hostname
+	}
+
+	buildLibrary(db, hostName)
+
+	all := len(args) > 0 && args[0] == "all"
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ALBUM\tARTIST\tTITLE\tTRACKS\tISSUES")
+
+	for _, report := range completenessReport(db, all) {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n",
+			report.Album.ID,
+			report.Artist,
+			report.Album.Title,
+			report.Album.TrackCount,
+			strings.Join(report.Issues, "; "))
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TrackLoudness is the EBU R128 loudness of one file
+type TrackLoudness struct {
+	ID         uint      `json:"id"`
+	FileID     uint      `gorm:"uniqueIndex" json:"fileId"`
+	AlbumID    uint      `gorm:"index" json:"albumId"`
+	SourceHash string    `gorm:"size:32" json:"-"`        // imohash of the file when it was analysed
+	Integrated float64   `gorm:"index" json:"integrated"` // LUFS, -70 when it's all below the gate
+	TruePeak   float64   `json:"truePeak"`                // dBTP
+	Peak       float64   `json:"peak"`                    // linear true peak, what replaygain stores
+	Range      float64   `json:"range"`                   // LU
+	Gain       float64   `json:"gain"`                    // dB to reach the replaygain 2.0 reference
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+// AlbumLoudness is the loudness of every track of an album played in a row
+type AlbumLoudness struct {
+	ID         uint      `json:"id"`
+	AlbumID    uint      `gorm:"uniqueIndex" json:"albumId"`
+	Tracks     int       `json:"tracks"`
+	Integrated float64   `json:"integrated"`
+	TruePeak   float64   `json:"truePeak"`
+	Peak       float64   `json:"peak"`
+	Range      float64   `json:"range"`
+	Gain       float64   `json:"gain"`
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+// Replaygain 2.0 aims for -18 LUFS, R128 gain tags are relative to -23
+const replayGainReference = -18.0
+const r128Reference = -23.0
+
+// Gates from BS.1770 and EBU Tech 3342
+const loudnessAbsoluteGate = -70.0
+const loudnessRelativeGate = -10.0
+const loudnessRangeGate = -20.0
+
+// Second order IIR filter, direct form 1
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+
+	return y
+}
+
+// The two K-weighting stages at any sample rate, a high shelf for the head
+// then a high pass. Coefficients worked back from the 48kHz ones in BS.1770.
+func kWeighting(sampleRate int) (biquad, biquad) {
+	fs := float64(sampleRate)
+
+	k := math.Tan(math.Pi * 1681.974450955533 / fs)
+	q := 0.7071752369554196
+	vh := math.Pow(10, 3.999843853973347/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0}
+
+	k = math.Tan(math.Pi * 38.13547087602444 / fs)
+	q = 0.5003270373238773
+	a0 = 1 + k/q + k*k
+
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0}
+
+	return shelf, highPass
+}
+
+// Channel weights, surrounds count for more and the LFE not at all. Only
+// 5.1 is laid out differently enough to need it.
+func loudnessWeights(channels int) []float64 {
+	weights := make([]float64, channels)
+
+	for i := range weights {
+		weights[i] = 1
+	}
+
+	if channels == 6 {
+		weights[3] = 0
+		weights[4] = 1.41
+		weights[5] = 1.41
+	}
+
+	return weights
+}
+
+// Upsamples to find peaks between samples, 12 taps per phase
+type truePeakMeter struct {
+	factor  int
+	taps    []float64
+	history [][]float64
+	peak    float64
+}
+
+func newTruePeakMeter(format pcmFormat) *truePeakMeter {
+	// at least 192kHz
+	factor := 1
+
+	for format.SampleRate*factor < 192000 && factor < 4 {
+		factor *= 2
+	}
+
+	// hann windowed sinc low pass at the original nyquist
+	taps := make([]float64, 12*factor)
+	center := float64(len(taps)-1) / 2
+
+	for i := range taps {
+		t := (float64(i) - center) / float64(factor)
+		sinc := 1.0
+
+		if t != 0 {
+			sinc = math.Sin(math.Pi*t) / (math.Pi * t)
+		}
+
+		taps[i] = sinc * (0.5 - 0.5*math.Cos(2*math.Pi*(float64(i)+0.5)/float64(len(taps))))
+	}
+
+	history := make([][]float64, format.Channels)
+
+	for c := range history {
+		history[c] = make([]float64, 12)
+	}
+
+	return &truePeakMeter{factor: factor, taps: taps, history: history}
+}
+
+func (m *truePeakMeter) process(channel int, x float64) {
+	history := m.history[channel]
+	copy(history[1:], history[:len(history)-1])
+	history[0] = x
+
+	if math.Abs(x) > m.peak {
+		m.peak = math.Abs(x)
+	}
+
+	if m.factor == 1 {
+		return
+	}
+
+	for phase := 0; phase < m.factor; phase++ {
+		y := 0.0
+
+		for k, sample := range history {
+			y += m.taps[k*m.factor+phase] * sample
+		}
+
+		if math.Abs(y) > m.peak {
+			m.peak = math.Abs(y)
+		}
+	}
+}
+
+// What's kept of a track to work out its loudness, or an album's
+type loudnessMeasurement struct {
+	Blocks     []float64 // mean square of each 400ms block, 100ms apart
+	ShortTerms []float64 // mean square of each 3s window, 100ms apart
+	Peak       float64
+}
+
+// Decode a file and measure it
+func measureLoudness(path string, extension string) (loudnessMeasurement, error) {
+	measurement := loudnessMeasurement{}
+
+	reader, err := openPCM(path, extension)
+
+	if err != nil {
+		return measurement, err
+	}
+
+	defer reader.Close()
+
+	format := reader.Format()
+	scale := 1 / float64(int64(1)<<(format.BitDepth-1))
+	weights := loudnessWeights(format.Channels)
+	filters := make([][2]biquad, format.Channels)
+
+	for c := range filters {
+		shelf, highPass := kWeighting(format.SampleRate)
+		filters[c] = [2]biquad{shelf, highPass}
+	}
+
+	peaks := newTruePeakMeter(format)
+
+	// weighted mean square of every 100ms
+	segmentSize := format.SampleRate / 10
+	segments := make([]float64, 0)
+	sum := 0.0
+	count := 0
+
+	for {
+		block, err := reader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return measurement, err
+		}
+
+		for i := range block[0] {
+			for c, channel := range block {
+				x := float64(channel[i]) * scale
+				peaks.process(c, x)
+
+				y := filters[c][1].process(filters[c][0].process(x))
+				sum += weights[c] * y * y
+			}
+
+			count++
+
+			if count == segmentSize {
+				segments = append(segments, sum/float64(segmentSize))
+				sum = 0
+				count = 0
+			}
+		}
+	}
+
+	for i := 3; i < len(segments); i++ {
+		measurement.Blocks = append(measurement.Blocks, meanOf(segments[i-3:i+1]))
+	}
+
+	for i := 29; i < len(segments); i++ {
+		measurement.ShortTerms = append(measurement.ShortTerms, meanOf(segments[i-29:i+1]))
+	}
+
+	measurement.Peak = peaks.peak
+
+	return measurement, nil
+}
+
+func meanOf(values []float64) float64 {
+	sum := 0.0
+
+	for _, value := range values {
+		sum += value
+	}
+
+	return sum / float64(len(values))
+}
+
+func energyToLUFS(energy float64) float64 {
+	return -0.691 + 10*math.Log10(energy)
+}
+
+// The energies above the absolute gate and then the relative gate. Returns
+// false if there was nothing above the absolute gate.
+func gatedEnergies(energies []float64, relativeGate float64) ([]float64, bool) {
+	loud := make([]float64, 0, len(energies))
+
+	for _, energy := range energies {
+		if energy > 0 && energyToLUFS(energy) > loudnessAbsoluteGate {
+			loud = append(loud, energy)
+		}
+	}
+
+	if len(loud) == 0 {
+		return loud, false
+	}
+
+	threshold := energyToLUFS(meanOf(loud)) + relativeGate
+	gated := make([]float64, 0, len(loud))
+
+	for _, energy := range loud {
+		if energyToLUFS(energy) > threshold {
+			gated = append(gated, energy)
+		}
+	}
+
+	return gated, true
+}
+
+// Integrated loudness in LUFS
+func integratedLoudness(blocks []float64) float64 {
+	gated, ok := gatedEnergies(blocks, loudnessRelativeGate)
+
+	if !ok || len(gated) == 0 {
+		return loudnessAbsoluteGate
+	}
+
+	return energyToLUFS(meanOf(gated))
+}
+
+// Loudness range in LU, the spread between the 10th and 95th percentile
+// of the short term loudness
+func loudnessRange(shortTerms []float64) float64 {
+	gated, ok := gatedEnergies(shortTerms, loudnessRangeGate)
+
+	if !ok || len(gated) < 2 {
+		return 0
+	}
+
+	sort.Float64s(gated)
+
+	low := gated[int(math.Round(float64(len(gated)-1)*0.10))]
+	high := gated[int(math.Round(float64(len(gated)-1)*0.95))]
+
+	return energyToLUFS(high) - energyToLUFS(low)
+}
+
+func linearToDB(value float64) float64 {
+	return math.Max(-120, 20*math.Log10(value))
+}
+
+func roundTo(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+
+	return math.Round(value*scale) / scale
+}
+
+// Loudness of one measurement, or of several played one after the other
+func summariseLoudness(measurements []loudnessMeasurement) (integrated float64, truePeak float64, peak float64, lra float64, gain float64) {
+	blocks := make([]float64, 0)
+	shortTerms := make([]float64, 0)
+
+	for _, measurement := range measurements {
+		blocks = append(blocks, measurement.Blocks...)
+		shortTerms = append(shortTerms, measurement.ShortTerms...)
+		peak = math.Max(peak, measurement.Peak)
+	}
+
+	integrated = roundTo(integratedLoudness(blocks), 2)
+
+	return integrated, roundTo(linearToDB(peak), 2), roundTo(peak, 6), roundTo(loudnessRange(shortTerms), 2), roundTo(replayGainReference-integrated, 2)
+}
+
+// A track of an album on this host
+type loudnessTrack struct {
+	File
+	AlbumID uint
+}
+
+// Measure every track of an album and the album as a whole. Skipped when
+// nothing has changed since last time, unless rescan is set. Tracks that
+// failed to decode aren't tried again until they change.
+func analyseAlbumLoudness(db *gorm.DB, albumID uint, tracks []loudnessTrack, rescan bool) {
+	hashes := make([]string, len(tracks))
+	failed := make([]bool, len(tracks))
+	failures := 0
+	changed := rescan
+
+	for i, track := range tracks {
+		sourceHash, err := hashFileImo(track.Base + track.Path)
+
+		if err != nil {
+			log.Println("Could not read `" + track.Path + "`: " + err.Error())
+			recordParseError(db, track.File, "read", "", err)
+			return
+		}
+
+		hashes[i] = sourceHash
+		failed[i] = !rescan && parseErrorIsCurrent(db, track.File, "loudness", sourceHash)
+
+		var count int64
+		db.Model(&TrackLoudness{}).Where(&TrackLoudness{FileID: track.ID, AlbumID: albumID, SourceHash: sourceHash}).Count(&count)
+
+		if failed[i] {
+			failures++
+		} else if count == 0 {
+			changed = true
+		}
+	}
+
+	// Tracks counts every track tried, measured or not
+	var albumCount int64
+	db.Model(&AlbumLoudness{}).Where(&AlbumLoudness{AlbumID: albumID, Tracks: len(tracks)}).Count(&albumCount)
+
+	// every track failed, there is no album row to look for
+	if !changed && (albumCount > 0 || failures == len(tracks)) {
+		return
+	}
+
+	measurements := make([]loudnessMeasurement, 0, len(tracks))
+
+	for i, track := range tracks {
+		if failed[i] {
+			continue
+		}
+
+		measurement, err := measureLoudness(track.Base+track.Path, track.ExtensionLowerCase)
+
+		if err != nil {
+			log.Println("Could not measure the loudness of `" + track.Path + "`: " + err.Error())
+			recordParseError(db, track.File, "loudness", hashes[i], err)
+			continue
+		}
+
+		clearParseError(db, track.File, "loudness")
+
+		measurements = append(measurements, measurement)
+
+		loudness := TrackLoudness{FileID: track.ID, AlbumID: albumID, SourceHash: hashes[i]}
+		loudness.Integrated, loudness.TruePeak, loudness.Peak, loudness.Range, loudness.Gain = summariseLoudness([]loudnessMeasurement{measurement})
+
+		db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "file_id"}},
+			UpdateAll: true}).Create(&loudness)
+	}
+
+	if len(measurements) == 0 {
+		return
+	}
+
+	album := AlbumLoudness{AlbumID: albumID, Tracks: len(tracks)}
+	album.Integrated, album.TruePeak, album.Peak, album.Range, album.Gain = summariseLoudness(measurements)
+
+	db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "album_id"}},
+		UpdateAll: true}).Create(&album)
+}
+
+// Measure every album with tracks on this host
+func analyseLoudness(db *gorm.DB, hostName string, path string, rescan bool) {
+	query := db.Table("tracks").
+		Select("files.*, tracks.album_id").
+		Joins("JOIN files ON files.id = tracks.file_id").
+		Where("files.host_name = ?", hostName).
+		Where("files.extension_lower_case IN ?", audioExtensions)
+
+	if len(path) > 0 {
+		query = query.Where("files.path LIKE ?", "%"+path+"%")
+	}
+
+	rows := make([]loudnessTrack, 0)
+	query.Order("files.path").Scan(&rows)
+
+	albums := make(map[uint][]loudnessTrack)
+
+	for _, row := range rows {
+		albums[row.AlbumID] = append(albums[row.AlbumID], row)
+	}
+
+	jobs := make(chan uint)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for albumID := range jobs {
+				analyseAlbumLoudness(db, albumID, albums[albumID], rescan)
+			}
+		}()
+	}
+
+	for albumID := range albums {
+		jobs <- albumID
+	}
+
+	close(jobs)
+	wg.Wait()
+}
+
+// R128 gain tags are Q7.8 fixed point
+func r128Gain(integrated float64) string {
+	gain := math.Round((r128Reference - integrated) * 256)
+
+	return strconv.Itoa(int(math.Max(-32768, math.Min(32767, gain))))
+}
+
+// A track's loudness with its album's and where the file is
+type loudnessRow struct {
+	TrackLoudness
+	Path            string  `json:"path"`
+	AlbumIntegrated float64 `json:"albumIntegrated"`
+	AlbumPeak       float64 `json:"albumPeak"`
+	AlbumGain       float64 `json:"albumGain"`
+	HasAlbum        bool    `json:"-"` // the album has been measured
+}
+
+func findLoudness(db *gorm.DB, path string) []loudnessRow {
+	rows := make([]loudnessRow, 0)
+
+	query := db.Table("track_loudnesses").
+		Select("track_loudnesses.*, files.path, album_loudnesses.integrated AS album_integrated, album_loudnesses.peak AS album_peak, album_loudnesses.gain AS album_gain, album_loudnesses.id IS NOT NULL AS has_album").
+		Joins("JOIN files ON files.id = track_loudnesses.file_id").
+		Joins("LEFT JOIN album_loudnesses ON album_loudnesses.album_id = track_loudnesses.album_id")
+
+	if len(path) > 0 {
+		query = query.Where("files.path LIKE ?", "%"+path+"%")
+	}
+
+	query.Order("files.path").Scan(&rows)
+
+	return rows
+}
+
+// Write replaygain tags, and R128 ones when r128 is set, to every measured
+// file that can be tagged. Goes through tagedit so it can be undone.
+func writeLoudnessTags(db *gorm.DB, hostName string, path string, r128 bool) tagEditResult {
+	result := tagEditResult{Batch: randSeq(12), Files: []tagEditFileResult{}}
+
+	for _, row := range findLoudness(db, path) {
+		file := File{}
+
+		if db.Where(&File{ID: row.FileID, HostName: hostName}).First(&file).Error != nil {
+			continue
+		}
+
+		if !stringInSlice(file.ExtensionLowerCase, tagWritableExtensions) {
+			continue
+		}
+
+		values := map[string]string{
+			"replaygain_track_gain": fmt.Sprintf("%.2f dB", row.Gain),
+			"replaygain_track_peak": fmt.Sprintf("%.6f", row.Peak)}
+
+		if r128 {
+			values["r128_track_gain"] = r128Gain(row.Integrated)
+		}
+
+		// album tags only once the album has been measured, not 0 dB
+		if row.HasAlbum {
+			values["replaygain_album_gain"] = fmt.Sprintf("%.2f dB", row.AlbumGain)
+			values["replaygain_album_peak"] = fmt.Sprintf("%.6f", row.AlbumPeak)
+
+			if r128 {
+				values["r128_album_gain"] = r128Gain(row.AlbumIntegrated)
+			}
+		}
+
+		current, err := readTagFields(file.Base+file.Path, file.ExtensionLowerCase)
+
+		if err != nil {
+			result.Files = append(result.Files, tagEditFileResult{FileID: file.ID, Path: file.Path, Error: err.Error()})
+			continue
+		}
+
+		// only touch files where something changed
+		changes := make([]tagChange, 0)
+
+		for _, field := range tagFieldNames() {
+			if value, ok := values[field]; ok && current[field] != value {
+				changes = append(changes, tagChange{Field: field, Value: value})
+			}
+		}
+
+		if len(changes) == 0 {
+			continue
+		}
+
+		fileResult := tagEditFileResult{FileID: file.ID, Path: file.Path}
+		fileResult.Previous, err = editFileTags(db, file, changes, result.Batch, "")
+
+		if err != nil {
+			fileResult.Error = err.Error()
+		}
+
+		result.Files = append(result.Files, fileResult)
+	}
+
+	return result
+}
+
+// loudness scan [--path] [--rescan] [--write] [--r128], loudness write, or
+// list tracks or albums
+func loudness(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&File{})
+	db.AutoMigrate(&Tag{})
+	db.AutoMigrate(&AudioProperties{})
+	db.AutoMigrate(&ParseError{})
+	db.AutoMigrate(&Artwork{})
+	migrateFileArtwork(db)
+	db.AutoMigrate(&TagEdit{})
+	db.AutoMigrate(&TrackLoudness{})
+	db.AutoMigrate(&AlbumLoudness{})
+
+	hostName, err := os.Hostname()
+
+	if err != nil {
+		panic(err) // could not get local hostname
+	}
+
+	if len(args) > 0 && (args[0] == "scan" || args[0] == "write") {
+		flags := flag.NewFlagSet("loudness "+args[0], flag.ExitOnError)
+		path := flags.String("path", "", "only files with paths containing this")
+		rescan := flags.Bool("rescan", false, "measure albums that haven't changed too")
+		write := flags.Bool("write", args[0] == "write", "write replaygain tags to the files")
+		r128 := flags.Bool("r128", false, "write R128_TRACK_GAIN and R128_ALBUM_GAIN too")
+		flags.Parse(args[1:])
+
+		if args[0] == "scan" {
+			analyseLoudness(db, hostName, *path, *rescan)
+		}
+
+		if *write {
+			printTagEditResult(writeLoudnessTags(db, hostName, *path, *r128))
+		}
+
+		return
+	}
+
+	flags := flag.NewFlagSet("loudness", flag.ExitOnError)
+	path := flags.String("path", "", "only files with paths containing this")
+	flags.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tLUFS\tTRUE PEAK\tLRA\tGAIN\tALBUM LUFS\tALBUM GAIN\tPATH")
+
+	for _, row := range findLoudness(db, *path) {
+		fmt.Fprintf(w, "%d\t%.2f\t%.2f\t%.2f\t%+.2f\t%.2f\t%+.2f\t%s\n",
+			row.FileID,
+			row.Integrated,
+			row.TruePeak,
+			row.Range,
+			row.Gain,
+			row.AlbumIntegrated,
+			row.AlbumGain,
+			row.Path)
+	}
+
+	w.Flush()
+}
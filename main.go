@@ -5,6 +5,8 @@ import (
 	"log"
 	"os"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 func main() {
@@ -27,6 +29,48 @@ func main() {
 			server()
 		case "testssh":
 			testSSH()
+		case "trusthost":
+			trustHost()
+		case "decrypt":
+			decryptFile(os.Args[2:])
+		case "verifyencrypted":
+			verifyEncrypted()
+		case "deadletter":
+			deadLetter(os.Args[2:])
+		case "parseerrors":
+			listParseErrors()
+		case "tagedit":
+			tagEdit(os.Args[2:])
+		case "organise":
+			organise(os.Args[2:])
+		case "search":
+			search(os.Args[2:])
+		case "smartplaylists":
+			smartPlaylists(os.Args[2:])
+		case "playlists":
+			playlists(os.Args[2:])
+		case "bpmkey":
+			bpmKey(os.Args[2:])
+		case "fingerprint":
+			fingerprint(os.Args[2:])
+		case "loudness":
+			loudness(os.Args[2:])
+		case "fakelossless":
+			fakeLossless(os.Args[2:])
+		case "mp3health":
+			mp3Health(os.Args[2:])
+		case "verifyflac":
+			verifyFLAC(os.Args[2:])
+		case "riplogs":
+			ripLogs(os.Args[2:])
+		case "checksfv":
+			checkSFV(os.Args[2:])
+		case "cue":
+			listCueTracks(os.Args[2:])
+		case "completeness":
+			completeness(os.Args[2:])
+		case "properties":
+			listAudioProperties(os.Args[2:])
 		default:
 			fmt.Printf("Please choose a command.\n")
 		}
@@ -57,8 +101,14 @@ func processPaths() {
 
 	// migrate
 	db.AutoMigrate(&File{})
+	migrateQueryTables(db)
+	db.AutoMigrate(&SmartPlaylist{})
+	db.AutoMigrate(&SmartPlaylistItem{})
 
 	handlePaths(getFilePaths(fileName), db)
+
+	// new and removed files change what smart playlists find
+	refreshSmartPlaylists(db)
 }
 
 func parseTags() {
@@ -69,24 +119,35 @@ func parseTags() {
 		panic(e) // could not get database...
 	}
 
-	deleteAllTags(db)
-
 	// migrate
 	db.AutoMigrate(&File{})
 	db.AutoMigrate(&Tag{})
+	db.AutoMigrate(&AudioProperties{})
+	db.AutoMigrate(&ParseError{})
+	db.AutoMigrate(&Artwork{})
+	migrateFileArtwork(db)
+	db.AutoMigrate(&Artist{})
+	db.AutoMigrate(&Album{})
+	db.AutoMigrate(&Track{})
+	db.AutoMigrate(&CueSheet{})
+	db.AutoMigrate(&CueTrack{})
+	db.AutoMigrate(&RipLog{})
+	db.AutoMigrate(&RipLogTrack{})
+	db.AutoMigrate(&Playlist{})
+	db.AutoMigrate(&PlaylistItem{})
+	migrateQueryTables(db)
+	db.AutoMigrate(&SmartPlaylist{})
+	db.AutoMigrate(&SmartPlaylistItem{})
 
-	var file File
-
-	rows, e := db.Model(&File{}).Rows()
+	// Get local hostname
+	localHostName, err := os.Hostname()
 
-	if e != nil {
-		panic(e) // could not create database model...
+	if err != nil {
+		panic(err) // could not get local hostname
 	}
 
-	for rows.Next() {
-		db.ScanRows(rows, &file)
-		parseTagsToDb(file, db)
-	}
+	parseFiles(db, localHostName)
+	refreshSmartPlaylists(db)
 }
 
 func syncFiles() {
@@ -99,6 +160,20 @@ func syncFiles() {
 
 	// migrate
 	db.AutoMigrate(&File{})
+	db.AutoMigrate(&SyncFailure{})
+	db.AutoMigrate(&Transcode{})
+	db.AutoMigrate(&EncryptedFile{})
+	db.AutoMigrate(&Fingerprint{})
+	db.AutoMigrate(&FingerprintHash{})
+	db.AutoMigrate(&Playlist{})
+	db.AutoMigrate(&PlaylistItem{})
+
+	// Check the passphrase matches the library before uploading anything
+	if conf.EncryptRemote {
+		if _, err := getEncryptionKey(db); err != nil {
+			panic(err) // bad encryption settings
+		}
+	}
 
 	// Get local hostname
 	localHostName, err := os.Hostname()
@@ -107,16 +182,23 @@ func syncFiles() {
 		panic(err) // could not get local hostname
 	}
 
+	// files may have moved since the playlists pointing at them were uploaded
+	resyncChangedPlaylists(db, localHostName)
+
 	limit := 10
-	offset := 0
 
 	// Loop forever
 	for {
 		// Empty array of files
 		files := make([]File, 0)
 
-		// Get 10 files for this hostname
-		db.Debug().Where(&File{HostName: localHostName}).Where("md5 IS NULL").Find(&files).Limit(limit).Offset(offset)
+		// Get 10 files for this hostname that haven't failed recently or been given up on
+		db.Debug().
+			Where(&File{HostName: localHostName}).
+			Where("md5 IS NULL OR md5 = ''").
+			Where("id NOT IN (?)", blockedSyncFileIDs(db)).
+			Limit(limit).
+			Find(&files)
 
 		// if no files were found pause for 10 seconds and then try again
 		if len(files) == 0 {
@@ -126,68 +208,119 @@ func syncFiles() {
 			continue
 		}
 
-		// Get remote path from conf
-		remotePath := conf.RemotePath
-
 		// Loop through all the files
 		for _, file := range files {
-			// Assuming we dont remove this at the end, skip to the next file
-			offset++
+			err := syncFile(file, db)
 
-			// path to local file
-			localFullPath := file.Base + file.Path
+			if err == nil {
+				clearSyncFailure(db, file)
+				continue
+			}
 
-			// path to file on remote server e.g /home/user/sync/trojans/sub7.exe
-			remoteFullPath := remotePath + file.Path
+			log.Println("Error syncing file", err)
 
-			log.Println("S: " + localFullPath)
-			log.Println("D: " + remoteFullPath)
+			// Not the file's fault, it will be picked up again once we reconnect
+			if isConnectionError(err) {
+				continue
+			}
 
-			fm, err := fileMatchOnRemoteServer(localFullPath, remoteFullPath, file, db)
+			recordSyncFailure(db, file, err)
+		}
+	}
+}
 
-			if err != nil {
-				log.Println("Error Getting match between local and remote", err)
-			}
+// Sync a single file to the remote server
+func syncFile(file File, db *gorm.DB) error {
+	// Playlists are rewritten to point at the remote copies, which can't be
+	// played straight from an encrypted remote anyway
+	if playlist, ok := importedPlaylist(db, file); ok && !conf.EncryptRemote {
+		return syncPlaylistFile(file, playlist, db)
+	}
 
-			// File already exists, and the md5sum matches, skip to next file in loop
-			if fm {
-				log.Println("Skipping file that already exists.")
-				continue
-			}
+	// Lossless files are transcoded first when a sync profile is set
+	if name, profile, ok := activeSyncProfile(); ok && profile.transcodes(file.ExtensionLowerCase) {
+		return syncTranscodedFile(file, name, profile, db)
+	}
 
-			// If file size is zero locally, just create it on remote, no need to upload or check
-			if file.FileSizeBytes == 0 {
-				if createZeroFileOnRemoteServerIfNotExists(remoteFullPath) {
-					log.Println("Creating zero file.")
-					continue
-				}
+	// Encrypted copies can't be matched against plain files in the old folder
+	if conf.EncryptRemote {
+		return syncEncryptedFile(file, db)
+	}
 
-				log.Println("Error creating zero file.")
-			}
+	// path to local file
+	localFullPath := file.Base + file.Path
 
-			// Was a previous version path specified
-			if len(conf.RemoteOldPath) > 0 {
-				// File already exists on remote server in old folder, copy to new folder
-				copy, err := copyFromOldFolderIfExists(file, localFullPath, remoteFullPath, db)
+	// path to file on remote server e.g /home/user/sync/trojans/sub7.exe
+	remoteFullPath := conf.RemotePath + file.Path
 
-				if err != nil {
-					log.Println("Error copying from old folder. " + err.Error())
-				}
+	log.Println("S: " + localFullPath)
+	log.Println("D: " + remoteFullPath)
 
-				if !copy {
-					log.Println("No match on remote server")
-				}
+	fm, err := fileMatchOnRemoteServer(localFullPath, remoteFullPath, file, db)
 
-				if copy {
-					continue
-				}
+	if err != nil {
+		log.Println("Error Getting match between local and remote", err)
+		return &SyncError{Op: "match", Path: localFullPath, Err: err}
+	}
+
+	// File already exists, and the md5sum matches, skip to next file in loop
+	if fm {
+		log.Println("Skipping file that already exists.")
+		return nil
+	}
 
+	// If file size is zero locally, just create it on remote, no need to upload or check
+	if file.FileSizeBytes == 0 {
+		err := createZeroFileOnRemoteServerIfNotExists(remoteFullPath)
+
+		if err != nil {
+			log.Println("Error creating zero file.")
+			return &SyncError{Op: "touch", Path: localFullPath, Err: err}
+		}
+
+		log.Println("Creating zero file.")
+
+		// md5 of nothing, so that this file is not picked up again
+		file.Md5 = HashStringMd5("")
+		file.VerifiedAt = time.Now()
+		db.Save(&file)
+
+		return nil
+	}
+
+	// Was a previous version path specified
+	if len(conf.RemoteOldPath) > 0 {
+		// File already exists on remote server in old folder, copy to new folder
+		copy, err := copyFromOldFolderIfExists(file, localFullPath, remoteFullPath, db)
+
+		if err != nil {
+			log.Println("Error copying from old folder. " + err.Error())
+
+			// No point trying to upload without a connection
+			if isConnectionError(err) {
+				return &SyncError{Op: "copy", Path: localFullPath, Err: err}
 			}
+		}
 
-			// If we got this far and no conditions were met, upload the file
-			uploadFile(localFullPath, remoteFullPath, file, db)
+		if copy {
+			return nil
 		}
+
+		log.Println("No match on remote server")
+	}
+
+	// If we got this far and no conditions were met, upload the file
+	match, err := uploadFile(localFullPath, remoteFullPath, file, db)
+
+	if err != nil {
+		return &SyncError{Op: "upload", Path: localFullPath, Err: err}
 	}
+
+	if !match {
+		return &SyncError{Op: "verify", Path: localFullPath, Err: errChecksumMismatch}
+	}
+
+	return nil
 }
 
 /**
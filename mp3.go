@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	errNoMP3Frames = errors.New("no mp3 frames found")
+)
+
+// Bitrates in kbps by [version is MPEG1][layer][index]
+var mp3Bitrates = [2][4][16]int{
+	// MPEG2 / 2.5
+	{
+		{},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},      // layer 3
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},      // layer 2
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0}, // layer 1
+	},
+	// MPEG1
+	{
+		{},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},     // layer 3
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},    // layer 2
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0}, // layer 1
+	},
+}
+
+// Sample rates by [version bits][index]
+var mp3SampleRates = [4][3]int{
+	{11025, 12000, 8000},  // MPEG2.5
+	{},                    // reserved
+	{22050, 24000, 16000}, // MPEG2
+	{44100, 48000, 32000}, // MPEG1
+}
+
+// mp3FrameHeader is the 4 byte header at the start of every mp3 frame
+type mp3FrameHeader struct {
+	Version    int // 3 = MPEG1, 2 = MPEG2, 0 = MPEG2.5
+	Layer      int // 1, 2 or 3
+	Protected  bool
+	Bitrate    int // kbps
+	SampleRate int
+	Padding    bool
+	Channels   int
+	Length     int // whole frame in bytes, including the header
+	Samples    int // samples per channel in this frame
+}
+
+// Parse a frame header, false if these 4 bytes aren't one
+func parseMP3FrameHeader(b []byte) (mp3FrameHeader, bool) {
+	h := mp3FrameHeader{}
+
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return h, false
+	}
+
+	h.Version = int(b[1]>>3) & 0x03
+	layerBits := int(b[1]>>1) & 0x03
+	bitrateIndex := int(b[2]>>4) & 0x0F
+	sampleRateIndex := int(b[2]>>2) & 0x03
+
+	// reserved or free format values
+	if h.Version == 1 || layerBits == 0 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return h, false
+	}
+
+	mpeg1 := 0
+	if h.Version == 3 {
+		mpeg1 = 1
+	}
+
+	h.Layer = 4 - layerBits
+	h.Protected = b[1]&0x01 == 0
+	h.Bitrate = mp3Bitrates[mpeg1][layerBits][bitrateIndex]
+	h.SampleRate = mp3SampleRates[h.Version][sampleRateIndex]
+	h.Padding = b[2]&0x02 != 0
+	h.Channels = 2
+
+	if b[3]>>6 == 3 {
+		h.Channels = 1
+	}
+
+	padding := 0
+	if h.Padding {
+		padding = 1
+	}
+
+	switch h.Layer {
+	case 1:
+		h.Samples = 384
+		h.Length = (12*h.Bitrate*1000/h.SampleRate + padding) * 4
+	case 2:
+		h.Samples = 1152
+		h.Length = 144*h.Bitrate*1000/h.SampleRate + padding
+	case 3:
+		if mpeg1 == 1 {
+			h.Samples = 1152
+			h.Length = 144*h.Bitrate*1000/h.SampleRate + padding
+		} else {
+			h.Samples = 576
+			h.Length = 72*h.Bitrate*1000/h.SampleRate + padding
+		}
+	}
+
+	return h, true
+}
+
+// Where the Xing/Info header sits in the first frame, after the side info
+func (h mp3FrameHeader) xingOffset() int {
+	if h.Version == 3 {
+		if h.Channels == 1 {
+			return 4 + 17
+		}
+
+		return 4 + 32
+	}
+
+	if h.Channels == 1 {
+		return 4 + 9
+	}
+
+	return 4 + 17
+}
+
+// mp3InfoHeader is what can be read from a Xing/Info/VBRI header and the
+// LAME tag after it
+type mp3InfoHeader struct {
+	Kind        string // Xing, Info or VBRI
+	Frames      int
+	Bytes       int
+	Encoder     string // e.g LAME3.99r
+	Mode        string // CBR, VBR or ABR
+	Delay       int    // encoder delay in samples
+	Padding     int    // padding at the end in samples
+	LameCRC     uint16 // crc of the first 190 bytes of the lame frame
+	LameCRCAt   int    // offset of the crc in the frame, 0 if there is no lame tag
+	MusicCRC    uint16 // crc of the audio, from the lame tag
+	MusicLength int    // bytes of audio, from the lame tag
+}
+
+// Read a Xing/Info/VBRI header from the first frame, if there is one
+func parseMP3InfoHeader(h mp3FrameHeader, frame []byte) (mp3InfoHeader, bool) {
+	info := mp3InfoHeader{}
+
+	// VBRI always sits 32 bytes after the header
+	if len(frame) >= 4+32+26 && string(frame[36:40]) == "VBRI" {
+		info.Kind = "VBRI"
+		info.Mode = "VBR"
+		info.Bytes = int(binary.BigEndian.Uint32(frame[36+10:]))
+		info.Frames = int(binary.BigEndian.Uint32(frame[36+14:]))
+
+		return info, true
+	}
+
+	o := h.xingOffset()
+
+	if len(frame) < o+8 {
+		return info, false
+	}
+
+	kind := string(frame[o : o+4])
+
+	if kind != "Xing" && kind != "Info" {
+		return info, false
+	}
+
+	info.Kind = kind
+	info.Mode = "VBR"
+
+	if kind == "Info" {
+		info.Mode = "CBR"
+	}
+
+	flags := binary.BigEndian.Uint32(frame[o+4:])
+	p := o + 8
+
+	if flags&0x01 != 0 && len(frame) >= p+4 {
+		info.Frames = int(binary.BigEndian.Uint32(frame[p:]))
+		p += 4
+	}
+
+	if flags&0x02 != 0 && len(frame) >= p+4 {
+		info.Bytes = int(binary.BigEndian.Uint32(frame[p:]))
+		p += 4
+	}
+
+	// table of contents
+	if flags&0x04 != 0 {
+		p += 100
+	}
+
+	// quality
+	if flags&0x08 != 0 {
+		p += 4
+	}
+
+	// LAME tag, 36 bytes
+	if len(frame) >= p+36 {
+		encoder := strings.TrimRight(string(frame[p:p+9]), "\x00 ")
+
+		if strings.HasPrefix(encoder, "LAME") || strings.HasPrefix(encoder, "Lavc") || strings.HasPrefix(encoder, "Lavf") {
+			info.Encoder = encoder
+
+			switch frame[p+9] & 0x0F {
+			case 1, 8:
+				info.Mode = "CBR"
+			case 2, 9:
+				info.Mode = "ABR"
+			case 3, 4, 5, 6:
+				info.Mode = "VBR"
+			}
+
+			delayPadding := frame[p+21 : p+24]
+			info.Delay = int(delayPadding[0])<<4 | int(delayPadding[1])>>4
+			info.Padding = int(delayPadding[1]&0x0F)<<8 | int(delayPadding[2])
+			info.MusicLength = int(binary.BigEndian.Uint32(frame[p+28:]))
+			info.MusicCRC = binary.BigEndian.Uint16(frame[p+32:])
+			info.LameCRC = binary.BigEndian.Uint16(frame[p+34:])
+			info.LameCRCAt = p + 34
+		}
+	}
+
+	return info, true
+}
+
+// Size of an ID3v2 tag at the start of a file, 0 if there isn't one
+func id3v2Size(b []byte) int64 {
+	if len(b) < 10 || string(b[0:3]) != "ID3" {
+		return 0
+	}
+
+	size := int64(b[6]&0x7f)<<21 | int64(b[7]&0x7f)<<14 | int64(b[8]&0x7f)<<7 | int64(b[9]&0x7f)
+
+	// footer present
+	if b[5]&0x10 != 0 {
+		size += 10
+	}
+
+	return size + 10
+}
+
+// Find where the audio starts, skipping any ID3v2 tags (sometimes there are
+// several) and junk before the first real frame
+func findFirstMP3Frame(f io.ReadSeeker) (int64, mp3FrameHeader, error) {
+	var offset int64
+	header := make([]byte, 10)
+
+	for {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return 0, mp3FrameHeader{}, err
+		}
+
+		if _, err := io.ReadFull(f, header); err != nil {
+			return 0, mp3FrameHeader{}, errNoMP3Frames
+		}
+
+		size := id3v2Size(header)
+
+		if size == 0 {
+			break
+		}
+
+		offset += size
+	}
+
+	// Look for two frames in a row so random 0xFF bytes don't count
+	buf := make([]byte, 64*1024)
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, mp3FrameHeader{}, err
+	}
+
+	n, _ := io.ReadFull(f, buf)
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		h, ok := parseMP3FrameHeader(buf[i:])
+
+		if !ok {
+			continue
+		}
+
+		next := i + h.Length
+
+		if next+4 <= len(buf) {
+			if _, ok := parseMP3FrameHeader(buf[next:]); !ok {
+				continue
+			}
+		}
+
+		return offset + int64(i), h, nil
+	}
+
+	return 0, mp3FrameHeader{}, errNoMP3Frames
+}
+
+// Read duration, bitrate etc from an mp3 file
+func readMP3Properties(f *os.File, size int64) (AudioProperties, error) {
+	props := AudioProperties{Codec: "mp3"}
+
+	start, h, err := findFirstMP3Frame(f)
+
+	if err != nil {
+		return props, err
+	}
+
+	props.SampleRate = h.SampleRate
+	props.Channels = h.Channels
+
+	if h.Layer != 3 {
+		props.Codec = "mp" + string(rune('0'+h.Layer))
+	}
+
+	frame := make([]byte, h.Length)
+
+	if _, err := f.ReadAt(frame, start); err != nil && err != io.EOF {
+		return props, err
+	}
+
+	// ID3v1 tag at the end isn't audio
+	audioBytes := size - start
+	tail := make([]byte, 3)
+
+	if _, err := f.ReadAt(tail, size-128); err == nil && bytes.Equal(tail, []byte("TAG")) {
+		audioBytes -= 128
+	}
+
+	info, ok := parseMP3InfoHeader(h, frame)
+
+	if ok && info.Frames > 0 {
+		samples := info.Frames*h.Samples - info.Delay - info.Padding
+
+		if samples <= 0 {
+			samples = info.Frames * h.Samples
+		}
+
+		props.Duration = float64(samples) / float64(h.SampleRate)
+		props.BitrateMode = info.Mode
+		props.Encoder = info.Encoder
+
+		if info.Bytes > 0 {
+			audioBytes = int64(info.Bytes)
+		}
+
+		if props.Duration > 0 {
+			props.Bitrate = int(float64(audioBytes) * 8 / props.Duration / 1000)
+		}
+
+		return props, nil
+	}
+
+	// No header, assume CBR and work it out from the file size
+	props.BitrateMode = "CBR"
+	props.Bitrate = h.Bitrate
+	props.Duration = float64(audioBytes) * 8 / float64(h.Bitrate*1000)
+
+	return props, nil
+}
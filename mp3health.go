@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MP3Health is the result of walking every frame of an mp3
+type MP3Health struct {
+	ID             uint      `json:"id"`
+	FileID         uint      `gorm:"uniqueIndex" json:"fileId"`
+	SourceHash     string    `gorm:"size:32" json:"-"`            // imohash of the file when it was scanned
+	Status         string    `gorm:"index;size:16" json:"status"` // ok, damaged or truncated
+	Issues         string    `gorm:"type:text" json:"issues"`     // ; separated
+	Frames         int       `json:"frames"`                      // audio frames found, not counting the Xing frame
+	ExpectedFrames int       `json:"expectedFrames"`              // from the Xing/VBRI header, 0 if there isn't one
+	JunkBytes      int64     `json:"junkBytes"`                   // bytes between frames that aren't frames
+	JunkRegions    int       `json:"junkRegions"`                 // how many places the stream lost sync
+	FirstJunkAt    int64     `json:"firstJunkAt"`                 // file offset, -1 if there is no junk
+	MissingBytes   int64     `json:"missingBytes"`                // cut off the end of the last frame
+	FrameCRCErrors int       `json:"frameCrcErrors"`              // protected frames with a bad crc
+	LameTagCRC     string    `gorm:"size:8" json:"lameTagCrc"`    // ok, mismatch, or empty with no lame tag
+	LameMusicCRC   string    `gorm:"size:8" json:"lameMusicCrc"`  // ok, mismatch, or empty
+	CreatedAt      time.Time `json:"-"`
+	UpdatedAt      time.Time `json:"-"`
+}
+
+// Extensions that are mpeg audio frames end to end
+var mp3HealthExtensions = []string{"mp3", "mp2"}
+
+// CRC-16 as LAME computes it for the tag and the music, reflected 0x8005
+func lameCRC16(crc uint16, b []byte) uint16 {
+	for _, c := range b {
+		crc ^= uint16(c)
+
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// CRC-16 of a protected frame, not reflected, over the last two header
+// bytes and the side info
+func frameCRC16(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// Where the audio stops, before any ID3v1 and APEv2 tags at the end
+func mp3AudioEnd(b []byte) int64 {
+	end := int64(len(b))
+
+	if end >= 128 && bytes.Equal(b[end-128:end-125], []byte("TAG")) {
+		end -= 128
+	}
+
+	if end >= 32 && bytes.Equal(b[end-32:end-24], []byte("APETAGEX")) {
+		footer := b[end-32:]
+		size := int64(binary.LittleEndian.Uint32(footer[12:16]))
+
+		// header present
+		if binary.LittleEndian.Uint32(footer[20:24])&0x80000000 != 0 {
+			size += 32
+		}
+
+		if size <= end {
+			end -= size
+		}
+	}
+
+	return end
+}
+
+// Is this a frame from the same stream as first, and is another frame or
+// the end of the audio straight after it. Stops random 0xFF bytes in junk
+// counting as frames.
+func mp3FrameAt(b []byte, pos int64, end int64, first mp3FrameHeader) (mp3FrameHeader, bool) {
+	if pos+4 > end {
+		return mp3FrameHeader{}, false
+	}
+
+	h, ok := parseMP3FrameHeader(b[pos:end])
+
+	if !ok || h.Version != first.Version || h.Layer != first.Layer || h.SampleRate != first.SampleRate {
+		return h, false
+	}
+
+	next := pos + int64(h.Length)
+
+	if next+4 <= end {
+		if n, ok := parseMP3FrameHeader(b[next:end]); !ok || n.Version != first.Version || n.Layer != first.Layer {
+			return h, false
+		}
+	}
+
+	return h, true
+}
+
+// Walk every frame of an mp3
+func scanMP3(b []byte) (MP3Health, error) {
+	health := MP3Health{FirstJunkAt: -1}
+
+	start, first, err := findFirstMP3Frame(bytes.NewReader(b))
+
+	if err != nil {
+		return health, err
+	}
+
+	end := mp3AudioEnd(b)
+	pos := start
+
+	// Xing/Info/VBRI frame, not audio
+	info, hasInfo := mp3InfoHeader{}, false
+
+	if start+int64(first.Length) <= end {
+		info, hasInfo = parseMP3InfoHeader(first, b[start:start+int64(first.Length)])
+	}
+
+	if hasInfo {
+		health.ExpectedFrames = info.Frames
+
+		// covers the frame up to the crc itself, the first 190 bytes for stereo mpeg1
+		if info.LameCRCAt > 0 {
+			if lameCRC16(0, b[start:start+int64(info.LameCRCAt)]) == info.LameCRC {
+				health.LameTagCRC = "ok"
+			} else {
+				health.LameTagCRC = "mismatch"
+			}
+		}
+
+		pos += int64(first.Length)
+	}
+
+	musicStart := pos
+
+	for pos < end {
+		h, ok := mp3FrameAt(b, pos, end, first)
+
+		// the last frame, cut short
+		if ok && pos+int64(h.Length) > end {
+			health.MissingBytes = pos + int64(h.Length) - end
+			health.Frames++
+			break
+		}
+
+		if !ok {
+			junkStart := pos
+
+			for pos < end {
+				if _, ok := mp3FrameAt(b, pos, end, first); ok {
+					break
+				}
+
+				pos++
+			}
+
+			// padding at the very end isn't worth calling junk
+			if pos >= end && isPadding(b[junkStart:end]) {
+				break
+			}
+
+			health.JunkBytes += pos - junkStart
+			health.JunkRegions++
+
+			if health.FirstJunkAt < 0 {
+				health.FirstJunkAt = junkStart
+			}
+
+			continue
+		}
+
+		if h.Protected && h.Layer == 3 {
+			sideInfo := h.xingOffset() - 4
+			crcEnd := pos + 6 + int64(sideInfo)
+
+			if crcEnd <= end {
+				// the crc sits between the header and the side info
+				data := append([]byte{b[pos+2], b[pos+3]}, b[pos+6:crcEnd]...)
+
+				if frameCRC16(data) != binary.BigEndian.Uint16(b[pos+4:pos+6]) {
+					health.FrameCRCErrors++
+				}
+			}
+		}
+
+		health.Frames++
+		pos += int64(h.Length)
+	}
+
+	if info.LameCRCAt > 0 && info.MusicLength > 0 {
+		musicEnd := start + int64(info.MusicLength)
+
+		if musicEnd <= end && musicEnd > musicStart {
+			if lameCRC16(0, b[musicStart:musicEnd]) == info.MusicCRC {
+				health.LameMusicCRC = "ok"
+			} else {
+				health.LameMusicCRC = "mismatch"
+			}
+		} else if musicEnd > end {
+			// shorter than LAME wrote it
+			health.LameMusicCRC = "mismatch"
+		}
+	}
+
+	issues := make([]string, 0)
+	health.Status = "ok"
+
+	if health.MissingBytes > 0 {
+		issues = append(issues, fmt.Sprintf("last frame is missing %d bytes", health.MissingBytes))
+	}
+
+	if health.ExpectedFrames > 0 && health.Frames < health.ExpectedFrames {
+		issues = append(issues, fmt.Sprintf("%d of %d frames", health.Frames, health.ExpectedFrames))
+	} else if health.ExpectedFrames > 0 && health.Frames > health.ExpectedFrames {
+		issues = append(issues, fmt.Sprintf("%d frames but the header says %d", health.Frames, health.ExpectedFrames))
+	}
+
+	if health.JunkRegions > 0 {
+		issues = append(issues, fmt.Sprintf("%d bytes of junk in %d places", health.JunkBytes, health.JunkRegions))
+	}
+
+	if health.FrameCRCErrors > 0 {
+		issues = append(issues, fmt.Sprintf("%d frame crc errors", health.FrameCRCErrors))
+	}
+
+	if health.LameTagCRC == "mismatch" {
+		issues = append(issues, "lame tag crc mismatch")
+	}
+
+	if health.LameMusicCRC == "mismatch" {
+		issues = append(issues, "lame music crc mismatch")
+	}
+
+	if len(issues) > 0 {
+		health.Status = "damaged"
+	}
+
+	if health.MissingBytes > 0 || (health.ExpectedFrames > 0 && health.Frames < health.ExpectedFrames) {
+		health.Status = "truncated"
+	}
+
+	health.Issues = strings.Join(issues, "; ")
+
+	return health, nil
+}
+
+// All zeros or all 0xFF
+func isPadding(b []byte) bool {
+	for _, c := range b {
+		if c != 0 && c != 0xFF {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Scan one file and store the result
+func scanMP3ToDb(db *gorm.DB, file File, sourceHash string) error {
+	b, err := os.ReadFile(file.Base + file.Path)
+
+	if err != nil {
+		return err
+	}
+
+	health, err := scanMP3(b)
+
+	if err != nil {
+		return err
+	}
+
+	health.FileID = file.ID
+	health.SourceHash = sourceHash
+
+	db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}},
+		UpdateAll: true}).Create(&health)
+
+	return nil
+}
+
+// Scan every mp3 on this host that is new or has changed since it was last
+// scanned, or every one with rescan
+func scanMP3s(db *gorm.DB, hostName string, path string, rescan bool) {
+	jobs := make(chan File)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for file := range jobs {
+				sourceHash, err := hashFileImo(file.Base + file.Path)
+
+				if err != nil {
+					log.Println("Could not read `" + file.Path + "`: " + err.Error())
+					recordParseError(db, file, "read", "", err)
+					continue
+				}
+
+				var count int64
+				db.Model(&MP3Health{}).Where(&MP3Health{FileID: file.ID, SourceHash: sourceHash}).Count(&count)
+
+				if count > 0 && !rescan {
+					continue
+				}
+
+				if err := scanMP3ToDb(db, file, sourceHash); err != nil {
+					log.Println("Could not scan `" + file.Path + "`: " + err.Error())
+					recordParseError(db, file, "frames", sourceHash, err)
+				} else {
+					clearParseError(db, file, "frames")
+				}
+			}
+		}()
+	}
+
+	query := db.Where(&File{HostName: hostName}).Where("extension_lower_case IN ?", mp3HealthExtensions)
+
+	if len(path) > 0 {
+		query = query.Where("path LIKE ?", "%"+path+"%")
+	}
+
+	batch := make([]File, 0)
+
+	query.FindInBatches(&batch, 500, func(tx *gorm.DB, n int) error {
+		for _, file := range batch {
+			jobs <- file
+		}
+
+		return nil
+	})
+
+	close(jobs)
+	wg.Wait()
+}
+
+// A health row with its file's path
+type mp3HealthRow struct {
+	MP3Health
+	Path string `json:"path"`
+}
+
+// Scan results, by status and path
+func findMP3Health(db *gorm.DB, status string, path string, all bool) []mp3HealthRow {
+	rows := make([]mp3HealthRow, 0)
+
+	query := db.Table("mp3_healths").
+		Select("mp3_healths.*, files.path").
+		Joins("JOIN files ON files.id = mp3_healths.file_id")
+
+	if len(status) > 0 {
+		query = query.Where("mp3_healths.status = ?", status)
+	} else if !all {
+		query = query.Where("mp3_healths.status <> ?", "ok")
+	}
+
+	if len(path) > 0 {
+		query = query.Where("files.path LIKE ?", "%"+path+"%")
+	}
+
+	query.Order("files.path").Scan(&rows)
+
+	return rows
+}
+
+// mp3health scan [--path] [--rescan], or list the results
+func mp3Health(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&MP3Health{})
+	db.AutoMigrate(&ParseError{})
+
+	if len(args) > 0 && args[0] == "scan" {
+		flags := flag.NewFlagSet("mp3health scan", flag.ExitOnError)
+		path := flags.String("path", "", "only files with paths containing this")
+		rescan := flags.Bool("rescan", false, "scan files that haven't changed too")
+		flags.Parse(args[1:])
+
+		hostName, err := os.Hostname()
+
+		if err != nil {
+			panic(err) // could not get local hostname
+		}
+
+		scanMP3s(db, hostName, *path, *rescan)
+
+		return
+	}
+
+	flags := flag.NewFlagSet("mp3health", flag.ExitOnError)
+	status := flags.String("status", "", "only files with this status, ok, damaged or truncated")
+	path := flags.String("path", "", "only files with paths containing this")
+	all := flags.Bool("all", false, "show healthy files too")
+	flags.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSTATUS\tFRAMES\tEXPECTED\tJUNK\tLAME TAG\tLAME MUSIC\tPATH\tISSUES")
+
+	for _, row := range findMP3Health(db, *status, *path, *all) {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n",
+			row.FileID,
+			row.Status,
+			row.Frames,
+			row.ExpectedFrames,
+			row.JunkBytes,
+			row.LameTagCRC,
+			row.LameMusicCRC,
+			row.Path,
+			row.Issues)
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Boxes that hold other boxes, on the way to the chunk offset tables and
+// the iTunes metadata
+var mp4ContainerBoxes = []string{"moov", "trak", "mdia", "minf", "stbl", "udta", "meta", "ilst"}
+
+// mp4Node is a box read into memory. Containers have children, everything
+// else keeps its body as raw bytes.
+type mp4Node struct {
+	Type     string
+	Prefix   []byte // version/flags before the children of a full box (meta)
+	Data     []byte
+	Children []*mp4Node
+}
+
+// Parse boxes from a buffer. Items in an ilst are containers too, of data,
+// mean and name boxes.
+func parseMP4Nodes(b []byte, parent string) ([]*mp4Node, error) {
+	nodes := make([]*mp4Node, 0)
+
+	for pos := 0; pos+8 <= len(b); {
+		size := int(binary.BigEndian.Uint32(b[pos : pos+4]))
+		node := &mp4Node{Type: string(b[pos+4 : pos+8])}
+		header := 8
+
+		switch size {
+		case 0:
+			size = len(b) - pos
+		case 1:
+			if pos+16 > len(b) {
+				return nil, errors.New("short mp4 box")
+			}
+
+			size = int(binary.BigEndian.Uint64(b[pos+8 : pos+16]))
+			header = 16
+		}
+
+		if size < header || pos+size > len(b) {
+			return nil, errors.New("mp4 box `" + node.Type + "` runs past its parent")
+		}
+
+		body := b[pos+header : pos+size]
+
+		if stringInSlice(node.Type, mp4ContainerBoxes) || parent == "ilst" {
+			if node.Type == "meta" {
+				if len(body) < 4 {
+					return nil, errors.New("short mp4 meta box")
+				}
+
+				node.Prefix = body[:4]
+				body = body[4:]
+			}
+
+			children, err := parseMP4Nodes(body, node.Type)
+
+			if err != nil {
+				return nil, err
+			}
+
+			node.Children = children
+		} else {
+			node.Data = body
+		}
+
+		nodes = append(nodes, node)
+		pos += size
+	}
+
+	return nodes, nil
+}
+
+func (node *mp4Node) bytes() []byte {
+	var body bytes.Buffer
+
+	body.Write(node.Prefix)
+
+	if node.Children != nil {
+		for _, child := range node.Children {
+			body.Write(child.bytes())
+		}
+	} else {
+		body.Write(node.Data)
+	}
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(8+body.Len()))
+	copy(header[4:8], node.Type)
+
+	return append(header, body.Bytes()...)
+}
+
+// First child of a type
+func (node *mp4Node) child(boxType string) *mp4Node {
+	for _, child := range node.Children {
+		if child.Type == boxType {
+			return child
+		}
+	}
+
+	return nil
+}
+
+// Get a child, adding an empty container if there isn't one
+func (node *mp4Node) ensure(boxType string) *mp4Node {
+	if child := node.child(boxType); child != nil {
+		return child
+	}
+
+	child := &mp4Node{Type: boxType, Children: []*mp4Node{}}
+
+	if boxType == "meta" {
+		// a meta box needs a handler saying it holds iTunes metadata
+		child.Prefix = []byte{0, 0, 0, 0}
+		child.Children = append(child.Children, &mp4Node{
+			Type: "hdlr",
+			Data: append([]byte{0, 0, 0, 0, 0, 0, 0, 0, 'm', 'd', 'i', 'r', 'a', 'p', 'p', 'l'}, make([]byte, 9)...)})
+	}
+
+	node.Children = append(node.Children, child)
+
+	return child
+}
+
+// Every box of a type anywhere below this one
+func (node *mp4Node) findAll(boxType string) []*mp4Node {
+	found := make([]*mp4Node, 0)
+
+	for _, child := range node.Children {
+		if child.Type == boxType {
+			found = append(found, child)
+		}
+
+		found = append(found, child.findAll(boxType)...)
+	}
+
+	return found
+}
+
+// Atom type and, for freeform atoms, the name
+func splitMP4Atom(atom string) (string, string, string) {
+	parts := strings.SplitN(atom, ":", 3)
+
+	if len(parts) == 3 {
+		return parts[0], parts[1], parts[2]
+	}
+
+	return atom, "", ""
+}
+
+// The mean or name of a freeform atom
+func freeformString(item *mp4Node, boxType string) string {
+	box := item.child(boxType)
+
+	if box == nil || len(box.Data) < 4 {
+		return ""
+	}
+
+	return string(box.Data[4:])
+}
+
+// Is this ilst item the one for an atom. Atom types use © in this file,
+// 0xa9 on disk.
+func mp4ItemMatches(item *mp4Node, atom string) bool {
+	boxType, mean, name := splitMP4Atom(atom)
+	boxType = strings.Replace(boxType, "©", "\xa9", 1)
+
+	if item.Type != boxType {
+		return false
+	}
+
+	if boxType != "----" {
+		return true
+	}
+
+	return freeformString(item, "mean") == mean && strings.EqualFold(freeformString(item, "name"), name)
+}
+
+// A data box, type 1 is UTF-8, 0 is implicit (binary), 21 is an integer
+func mp4DataBox(dataType byte, payload []byte) *mp4Node {
+	return &mp4Node{Type: "data", Data: append([]byte{0, 0, 0, dataType, 0, 0, 0, 0}, payload...)}
+}
+
+// Build the ilst item for a field
+func newMP4Item(field tagField, value string) (*mp4Node, error) {
+	boxType, mean, name := splitMP4Atom(field.MP4)
+	boxType = strings.Replace(boxType, "©", "\xa9", 1)
+
+	item := &mp4Node{Type: boxType}
+
+	switch boxType {
+	case "trkn", "disk":
+		number, total := splitNumberTotal(value)
+		n, err := strconv.Atoi(number)
+
+		if err != nil {
+			return nil, errors.New("`" + value + "` isn't a number")
+		}
+
+		t, _ := strconv.Atoi(total)
+
+		payload := make([]byte, 6)
+		binary.BigEndian.PutUint16(payload[2:4], uint16(n))
+		binary.BigEndian.PutUint16(payload[4:6], uint16(t))
+
+		// trkn has two more bytes of padding than disk
+		if boxType == "trkn" {
+			payload = append(payload, 0, 0)
+		}
+
+		item.Children = []*mp4Node{mp4DataBox(0, payload)}
+	case "tmpo":
+		bpm, err := strconv.ParseFloat(value, 64)
+
+		if err != nil {
+			return nil, errors.New("`" + value + "` isn't a number")
+		}
+
+		payload := make([]byte, 2)
+		binary.BigEndian.PutUint16(payload, uint16(bpm+0.5))
+		item.Children = []*mp4Node{mp4DataBox(21, payload)}
+	case "----":
+		item.Children = []*mp4Node{
+			{Type: "mean", Data: append([]byte{0, 0, 0, 0}, mean...)},
+			{Type: "name", Data: append([]byte{0, 0, 0, 0}, name...)},
+			mp4DataBox(1, []byte(value))}
+	default:
+		item.Children = []*mp4Node{mp4DataBox(1, []byte(value))}
+	}
+
+	return item, nil
+}
+
+// Value of an ilst item as text
+func mp4ItemText(item *mp4Node) string {
+	data := item.child("data")
+
+	if data == nil || len(data.Data) < 8 {
+		return ""
+	}
+
+	dataType := data.Data[3]
+	payload := data.Data[8:]
+
+	switch {
+	case (item.Type == "trkn" || item.Type == "disk") && len(payload) >= 6:
+		number := strconv.Itoa(int(binary.BigEndian.Uint16(payload[2:4])))
+
+		if total := binary.BigEndian.Uint16(payload[4:6]); total > 0 {
+			number += "/" + strconv.Itoa(int(total))
+		}
+
+		return number
+	case dataType == 21 && len(payload) == 1:
+		return strconv.Itoa(int(int8(payload[0])))
+	case dataType == 21 && len(payload) == 2:
+		return strconv.Itoa(int(int16(binary.BigEndian.Uint16(payload))))
+	case dataType == 21 && len(payload) == 4:
+		return strconv.Itoa(int(int32(binary.BigEndian.Uint32(payload))))
+	}
+
+	return string(payload)
+}
+
+// Read moov and note where it sits
+func readMP4Moov(f *os.File) (*mp4Node, mp4Box, []mp4Box, error) {
+	stat, err := f.Stat()
+
+	if err != nil {
+		return nil, mp4Box{}, nil, err
+	}
+
+	top := readMP4Boxes(f, 0, stat.Size())
+
+	if len(top) == 0 || top[0].Type != "ftyp" {
+		return nil, mp4Box{}, nil, errUnknownContainer
+	}
+
+	for _, box := range top {
+		if box.Type != "moov" {
+			continue
+		}
+
+		body := make([]byte, box.Size)
+
+		if _, err := f.ReadAt(body, box.Start); err != nil {
+			return nil, box, top, err
+		}
+
+		children, err := parseMP4Nodes(body, "moov")
+
+		if err != nil {
+			return nil, box, top, err
+		}
+
+		return &mp4Node{Type: "moov", Children: children}, box, top, nil
+	}
+
+	return nil, mp4Box{}, top, errors.New("no moov box")
+}
+
+func readMP4Fields(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	moov, _, _, err := readMP4Moov(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+
+	udta := moov.child("udta")
+
+	if udta == nil || udta.child("meta") == nil || udta.child("meta").child("ilst") == nil {
+		return values, nil
+	}
+
+	ilst := udta.child("meta").child("ilst")
+
+	for _, field := range tagFields {
+		for _, item := range ilst.Children {
+			if mp4ItemMatches(item, field.MP4) {
+				values[field.Name] = mp4ItemText(item)
+				break
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// Move the chunk offsets of every track that point past moov, since the
+// audio moves when moov changes size
+func shiftMP4ChunkOffsets(moov *mp4Node, after int64, delta int64) error {
+	for _, stco := range moov.findAll("stco") {
+		if len(stco.Data) < 8 {
+			continue
+		}
+
+		count := int(binary.BigEndian.Uint32(stco.Data[4:8]))
+
+		for i := 0; i < count && 8+i*4+4 <= len(stco.Data); i++ {
+			b := stco.Data[8+i*4 : 8+i*4+4]
+			offset := int64(binary.BigEndian.Uint32(b))
+
+			if offset < after {
+				continue
+			}
+
+			if offset+delta > 0xFFFFFFFF || offset+delta < 0 {
+				return errors.New("chunk offset out of range for stco")
+			}
+
+			binary.BigEndian.PutUint32(b, uint32(offset+delta))
+		}
+	}
+
+	for _, co64 := range moov.findAll("co64") {
+		if len(co64.Data) < 8 {
+			continue
+		}
+
+		count := int(binary.BigEndian.Uint32(co64.Data[4:8]))
+
+		for i := 0; i < count && 8+i*8+8 <= len(co64.Data); i++ {
+			b := co64.Data[8+i*8 : 8+i*8+8]
+			offset := int64(binary.BigEndian.Uint64(b))
+
+			if offset >= after {
+				binary.BigEndian.PutUint64(b, uint64(offset+delta))
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeMP4Fields(path string, changes []tagChange) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	moov, moovBox, top, err := readMP4Moov(f)
+
+	if err != nil {
+		return err
+	}
+
+	ilst := moov.ensure("udta").ensure("meta").ensure("ilst")
+
+	for _, change := range changes {
+		field, ok := getTagField(change.Field)
+
+		if !ok {
+			return errors.New("unknown tag field `" + change.Field + "`")
+		}
+
+		items := make([]*mp4Node, 0, len(ilst.Children))
+
+		for _, item := range ilst.Children {
+			// genres can also be stored as an id3v1 number
+			if mp4ItemMatches(item, field.MP4) || (field.Name == "genre" && item.Type == "gnre") {
+				continue
+			}
+
+			items = append(items, item)
+		}
+
+		if !change.Clear {
+			item, err := newMP4Item(field, change.Value)
+
+			if err != nil {
+				return err
+			}
+
+			items = append(items, item)
+		}
+
+		ilst.Children = items
+	}
+
+	oldEnd := moovBox.Start + moovBox.Size
+	oldSize := moovBox.Header + moovBox.Size
+	newSize := int64(len(moov.bytes()))
+
+	if err := shiftMP4ChunkOffsets(moov, oldEnd, newSize-oldSize); err != nil {
+		return err
+	}
+
+	newMoov := moov.bytes()
+
+	last := top[len(top)-1]
+
+	return rewriteFile(path, func(w io.Writer) error {
+		for _, box := range top {
+			start := box.Start - box.Header
+
+			if box.Type == "moov" {
+				if _, err := w.Write(newMoov); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if _, err := io.Copy(w, io.NewSectionReader(f, start, box.Header+box.Size)); err != nil {
+				return err
+			}
+		}
+
+		// anything after the last box we could read
+		return copyFrom(w, f, last.Start+last.Size)
+	})
+}
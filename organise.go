@@ -0,0 +1,597 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// OrganiseMove is the undo log, one row per file moved by organise. Paths
+// are relative to the file's Base.
+type OrganiseMove struct {
+	ID        uint
+	Batch     string `gorm:"index;size:16"`
+	FileID    uint   `gorm:"index"` // 0 for sidecars that aren't in the files table
+	Base      string
+	FromPath  string
+	ToPath    string
+	UndoOf    string `gorm:"index;size:16"`
+	UndoneBy  string `gorm:"index;size:16"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// A planned move
+type organiseMove struct {
+	FileID uint
+	Base   string
+	From   string
+	To     string
+}
+
+// A file organise left where it is, and why
+type organiseSkip struct {
+	FileID uint
+	Path   string
+	Reason string
+}
+
+// A source directory, relative paths only mean something with their base
+type organiseDir struct {
+	Base string
+	Dir  string
+}
+
+// {field} or {field:02}
+var templatePlaceholder = regexp.MustCompile(`\{([a-z_]+)(?::(0?\d+))?\}`)
+
+// Characters that aren't allowed in file names on at least one of the
+// systems the library ends up on
+var illegalPathCharacters = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f]`)
+
+// Names windows won't create
+var reservedFileNames = []string{"con", "prn", "aux", "nul",
+	"com1", "com2", "com3", "com4", "com5", "com6", "com7", "com8", "com9",
+	"lpt1", "lpt2", "lpt3", "lpt4", "lpt5", "lpt6", "lpt7", "lpt8", "lpt9"}
+
+// Make a tag value safe to use as one path component
+func sanitisePathComponent(s string) string {
+	s = illegalPathCharacters.ReplaceAllString(s, "_")
+	s = strings.Join(strings.Fields(s), " ")
+	s = strings.TrimRight(s, ". ")
+
+	// leave room for " (2)" and an extension
+	for len(s) > 200 {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+
+	if len(s) == 0 || s == "." || s == ".." {
+		return "_"
+	}
+
+	if strings.HasPrefix(s, ".") {
+		s = "_" + s[1:]
+	}
+
+	base := strings.ToLower(strings.SplitN(s, ".", 2)[0])
+
+	if stringInSlice(base, reservedFileNames) {
+		s = "_" + s
+	}
+
+	return s
+}
+
+// Values a template can use for a file. Missing tags are left empty,
+// planOrganise skips files missing a field the template needs.
+func templateValues(file File, t Tag) map[string]string {
+	extension := file.ExtensionLowerCase
+	albumArtist := t.AlbumArtist
+
+	if len(albumArtist) == 0 {
+		albumArtist = t.Artist
+	}
+
+	year := t.Year
+
+	if len(year) > 4 {
+		year = year[:4]
+	}
+
+	// only number discs when there is more than one
+	disc := ""
+
+	if t.DiscTotal > 1 || t.DiscNumber > 1 {
+		disc = strconv.Itoa(t.DiscNumber)
+	}
+
+	track := ""
+
+	if t.TrackNumber > 0 {
+		track = strconv.Itoa(t.TrackNumber)
+	}
+
+	return map[string]string{
+		"albumartist":   albumArtist,
+		"artist":        t.Artist,
+		"album":         t.Album,
+		"year":          year,
+		"title":         t.Title,
+		"track":         track,
+		"disc":          disc,
+		"genre":         t.Genre,
+		"label":         t.Label,
+		"catalognumber": t.CatalogNumber,
+		"ext":           extension,
+	}
+}
+
+// Build a relative path from a template. Each directory and the file name
+// are sanitised separately, so a / in a tag can't add a directory.
+func renderTemplate(template string, values map[string]string) (string, error) {
+	components := strings.Split(template, "/")
+	rendered := make([]string, 0, len(components))
+
+	for _, component := range components {
+		var err error
+
+		out := templatePlaceholder.ReplaceAllStringFunc(component, func(placeholder string) string {
+			match := templatePlaceholder.FindStringSubmatch(placeholder)
+			value, ok := values[match[1]]
+
+			if !ok {
+				err = errors.New("unknown template field `" + match[1] + "`")
+				return ""
+			}
+
+			// zero pad numbers, {track:02}
+			if len(match[2]) > 0 && len(value) > 0 {
+				width, _ := strconv.Atoi(match[2])
+
+				if n, convErr := strconv.Atoi(value); convErr == nil {
+					value = fmt.Sprintf("%0*d", width, n)
+				}
+			}
+
+			return value
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+		// empty fields leave separators hanging, "{year} - {album}" -> "- Donk"
+		rendered = append(rendered, sanitisePathComponent(strings.Trim(out, " -")))
+	}
+
+	return strings.Join(rendered, "/"), nil
+}
+
+// Fields that name a file or its album, a file without them would end up
+// somewhere like "_/_.mp3"
+var requiredTemplateFields = []string{"albumartist", "artist", "album", "title"}
+
+// Required fields the template uses that are empty for a file
+func missingTemplateFields(template string, values map[string]string) []string {
+	missing := make([]string, 0)
+
+	for _, match := range templatePlaceholder.FindAllStringSubmatch(template, -1) {
+		if stringInSlice(match[1], requiredTemplateFields) && len(values[match[1]]) == 0 && !stringInSlice(match[1], missing) {
+			missing = append(missing, match[1])
+		}
+	}
+
+	return missing
+}
+
+// Non-audio files that move with their album
+func organiseSidecarExtensions() []string {
+	extensions := []string{"cue"}
+	extensions = append(extensions, ripLogExtensions...)
+	extensions = append(extensions, playlistExtensions...)
+	extensions = append(extensions, checksumManifestExtensions...)
+
+	return append(extensions, imageExtensions...)
+}
+
+// Add " (2)", " (3)"... before the extension until the path is free
+func uniquePath(base string, path string, taken map[string]bool) string {
+	extension := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, extension)
+	candidate := path
+
+	for i := 2; ; i++ {
+		if !taken[strings.ToLower(candidate)] {
+			if _, err := os.Lstat(base + candidate); os.IsNotExist(err) {
+				return candidate
+			}
+		}
+
+		candidate = stem + " (" + strconv.Itoa(i) + ")" + extension
+	}
+}
+
+// Work out where every file should go. Files already in the right place
+// are left out, files missing tags the template needs are skipped.
+func planOrganise(db *gorm.DB, hostName string, template string, pathPrefix string) ([]organiseMove, []organiseSkip, error) {
+	moves := make([]organiseMove, 0)
+	skipped := make([]organiseSkip, 0)
+
+	files := make([]File, 0)
+
+	query := db.Where(&File{HostName: hostName}).Where("extension_lower_case IN ?", audioExtensions)
+
+	if len(pathPrefix) > 0 {
+		query = query.Where("path LIKE ?", strings.NewReplacer("%", `\%`, "_", `\_`).Replace(pathPrefix)+"%")
+	}
+
+	query.Order("path").Find(&files)
+
+	taken := make(map[string]bool)
+	planned := make(map[string]bool)
+
+	// where each source directory's audio is going
+	targetDirs := make(map[organiseDir]map[string]bool)
+
+	for _, file := range files {
+		t := Tag{}
+
+		if db.Where(&Tag{FileID: file.ID}).First(&t).Error != nil {
+			skipped = append(skipped, organiseSkip{FileID: file.ID, Path: file.Path, Reason: "no tags"})
+			continue
+		}
+
+		values := templateValues(file, t)
+
+		if missing := missingTemplateFields(template, values); len(missing) > 0 {
+			skipped = append(skipped, organiseSkip{FileID: file.ID, Path: file.Path, Reason: "no " + strings.Join(missing, ", ")})
+			continue
+		}
+
+		to, err := renderTemplate(template, values)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		from := organiseDir{Base: file.Base, Dir: filepath.Dir(file.Path)}
+		planned[file.Base+file.Path] = true
+
+		if targetDirs[from] == nil {
+			targetDirs[from] = make(map[string]bool)
+		}
+
+		if to == file.Path {
+			targetDirs[from][filepath.Dir(to)] = true
+			taken[strings.ToLower(to)] = true
+			continue
+		}
+
+		to = uniquePath(file.Base, to, taken)
+		taken[strings.ToLower(to)] = true
+		targetDirs[from][filepath.Dir(to)] = true
+
+		moves = append(moves, organiseMove{FileID: file.ID, Base: file.Base, From: file.Path, To: to})
+	}
+
+	// Sidecars (cue, log, cover...) follow their album, but only when all of
+	// the audio in their directory is going to the same place
+	dirs := make([]organiseDir, 0, len(targetDirs))
+
+	for dir := range targetDirs {
+		dirs = append(dirs, dir)
+	}
+
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].Base+dirs[i].Dir < dirs[j].Base+dirs[j].Dir
+	})
+
+	sidecarExtensions := organiseSidecarExtensions()
+
+	for _, from := range dirs {
+		if len(targetDirs[from]) != 1 {
+			continue
+		}
+
+		var toDir string
+
+		for dir := range targetDirs[from] {
+			toDir = dir
+		}
+
+		if toDir == from.Dir {
+			continue
+		}
+
+		entries, err := os.ReadDir(from.Base + from.Dir)
+
+		if err != nil || !allAudioPlanned(from, entries, planned) {
+			continue
+		}
+
+		for _, entry := range entries {
+			extension := trimLeftChars(strings.ToLower(filepath.Ext(entry.Name())), 1)
+
+			if !entry.Type().IsRegular() || !stringInSlice(extension, sidecarExtensions) {
+				continue
+			}
+
+			path := filepath.Join(from.Dir, entry.Name())
+			to := uniquePath(from.Base, filepath.Join(toDir, entry.Name()), taken)
+			taken[strings.ToLower(to)] = true
+
+			sidecar := File{}
+			db.Where(&File{FullPathMd5: HashStringMd5(from.Base + path), HostName: hostName}).First(&sidecar)
+
+			moves = append(moves, organiseMove{FileID: sidecar.ID, Base: from.Base, From: path, To: to})
+		}
+	}
+
+	return moves, skipped, nil
+}
+
+// Is every audio file in a directory part of the plan. If some are staying
+// behind (no tags, outside the path filter) the sidecars stay with them.
+func allAudioPlanned(dir organiseDir, entries []os.DirEntry, planned map[string]bool) bool {
+	for _, entry := range entries {
+		extension := trimLeftChars(strings.ToLower(filepath.Ext(entry.Name())), 1)
+
+		if stringInSlice(extension, audioExtensions) && !planned[dir.Base+filepath.Join(dir.Dir, entry.Name())] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Move a file, copying when the target is on another filesystem
+func moveFile(from string, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(to); err == nil {
+		return errors.New("`" + to + "` already exists")
+	}
+
+	err := os.Rename(from, to)
+
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(from)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	stat, err := in.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, stat.Mode().Perm())
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(to)
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+
+	os.Chtimes(to, stat.ModTime(), stat.ModTime())
+
+	return os.Remove(from)
+}
+
+// Remove directories left empty by a move, stopping at the base
+func removeEmptyDirs(base string, dir string) {
+	for dir != "." && dir != "/" && len(dir) > 0 {
+		if err := os.Remove(base + dir); err != nil {
+			return
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Point a File row at its new path. The remote copy is at the old path, so
+// md5 is cleared to sync it again.
+func updateFilePath(db *gorm.DB, fileID uint, base string, path string) {
+	if fileID == 0 {
+		return
+	}
+
+	file := File{}
+
+	if db.First(&file, fileID).Error != nil {
+		return
+	}
+
+	file.Path = path
+	file.FileName = filepath.Base(path)
+	file.FullPathMd5 = HashStringMd5(base + path)
+	file.PathHash = stringToMurmur(base + path)
+	file.Md5 = ""
+	file.VerifiedAt = time.Time{}
+
+	db.Save(&file)
+}
+
+// Carry out moves and log them under a batch
+func applyOrganise(db *gorm.DB, moves []organiseMove, batch string, undoOf string) []error {
+	errs := make([]error, 0)
+	emptied := make(map[string]string)
+
+	for _, move := range moves {
+		if err := moveFile(move.Base+move.From, move.Base+move.To); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", move.From, err))
+			continue
+		}
+
+		updateFilePath(db, move.FileID, move.Base, move.To)
+
+		db.Create(&OrganiseMove{
+			Batch:    batch,
+			FileID:   move.FileID,
+			Base:     move.Base,
+			FromPath: move.From,
+			ToPath:   move.To,
+			UndoOf:   undoOf})
+
+		emptied[filepath.Dir(move.From)] = move.Base
+	}
+
+	for dir, base := range emptied {
+		removeEmptyDirs(base, dir)
+	}
+
+	return errs
+}
+
+// Move everything in a batch back
+func undoOrganise(db *gorm.DB, batch string) (string, []error, error) {
+	logged := make([]OrganiseMove, 0)
+	db.Where(&OrganiseMove{Batch: batch}).Order("id desc").Find(&logged)
+
+	if len(logged) == 0 {
+		return "", nil, errors.New("no moves in batch `" + batch + "`")
+	}
+
+	undoBatch := randSeq(12)
+	errs := make([]error, 0)
+
+	for _, move := range logged {
+		if len(move.UndoneBy) > 0 {
+			continue
+		}
+
+		back := organiseMove{FileID: move.FileID, Base: move.Base, From: move.ToPath, To: move.FromPath}
+
+		if moveErrs := applyOrganise(db, []organiseMove{back}, undoBatch, batch); len(moveErrs) > 0 {
+			errs = append(errs, moveErrs...)
+			continue
+		}
+
+		move.UndoneBy = undoBatch
+		db.Save(&move)
+	}
+
+	return undoBatch, errs, nil
+}
+
+func printOrganiseMoves(moves []organiseMove) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tFROM\tTO")
+
+	for _, move := range moves {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", move.FileID, move.From, move.To)
+	}
+
+	w.Flush()
+}
+
+func printOrganiseSkips(skipped []organiseSkip) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tPATH\tREASON")
+
+	for _, skip := range skipped {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", skip.FileID, skip.Path, skip.Reason)
+	}
+
+	w.Flush()
+}
+
+// organise command
+func organise(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&File{})
+	db.AutoMigrate(&Tag{})
+	db.AutoMigrate(&OrganiseMove{})
+
+	if len(args) > 1 && args[0] == "undo" {
+		batch, errs, err := undoOrganise(db, args[1])
+
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+
+		fmt.Printf("Undone as batch %s\n", batch)
+		return
+	}
+
+	flags := flag.NewFlagSet("organise", flag.ExitOnError)
+	template := flags.String("template", conf.OrganiseTemplate, "where files go, relative to searchDirectory")
+	path := flags.String("path", "", "only files under this path")
+	dryRun := flags.Bool("dry-run", false, "show what would move without moving anything")
+	flags.Parse(args)
+
+	hostName, err := os.Hostname()
+
+	if err != nil {
+		panic(err) // could not get local hostname
+	}
+
+	moves, skipped, err := planOrganise(db, hostName, *template, *path)
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	printOrganiseMoves(moves)
+
+	if len(skipped) > 0 {
+		fmt.Printf("Skipped %d files:\n", len(skipped))
+		printOrganiseSkips(skipped)
+	}
+
+	if *dryRun {
+		fmt.Printf("Dry run, %d files would move.\n", len(moves))
+		return
+	}
+
+	batch := randSeq(12)
+
+	for _, err := range applyOrganise(db, moves, batch, "") {
+		fmt.Println(err)
+	}
+
+	fmt.Printf("Batch %s, undo with: organise undo %s\n", batch, batch)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ParseError is the last thing that went wrong reading a file, per stage
+// (tags, properties...). It is kept until the file parses cleanly.
+type ParseError struct {
+	ID         uint
+	FileID     uint   `gorm:"uniqueIndex:idx_parse_error_file_stage"`
+	Stage      string `gorm:"uniqueIndex:idx_parse_error_file_stage;size:32"`
+	SourceHash string `gorm:"size:32"` // imohash of the file when it failed
+	Error      string `gorm:"type:text"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// Record that a stage failed for a file
+func recordParseError(db *gorm.DB, file File, stage string, sourceHash string, err error) {
+	parseError := ParseError{
+		FileID:     file.ID,
+		Stage:      stage,
+		SourceHash: sourceHash,
+		Error:      err.Error()}
+
+	db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}, {Name: "stage"}},
+		DoUpdates: clause.AssignmentColumns([]string{"source_hash", "error", "updated_at"})}).Create(&parseError)
+}
+
+// Did a stage fail on this version of a file, no point trying again until
+// it changes
+func parseErrorIsCurrent(db *gorm.DB, file File, stage string, sourceHash string) bool {
+	var count int64
+
+	db.Model(&ParseError{}).Where(&ParseError{FileID: file.ID, Stage: stage, SourceHash: sourceHash}).Count(&count)
+
+	return count > 0
+}
+
+// Did a stage fail on an older version of a file
+func hasStaleParseError(db *gorm.DB, file File, stage string, sourceHash string) bool {
+	var count int64
+
+	db.Model(&ParseError{}).Where(&ParseError{FileID: file.ID, Stage: stage}).Where("source_hash <> ?", sourceHash).Count(&count)
+
+	return count > 0
+}
+
+// Forget any error from a stage that has now worked
+func clearParseError(db *gorm.DB, file File, stage string) {
+	db.Where(&ParseError{FileID: file.ID, Stage: stage}).Delete(&ParseError{})
+}
+
+// List files that could not be parsed
+func listParseErrors() {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&ParseError{})
+
+	parseErrors := make([]ParseError, 0)
+	db.Order("file_id").Find(&parseErrors)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSTAGE\tFAILED AT\tPATH\tERROR")
+
+	for _, parseError := range parseErrors {
+		file := File{}
+		db.First(&file, parseError.FileID)
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+			parseError.FileID,
+			parseError.Stage,
+			parseError.UpdatedAt.Format(time.RFC3339),
+			file.Path,
+			parseError.Error)
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/mewkiz/flac"
+)
+
+// pcmFormat describes decoded audio
+type pcmFormat struct {
+	SampleRate int
+	Channels   int
+	BitDepth   int
+}
+
+// pcmReader hands out decoded audio a block at a time, one slice of
+// samples per channel. Next returns io.EOF at the end.
+type pcmReader interface {
+	Format() pcmFormat
+	Next() ([][]int32, error)
+	Close() error
+}
+
+// Formats decoded without ffmpeg, the rest of audioExtensions need it
+var pcmExtensions = []string{"flac", "wav", "aif", "aiff", "aifc"}
+
+// Open an audio file for decoding
+func openPCM(path string, extension string) (pcmReader, error) {
+	switch extension {
+	case "flac":
+		return openFLACPCM(path)
+	case "wav":
+		return openWAVPCM(path)
+	case "aif", "aiff", "aifc":
+		return openAIFFPCM(path)
+	}
+
+	if stringInSlice(extension, audioExtensions) {
+		return openFFmpegPCM(path, extension)
+	}
+
+	return nil, errors.New("can't decode `" + extension + "` files")
+}
+
+type flacPCM struct {
+	stream *flac.Stream
+}
+
+func openFLACPCM(path string) (pcmReader, error) {
+	stream, err := flac.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &flacPCM{stream: stream}, nil
+}
+
+func (p *flacPCM) Format() pcmFormat {
+	return pcmFormat{
+		SampleRate: int(p.stream.Info.SampleRate),
+		Channels:   int(p.stream.Info.NChannels),
+		BitDepth:   int(p.stream.Info.BitsPerSample)}
+}
+
+func (p *flacPCM) Next() ([][]int32, error) {
+	frame, err := p.stream.ParseNext()
+
+	if err != nil {
+		return nil, err
+	}
+
+	block := make([][]int32, len(frame.Subframes))
+
+	for i, subframe := range frame.Subframes {
+		block[i] = subframe.Samples[:subframe.NSamples]
+	}
+
+	return block, nil
+}
+
+func (p *flacPCM) Close() error {
+	return p.stream.Close()
+}
+
+// Uncompressed integer samples, interleaved, from wav, aiff or ffmpeg
+type intPCM struct {
+	f         io.ReadCloser
+	format    pcmFormat
+	remaining int64
+	buffer    []byte
+	bigEndian bool // aiff
+	unsigned  bool // 8 bit wav
+}
+
+// Start reading samples at the start of the audio data
+func newIntPCM(f *os.File, format pcmFormat, dataStart int64, dataSize int64) (*intPCM, error) {
+	if format.Channels == 0 || format.BitDepth == 0 || format.BitDepth > 32 {
+		return nil, errors.New("unsupported pcm format")
+	}
+
+	if _, err := f.Seek(dataStart, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// 4096 frames at a time
+	width := (format.BitDepth + 7) / 8
+
+	return &intPCM{f: f, format: format, remaining: dataSize, buffer: make([]byte, 4096*format.Channels*width)}, nil
+}
+
+// Integer pcm only, which is all a rip will be
+func openWAVPCM(path string) (pcmReader, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	header := make([]byte, 12)
+
+	if _, err := io.ReadFull(f, header); err != nil || string(header[8:12]) != "WAVE" {
+		f.Close()
+		return nil, errUnknownContainer
+	}
+
+	format := pcmFormat{}
+	var formatTag uint16
+	var dataStart int64
+	var dataSize int64 = -1
+
+	err = walkChunks(f, 12, stat.Size(), binary.LittleEndian, func(chunk chunkHeader) error {
+		switch chunk.ID {
+		case "fmt ":
+			b := make([]byte, 16)
+
+			if _, err := io.ReadFull(f, b); err != nil {
+				return errors.New("short wav fmt chunk")
+			}
+
+			formatTag = binary.LittleEndian.Uint16(b[0:2])
+			format.Channels = int(binary.LittleEndian.Uint16(b[2:4]))
+			format.SampleRate = int(binary.LittleEndian.Uint32(b[4:8]))
+			format.BitDepth = int(binary.LittleEndian.Uint16(b[14:16]))
+		case "data":
+			if dataSize < 0 {
+				dataStart, _ = f.Seek(0, io.SeekCurrent)
+				dataSize = chunk.Size
+
+				// truncated, or RF64 with the size in ds64
+				if dataSize > stat.Size()-dataStart {
+					dataSize = stat.Size() - dataStart
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil && dataSize < 0 {
+		err = errNoAudioStream
+	}
+
+	// WAVE_FORMAT_PCM or WAVE_FORMAT_EXTENSIBLE
+	if err == nil && ((formatTag != 1 && formatTag != 0xFFFE) || format.BitDepth%8 != 0) {
+		err = errors.New("wav is not integer pcm")
+	}
+
+	var p *intPCM
+
+	if err == nil {
+		p, err = newIntPCM(f, format, dataStart, dataSize)
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	p.unsigned = format.BitDepth == 8
+
+	return p, nil
+}
+
+// Uncompressed aiff, or aifc with no compression or byte swapped
+func openAIFFPCM(path string) (pcmReader, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	header := make([]byte, 12)
+
+	if _, err := io.ReadFull(f, header); err != nil || string(header[0:4]) != "FORM" || (string(header[8:12]) != "AIFF" && string(header[8:12]) != "AIFC") {
+		f.Close()
+		return nil, errUnknownContainer
+	}
+
+	format := pcmFormat{}
+	bigEndian := true
+	var dataStart int64
+	var dataSize int64 = -1
+
+	err = walkChunks(f, 12, stat.Size(), binary.BigEndian, func(chunk chunkHeader) error {
+		switch chunk.ID {
+		case "COMM":
+			b, err := readHeaderChunk(f, chunk)
+
+			if err != nil || len(b) < 18 {
+				return errors.New("short aiff COMM chunk")
+			}
+
+			format.Channels = int(binary.BigEndian.Uint16(b[0:2]))
+			format.BitDepth = int(binary.BigEndian.Uint16(b[6:8]))
+			format.SampleRate = int(math.Round(float80(b[8:18])))
+
+			if len(b) >= 22 {
+				switch string(b[18:22]) {
+				case "NONE", "twos":
+				case "sowt":
+					bigEndian = false
+				default:
+					return errors.New("aifc compression `" + string(b[18:22]) + "` isn't supported")
+				}
+			}
+		case "SSND":
+			// offset and block size come before the samples
+			b := make([]byte, 8)
+
+			if _, err := io.ReadFull(f, b); err != nil {
+				return errors.New("short aiff SSND chunk")
+			}
+
+			position, _ := f.Seek(0, io.SeekCurrent)
+			offset := int64(binary.BigEndian.Uint32(b[0:4]))
+			dataStart = position + offset
+			dataSize = chunk.Size - 8 - offset
+
+			if dataSize > stat.Size()-dataStart {
+				dataSize = stat.Size() - dataStart
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil && dataSize < 0 {
+		err = errNoAudioStream
+	}
+
+	var p *intPCM
+
+	if err == nil {
+		p, err = newIntPCM(f, format, dataStart, dataSize)
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	p.bigEndian = bigEndian
+
+	return p, nil
+}
+
+func (p *intPCM) Format() pcmFormat {
+	return p.format
+}
+
+func (p *intPCM) Next() ([][]int32, error) {
+	if p.remaining <= 0 {
+		return nil, io.EOF
+	}
+
+	buffer := p.buffer
+
+	if int64(len(buffer)) > p.remaining {
+		buffer = buffer[:p.remaining]
+	}
+
+	n, err := io.ReadFull(p.f, buffer)
+
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	if n == 0 {
+		return nil, io.EOF
+	}
+
+	p.remaining -= int64(n)
+
+	width := (p.format.BitDepth + 7) / 8
+	frames := n / (width * p.format.Channels)
+	block := make([][]int32, p.format.Channels)
+
+	for c := range block {
+		block[c] = make([]int32, frames)
+	}
+
+	for i := 0; i < frames; i++ {
+		for c := 0; c < p.format.Channels; c++ {
+			b := buffer[(i*p.format.Channels+c)*width : (i*p.format.Channels+c+1)*width]
+
+			// samples narrower than their bytes are left justified
+			var sample uint32
+
+			for k := 0; k < width; k++ {
+				if p.bigEndian {
+					sample = sample<<8 | uint32(b[k])
+				} else {
+					sample = sample<<8 | uint32(b[width-1-k])
+				}
+			}
+
+			value := int32(sample<<(32-8*width)) >> (32 - p.format.BitDepth)
+
+			// 8 bit wav is unsigned
+			if p.unsigned {
+				value = int32(sample) - 128
+			}
+
+			block[c][i] = value
+		}
+	}
+
+	return block, err
+}
+
+func (p *intPCM) Close() error {
+	return p.f.Close()
+}
+
+// Lossy formats are decoded by ffmpeg to 32 bit pcm on a pipe, at the rate
+// and channel count the headers say
+type ffmpegPCM struct {
+	*intPCM
+	cmd    *exec.Cmd
+	stderr *strings.Builder
+	done   bool
+}
+
+func openFFmpegPCM(path string, extension string) (pcmReader, error) {
+	properties, err := readAudioProperties(path, extension)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if properties.SampleRate == 0 || properties.Channels == 0 {
+		return nil, errors.New("no sample rate or channel count in the headers")
+	}
+
+	cmd := exec.Command("ffmpeg", "-v", "error", "-nostdin", "-i", path,
+		"-map", "0:a:0", "-ar", strconv.Itoa(properties.SampleRate), "-ac", strconv.Itoa(properties.Channels),
+		"-f", "s32le", "-c:a", "pcm_s32le", "-")
+
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	stderr := &strings.Builder{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	format := pcmFormat{SampleRate: properties.SampleRate, Channels: properties.Channels, BitDepth: 32}
+
+	return &ffmpegPCM{
+		intPCM: &intPCM{f: stdout, format: format, remaining: math.MaxInt64, buffer: make([]byte, 4096*format.Channels*4)},
+		cmd:    cmd,
+		stderr: stderr}, nil
+}
+
+// The end of the pipe is only the end of the audio if ffmpeg exited cleanly
+func (p *ffmpegPCM) Next() ([][]int32, error) {
+	block, err := p.intPCM.Next()
+
+	if err == io.EOF && !p.done {
+		p.done = true
+
+		if waitErr := p.cmd.Wait(); waitErr != nil {
+			return nil, errors.New("ffmpeg: " + waitErr.Error() + ": " + strings.TrimSpace(p.stderr.String()))
+		}
+	}
+
+	return block, err
+}
+
+func (p *ffmpegPCM) Close() error {
+	p.intPCM.Close()
+
+	if !p.done {
+		p.done = true
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+	}
+
+	return nil
+}
+
+// CRC32 of 16 bit stereo audio the way EAC and XLD log it, with and without
+// the null samples (EAC leaves them out unless told otherwise)
+func pcmCRC32(path string, extension string) (uint32, uint32, error) {
+	reader, err := openPCM(path, extension)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer reader.Close()
+
+	format := reader.Format()
+
+	if format.BitDepth != 16 || format.Channels != 2 {
+		return 0, 0, errors.New("not cd audio")
+	}
+
+	crc := crc32.NewIEEE()
+	skipZero := crc32.NewIEEE()
+
+	for {
+		block, err := reader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		buffer := make([]byte, 0, len(block[0])*4)
+		skipBuffer := make([]byte, 0, len(block[0])*4)
+
+		for i := range block[0] {
+			for c := 0; c < 2; c++ {
+				sample := uint16(block[c][i])
+				buffer = append(buffer, byte(sample), byte(sample>>8))
+
+				if sample != 0 {
+					skipBuffer = append(skipBuffer, byte(sample), byte(sample>>8))
+				}
+			}
+		}
+
+		crc.Write(buffer)
+		skipZero.Write(skipBuffer)
+	}
+
+	return crc.Sum32(), skipZero.Sum32(), nil
+}
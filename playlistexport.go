@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var playlistExportFormats = []string{"m3u", "m3u8", "pls", "xspf"}
+
+// Where an exported playlist will live and how its entries should point at
+// the files
+type playlistTarget struct {
+	Directory string // where the playlist is written, relative paths start here
+	Root      string // prefix for file paths, each file's own base if empty
+	Absolute  bool
+	Profile   syncProfile
+	Transcode bool // swap the extensions of files the profile transcodes
+}
+
+// Point at the local files, from a playlist written to directory
+func localPlaylistTarget(directory string, absolute bool) playlistTarget {
+	return playlistTarget{Directory: directory, Absolute: absolute}
+}
+
+// Point at the synced copies, from a playlist uploaded to directory
+func remotePlaylistTarget(directory string, absolute bool) playlistTarget {
+	_, profile, ok := activeSyncProfile()
+
+	return playlistTarget{Directory: directory, Root: conf.RemotePath, Absolute: absolute, Profile: profile, Transcode: ok}
+}
+
+// Where a file ends up for this target
+func (t playlistTarget) location(base string, filePath string, extension string) string {
+	root := t.Root
+
+	if len(root) == 0 {
+		root = base
+	}
+
+	if t.Transcode && t.Profile.transcodes(extension) {
+		filePath = replaceExtension(filePath, t.Profile.extension())
+	}
+
+	full := root + filePath
+
+	if t.Absolute {
+		return full
+	}
+
+	relative, err := filepath.Rel(t.Directory, full)
+
+	if err != nil {
+		return full
+	}
+
+	return filepath.ToSlash(relative)
+}
+
+// An entry with the file it resolved to and what its tags say
+type playlistExportRow struct {
+	PlaylistItem
+	Base               string
+	Path               string
+	ExtensionLowerCase string
+	TagTitle           string
+	TagArtist          string
+	FileDuration       float64
+}
+
+// The entries of a playlist rewritten for a target. Entries that never
+// resolved keep the location they were written with.
+func playlistExportEntries(db *gorm.DB, playlistID uint, target playlistTarget) []playlistEntry {
+	rows := make([]playlistExportRow, 0)
+
+	db.Table("playlist_items").
+		Select("playlist_items.*, files.base, files.path, files.extension_lower_case, "+
+			"tags.title AS tag_title, tags.artist AS tag_artist, audio_properties.duration AS file_duration").
+		Joins("LEFT JOIN files ON files.id = playlist_items.file_id").
+		Joins("LEFT JOIN tags ON tags.file_id = playlist_items.file_id").
+		Joins("LEFT JOIN audio_properties ON audio_properties.file_id = playlist_items.file_id").
+		Where("playlist_items.playlist_id = ?", playlistID).
+		Order("playlist_items.position").
+		Scan(&rows)
+
+	entries := make([]playlistEntry, 0, len(rows))
+
+	for _, row := range rows {
+		entry := playlistEntry{Location: row.Location, Title: row.Title, Artist: row.Artist, Duration: row.Duration}
+
+		// the file may have gone since the playlist was parsed
+		if row.FileID > 0 && len(row.Path) > 0 {
+			entry.Location = target.location(row.Base, row.Path, row.ExtensionLowerCase)
+
+			// the tags are more likely to be right than the playlist
+			if len(row.TagTitle) > 0 {
+				entry.Title = row.TagTitle
+				entry.Artist = row.TagArtist
+			}
+
+			if row.FileDuration > 0 {
+				entry.Duration = row.FileDuration
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// "Artist - Title", or just the title
+func joinArtistTitle(artist string, title string) string {
+	if len(artist) > 0 && len(title) > 0 {
+		return artist + " - " + title
+	}
+
+	return artist + title
+}
+
+// Whole seconds, -1 when unknown, as m3u and pls expect
+func playlistSeconds(duration float64) int {
+	if duration <= 0 {
+		return -1
+	}
+
+	return int(math.Round(duration))
+}
+
+// Extended m3u, always utf-8
+func renderM3U(name string, entries []playlistEntry) []byte {
+	var b bytes.Buffer
+
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#PLAYLIST:" + name + "\n")
+
+	for _, entry := range entries {
+		if info := joinArtistTitle(entry.Artist, entry.Title); len(info) > 0 || entry.Duration > 0 {
+			fmt.Fprintf(&b, "#EXTINF:%d,%s\n", playlistSeconds(entry.Duration), info)
+		}
+
+		b.WriteString(entry.Location + "\n")
+	}
+
+	return b.Bytes()
+}
+
+func renderPLS(entries []playlistEntry) []byte {
+	var b bytes.Buffer
+
+	b.WriteString("[playlist]\n")
+
+	for i, entry := range entries {
+		n := strconv.Itoa(i + 1)
+
+		b.WriteString("File" + n + "=" + entry.Location + "\n")
+
+		if info := joinArtistTitle(entry.Artist, entry.Title); len(info) > 0 {
+			b.WriteString("Title" + n + "=" + info + "\n")
+		}
+
+		b.WriteString("Length" + n + "=" + strconv.Itoa(playlistSeconds(entry.Duration)) + "\n")
+	}
+
+	b.WriteString("NumberOfEntries=" + strconv.Itoa(len(entries)) + "\n")
+	b.WriteString("Version=2\n")
+
+	return b.Bytes()
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Duration int64  `xml:"duration,omitempty"` // ms
+}
+
+type xspfDocument struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+// A path as a uri, file:// for absolute ones. Streams and other urls are
+// left alone.
+func xspfLocation(location string) string {
+	if strings.Contains(location, "://") {
+		return location
+	}
+
+	segments := strings.Split(location, "/")
+
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	escaped := strings.Join(segments, "/")
+
+	if strings.HasPrefix(location, "/") {
+		return "file://" + escaped
+	}
+
+	return escaped
+}
+
+func renderXSPF(name string, entries []playlistEntry) ([]byte, error) {
+	document := xspfDocument{Version: "1", Xmlns: "http://xspf.org/ns/0/", Title: name}
+
+	for _, entry := range entries {
+		track := xspfTrack{Location: xspfLocation(entry.Location), Title: entry.Title, Creator: entry.Artist}
+
+		if entry.Duration > 0 {
+			track.Duration = int64(math.Round(entry.Duration * 1000))
+		}
+
+		document.Tracks = append(document.Tracks, track)
+	}
+
+	b, err := xml.MarshalIndent(document, "", "  ")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
+
+// Write a playlist in any of the export formats
+func renderPlaylist(format string, name string, entries []playlistEntry) ([]byte, error) {
+	switch format {
+	case "m3u", "m3u8":
+		return renderM3U(name, entries), nil
+	case "pls":
+		return renderPLS(entries), nil
+	case "xspf":
+		return renderXSPF(name, entries)
+	}
+
+	return nil, fmt.Errorf("unknown playlist format `%s`", format)
+}
+
+// Render an imported playlist for a target
+func exportPlaylist(db *gorm.DB, playlist Playlist, format string, target playlistTarget) ([]byte, error) {
+	return renderPlaylist(format, playlist.Name, playlistExportEntries(db, playlist.ID, target))
+}
+
+// The imported playlist of a file, if it has been parsed
+func importedPlaylist(db *gorm.DB, file File) (Playlist, bool) {
+	playlist := Playlist{}
+
+	if !stringInSlice(file.ExtensionLowerCase, playlistExtensions) {
+		return playlist, false
+	}
+
+	if err := db.Where(&Playlist{FileID: file.ID}).First(&playlist).Error; err != nil {
+		return playlist, false
+	}
+
+	return playlist, true
+}
+
+// A playlist rewritten to point at the remote copies, with its format and
+// where it goes
+func renderRemotePlaylist(db *gorm.DB, file File, playlist Playlist) ([]byte, string, string, error) {
+	format := file.ExtensionLowerCase
+	relPath := file.Path
+
+	if len(conf.SyncPlaylistFormat) > 0 && conf.SyncPlaylistFormat != format {
+		format = conf.SyncPlaylistFormat
+		relPath = replaceExtension(relPath, format)
+	}
+
+	remoteFullPath := conf.RemotePath + relPath
+	target := remotePlaylistTarget(path.Dir(remoteFullPath), conf.SyncPlaylistPaths == "absolute")
+
+	b, err := exportPlaylist(db, playlist, format, target)
+
+	return b, format, remoteFullPath, err
+}
+
+// Upload a playlist rewritten to point at the remote copies, in place of
+// the original that points at local paths
+func syncPlaylistFile(file File, playlist Playlist, db *gorm.DB) error {
+	localFullPath := file.Base + file.Path
+
+	sourceMd5, err := hashFileMd5(localFullPath)
+
+	if err != nil {
+		return &SyncError{Op: "hash", Path: localFullPath, Err: err}
+	}
+
+	b, format, remoteFullPath, err := renderRemotePlaylist(db, file, playlist)
+
+	if err != nil {
+		return &SyncError{Op: "playlist", Path: localFullPath, Err: err}
+	}
+
+	// named by content, so an unchanged playlist is never written twice
+	md5 := HashStringMd5(string(b))
+	cachePath := filepath.Join("cache", "playlists", md5+"."+format)
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return &SyncError{Op: "playlist", Path: localFullPath, Err: err}
+	}
+
+	if err := os.WriteFile(cachePath, b, 0644); err != nil {
+		return &SyncError{Op: "playlist", Path: localFullPath, Err: err}
+	}
+
+	defer os.Remove(cachePath)
+
+	log.Println("S: " + localFullPath)
+	log.Println("D: " + remoteFullPath)
+
+	match, err := remoteFileMatchesMd5(remoteFullPath, md5)
+
+	if err != nil {
+		return &SyncError{Op: "match", Path: localFullPath, Err: err}
+	}
+
+	if match {
+		log.Println("Skipping playlist that already exists.")
+	} else {
+		if err := uploadPath(cachePath, remoteFullPath, int64(len(b))); err != nil {
+			return &SyncError{Op: "upload", Path: localFullPath, Err: err}
+		}
+
+		match, err = remoteFileMatchesMd5(remoteFullPath, md5)
+
+		if err != nil {
+			return &SyncError{Op: "verify", Path: localFullPath, Err: err}
+		}
+
+		if !match {
+			return &SyncError{Op: "verify", Path: localFullPath, Err: errChecksumMismatch}
+		}
+	}
+
+	file.Md5 = sourceMd5
+	file.VerifiedAt = time.Now()
+	db.Save(&file)
+
+	db.Model(&playlist).Update("synced_md5", md5)
+
+	return nil
+}
+
+// Sync playlists again when what they'd be rewritten to has changed, e.g an
+// entry was found or a file it points at moved. Playlists that were synced
+// as they are, before they were imported, have never had a rewritten copy
+// uploaded.
+func resyncChangedPlaylists(db *gorm.DB, hostName string) {
+	// encrypted remotes get the original file
+	if conf.EncryptRemote {
+		return
+	}
+
+	files := make([]File, 0)
+
+	db.Where(&File{HostName: hostName}).
+		Where("extension_lower_case IN ?", playlistExtensions).
+		Where("md5 <> ''").
+		Find(&files)
+
+	for _, file := range files {
+		playlist, ok := importedPlaylist(db, file)
+
+		if !ok {
+			continue
+		}
+
+		if len(playlist.SyncedMd5) > 0 {
+			b, _, _, err := renderRemotePlaylist(db, file, playlist)
+
+			if err != nil || HashStringMd5(string(b)) == playlist.SyncedMd5 {
+				continue
+			}
+		}
+
+		db.Model(&File{}).Where("id = ?", file.ID).Update("md5", "")
+	}
+}
+
+// playlists export <id> [--format m3u8 --out file --absolute --remote]
+func exportPlaylistCommand(db *gorm.DB, args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: playlists export <id> [--format m3u8|pls|xspf] [--out file] [--absolute] [--remote]")
+		os.Exit(1)
+	}
+
+	id, err := strconv.Atoi(args[0])
+
+	if err != nil {
+		fmt.Println("`" + args[0] + "` isn't a playlist id")
+		os.Exit(1)
+	}
+
+	flags := flag.NewFlagSet("playlists export", flag.ExitOnError)
+	format := flags.String("format", "m3u8", "m3u, m3u8, pls or xspf")
+	out := flags.String("out", "", "write to this file instead of stdout")
+	absolute := flags.Bool("absolute", false, "absolute paths instead of relative to the playlist")
+	remote := flags.Bool("remote", false, "point at the synced copies under remotePath")
+	flags.Parse(args[1:])
+
+	if !stringInSlice(*format, playlistExportFormats) {
+		fmt.Println("`" + *format + "` isn't one of " + strings.Join(playlistExportFormats, ", "))
+		os.Exit(1)
+	}
+
+	playlist := Playlist{}
+	file := File{}
+
+	if err := db.First(&playlist, id).Error; err != nil {
+		fmt.Println("No playlist with id " + args[0])
+		os.Exit(1)
+	}
+
+	db.First(&file, playlist.FileID)
+
+	// relative paths start from wherever the playlist ends up
+	directory := path.Dir(file.Base + file.Path)
+
+	if len(*out) > 0 {
+		directory, _ = filepath.Abs(filepath.Dir(*out))
+	}
+
+	target := localPlaylistTarget(directory, *absolute)
+
+	if *remote {
+		target = remotePlaylistTarget(path.Dir(conf.RemotePath+file.Path), *absolute)
+	}
+
+	b, err := exportPlaylist(db, playlist, *format, target)
+
+	if err != nil {
+		panic(err) // unknown format, checked above
+	}
+
+	if len(*out) == 0 {
+		os.Stdout.Write(b)
+		return
+	}
+
+	if err := os.WriteFile(*out, b, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPlaylistTargetLocation(t *testing.T) {
+	opus := syncProfile{Formats: []string{"flac", "wav"}, Format: "opus"}
+
+	tests := []struct {
+		name      string
+		target    playlistTarget
+		path      string
+		extension string
+		want      string
+	}{
+		{
+			name:      "local, next to the playlist",
+			target:    playlistTarget{Directory: "/music/Donk"},
+			path:      "Donk/a.mp3",
+			extension: "mp3",
+			want:      "a.mp3",
+		},
+		{
+			name:      "local, relative to the playlist",
+			target:    playlistTarget{Directory: "/music/Mixes"},
+			path:      "Donk/Best Of/a.mp3",
+			extension: "mp3",
+			want:      "../Donk/Best Of/a.mp3",
+		},
+		{
+			name:      "local, absolute",
+			target:    playlistTarget{Directory: "/music/Mixes", Absolute: true},
+			path:      "Donk/a.mp3",
+			extension: "mp3",
+			want:      "/music/Donk/a.mp3",
+		},
+		{
+			name:      "remote, relative",
+			target:    playlistTarget{Directory: "/srv/sync/Mixes", Root: "/srv/sync/"},
+			path:      "Donk/a.mp3",
+			extension: "mp3",
+			want:      "../Donk/a.mp3",
+		},
+		{
+			name:      "remote, absolute",
+			target:    playlistTarget{Directory: "/srv/sync/Mixes", Root: "/srv/sync/", Absolute: true},
+			path:      "Donk/a.mp3",
+			extension: "mp3",
+			want:      "/srv/sync/Donk/a.mp3",
+		},
+		{
+			name:      "transcoded extension swapped",
+			target:    playlistTarget{Directory: "/srv/sync/Mixes", Root: "/srv/sync/", Profile: opus, Transcode: true},
+			path:      "Donk/a.flac",
+			extension: "flac",
+			want:      "../Donk/a.opus",
+		},
+		{
+			name:      "files the profile copies keep their extension",
+			target:    playlistTarget{Directory: "/srv/sync/Mixes", Root: "/srv/sync/", Absolute: true, Profile: opus, Transcode: true},
+			path:      "Donk/a.mp3",
+			extension: "mp3",
+			want:      "/srv/sync/Donk/a.mp3",
+		},
+		{
+			name:      "no swap without an active profile",
+			target:    playlistTarget{Directory: "/srv/sync/Mixes", Root: "/srv/sync/", Absolute: true, Profile: opus},
+			path:      "Donk/a.flac",
+			extension: "flac",
+			want:      "/srv/sync/Donk/a.flac",
+		},
+	}
+
+	for _, test := range tests {
+		if got := test.target.location("/music/", test.path, test.extension); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// An entry with everything, one with only a location and a stream
+func exportEntries() []playlistEntry {
+	return []playlistEntry{
+		{Location: "../Donk/a b.mp3", Artist: "Klubbheads", Title: "Klubbhopping", Duration: 215.6},
+		{Location: "/music/Donk/Déjà #1.flac"},
+		{Location: "http://stream.example/live", Title: "Radio"},
+	}
+}
+
+func TestRenderM3U(t *testing.T) {
+	want := `#EXTM3U
+#PLAYLIST:Friday
+#EXTINF:216,Klubbheads - Klubbhopping
+../Donk/a b.mp3
+/music/Donk/Déjà #1.flac
+#EXTINF:-1,Radio
+http://stream.example/live
+`
+
+	if got := string(renderM3U("Friday", exportEntries())); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRenderPLS(t *testing.T) {
+	want := `[playlist]
+File1=../Donk/a b.mp3
+Title1=Klubbheads - Klubbhopping
+Length1=216
+File2=/music/Donk/Déjà #1.flac
+Length2=-1
+File3=http://stream.example/live
+Title3=Radio
+Length3=-1
+NumberOfEntries=3
+Version=2
+`
+
+	if got := string(renderPLS(exportEntries())); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestXSPFLocation(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "a.mp3", want: "a.mp3"},
+		{in: "../Donk/a b.mp3", want: "../Donk/a%20b.mp3"},
+		{in: "/music/Donk/Déjà #1.flac", want: "file:///music/Donk/D%C3%A9j%C3%A0%20%231.flac"},
+		{in: "/music/100%/a?.mp3", want: "file:///music/100%25/a%3F.mp3"},
+		{in: "http://stream.example/live", want: "http://stream.example/live"},
+	}
+
+	for _, test := range tests {
+		if got := xspfLocation(test.in); got != test.want {
+			t.Errorf("xspfLocation(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRenderXSPF(t *testing.T) {
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <title>Fish &amp; Chips</title>
+  <trackList>
+    <track>
+      <location>../Donk/a%20b.mp3</location>
+      <title>Klubbhopping</title>
+      <creator>Klubbheads</creator>
+      <duration>215600</duration>
+    </track>
+    <track>
+      <location>file:///music/Donk/D%C3%A9j%C3%A0%20%231.flac</location>
+    </track>
+    <track>
+      <location>http://stream.example/live</location>
+      <title>Radio</title>
+    </track>
+  </trackList>
+</playlist>
+`
+
+	got, err := renderXSPF("Fish & Chips", exportEntries())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// and it reads back the same
+	title, entries, err := parseXSPF(got)
+
+	if err != nil || title != "Fish & Chips" || len(entries) != 3 || entries[0].Duration != 215.6 {
+		t.Errorf("parseXSPF = %q, %+v, %v", title, entries, err)
+	}
+}
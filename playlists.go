@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Playlist is an .m3u, .m3u8, .pls or .xspf file in the library
+type Playlist struct {
+	ID         uint      `json:"id"`
+	FileID     uint      `gorm:"uniqueIndex" json:"fileId"`
+	SourceHash string    `gorm:"size:32" json:"-"` // imohash of the file when it was parsed
+	Name       string    `json:"name"`
+	Format     string    `gorm:"size:8" json:"format"` // m3u, pls or xspf
+	ItemCount  int       `json:"itemCount"`
+	Resolved   int       `json:"resolved"`
+	Unresolved int       `gorm:"index" json:"unresolved"`
+	SyncedMd5  string    `gorm:"size:32" json:"-"` // md5 of the rewritten playlist last uploaded
+	Library    string    `gorm:"size:64" json:"-"` // playlistLibraryState when the entries were resolved
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+// PlaylistItem is one entry of a playlist and the file it points at, if it
+// could be found
+type PlaylistItem struct {
+	ID         uint      `json:"id"`
+	PlaylistID uint      `gorm:"uniqueIndex:idx_playlist_item_position" json:"playlistId"`
+	Position   int       `gorm:"uniqueIndex:idx_playlist_item_position" json:"position"` // from 1
+	Location   string    `gorm:"type:text" json:"location"`                              // as written in the playlist
+	Title      string    `json:"title"`
+	Artist     string    `json:"artist"`
+	Duration   float64   `json:"duration"` // seconds, 0 if it didn't say
+	FileID     uint      `gorm:"index" json:"fileId"`
+	Match      string    `gorm:"size:8" json:"match"` // path, case, suffix, tag or stream, empty if unresolved
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+var playlistExtensions = []string{"m3u", "m3u8", "pls", "xspf"}
+
+// An entry as read from a playlist file
+type playlistEntry struct {
+	Location string
+	Title    string
+	Artist   string
+	Duration float64
+}
+
+// Split "Artist - Title"
+func splitArtistTitle(s string) (string, string) {
+	if parts := strings.SplitN(s, " - ", 2); len(parts) == 2 {
+		return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	}
+
+	return "", strings.TrimSpace(s)
+}
+
+// Extended m3u, #EXTINF:duration,Artist - Title before each location
+func parseM3U(text string) (string, []playlistEntry) {
+	name := ""
+	entries := make([]playlistEntry, 0)
+	next := playlistEntry{}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case len(line) == 0:
+		case strings.HasPrefix(line, "#PLAYLIST:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "#PLAYLIST:"))
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info := strings.TrimPrefix(line, "#EXTINF:")
+			comma := strings.Index(info, ",")
+
+			if comma < 0 {
+				continue
+			}
+
+			// the duration can be followed by attributes, key="value"
+			if fields := strings.Fields(info[:comma]); len(fields) > 0 {
+				duration, _ := strconv.ParseFloat(fields[0], 64)
+				next.Duration = math.Max(0, duration)
+			}
+
+			next.Artist, next.Title = splitArtistTitle(info[comma+1:])
+		case strings.HasPrefix(line, "#"):
+		default:
+			next.Location = line
+			entries = append(entries, next)
+			next = playlistEntry{}
+		}
+	}
+
+	return name, entries
+}
+
+// [playlist] with File1=, Title1=, Length1=
+func parsePLS(text string) []playlistEntry {
+	byNumber := make(map[int]*playlistEntry)
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		for _, field := range []string{"file", "title", "length"} {
+			if !strings.HasPrefix(key, field) {
+				continue
+			}
+
+			n, err := strconv.Atoi(key[len(field):])
+
+			if err != nil {
+				continue
+			}
+
+			if byNumber[n] == nil {
+				byNumber[n] = &playlistEntry{}
+			}
+
+			switch field {
+			case "file":
+				byNumber[n].Location = value
+			case "title":
+				byNumber[n].Artist, byNumber[n].Title = splitArtistTitle(value)
+			case "length":
+				duration, _ := strconv.ParseFloat(value, 64)
+				byNumber[n].Duration = math.Max(0, duration)
+			}
+		}
+	}
+
+	numbers := make([]int, 0, len(byNumber))
+
+	for n, entry := range byNumber {
+		if len(entry.Location) > 0 {
+			numbers = append(numbers, n)
+		}
+	}
+
+	sort.Ints(numbers)
+
+	entries := make([]playlistEntry, 0, len(numbers))
+
+	for _, n := range numbers {
+		entries = append(entries, *byNumber[n])
+	}
+
+	return entries
+}
+
+type xspfPlaylist struct {
+	Title  string `xml:"title"`
+	Tracks []struct {
+		Location []string `xml:"location"`
+		Title    string   `xml:"title"`
+		Creator  string   `xml:"creator"`
+		Duration int64    `xml:"duration"` // ms
+	} `xml:"trackList>track"`
+}
+
+func parseXSPF(b []byte) (string, []playlistEntry, error) {
+	playlist := xspfPlaylist{}
+
+	if err := xml.Unmarshal(b, &playlist); err != nil {
+		return "", nil, err
+	}
+
+	entries := make([]playlistEntry, 0, len(playlist.Tracks))
+
+	for _, track := range playlist.Tracks {
+		entry := playlistEntry{Title: track.Title, Artist: track.Creator, Duration: float64(track.Duration) / 1000}
+
+		if len(track.Location) > 0 {
+			entry.Location = strings.TrimSpace(track.Location[0])
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return playlist.Title, entries, nil
+}
+
+var drivePattern = regexp.MustCompile(`^/?[A-Za-z]:/`)
+
+// Turn a playlist location into a path with / separators. Absolute is set
+// for paths from the root of some disk, ok is false for streams.
+func playlistLocation(location string) (string, bool, bool) {
+	if strings.HasPrefix(strings.ToLower(location), "file:") {
+		if u, err := url.Parse(location); err == nil && len(u.Path) > 0 {
+			location = u.Path
+		} else {
+			location = strings.TrimPrefix(location[5:], "//")
+		}
+	} else if strings.Contains(location, "://") {
+		return "", false, false
+	}
+
+	location = strings.ReplaceAll(location, `\`, "/")
+
+	// C:/Music/... or /C:/Music/... from a file url
+	if drive := drivePattern.FindString(location); len(drive) > 0 {
+		return "/" + location[len(drive):], true, true
+	}
+
+	// \\server\share
+	if strings.HasPrefix(location, "//") {
+		return location[1:], true, true
+	}
+
+	return location, strings.HasPrefix(location, "/"), true
+}
+
+// Lower case and composed, so café from a mac matches café from anywhere
+func foldPath(s string) string {
+	return strings.ToLower(norm.NFC.String(s))
+}
+
+var bracketsPattern = regexp.MustCompile(`[(\[][^)\]]*[)\]]`)
+var trackNumberPattern = regexp.MustCompile(`^\d{1,3}\s*[-._ ]\s*`)
+
+// Only the letters and digits of a title or artist, without anything in
+// brackets, e.g "Song (Radio Edit)" and "song" are the same
+func foldTagValue(s string) string {
+	s = bracketsPattern.ReplaceAllString(foldPath(s), "")
+
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+
+		return -1
+	}, s)
+}
+
+// Every audio file on a host, looked up the ways a playlist might point
+// at one
+type playlistResolver struct {
+	base      string
+	byPath    map[string]File
+	byFolded  map[string]File
+	byName    map[string][]File
+	byTag     map[string][]File
+	byTitle   map[string][]File
+	durations map[uint]float64
+}
+
+func newPlaylistResolver(db *gorm.DB, hostName string) *playlistResolver {
+	resolver := &playlistResolver{
+		base:      foldPath(conf.SearchDirectory),
+		byPath:    make(map[string]File),
+		byFolded:  make(map[string]File),
+		byName:    make(map[string][]File),
+		byTag:     make(map[string][]File),
+		byTitle:   make(map[string][]File),
+		durations: make(map[uint]float64)}
+
+	localFiles := db.Model(&File{}).Select("id").Where(&File{HostName: hostName}).Where("extension_lower_case IN ?", audioExtensions)
+
+	files := make([]File, 0)
+	db.Where("id IN (?)", localFiles).Find(&files)
+
+	filesByID := make(map[uint]File)
+
+	for _, file := range files {
+		filesByID[file.ID] = file
+		resolver.byPath[file.Path] = file
+		resolver.byFolded[foldPath(file.Path)] = file
+
+		name := foldPath(path.Base(file.Path))
+		resolver.byName[name] = append(resolver.byName[name], file)
+	}
+
+	tags := make([]Tag, 0)
+	db.Where("file_id IN (?)", localFiles).Find(&tags)
+
+	for _, t := range tags {
+		title := foldTagValue(t.Title)
+
+		if len(title) == 0 {
+			continue
+		}
+
+		file := filesByID[t.FileID]
+		resolver.byTitle[title] = append(resolver.byTitle[title], file)
+
+		if artist := foldTagValue(t.Artist); len(artist) > 0 {
+			resolver.byTag[artist+"\x00"+title] = append(resolver.byTag[artist+"\x00"+title], file)
+		}
+	}
+
+	properties := make([]AudioProperties, 0)
+	db.Where("file_id IN (?)", localFiles).Find(&properties)
+
+	for _, props := range properties {
+		resolver.durations[props.FileID] = props.Duration
+	}
+
+	return resolver
+}
+
+// A relative path, exactly or ignoring case
+func (r *playlistResolver) lookup(p string) (File, string, bool) {
+	if file, ok := r.byPath[p]; ok {
+		return file, "path", true
+	}
+
+	if file, ok := r.byFolded[foldPath(p)]; ok {
+		return file, "case", true
+	}
+
+	return File{}, "", false
+}
+
+// The file whose path ends with the most of the same directories, when
+// there is only one
+func (r *playlistResolver) suffix(p string, directory string) (File, bool) {
+	parts := strings.Split(foldPath(p), "/")
+	best := 0
+	matches := make([]File, 0)
+
+	for _, file := range r.byName[parts[len(parts)-1]] {
+		candidate := strings.Split(foldPath(file.Path), "/")
+		common := 0
+
+		for common < len(parts) && common < len(candidate) && parts[len(parts)-1-common] == candidate[len(candidate)-1-common] {
+			common++
+		}
+
+		if common > best {
+			best = common
+			matches = matches[:0]
+		}
+
+		if common == best {
+			matches = append(matches, file)
+		}
+	}
+
+	if len(matches) == 1 {
+		return matches[0], true
+	}
+
+	// only the name matched, but one of them is next to the playlist
+	if best > 0 {
+		for _, file := range matches {
+			if path.Dir(file.Path) == directory {
+				return file, true
+			}
+		}
+	}
+
+	return File{}, false
+}
+
+// The file with the same artist and title, closest in length if there's
+// more than one
+func (r *playlistResolver) tag(entry playlistEntry, location string) (File, bool) {
+	artist, title := entry.Artist, entry.Title
+
+	// Artist - Title.mp3, maybe after a track number
+	if len(title) == 0 && len(location) > 0 {
+		name := strings.TrimSuffix(path.Base(location), path.Ext(location))
+		artist, title = splitArtistTitle(trackNumberPattern.ReplaceAllString(name, ""))
+	}
+
+	candidates := r.byTag[foldTagValue(artist)+"\x00"+foldTagValue(title)]
+
+	// no artist to go on, only take a title that's unique
+	if len(foldTagValue(artist)) == 0 {
+		candidates = r.byTitle[foldTagValue(title)]
+
+		if len(candidates) != 1 {
+			return File{}, false
+		}
+	}
+
+	if len(candidates) == 0 {
+		return File{}, false
+	}
+
+	best := candidates[0]
+
+	if entry.Duration > 0 {
+		for _, file := range candidates {
+			if math.Abs(r.durations[file.ID]-entry.Duration) < math.Abs(r.durations[best.ID]-entry.Duration) {
+				best = file
+			}
+		}
+	}
+
+	return best, true
+}
+
+// Find the file an entry points at. directory is where the playlist is,
+// relative to the search directory like File.Path.
+func (r *playlistResolver) resolve(directory string, entry playlistEntry) (File, string, bool) {
+	location, absolute, ok := playlistLocation(entry.Location)
+
+	if ok && len(location) > 0 {
+		candidates := make([]string, 0)
+
+		if absolute {
+			// from this search directory, on this machine
+			if folded := foldPath(location); strings.HasPrefix(folded, r.base) {
+				candidates = append(candidates, folded[len(r.base):])
+			}
+		} else {
+			candidates = append(candidates, strings.TrimPrefix(path.Join(directory, location), "./"))
+		}
+
+		for _, candidate := range candidates {
+			if file, match, ok := r.lookup(candidate); ok {
+				return file, match, true
+			}
+		}
+
+		if file, ok := r.suffix(location, directory); ok {
+			return file, "suffix", true
+		}
+	}
+
+	if file, ok := r.tag(entry, location); ok {
+		return file, "tag", true
+	}
+
+	return File{}, "", false
+}
+
+// Read a playlist file into entries
+func readPlaylist(file File) (string, string, []playlistEntry, error) {
+	b, err := os.ReadFile(file.Base + file.Path)
+
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	name := strings.TrimSuffix(path.Base(file.Path), path.Ext(file.Path))
+
+	switch file.ExtensionLowerCase {
+	case "pls":
+		return name, "pls", parsePLS(decodeLogText(b)), nil
+	case "xspf":
+		title, entries, err := parseXSPF(b)
+
+		if len(title) > 0 {
+			name = title
+		}
+
+		return name, "xspf", entries, err
+	}
+
+	title, entries := parseM3U(decodeLogText(b))
+
+	if len(title) > 0 {
+		name = title
+	}
+
+	return name, "m3u", entries, nil
+}
+
+// Parse a playlist and resolve every entry
+func parsePlaylistToDb(db *gorm.DB, resolver *playlistResolver, file File, sourceHash string, library string) error {
+	name, format, entries, err := readPlaylist(file)
+
+	if err != nil {
+		return err
+	}
+
+	playlist := Playlist{FileID: file.ID}
+	db.Where(&Playlist{FileID: file.ID}).FirstOrInit(&playlist)
+
+	playlist.SourceHash = sourceHash
+	playlist.Library = library
+	playlist.Name = name
+	playlist.Format = format
+	playlist.ItemCount = len(entries)
+	playlist.Resolved = 0
+	playlist.Unresolved = 0
+
+	items := make([]PlaylistItem, 0, len(entries))
+	directory := path.Dir(file.Path)
+
+	for i, entry := range entries {
+		item := PlaylistItem{
+			Position: i + 1,
+			Location: entry.Location,
+			Title:    entry.Title,
+			Artist:   entry.Artist,
+			Duration: entry.Duration}
+
+		// internet radio, there's no file to find
+		if _, _, ok := playlistLocation(entry.Location); !ok {
+			item.Match = "stream"
+		} else if audio, match, ok := resolver.resolve(directory, entry); ok {
+			item.FileID = audio.ID
+			item.Match = match
+			playlist.Resolved++
+		} else {
+			playlist.Unresolved++
+		}
+
+		items = append(items, item)
+	}
+
+	db.Save(&playlist)
+
+	for i := range items {
+		items[i].PlaylistID = playlist.ID
+	}
+
+	if len(items) > 0 {
+		db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "playlist_id"}, {Name: "position"}},
+			UpdateAll: true}).CreateInBatches(&items, 500)
+	}
+
+	db.Where(&PlaylistItem{PlaylistID: playlist.ID}).Where("position > ?", len(items)).Delete(&PlaylistItem{})
+
+	return nil
+}
+
+// The audio files on a host as far as resolving playlists goes. Changes
+// when files are added or removed or their tags are read again.
+func playlistLibraryState(db *gorm.DB, hostName string) string {
+	state := ""
+
+	db.Table("files").
+		Select("CONCAT(COUNT(*), '-', COALESCE(MAX(files.id), 0), '-', COALESCE(UNIX_TIMESTAMP(MAX(tags.updated_at)), 0))").
+		Joins("LEFT JOIN tags ON tags.file_id = files.id").
+		Where("files.host_name = ?", hostName).
+		Where("files.extension_lower_case IN ?", audioExtensions).
+		Row().Scan(&state)
+
+	return state
+}
+
+// Parse every playlist on this host that is new or has changed, and resolve
+// them all again when the audio files they could point at have changed
+func parsePlaylists(db *gorm.DB, hostName string) {
+	files := make([]File, 0)
+	db.Where(&File{HostName: hostName}).Where("extension_lower_case IN ?", playlistExtensions).Find(&files)
+
+	library := playlistLibraryState(db, hostName)
+
+	// loading every file and tag is slow, only when something needs it
+	var resolver *playlistResolver
+
+	for _, file := range files {
+		sourceHash, err := hashFileImo(file.Base + file.Path)
+
+		if err != nil {
+			log.Println("Could not read `" + file.Path + "`: " + err.Error())
+			recordParseError(db, file, "read", "", err)
+			continue
+		}
+
+		var count int64
+		db.Model(&Playlist{}).Where(&Playlist{FileID: file.ID, SourceHash: sourceHash, Library: library}).Count(&count)
+
+		if count > 0 {
+			continue
+		}
+
+		if resolver == nil {
+			resolver = newPlaylistResolver(db, hostName)
+		}
+
+		if err := parsePlaylistToDb(db, resolver, file, sourceHash, library); err != nil {
+			log.Println("Could not parse playlist `" + file.Path + "`: " + err.Error())
+			recordParseError(db, file, "playlist", sourceHash, err)
+		} else {
+			clearParseError(db, file, "playlist")
+		}
+	}
+
+	// playlists whose file has gone
+	db.Where("file_id NOT IN (?)", db.Model(&File{}).Select("id")).Delete(&Playlist{})
+	db.Where("playlist_id NOT IN (?)", db.Model(&Playlist{}).Select("id")).Delete(&PlaylistItem{})
+
+	resyncChangedPlaylists(db, hostName)
+}
+
+// A playlist with where its file is
+type playlistRow struct {
+	Playlist
+	Path string `json:"path"`
+}
+
+func findPlaylists(db *gorm.DB, path string, unresolved bool) []playlistRow {
+	rows := make([]playlistRow, 0)
+
+	query := db.Table("playlists").
+		Select("playlists.*, files.path").
+		Joins("JOIN files ON files.id = playlists.file_id")
+
+	if len(path) > 0 {
+		query = query.Where("files.path LIKE ?", "%"+escapeLike(path)+"%")
+	}
+
+	if unresolved {
+		query = query.Where("playlists.unresolved > 0")
+	}
+
+	query.Order("files.path").Scan(&rows)
+
+	return rows
+}
+
+// An entry with the path of the file it resolved to
+type playlistItemRow struct {
+	PlaylistItem
+	Path string `json:"path"`
+}
+
+func findPlaylistItems(db *gorm.DB, playlistID uint) []playlistItemRow {
+	rows := make([]playlistItemRow, 0)
+
+	db.Table("playlist_items").
+		Select("playlist_items.*, files.path").
+		Joins("LEFT JOIN files ON files.id = playlist_items.file_id").
+		Where("playlist_items.playlist_id = ?", playlistID).
+		Order("playlist_items.position").
+		Scan(&rows)
+
+	return rows
+}
+
+// playlists import, playlists show <id>, or list playlists and the entries
+// that couldn't be found
+func playlists(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&Playlist{})
+	db.AutoMigrate(&PlaylistItem{})
+	db.AutoMigrate(&ParseError{})
+
+	if len(args) > 0 && args[0] == "import" {
+		hostName, err := os.Hostname()
+
+		if err != nil {
+			panic(err) // could not get local hostname
+		}
+
+		parsePlaylists(db, hostName)
+
+		return
+	}
+
+	if len(args) > 0 && args[0] == "export" {
+		exportPlaylistCommand(db, args[1:])
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	if len(args) > 1 && args[0] == "show" {
+		id, err := strconv.Atoi(args[1])
+
+		if err != nil {
+			fmt.Println("`" + args[1] + "` isn't a playlist id")
+			os.Exit(1)
+		}
+
+		fmt.Fprintln(w, "#\tMATCH\tFILE\tLOCATION\tPATH")
+
+		for _, item := range findPlaylistItems(db, uint(id)) {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", item.Position, item.Match, item.FileID, item.Location, item.Path)
+		}
+
+		w.Flush()
+
+		return
+	}
+
+	flags := flag.NewFlagSet("playlists", flag.ExitOnError)
+	path := flags.String("path", "", "only playlists with paths containing this")
+	unresolved := flags.Bool("unresolved", false, "list the entries that couldn't be found")
+	flags.Parse(args)
+
+	if *unresolved {
+		fmt.Fprintln(w, "PLAYLIST\t#\tLOCATION\tARTIST\tTITLE")
+
+		for _, playlist := range findPlaylists(db, *path, true) {
+			for _, item := range findPlaylistItems(db, playlist.ID) {
+				if item.FileID == 0 {
+					fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", playlist.Path, item.Position, item.Location, item.Artist, item.Title)
+				}
+			}
+		}
+
+		w.Flush()
+
+		return
+	}
+
+	fmt.Fprintln(w, "ID\tNAME\tFORMAT\tITEMS\tRESOLVED\tUNRESOLVED\tPATH")
+
+	for _, playlist := range findPlaylists(db, *path, false) {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			playlist.ID,
+			playlist.Name,
+			playlist.Format,
+			playlist.ItemCount,
+			playlist.Resolved,
+			playlist.Unresolved,
+			playlist.Path)
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseM3U(t *testing.T) {
+	name, entries := parseM3U(`#EXTM3U
+#PLAYLIST:Friday
+#EXTINF:123,AC/DC - Hells Bells
+Music\AC-DC\01 Hells Bells.flac
+
+#EXTINF:-1 tvg-id="x",Untitled
+http://stream.example/live
+# a comment
+plain.mp3
+`)
+
+	if name != "Friday" {
+		t.Errorf("name = %q, want Friday", name)
+	}
+
+	want := []playlistEntry{
+		{Location: `Music\AC-DC\01 Hells Bells.flac`, Artist: "AC/DC", Title: "Hells Bells", Duration: 123},
+		{Location: "http://stream.example/live", Title: "Untitled"},
+		{Location: "plain.mp3"},
+	}
+
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %+v, want %+v", entries, want)
+	}
+}
+
+func TestParsePLS(t *testing.T) {
+	entries := parsePLS(`[playlist]
+File2=b.mp3
+Title2=Two
+File1=a.mp3
+Title1=Artist - One
+Length1=61
+Length3=5
+NumberOfEntries=2
+Version=2
+`)
+
+	want := []playlistEntry{
+		{Location: "a.mp3", Artist: "Artist", Title: "One", Duration: 61},
+		{Location: "b.mp3", Title: "Two"},
+	}
+
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %+v, want %+v", entries, want)
+	}
+}
+
+func TestParseXSPF(t *testing.T) {
+	title, entries, err := parseXSPF([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <title>Mix</title>
+  <trackList>
+    <track>
+      <location> file:///music/a.flac </location>
+      <location>file:///backup/a.flac</location>
+      <title>One</title>
+      <creator>Artist</creator>
+      <duration>61500</duration>
+    </track>
+    <track>
+      <title>No location</title>
+    </track>
+  </trackList>
+</playlist>`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if title != "Mix" {
+		t.Errorf("title = %q, want Mix", title)
+	}
+
+	want := []playlistEntry{
+		{Location: "file:///music/a.flac", Title: "One", Artist: "Artist", Duration: 61.5},
+		{Title: "No location"},
+	}
+
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %+v, want %+v", entries, want)
+	}
+
+	if _, _, err := parseXSPF([]byte("<playlist>")); err == nil {
+		t.Error("broken xml didn't error")
+	}
+}
+
+func TestPlaylistLocation(t *testing.T) {
+	tests := []struct {
+		in           string
+		want         string
+		wantAbsolute bool
+		wantOk       bool
+	}{
+		{in: "Music/a.mp3", want: "Music/a.mp3", wantOk: true},
+		{in: `..\a.mp3`, want: "../a.mp3", wantOk: true},
+		{in: "/home/me/a.mp3", want: "/home/me/a.mp3", wantAbsolute: true, wantOk: true},
+		{in: `C:\Music\a.mp3`, want: "/Music/a.mp3", wantAbsolute: true, wantOk: true},
+		{in: "file:///C:/Music/a%20b.mp3", want: "/Music/a b.mp3", wantAbsolute: true, wantOk: true},
+		{in: "file:///home/me/a.mp3", want: "/home/me/a.mp3", wantAbsolute: true, wantOk: true},
+		{in: `\\server\share\a.mp3`, want: "/server/share/a.mp3", wantAbsolute: true, wantOk: true},
+		{in: "http://stream.example/live", wantOk: false},
+	}
+
+	for _, test := range tests {
+		got, absolute, ok := playlistLocation(test.in)
+
+		if got != test.want || absolute != test.wantAbsolute || ok != test.wantOk {
+			t.Errorf("playlistLocation(%q) = %q, %v, %v, want %q, %v, %v", test.in, got, absolute, ok, test.want, test.wantAbsolute, test.wantOk)
+		}
+	}
+}
+
+func TestFoldTagValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "Song (Radio Edit)", want: "song"},
+		{in: "AC/DC", want: "acdc"},
+		{in: "Café [Live]", want: "café"},
+		{in: "Cafe\u0301", want: "café"},
+	}
+
+	for _, test := range tests {
+		if got := foldTagValue(test.in); got != test.want {
+			t.Errorf("foldTagValue(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
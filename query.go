@@ -0,0 +1,697 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// A field that can be filtered and ordered on, e.g genre or bpm
+type queryField struct {
+	Column string // sql, never anything from the query itself
+	Kind   string // text, number, time or key
+	Table  string // joined only when used, empty for the ones that always are
+}
+
+var queryFields = map[string]queryField{
+	"path":        {"files.path", "text", ""},
+	"filename":    {"files.file_name", "text", ""},
+	"format":      {"files.extension_lower_case", "text", ""},
+	"size":        {"files.file_size_bytes", "number", ""},
+	"host":        {"files.host_name", "text", ""},
+	"added":       {"files.created_at", "time", ""},
+	"audiostatus": {"files.audio_status", "text", ""},
+	"title":       {"tags.title", "text", ""},
+	"artist":      {"tags.artist", "text", ""},
+	"album":       {"tags.album", "text", ""},
+	"albumartist": {"tags.album_artist", "text", ""},
+	"composer":    {"tags.composer", "text", ""},
+	"genre":       {"tags.genre", "text", ""},
+	"year":        {"CAST(LEFT(tags.year, 4) AS UNSIGNED)", "number", ""}, // text, "2004" or "2004-05-01"
+	"label":       {"tags.label", "text", ""},
+	"track":       {"tags.track_number", "number", ""},
+	"disc":        {"tags.disc_number", "number", ""},
+	"bpm":         {"COALESCE(NULLIF(tags.bpm, 0), bpm_keys.bpm)", "number", ""}, // tagged, or detected by bpmkey scan
+	"key":         {"bpm_keys.camelot", "key", ""},
+	"codec":       {"audio_properties.codec", "text", ""},
+	"duration":    {"audio_properties.duration", "number", ""},
+	"bitrate":     {"audio_properties.bitrate", "number", ""},
+	"mode":        {"audio_properties.bitrate_mode", "text", ""},
+	"samplerate":  {"audio_properties.sample_rate", "number", ""},
+	"bitdepth":    {"audio_properties.bit_depth", "number", ""},
+	"channels":    {"audio_properties.channels", "number", ""},
+	"loudness":    {"track_loudnesses.integrated", "number", "track_loudnesses"},
+	"spectrum":    {"spectrum_analyses.verdict", "text", "spectrum_analyses"},
+	"health":      {"mp3_healths.status", "text", "mp3_healths"},
+}
+
+// Everything outside files is LEFT JOINed, NULL when a file has no row
+func (f queryField) nullable() bool {
+	return !strings.HasPrefix(f.Column, "files.")
+}
+
+// Tables only some fields need
+var queryJoins = map[string]string{
+	"track_loudnesses":  "LEFT JOIN track_loudnesses ON track_loudnesses.file_id = files.id",
+	"spectrum_analyses": "LEFT JOIN spectrum_analyses ON spectrum_analyses.file_id = files.id",
+	"mp3_healths":       "LEFT JOIN mp3_healths ON mp3_healths.file_id = files.id",
+}
+
+// What a word on its own is looked for in
+var queryTextColumns = []string{"files.path", "tags.artist", "tags.title", "tags.album"}
+
+var queryOperators = []string{"=", "!=", "<", "<=", ">", ">="}
+
+// Days in each unit of "added in last 3 weeks"
+var queryPeriods = map[string]int{"day": 1, "week": 7, "month": 30, "year": 365}
+
+// A condition compiled to sql with its parameters
+type queryCondition struct {
+	SQL  string
+	Args []interface{}
+}
+
+// A parsed query, e.g
+// genre=techno AND bpm 124..128 AND added in last 30 days ORDER BY random LIMIT 100
+type libraryQuery struct {
+	Where  queryCondition // empty for every file
+	Tables []string       // from queryJoins
+	Order  []string
+	Limit  int
+	Offset int
+	Hosts  bool // host is in the conditions
+}
+
+type queryToken struct {
+	Text   string
+	Quoted bool
+}
+
+// Split a query into words, quoted strings, operators and brackets
+func tokenizeQuery(s string) ([]queryToken, error) {
+	tokens := make([]queryToken, 0)
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			end := i + 1
+
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+
+			if end == len(runes) {
+				return nil, errors.New("unclosed quote")
+			}
+
+			tokens = append(tokens, queryToken{Text: string(runes[i+1 : end]), Quoted: true})
+			i = end + 1
+		case strings.ContainsRune("=!<>,()", r):
+			if i+1 < len(runes) && runes[i+1] == '=' && strings.ContainsRune("!<>", r) {
+				tokens = append(tokens, queryToken{Text: string(runes[i : i+2])})
+				i += 2
+			} else {
+				tokens = append(tokens, queryToken{Text: string(r)})
+				i++
+			}
+		default:
+			end := i
+
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("=!<>,()\"'", runes[end]) {
+				end++
+			}
+
+			tokens = append(tokens, queryToken{Text: string(runes[i:end])})
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	tables map[string]bool
+	hosts  bool
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+
+	return p.tokens[p.pos], true
+}
+
+func (p *queryParser) next() (queryToken, bool) {
+	token, ok := p.peek()
+
+	if ok {
+		p.pos++
+	}
+
+	return token, ok
+}
+
+// Is the next token this keyword, in any case
+func (p *queryParser) keyword(word string) bool {
+	token, ok := p.peek()
+
+	return ok && !token.Quoted && strings.EqualFold(token.Text, word)
+}
+
+func (p *queryParser) expect(word string) error {
+	if !p.keyword(word) {
+		return fmt.Errorf("expected %s", strings.ToUpper(word))
+	}
+
+	p.pos++
+
+	return nil
+}
+
+// Nothing left but ORDER BY, LIMIT, OFFSET or a closing bracket
+func (p *queryParser) endOfConditions() bool {
+	token, ok := p.peek()
+
+	return !ok || p.keyword("order") || p.keyword("limit") || p.keyword("offset") || p.keyword("or") || (!token.Quoted && token.Text == ")")
+}
+
+func queryFieldNames() string {
+	names := make([]string, 0, len(queryFields))
+
+	for name := range queryFields {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// Look up a field, remembering which tables it needs
+func (p *queryParser) field(name string) (queryField, error) {
+	field, ok := queryFields[strings.ToLower(name)]
+
+	if !ok {
+		return field, fmt.Errorf("unknown field `%s`, try one of %s", name, queryFieldNames())
+	}
+
+	if len(field.Table) > 0 {
+		p.tables[field.Table] = true
+	}
+
+	return field, nil
+}
+
+// Turn a value into what the field's column holds
+func queryValue(field queryField, value string) (interface{}, error) {
+	switch field.Kind {
+	case "number":
+		number, err := strconv.ParseFloat(value, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("`%s` isn't a number", value)
+		}
+
+		return number, nil
+	case "time":
+		date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+
+		if err != nil {
+			return nil, fmt.Errorf("`%s` isn't a date like 2006-01-02", value)
+		}
+
+		return date, nil
+	case "key":
+		key := camelotFromKey(value)
+
+		if len(key) == 0 {
+			return nil, fmt.Errorf("`%s` isn't a key", value)
+		}
+
+		return key, nil
+	}
+
+	return value, nil
+}
+
+// Escape what LIKE treats as special
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// Turn * and ? into a LIKE pattern, anything else matches itself
+func likePattern(value string) string {
+	return strings.NewReplacer("*", "%", "?", "_").Replace(escapeLike(value))
+}
+
+// a OR b OR c
+func (p *queryParser) or() (queryCondition, error) {
+	left, err := p.and()
+
+	if err != nil {
+		return left, err
+	}
+
+	for p.keyword("or") {
+		p.pos++
+
+		right, err := p.and()
+
+		if err != nil {
+			return right, err
+		}
+
+		left = queryCondition{SQL: "(" + left.SQL + " OR " + right.SQL + ")", Args: append(left.Args, right.Args...)}
+	}
+
+	return left, nil
+}
+
+// a AND b, or just a b
+func (p *queryParser) and() (queryCondition, error) {
+	left, err := p.not()
+
+	if err != nil {
+		return left, err
+	}
+
+	for !p.endOfConditions() {
+		if p.keyword("and") {
+			p.pos++
+		}
+
+		right, err := p.not()
+
+		if err != nil {
+			return right, err
+		}
+
+		left = queryCondition{SQL: "(" + left.SQL + " AND " + right.SQL + ")", Args: append(left.Args, right.Args...)}
+	}
+
+	return left, nil
+}
+
+// NOT a, (a OR b), or a condition
+func (p *queryParser) not() (queryCondition, error) {
+	if p.keyword("not") {
+		p.pos++
+
+		condition, err := p.not()
+
+		if err != nil {
+			return condition, err
+		}
+
+		return queryCondition{SQL: "NOT " + condition.SQL, Args: condition.Args}, nil
+	}
+
+	if p.keyword("(") {
+		p.pos++
+
+		condition, err := p.or()
+
+		if err != nil {
+			return condition, err
+		}
+
+		if err := p.expect(")"); err != nil {
+			return condition, err
+		}
+
+		return condition, nil
+	}
+
+	return p.condition()
+}
+
+// field op value, field low..high, field in last 30 days, or a word to
+// look for in the path, artist, title and album
+func (p *queryParser) condition() (queryCondition, error) {
+	name, ok := p.next()
+
+	if !ok || (!name.Quoted && (stringInSlice(name.Text, queryOperators) || name.Text == ")" || name.Text == ",")) {
+		return queryCondition{}, errors.New("expected a field or a word to search for")
+	}
+
+	// "back in black" is three words, "added in last 3 weeks" is a field.
+	// An unknown name before an operator is still a field, to say so.
+	next, _ := p.peek()
+	_, known := queryFields[strings.ToLower(name.Text)]
+	isField := !name.Quoted && !next.Quoted &&
+		(stringInSlice(next.Text, queryOperators) || (known && (strings.EqualFold(next.Text, "in") || strings.Contains(next.Text, ".."))))
+
+	if !isField {
+		return p.term(name), nil
+	}
+
+	field, err := p.field(name.Text)
+
+	if err != nil {
+		return queryCondition{}, err
+	}
+
+	if strings.EqualFold(name.Text, "host") {
+		p.hosts = true
+	}
+
+	if p.keyword("in") {
+		p.pos++
+
+		return p.period(name.Text, field)
+	}
+
+	operator := "="
+
+	if stringInSlice(next.Text, queryOperators) {
+		operator = next.Text
+		p.pos++
+	}
+
+	value, ok := p.next()
+
+	if !ok || (!value.Quoted && stringInSlice(value.Text, []string{"(", ")", ","})) {
+		return queryCondition{}, fmt.Errorf("expected a value after `%s`", name.Text)
+	}
+
+	// a range, 124..128
+	if bounds := strings.SplitN(value.Text, "..", 2); !value.Quoted && len(bounds) == 2 && operator == "=" {
+		low, err := queryValue(field, bounds[0])
+
+		if err != nil {
+			return queryCondition{}, err
+		}
+
+		high, err := queryValue(field, bounds[1])
+
+		if err != nil {
+			return queryCondition{}, err
+		}
+
+		return queryCondition{SQL: field.Column + " BETWEEN ? AND ?", Args: []interface{}{low, high}}, nil
+	}
+
+	// a wildcard, artist=Burial* or title!=*remix*, quoted values are literal
+	if field.Kind == "text" && !value.Quoted && strings.ContainsAny(value.Text, "*?") {
+		switch operator {
+		case "=":
+			return queryCondition{SQL: field.Column + " LIKE ?", Args: []interface{}{likePattern(value.Text)}}, nil
+		case "!=":
+			return notEqual(field, field.Column+" NOT LIKE ?", likePattern(value.Text)), nil
+		}
+
+		return queryCondition{}, fmt.Errorf("wildcards only work with = and !=, not `%s`", operator)
+	}
+
+	v, err := queryValue(field, value.Text)
+
+	if err != nil {
+		return queryCondition{}, err
+	}
+
+	if operator == "!=" {
+		return notEqual(field, field.Column+" != ?", v), nil
+	}
+
+	return queryCondition{SQL: field.Column + " " + operator + " ?", Args: []interface{}{v}}, nil
+}
+
+// spectrum!=lossless should find files that were never scanned too
+func notEqual(field queryField, sql string, value interface{}) queryCondition {
+	if field.nullable() {
+		sql = "(" + sql + " OR " + field.Column + " IS NULL)"
+	}
+
+	return queryCondition{SQL: sql, Args: []interface{}{value}}
+}
+
+// A word or quoted phrase anywhere in the path, artist, title or album
+func (p *queryParser) term(word queryToken) queryCondition {
+	pattern := "%" + likePattern(word.Text) + "%"
+
+	// quoted phrases are literal
+	if word.Quoted {
+		pattern = "%" + escapeLike(word.Text) + "%"
+	}
+
+	columns := make([]string, 0, len(queryTextColumns))
+	args := make([]interface{}, 0, len(queryTextColumns))
+
+	for _, column := range queryTextColumns {
+		columns = append(columns, column+" LIKE ?")
+		args = append(args, pattern)
+	}
+
+	return queryCondition{SQL: "(" + strings.Join(columns, " OR ") + ")", Args: args}
+}
+
+// last 30 days, after "added in"
+func (p *queryParser) period(name string, field queryField) (queryCondition, error) {
+	if field.Kind != "time" {
+		return queryCondition{}, fmt.Errorf("`%s` isn't a date, `in last` only works on added", name)
+	}
+
+	if err := p.expect("last"); err != nil {
+		return queryCondition{}, err
+	}
+
+	count, _ := p.next()
+	n, err := strconv.Atoi(count.Text)
+
+	if err != nil || n <= 0 {
+		return queryCondition{}, fmt.Errorf("`%s` isn't a number of days, weeks, months or years", count.Text)
+	}
+
+	unit, _ := p.next()
+	days, ok := queryPeriods[strings.TrimSuffix(strings.ToLower(unit.Text), "s")]
+
+	if !ok {
+		return queryCondition{}, fmt.Errorf("`%s` isn't days, weeks, months or years", unit.Text)
+	}
+
+	return queryCondition{SQL: field.Column + " >= ?", Args: []interface{}{time.Now().AddDate(0, 0, -n*days)}}, nil
+}
+
+// ORDER BY random, or fields with ASC or DESC
+func (p *queryParser) order() ([]string, error) {
+	order := make([]string, 0)
+
+	for {
+		name, ok := p.next()
+
+		if !ok {
+			return nil, errors.New("expected a field after ORDER BY")
+		}
+
+		if strings.EqualFold(name.Text, "random") {
+			order = append(order, "RAND()")
+		} else {
+			field, err := p.field(name.Text)
+
+			if err != nil {
+				return nil, err
+			}
+
+			direction := "ASC"
+
+			if p.keyword("desc") {
+				direction = "DESC"
+				p.pos++
+			} else if p.keyword("asc") {
+				p.pos++
+			}
+
+			order = append(order, field.Column+" "+direction)
+		}
+
+		if token, ok := p.peek(); !ok || token.Text != "," {
+			return order, nil
+		}
+
+		p.pos++
+	}
+}
+
+// A count after LIMIT or OFFSET
+func (p *queryParser) count(keyword string) (int, error) {
+	token, _ := p.next()
+	n, err := strconv.Atoi(token.Text)
+
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("`%s` isn't a number for %s", token.Text, keyword)
+	}
+
+	return n, nil
+}
+
+// Parse a query, conditions with AND, OR, NOT and brackets, then optional
+// ORDER BY, LIMIT and OFFSET
+func parseQuery(s string) (libraryQuery, error) {
+	query := libraryQuery{}
+
+	tokens, err := tokenizeQuery(s)
+
+	if err != nil {
+		return query, err
+	}
+
+	p := &queryParser{tokens: tokens, tables: make(map[string]bool)}
+
+	if !p.endOfConditions() {
+		if query.Where, err = p.or(); err != nil {
+			return query, err
+		}
+	}
+
+	if p.keyword("order") {
+		p.pos++
+
+		if err := p.expect("by"); err != nil {
+			return query, err
+		}
+
+		if query.Order, err = p.order(); err != nil {
+			return query, err
+		}
+	}
+
+	if p.keyword("limit") {
+		p.pos++
+
+		if query.Limit, err = p.count("LIMIT"); err != nil {
+			return query, err
+		}
+	}
+
+	if p.keyword("offset") {
+		p.pos++
+
+		if query.Offset, err = p.count("OFFSET"); err != nil {
+			return query, err
+		}
+	}
+
+	if token, ok := p.peek(); ok {
+		return query, fmt.Errorf("unexpected `%s`", token.Text)
+	}
+
+	for table := range p.tables {
+		query.Tables = append(query.Tables, table)
+	}
+
+	sort.Strings(query.Tables)
+
+	query.Hosts = p.hosts
+
+	return query, nil
+}
+
+// Only files on one host, unless the query already says which
+func (q libraryQuery) onHost(hostName string) libraryQuery {
+	if q.Hosts {
+		return q
+	}
+
+	condition := queryCondition{SQL: "files.host_name = ?", Args: []interface{}{hostName}}
+
+	if len(q.Where.SQL) > 0 {
+		condition = queryCondition{SQL: "(" + q.Where.SQL + " AND " + condition.SQL + ")", Args: append(q.Where.Args, hostName)}
+	}
+
+	q.Where = condition
+
+	return q
+}
+
+// A file as the query language sees it
+type queryRow struct {
+	ID                 uint      `json:"id"`
+	Path               string    `json:"path"`
+	Base               string    `json:"-"`
+	ExtensionLowerCase string    `json:"format"`
+	Artist             string    `json:"artist"`
+	Title              string    `json:"title"`
+	Album              string    `json:"album"`
+	Genre              string    `json:"genre"`
+	Year               string    `json:"year"`
+	BPM                float64   `json:"bpm"`
+	Camelot            string    `json:"key"`
+	Duration           float64   `json:"duration"`
+	Bitrate            int       `json:"bitrate"`
+	CreatedAt          time.Time `json:"added"`
+}
+
+// Every table the query language joins, so queries work before the scans
+// that fill them have ever run
+func migrateQueryTables(db *gorm.DB) {
+	db.AutoMigrate(&Tag{})
+	db.AutoMigrate(&AudioProperties{})
+	db.AutoMigrate(&BPMKey{})
+	db.AutoMigrate(&TrackLoudness{})
+	db.AutoMigrate(&SpectrumAnalysis{})
+	db.AutoMigrate(&MP3Health{})
+}
+
+// Files with everything the query language can look at joined on
+func queryBase(db *gorm.DB) *gorm.DB {
+	return db.Table("files").
+		Select("files.id, files.path, files.base, files.extension_lower_case, " +
+			"tags.artist, tags.title, tags.album, tags.genre, tags.year, " +
+			queryFields["bpm"].Column + " AS bpm, bpm_keys.camelot, " +
+			"audio_properties.duration, audio_properties.bitrate, files.created_at").
+		Joins("LEFT JOIN tags ON tags.file_id = files.id").
+		Joins("LEFT JOIN audio_properties ON audio_properties.file_id = files.id").
+		Joins("LEFT JOIN bpm_keys ON bpm_keys.file_id = files.id")
+}
+
+// Apply the query's conditions, order and limit
+func (q libraryQuery) apply(query *gorm.DB) *gorm.DB {
+	for _, table := range q.Tables {
+		query = query.Joins(queryJoins[table])
+	}
+
+	if len(q.Where.SQL) > 0 {
+		query = query.Where(q.Where.SQL, q.Where.Args...)
+	}
+
+	for _, order := range q.Order {
+		query = query.Order(order)
+	}
+
+	if len(q.Order) == 0 {
+		query = query.Order("files.path")
+	}
+
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+
+	if q.Offset > 0 {
+		query = query.Offset(q.Offset)
+	}
+
+	return query
+}
+
+// Run a query over every file
+func runQuery(db *gorm.DB, q libraryQuery) []queryRow {
+	rows := make([]queryRow, 0)
+
+	q.apply(queryBase(db)).Scan(&rows)
+
+	return rows
+}
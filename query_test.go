@@ -0,0 +1,240 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeQuery(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []queryToken
+		wantErr bool
+	}{
+		{in: "", want: []queryToken{}},
+		{in: "genre=techno", want: []queryToken{{Text: "genre"}, {Text: "="}, {Text: "techno"}}},
+		{in: "bpm>=120 bpm!=130", want: []queryToken{{Text: "bpm"}, {Text: ">="}, {Text: "120"}, {Text: "bpm"}, {Text: "!="}, {Text: "130"}}},
+		{in: `title="near dark" 'a b'`, want: []queryToken{{Text: "title"}, {Text: "="}, {Text: "near dark", Quoted: true}, {Text: "a b", Quoted: true}}},
+		{in: "(a,b)", want: []queryToken{{Text: "("}, {Text: "a"}, {Text: ","}, {Text: "b"}, {Text: ")"}}},
+		{in: "bpm 124..128", want: []queryToken{{Text: "bpm"}, {Text: "124..128"}}},
+		{in: `title="open`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := tokenizeQuery(test.in)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("tokenizeQuery(%q) error = %v, want error %v", test.in, err, test.wantErr)
+			continue
+		}
+
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenizeQuery(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+// The condition a bare word compiles to
+func termSQL() string {
+	return "(files.path LIKE ? OR tags.artist LIKE ? OR tags.title LIKE ? OR tags.album LIKE ?)"
+}
+
+func termArgs(pattern string) []interface{} {
+	return []interface{}{pattern, pattern, pattern, pattern}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want libraryQuery
+	}{
+		{
+			name: "empty",
+			in:   "",
+			want: libraryQuery{},
+		},
+		{
+			name: "field",
+			in:   "genre=techno",
+			want: libraryQuery{Where: queryCondition{SQL: "tags.genre = ?", Args: []interface{}{"techno"}}},
+		},
+		{
+			name: "field names are case insensitive",
+			in:   "GENRE = techno",
+			want: libraryQuery{Where: queryCondition{SQL: "tags.genre = ?", Args: []interface{}{"techno"}}},
+		},
+		{
+			name: "range",
+			in:   "bpm 124..128",
+			want: libraryQuery{Where: queryCondition{SQL: "COALESCE(NULLIF(tags.bpm, 0), bpm_keys.bpm) BETWEEN ? AND ?", Args: []interface{}{124.0, 128.0}}},
+		},
+		{
+			name: "year is compared as a number",
+			in:   "year=1990..1999",
+			want: libraryQuery{Where: queryCondition{SQL: "CAST(LEFT(tags.year, 4) AS UNSIGNED) BETWEEN ? AND ?", Args: []interface{}{1990.0, 1999.0}}},
+		},
+		{
+			name: "wildcard",
+			in:   "artist=Burial*",
+			want: libraryQuery{Where: queryCondition{SQL: "tags.artist LIKE ?", Args: []interface{}{"Burial%"}}},
+		},
+		{
+			name: "quoted values are literal",
+			in:   `title="100%*"`,
+			want: libraryQuery{Where: queryCondition{SQL: "tags.title = ?", Args: []interface{}{"100%*"}}},
+		},
+		{
+			name: "not equal on files",
+			in:   "format!=mp3",
+			want: libraryQuery{Where: queryCondition{SQL: "files.extension_lower_case != ?", Args: []interface{}{"mp3"}}},
+		},
+		{
+			name: "not equal on a joined table includes missing rows",
+			in:   "spectrum!=lossy",
+			want: libraryQuery{
+				Where:  queryCondition{SQL: "(spectrum_analyses.verdict != ? OR spectrum_analyses.verdict IS NULL)", Args: []interface{}{"lossy"}},
+				Tables: []string{"spectrum_analyses"}},
+		},
+		{
+			name: "not like on a joined table includes missing rows",
+			in:   "title!=*remix*",
+			want: libraryQuery{Where: queryCondition{SQL: "(tags.title NOT LIKE ? OR tags.title IS NULL)", Args: []interface{}{"%remix%"}}},
+		},
+		{
+			name: "key in any notation",
+			in:   "key!=Am",
+			want: libraryQuery{Where: queryCondition{SQL: "(bpm_keys.camelot != ? OR bpm_keys.camelot IS NULL)", Args: []interface{}{"8A"}}},
+		},
+		{
+			name: "words",
+			in:   "burial",
+			want: libraryQuery{Where: queryCondition{SQL: termSQL(), Args: termArgs("%burial%")}},
+		},
+		{
+			name: "in is a word when it doesn't follow a field",
+			in:   "back in black",
+			want: libraryQuery{Where: queryCondition{
+				SQL:  "((" + termSQL() + " AND " + termSQL() + ") AND " + termSQL() + ")",
+				Args: append(append(termArgs("%back%"), termArgs("%in%")...), termArgs("%black%")...)}},
+		},
+		{
+			name: "and, or, not and brackets",
+			in:   "(genre=techno OR genre=house) AND NOT format=mp3",
+			want: libraryQuery{Where: queryCondition{
+				SQL:  "((tags.genre = ? OR tags.genre = ?) AND NOT files.extension_lower_case = ?)",
+				Args: []interface{}{"techno", "house", "mp3"}}},
+		},
+		{
+			name: "host",
+			in:   "host=server",
+			want: libraryQuery{Where: queryCondition{SQL: "files.host_name = ?", Args: []interface{}{"server"}}, Hosts: true},
+		},
+		{
+			name: "order and limit",
+			in:   "genre=techno ORDER BY bpm DESC, random LIMIT 100",
+			want: libraryQuery{
+				Where: queryCondition{SQL: "tags.genre = ?", Args: []interface{}{"techno"}},
+				Order: []string{"COALESCE(NULLIF(tags.bpm, 0), bpm_keys.bpm) DESC", "RAND()"},
+				Limit: 100},
+		},
+		{
+			name: "limit and offset",
+			in:   "genre=techno LIMIT 10 OFFSET 20",
+			want: libraryQuery{Where: queryCondition{SQL: "tags.genre = ?", Args: []interface{}{"techno"}}, Limit: 10, Offset: 20},
+		},
+		{
+			name: "offset without limit",
+			in:   "genre=techno OFFSET 20",
+			want: libraryQuery{Where: queryCondition{SQL: "tags.genre = ?", Args: []interface{}{"techno"}}, Offset: 20},
+		},
+		{
+			name: "only an offset",
+			in:   "offset 5",
+			want: libraryQuery{Offset: 5},
+		},
+		{
+			name: "joined tables once each",
+			in:   "loudness > -9 ORDER BY loudness",
+			want: libraryQuery{
+				Where:  queryCondition{SQL: "track_loudnesses.integrated > ?", Args: []interface{}{-9.0}},
+				Order:  []string{"track_loudnesses.integrated ASC"},
+				Tables: []string{"track_loudnesses"}},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseQuery(test.in)
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got  %+v\n want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []string{
+		"nosuchfield=1",
+		"genre=",
+		"bpm=fast",
+		"year>=199x",
+		"key=H",
+		"bpm<=*0",
+		"genre=techno LIMIT many",
+		"genre=techno OFFSET -1",
+		"(genre=techno",
+		"genre=techno)",
+		"added in last 3 fortnights",
+		"genre in last 3 days",
+		"ORDER BY",
+		"ORDER BY nosuchfield",
+		"= techno",
+	}
+
+	for _, in := range tests {
+		if _, err := parseQuery(in); err == nil {
+			t.Errorf("parseQuery(%q) didn't error", in)
+		}
+	}
+}
+
+func TestOnHost(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want queryCondition
+	}{
+		{
+			name: "no conditions",
+			in:   "",
+			want: queryCondition{SQL: "files.host_name = ?", Args: []interface{}{"local"}},
+		},
+		{
+			name: "added to the conditions",
+			in:   "genre=techno OR genre=house",
+			want: queryCondition{SQL: "((tags.genre = ? OR tags.genre = ?) AND files.host_name = ?)", Args: []interface{}{"techno", "house", "local"}},
+		},
+		{
+			name: "the query says which host",
+			in:   "host=server",
+			want: queryCondition{SQL: "files.host_name = ?", Args: []interface{}{"server"}},
+		},
+	}
+
+	for _, test := range tests {
+		q, err := parseQuery(test.in)
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if got := q.onHost("local").Where; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SyncFailure tracks a file that failed to sync, when to try it next and
+// whether we have given up on it (the dead letter list)
+type SyncFailure struct {
+	ID            uint
+	FileID        uint `gorm:"uniqueIndex"`
+	Attempts      int
+	LastError     string    `gorm:"type:text"`
+	NextAttemptAt time.Time `gorm:"index"`
+	Dead          bool      `gorm:"index"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Exponential backoff with jitter. Attempt starts at 1, the delay doubles
+// each attempt up to max, then a random amount of up to half is taken off
+// so that lots of retries don't all land at the same moment.
+func backoffDelay(attempt int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+
+	for i := 1; i < attempt && delay < max; i++ {
+		delay = delay * 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	half := int64(delay / 2)
+
+	if half <= 0 {
+		return delay
+	}
+
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Subquery of file ids that should not be synced right now
+func blockedSyncFileIDs(db *gorm.DB) *gorm.DB {
+	return db.Model(&SyncFailure{}).
+		Select("file_id").
+		Where("dead = ? OR next_attempt_at > ?", true, time.Now())
+}
+
+// Record a failed attempt at syncing a file, moving it to the dead letter
+// list once it has used up all of its attempts
+func recordSyncFailure(db *gorm.DB, file File, cause error) SyncFailure {
+	failure := SyncFailure{}
+
+	db.Where(&SyncFailure{FileID: file.ID}).FirstOrInit(&failure)
+
+	failure.FileID = file.ID
+	failure.Attempts++
+	failure.LastError = cause.Error()
+
+	if failure.Attempts >= conf.SyncMaxAttempts {
+		log.Printf("Giving up on %s after %d attempts\n", file.Path, failure.Attempts)
+		failure.Dead = true
+	} else {
+		delay := backoffDelay(failure.Attempts, conf.RetryBaseDelay, conf.RetryMaxDelay)
+		log.Printf("Will retry %s in %s\n", file.Path, delay)
+		failure.NextAttemptAt = time.Now().Add(delay)
+	}
+
+	db.Save(&failure)
+
+	return failure
+}
+
+// Forget about previous failures once a file has synced
+func clearSyncFailure(db *gorm.DB, file File) {
+	db.Where(&SyncFailure{FileID: file.ID}).Delete(&SyncFailure{})
+}
+
+// Get everything on the dead letter list
+func getDeadSyncFailures(db *gorm.DB) []SyncFailure {
+	failures := make([]SyncFailure, 0)
+
+	db.Where("dead = ?", true).Order("updated_at").Find(&failures)
+
+	return failures
+}
+
+// deadletter          - list files that have permanently failed to sync
+// deadletter retry    - put every dead file back in the queue
+// deadletter retry 12 - put file 12 back in the queue
+func deadLetter(args []string) {
+	// check db is ready
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	// migrate
+	db.AutoMigrate(&File{})
+	db.AutoMigrate(&SyncFailure{})
+
+	if len(args) > 0 && args[0] == "retry" {
+		query := db.Where("dead = ?", true)
+
+		if len(args) > 1 {
+			id, err := strconv.ParseUint(args[1], 10, 64)
+
+			if err != nil {
+				panic(err) // not a file id
+			}
+
+			query = query.Where(&SyncFailure{FileID: uint(id)})
+		}
+
+		result := query.Delete(&SyncFailure{})
+
+		fmt.Printf("Requeued %d files.\n", result.RowsAffected)
+
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tATTEMPTS\tFAILED AT\tPATH\tLAST ERROR")
+
+	for _, failure := range getDeadSyncFailures(db) {
+		file := File{}
+		db.First(&file, failure.FileID)
+
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n",
+			failure.FileID,
+			failure.Attempts,
+			failure.UpdatedAt.Format(time.RFC3339),
+			file.Path,
+			failure.LastError)
+	}
+
+	w.Flush()
+}
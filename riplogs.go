@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf16"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RipLog is what the .log, .accurip and .nfo files in a release directory
+// say about how it was ripped
+type RipLog struct {
+	ID                    uint      `json:"id"`
+	DirectoryHash         string    `gorm:"uniqueIndex;size:32" json:"-"` // md5 of host and full directory
+	HostName              string    `gorm:"index;size:256" json:"hostName"`
+	Directory             string    `json:"directory"`             // relative to the search directory, like File.Path
+	SourceHash            string    `gorm:"size:32" json:"-"`      // sidecars and audio when it was parsed
+	Sidecars              string    `json:"sidecars"`              // file names it was read from
+	Ripper                string    `gorm:"size:32" json:"ripper"` // EAC, XLD, CUETools
+	RipperVersion         string    `gorm:"size:64" json:"ripperVersion"`
+	Drive                 string    `json:"drive"`
+	ReadMode              string    `json:"readMode"`
+	ReadOffset            string    `gorm:"size:16" json:"readOffset"`
+	TracksTotal           int       `json:"tracksTotal"`
+	TracksAccurate        int       `json:"tracksAccurate"`
+	AccurateRipConfidence int       `json:"accurateRipConfidence"` // lowest of the accurate tracks
+	SuspiciousPositions   int       `json:"suspiciousPositions"`
+	CRCChecked            int       `json:"crcChecked"`
+	CRCMismatched         int       `json:"crcMismatched"`
+	Group                 string    `gorm:"size:64" json:"group"` // scene group from the nfo
+	Source                string    `json:"source"`
+	Encoder               string    `json:"encoder"`
+	Issues                string    `gorm:"type:text" json:"issues"` // ; separated
+	NotRipLog             bool      `json:"-"`                       // the sidecars weren't from a ripper, kept so they aren't read again
+	CreatedAt             time.Time `json:"-"`
+	UpdatedAt             time.Time `json:"-"`
+}
+
+// RipLogTrack is one track of a rip log and how its logged crc compares
+// with the audio we have
+type RipLogTrack struct {
+	ID               uint      `json:"id"`
+	RipLogID         uint      `gorm:"uniqueIndex:idx_rip_log_track_number" json:"ripLogId"`
+	Number           int       `gorm:"uniqueIndex:idx_rip_log_track_number" json:"number"` // 0 for a whole image range
+	FileName         string    `json:"fileName"`
+	FileID           uint      `gorm:"index" json:"fileId"`
+	CopyCRC          string    `gorm:"size:8" json:"copyCrc"`
+	CopyCRCSkipZero  string    `gorm:"size:8" json:"copyCrcSkipZero"`
+	TestCRC          string    `gorm:"size:8" json:"testCrc"`
+	AccurateRip      string    `gorm:"size:16" json:"accurateRip"` // accurate, inaccurate, not present
+	Confidence       int       `json:"confidence"`
+	Suspicious       int       `json:"suspicious"`
+	AudioCRC         string    `gorm:"size:8" json:"audioCrc"`
+	AudioCRCSkipZero string    `gorm:"size:8" json:"audioCrcSkipZero"`
+	CRCStatus        string    `gorm:"size:16" json:"crcStatus"` // match, mismatch, unchecked
+	CreatedAt        time.Time `json:"-"`
+	UpdatedAt        time.Time `json:"-"`
+}
+
+// Sidecars a rip is described by
+var ripLogExtensions = []string{"log", "accurip", "nfo"}
+
+// What a set of sidecars says, before it is matched to files
+type ripText struct {
+	Ripper        string
+	RipperVersion string
+	Drive         string
+	ReadMode      string
+	ReadOffset    string
+	Group         string
+	Source        string
+	Encoder       string
+	Tracks        map[int]*ripTrackText
+}
+
+type ripTrackText struct {
+	FileName        string
+	CopyCRC         string
+	CopyCRCSkipZero string
+	TestCRC         string
+	AccurateRip     string
+	Confidence      int
+	Suspicious      int
+}
+
+func (rip *ripText) track(number int) *ripTrackText {
+	if rip.Tracks[number] == nil {
+		rip.Tracks[number] = &ripTrackText{}
+	}
+
+	return rip.Tracks[number]
+}
+
+var (
+	eacVersionLine      = regexp.MustCompile(`^Exact Audio Copy (V\S+(?: \S+)?) from`)
+	xldVersionLine      = regexp.MustCompile(`^X Lossless Decoder version (\S+)`)
+	cueToolsVersionLine = regexp.MustCompile(`^\[CUETools log; .*Version: ([^\]]+)\]`)
+	driveLine           = regexp.MustCompile(`^Used drive\s*:\s*(.+?)(?:\s+Adapter:.*)?$`)
+	readModeLine        = regexp.MustCompile(`^(?:Read|Ripper) mode\s*:\s*(.+)$`)
+	readOffsetLine      = regexp.MustCompile(`^Read offset correction\s*:\s*(-?\d+)`)
+	trackLine           = regexp.MustCompile(`^Track\s+(\d+)$`)
+	rangeLine           = regexp.MustCompile(`^(Range status and errors|Selected range)`)
+	fileNameLine        = regexp.MustCompile(`^Filename(?:\s*:)?\s+(.+)$`)
+	copyCRCLine         = regexp.MustCompile(`^(?:Copy CRC|CRC32 hash)\s*:?\s*([0-9A-Fa-f]{8})$`)
+	skipZeroCRCLine     = regexp.MustCompile(`^CRC32 hash \(skip zero\)\s*:\s*([0-9A-Fa-f]{8})$`)
+	testCRCLine         = regexp.MustCompile(`^(?:Test CRC|CRC32 hash \(test run\))\s*:?\s*([0-9A-Fa-f]{8})$`)
+	accurateLine        = regexp.MustCompile(`^(?:->)?Accurately ripped.*?confidence (\d+)`)
+	inaccurateLine      = regexp.MustCompile(`^(?:Cannot be verified as accurate|->Rip may not be accurate)`)
+	notPresentLine      = regexp.MustCompile(`^(?:->)?Track not present in AccurateRip database`)
+	suspiciousLine      = regexp.MustCompile(`^(?:Suspicious position|\(\d+\)\s+\d+:\d+:\d+)`)
+	cueToolsARLine      = regexp.MustCompile(`^(\d+)\s+\[[0-9a-fA-F]{8}\|[0-9a-fA-F]{8}\]\s+\((\d+)(?:\+(\d+))?/\d+\)\s+(.+)$`)
+	cueToolsCRCLine     = regexp.MustCompile(`^(\d+|--)\s+[\d.]+\s+\[([0-9A-Fa-f]{8})\]\s+\[([0-9A-Fa-f]{8})\]`)
+	nfoFieldLine        = regexp.MustCompile(`(?i)^[^a-z]*(source|encoder|ripper|grabber|ripped by|quality)[\s.:_]*:\s*(.+?)[^\w)\]]*$`)
+)
+
+// EAC writes UTF-16 logs, everything else is UTF-8 or a code page
+func decodeLogText(b []byte) string {
+	if len(b) >= 2 && ((b[0] == 0xFF && b[1] == 0xFE) || (b[0] == 0xFE && b[1] == 0xFF)) {
+		var order binary.ByteOrder = binary.LittleEndian
+
+		if b[0] == 0xFE {
+			order = binary.BigEndian
+		}
+
+		units := make([]uint16, 0, len(b)/2)
+
+		for i := 2; i+1 < len(b); i += 2 {
+			units = append(units, order.Uint16(b[i:]))
+		}
+
+		return string(utf16.Decode(units))
+	}
+
+	return decodeLegacyText(b)
+}
+
+// Read an EAC or XLD log into rip
+func parseRipperLog(text string, rip *ripText) {
+	current := -1
+	scanner := bufio.NewScanner(strings.NewReader(text))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if match := eacVersionLine.FindStringSubmatch(line); match != nil {
+			rip.Ripper, rip.RipperVersion = "EAC", match[1]
+		} else if match := xldVersionLine.FindStringSubmatch(line); match != nil {
+			rip.Ripper, rip.RipperVersion = "XLD", match[1]
+		} else if match := driveLine.FindStringSubmatch(line); match != nil {
+			rip.Drive = match[1]
+		} else if match := readModeLine.FindStringSubmatch(line); match != nil && len(rip.ReadMode) == 0 {
+			rip.ReadMode = match[1]
+		} else if match := readOffsetLine.FindStringSubmatch(line); match != nil {
+			rip.ReadOffset = match[1]
+		} else if match := trackLine.FindStringSubmatch(line); match != nil {
+			current, _ = strconv.Atoi(match[1])
+		} else if rangeLine.MatchString(line) {
+			current = 0
+		} else if current < 0 {
+			continue
+		} else if match := fileNameLine.FindStringSubmatch(line); match != nil {
+			rip.track(current).FileName = match[1]
+		} else if match := skipZeroCRCLine.FindStringSubmatch(line); match != nil {
+			rip.track(current).CopyCRCSkipZero = strings.ToUpper(match[1])
+		} else if match := testCRCLine.FindStringSubmatch(line); match != nil {
+			rip.track(current).TestCRC = strings.ToUpper(match[1])
+		} else if match := copyCRCLine.FindStringSubmatch(line); match != nil {
+			rip.track(current).CopyCRC = strings.ToUpper(match[1])
+		} else if match := accurateLine.FindStringSubmatch(line); match != nil {
+			rip.track(current).AccurateRip = "accurate"
+			rip.track(current).Confidence, _ = strconv.Atoi(match[1])
+		} else if inaccurateLine.MatchString(line) {
+			rip.track(current).AccurateRip = "inaccurate"
+		} else if notPresentLine.MatchString(line) {
+			rip.track(current).AccurateRip = "not present"
+		} else if suspiciousLine.MatchString(line) {
+			rip.track(current).Suspicious++
+		}
+	}
+}
+
+// Read a CUETools .accurip, only filling in what the ripper log didn't
+func parseAccurip(text string, rip *ripText) {
+	scanner := bufio.NewScanner(strings.NewReader(text))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if match := cueToolsVersionLine.FindStringSubmatch(line); match != nil && len(rip.Ripper) == 0 {
+			rip.Ripper, rip.RipperVersion = "CUETools", match[1]
+		} else if match := cueToolsARLine.FindStringSubmatch(line); match != nil {
+			number, _ := strconv.Atoi(match[1])
+			track := rip.track(number)
+
+			if len(track.AccurateRip) > 0 {
+				continue
+			}
+
+			v1, _ := strconv.Atoi(match[2])
+			v2, _ := strconv.Atoi(match[3])
+
+			switch {
+			case strings.HasPrefix(match[4], "Accurately ripped"):
+				track.AccurateRip, track.Confidence = "accurate", v1+v2
+			case strings.Contains(match[4], "not present"):
+				track.AccurateRip = "not present"
+			default:
+				track.AccurateRip = "inaccurate"
+			}
+		} else if match := cueToolsCRCLine.FindStringSubmatch(line); match != nil {
+			number := 0
+
+			if match[1] != "--" {
+				number, _ = strconv.Atoi(match[1])
+			}
+
+			track := rip.track(number)
+
+			if len(track.CopyCRC) == 0 {
+				track.CopyCRC = strings.ToUpper(match[2])
+				track.CopyCRCSkipZero = strings.ToUpper(match[3])
+			}
+		}
+	}
+}
+
+// Read the few useful fields out of a scene nfo, the group is the last part
+// of the file name, 00-artist-album-2004-grp.nfo
+func parseNfo(text string, fileName string, rip *ripText) {
+	parts := strings.Split(strings.TrimSuffix(fileName, filepath.Ext(fileName)), "-")
+
+	if len(parts) >= 3 {
+		rip.Group = parts[len(parts)-1]
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+
+	for scanner.Scan() {
+		match := nfoFieldLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+
+		if match == nil {
+			continue
+		}
+
+		switch strings.ToLower(match[1]) {
+		case "source":
+			rip.Source = match[2]
+		case "encoder", "quality":
+			if len(rip.Encoder) == 0 {
+				rip.Encoder = match[2]
+			}
+		case "ripper", "grabber", "ripped by":
+			if len(rip.Ripper) == 0 {
+				rip.Ripper = match[2]
+			}
+		}
+	}
+}
+
+// Find the audio file a logged track was ripped to. Logs name the file as
+// it was first written, often a wav that was later encoded, so only the
+// name without the extension is compared. Falls back to the nth audio file.
+func findRipTrackFile(track ripTrackText, number int, audio []File, trackCount int) (File, bool) {
+	if len(track.FileName) > 0 {
+		name := filepath.Base(strings.ReplaceAll(track.FileName, "\\", "/"))
+		stem := strings.TrimSuffix(name, filepath.Ext(name))
+
+		for _, file := range audio {
+			if strings.EqualFold(strings.TrimSuffix(file.FileName, filepath.Ext(file.FileName)), stem) {
+				return file, true
+			}
+		}
+	}
+
+	// an image rip
+	if number == 0 && len(audio) == 1 {
+		return audio[0], true
+	}
+
+	if number > 0 && number <= len(audio) && len(audio) == trackCount {
+		return audio[number-1], true
+	}
+
+	return File{}, false
+}
+
+// Parse the sidecars of one release and compare the logged crcs with the audio
+func parseRipLogToDb(db *gorm.DB, dir string, sidecars []File, audio []File, sourceHash string) error {
+	rip := ripText{Tracks: make(map[int]*ripTrackText)}
+	names := make([]string, 0, len(sidecars))
+
+	// ripper logs first so they win over the accurip
+	sort.SliceStable(sidecars, func(i, j int) bool {
+		return sidecars[i].ExtensionLowerCase == "log" && sidecars[j].ExtensionLowerCase != "log"
+	})
+
+	for _, sidecar := range sidecars {
+		b, err := os.ReadFile(sidecar.Base + sidecar.Path)
+
+		if err != nil {
+			return err
+		}
+
+		text := decodeLogText(b)
+
+		switch sidecar.ExtensionLowerCase {
+		case "log":
+			parseRipperLog(text, &rip)
+		case "accurip":
+			parseAccurip(text, &rip)
+		case "nfo":
+			parseNfo(text, sidecar.FileName, &rip)
+		}
+
+		names = append(names, sidecar.FileName)
+	}
+
+	ripLog := RipLog{DirectoryHash: HashStringMd5(sidecars[0].HostName + sidecars[0].Base + dir)}
+	db.Where(&RipLog{DirectoryHash: ripLog.DirectoryHash}).FirstOrInit(&ripLog)
+
+	// a log from something other than a ripper, and no nfo either
+	ripLog.NotRipLog = len(rip.Tracks) == 0 && len(rip.Ripper) == 0 && len(rip.Group) == 0
+
+	ripLog.HostName = sidecars[0].HostName
+	ripLog.Directory = dir
+	ripLog.SourceHash = sourceHash
+	ripLog.Sidecars = strings.Join(names, ", ")
+	ripLog.Ripper = rip.Ripper
+	ripLog.RipperVersion = rip.RipperVersion
+	ripLog.Drive = rip.Drive
+	ripLog.ReadMode = rip.ReadMode
+	ripLog.ReadOffset = rip.ReadOffset
+	ripLog.Group = rip.Group
+	ripLog.Source = rip.Source
+	ripLog.Encoder = rip.Encoder
+	ripLog.TracksTotal = 0
+	ripLog.TracksAccurate = 0
+	ripLog.AccurateRipConfidence = 0
+	ripLog.SuspiciousPositions = 0
+	ripLog.CRCChecked = 0
+	ripLog.CRCMismatched = 0
+	ripLog.Issues = ""
+	db.Save(&ripLog)
+
+	if ripLog.NotRipLog {
+		db.Where(&RipLogTrack{RipLogID: ripLog.ID}).Delete(&RipLogTrack{})
+		return nil
+	}
+
+	numbers := make([]int, 0, len(rip.Tracks))
+
+	for number := range rip.Tracks {
+		numbers = append(numbers, number)
+	}
+
+	sort.Ints(numbers)
+
+	issues := make([]string, 0)
+	notAccurate := 0
+	notPresent := 0
+	testMismatches := 0
+	missing := 0
+	trackCount := len(numbers)
+
+	if _, ok := rip.Tracks[0]; ok {
+		trackCount--
+	}
+
+	for _, number := range numbers {
+		text := rip.Tracks[number]
+
+		track := RipLogTrack{
+			RipLogID:        ripLog.ID,
+			Number:          number,
+			FileName:        text.FileName,
+			CopyCRC:         text.CopyCRC,
+			CopyCRCSkipZero: text.CopyCRCSkipZero,
+			TestCRC:         text.TestCRC,
+			AccurateRip:     text.AccurateRip,
+			Confidence:      text.Confidence,
+			Suspicious:      text.Suspicious,
+			CRCStatus:       "unchecked"}
+
+		if number > 0 {
+			ripLog.TracksTotal++
+		}
+
+		switch text.AccurateRip {
+		case "accurate":
+			ripLog.TracksAccurate++
+
+			if ripLog.AccurateRipConfidence == 0 || text.Confidence < ripLog.AccurateRipConfidence {
+				ripLog.AccurateRipConfidence = text.Confidence
+			}
+		case "inaccurate":
+			notAccurate++
+		case "not present":
+			notPresent++
+		}
+
+		ripLog.SuspiciousPositions += text.Suspicious
+
+		if len(text.TestCRC) > 0 && len(text.CopyCRC) > 0 && text.TestCRC != text.CopyCRC {
+			testMismatches++
+		}
+
+		file, found := findRipTrackFile(*text, number, audio, trackCount)
+
+		if found {
+			track.FileID = file.ID
+		} else if number > 0 && len(text.CopyCRC) > 0 && len(audio) > 0 {
+			// a whole disc crc next to per track files has nothing to match
+			missing++
+		}
+
+		// the logged crc is of the pcm audio, not the file, so it has to be decoded
+		if found && len(text.CopyCRC) > 0 && stringInSlice(file.ExtensionLowerCase, pcmExtensions) {
+			crc, skipZero, err := pcmCRC32(file.Base+file.Path, file.ExtensionLowerCase)
+
+			if err != nil {
+				log.Println("Could not decode `" + file.Path + "`: " + err.Error())
+			} else {
+				track.AudioCRC = fmt.Sprintf("%08X", crc)
+				track.AudioCRCSkipZero = fmt.Sprintf("%08X", skipZero)
+				track.CRCStatus = "mismatch"
+
+				for _, logged := range []string{text.CopyCRC, text.CopyCRCSkipZero} {
+					if logged == track.AudioCRC || logged == track.AudioCRCSkipZero {
+						track.CRCStatus = "match"
+					}
+				}
+
+				ripLog.CRCChecked++
+
+				if track.CRCStatus == "mismatch" {
+					ripLog.CRCMismatched++
+				}
+			}
+		}
+
+		db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "rip_log_id"}, {Name: "number"}},
+			UpdateAll: true}).Create(&track)
+	}
+
+	if len(numbers) > 0 {
+		db.Where(&RipLogTrack{RipLogID: ripLog.ID}).Where("number NOT IN ?", numbers).Delete(&RipLogTrack{})
+	} else {
+		db.Where(&RipLogTrack{RipLogID: ripLog.ID}).Delete(&RipLogTrack{})
+	}
+
+	lossless := false
+
+	for _, file := range audio {
+		if stringInSlice(file.ExtensionLowerCase, pcmExtensions) {
+			lossless = true
+		}
+	}
+
+	if lossless && len(numbers) == 0 {
+		issues = append(issues, "no rip log")
+	}
+
+	if mode := strings.ToLower(rip.ReadMode); strings.Contains(mode, "burst") {
+		issues = append(issues, "read in burst mode")
+	}
+
+	if notAccurate > 0 {
+		issues = append(issues, fmt.Sprintf("%d tracks not accurate", notAccurate))
+	}
+
+	if notPresent > 0 {
+		issues = append(issues, fmt.Sprintf("%d tracks not in AccurateRip", notPresent))
+	}
+
+	if ripLog.SuspiciousPositions > 0 {
+		issues = append(issues, fmt.Sprintf("%d suspicious positions", ripLog.SuspiciousPositions))
+	}
+
+	if testMismatches > 0 {
+		issues = append(issues, fmt.Sprintf("%d test and copy crcs differ", testMismatches))
+	}
+
+	if ripLog.CRCMismatched > 0 {
+		issues = append(issues, fmt.Sprintf("%d tracks don't match the logged crc", ripLog.CRCMismatched))
+	}
+
+	if missing > 0 {
+		issues = append(issues, fmt.Sprintf("%d logged tracks missing", missing))
+	}
+
+	ripLog.Issues = strings.Join(issues, "; ")
+	db.Save(&ripLog)
+
+	return nil
+}
+
+// Parse the rip logs of every release on this host that has changed. A
+// release is re-read when a sidecar or one of its audio files changes.
+func parseRipLogs(db *gorm.DB, hostName string) {
+	sidecars := make([]File, 0)
+
+	db.Where(&File{HostName: hostName}).
+		Where("extension_lower_case IN ?", ripLogExtensions).
+		Order("path").
+		Find(&sidecars)
+
+	releases := make(map[string][]File)
+
+	for _, sidecar := range sidecars {
+		dir := filepath.Dir(sidecar.Path)
+		releases[dir] = append(releases[dir], sidecar)
+	}
+
+	for dir, release := range releases {
+		neighbours := make([]File, 0)
+
+		db.Where(&File{HostName: hostName, Base: release[0].Base}).
+			Where("path LIKE ?", pathsUnder(dir)).
+			Where("extension_lower_case IN ?", audioExtensions).
+			Order("path").
+			Find(&neighbours)
+
+		audio := make([]File, 0, len(neighbours))
+		hashes := make([]string, 0, len(neighbours)+len(release))
+
+		for _, file := range neighbours {
+			if filepath.Dir(file.Path) == dir {
+				audio = append(audio, file)
+				hashes = append(hashes, file.FileName+strconv.FormatInt(file.Crc32, 16))
+			}
+		}
+
+		for _, sidecar := range release {
+			hashes = append(hashes, sidecar.FileName+strconv.FormatInt(sidecar.Crc32, 16))
+		}
+
+		sourceHash := HashStringMd5(strings.Join(hashes, "|"))
+
+		var count int64
+		db.Model(&RipLog{}).Where(&RipLog{DirectoryHash: HashStringMd5(hostName + release[0].Base + dir), SourceHash: sourceHash}).Count(&count)
+
+		if count > 0 {
+			continue
+		}
+
+		if err := parseRipLogToDb(db, dir, release, audio, sourceHash); err != nil {
+			log.Println("Could not read rip logs in `" + dir + "`: " + err.Error())
+
+			for _, sidecar := range release {
+				recordParseError(db, sidecar, "riplog", "", err)
+			}
+		} else {
+			for _, sidecar := range release {
+				clearParseError(db, sidecar, "riplog")
+			}
+		}
+	}
+}
+
+// A rip log with its tracks
+type ripLogReport struct {
+	RipLog
+	Tracks []RipLogTrack `json:"tracks"`
+}
+
+// Rip logs, only those with issues unless all is set
+func findRipLogs(db *gorm.DB, all bool, path string) []ripLogReport {
+	ripLogs := make([]RipLog, 0)
+	query := db.Where("not_rip_log = ?", false).Order("directory")
+
+	if !all {
+		query = query.Where("issues <> ''")
+	}
+
+	if len(path) > 0 {
+		query = query.Where("directory LIKE ?", "%"+escapeLike(path)+"%")
+	}
+
+	query.Find(&ripLogs)
+
+	reports := make([]ripLogReport, 0, len(ripLogs))
+
+	for _, ripLog := range ripLogs {
+		report := ripLogReport{RipLog: ripLog, Tracks: make([]RipLogTrack, 0)}
+		db.Where(&RipLogTrack{RipLogID: ripLog.ID}).Order("number").Find(&report.Tracks)
+		reports = append(reports, report)
+	}
+
+	return reports
+}
+
+// Print the rip quality of every release, poorly ripped ones by default
+func ripLogs(args []string) {
+	flags := flag.NewFlagSet("riplogs", flag.ExitOnError)
+	all := flags.Bool("all", false, "show releases without issues too")
+	path := flags.String("path", "", "only releases with paths containing this")
+	flags.Parse(args)
+
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&RipLog{})
+	db.AutoMigrate(&RipLogTrack{})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RELEASE\tRIPPER\tDRIVE\tMODE\tACCURATE\tCONFIDENCE\tCRC\tISSUES")
+
+	for _, report := range findRipLogs(db, *all, *path) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d/%d\t%d\t%d/%d\t%s\n",
+			report.Directory,
+			strings.TrimSpace(report.Ripper+" "+report.RipperVersion),
+			report.Drive,
+			report.ReadMode,
+			report.TracksAccurate,
+			report.TracksTotal,
+			report.AccurateRipConfidence,
+			report.CRCChecked-report.CRCMismatched,
+			report.CRCChecked,
+			report.Issues)
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var searchOutputs = []string{"table", "json", "csv"}
+
+func printQueryRows(rows []queryRow) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tARTIST\tTITLE\tGENRE\tBPM\tKEY\tFORMAT\tPATH")
+
+	for _, row := range rows {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%.1f\t%s\t%s\t%s\n", row.ID, row.Artist, row.Title, row.Genre, row.BPM, row.Camelot, row.ExtensionLowerCase, row.Path)
+	}
+
+	w.Flush()
+}
+
+// Every column of the rows, with a header
+func writeQueryCSV(out io.Writer, rows []queryRow) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"id", "path", "format", "artist", "title", "album", "genre", "year", "bpm", "key", "duration", "bitrate", "added"})
+
+	for _, row := range rows {
+		w.Write([]string{
+			strconv.FormatUint(uint64(row.ID), 10),
+			row.Path,
+			row.ExtensionLowerCase,
+			row.Artist,
+			row.Title,
+			row.Album,
+			row.Genre,
+			row.Year,
+			strconv.FormatFloat(row.BPM, 'f', -1, 64),
+			row.Camelot,
+			strconv.FormatFloat(row.Duration, 'f', -1, 64),
+			strconv.Itoa(row.Bitrate),
+			row.CreatedAt.Format(time.RFC3339)})
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
+
+// search [--output table|json|csv] [--limit 100] <query>
+func search(args []string) {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	output := flags.String("output", "table", "table, json or csv")
+	limit := flags.Int("limit", 0, "at most this many files, when the query has no LIMIT")
+	flags.Parse(args)
+
+	if !stringInSlice(*output, searchOutputs) {
+		fmt.Println("`" + *output + "` isn't one of " + strings.Join(searchOutputs, ", "))
+		os.Exit(1)
+	}
+
+	q, err := parseQuery(strings.Join(flags.Args(), " "))
+
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if q.Limit == 0 {
+		q.Limit = *limit
+	}
+
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	migrateQueryTables(db)
+
+	rows := runQuery(db, q)
+
+	switch *output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(rows)
+	case "csv":
+		writeQueryCSV(os.Stdout, rows)
+	default:
+		printQueryRows(rows)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SmartPlaylist is a saved query, its files are worked out again whenever
+// the library changes
+type SmartPlaylist struct {
+	ID          uint      `json:"id"`
+	Name        string    `gorm:"uniqueIndex;size:255" json:"name"`
+	Query       string    `gorm:"type:text" json:"query"`
+	ItemCount   int       `json:"itemCount"`
+	Error       string    `gorm:"type:text" json:"error,omitempty"` // why the last evaluation failed
+	EvaluatedAt time.Time `json:"evaluatedAt"`
+	CreatedAt   time.Time `json:"-"`
+	UpdatedAt   time.Time `json:"-"`
+}
+
+// SmartPlaylistItem is a file found by the last evaluation, in order
+type SmartPlaylistItem struct {
+	ID              uint `json:"id"`
+	SmartPlaylistID uint `gorm:"uniqueIndex:idx_smart_playlist_item_position" json:"smartPlaylistId"`
+	Position        int  `gorm:"uniqueIndex:idx_smart_playlist_item_position" json:"position"` // from 1
+	FileID          uint `gorm:"index" json:"fileId"`
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// Run a smart playlist's query and store what it found. Only files on this
+// host, they are exported as local paths, unless the query names a host.
+func evaluateSmartPlaylist(db *gorm.DB, playlist *SmartPlaylist) ([]queryRow, error) {
+	// parsed every time, "added in last 30 days" moves on
+	q, err := parseQuery(playlist.Query)
+
+	playlist.EvaluatedAt = time.Now()
+
+	if err != nil {
+		playlist.Error = err.Error()
+		db.Save(playlist)
+
+		return nil, err
+	}
+
+	hostName, err := os.Hostname()
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows := runQuery(db, q.onHost(hostName))
+	items := make([]SmartPlaylistItem, 0, len(rows))
+
+	for i, row := range rows {
+		items = append(items, SmartPlaylistItem{SmartPlaylistID: playlist.ID, Position: i + 1, FileID: row.ID})
+	}
+
+	if len(items) > 0 {
+		db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "smart_playlist_id"}, {Name: "position"}},
+			UpdateAll: true}).CreateInBatches(&items, 500)
+	}
+
+	db.Where(&SmartPlaylistItem{SmartPlaylistID: playlist.ID}).Where("position > ?", len(items)).Delete(&SmartPlaylistItem{})
+
+	playlist.ItemCount = len(items)
+	playlist.Error = ""
+	db.Save(playlist)
+
+	return rows, nil
+}
+
+// Evaluate every smart playlist, after the files or tags change
+func refreshSmartPlaylists(db *gorm.DB) {
+	playlists := make([]SmartPlaylist, 0)
+	db.Order("name").Find(&playlists)
+
+	for i := range playlists {
+		if _, err := evaluateSmartPlaylist(db, &playlists[i]); err != nil {
+			log.Println("Could not evaluate smart playlist `" + playlists[i].Name + "`: " + err.Error())
+		}
+	}
+}
+
+// Save a smart playlist, the query has to parse first
+func saveSmartPlaylist(db *gorm.DB, name string, query string) (SmartPlaylist, []queryRow, error) {
+	playlist := SmartPlaylist{}
+
+	if _, err := parseQuery(query); err != nil {
+		return playlist, nil, err
+	}
+
+	db.Where(&SmartPlaylist{Name: name}).FirstOrInit(&playlist)
+	playlist.Name = name
+	playlist.Query = query
+	db.Save(&playlist)
+
+	rows, err := evaluateSmartPlaylist(db, &playlist)
+
+	return playlist, rows, err
+}
+
+// A smart playlist by id or name
+func findSmartPlaylist(db *gorm.DB, idOrName string) (SmartPlaylist, error) {
+	playlist := SmartPlaylist{}
+
+	if id, err := strconv.Atoi(idOrName); err == nil {
+		return playlist, db.First(&playlist, id).Error
+	}
+
+	return playlist, db.Where(&SmartPlaylist{Name: idOrName}).First(&playlist).Error
+}
+
+// The files of the last evaluation, in order
+func findSmartPlaylistItems(db *gorm.DB, playlistID uint) []queryRow {
+	rows := make([]queryRow, 0)
+
+	queryBase(db).
+		Joins("JOIN smart_playlist_items ON smart_playlist_items.file_id = files.id").
+		Where("smart_playlist_items.smart_playlist_id = ?", playlistID).
+		Order("smart_playlist_items.position").
+		Scan(&rows)
+
+	return rows
+}
+
+// Query rows as playlist entries pointing at the local files
+func queryRowEntries(rows []queryRow, target playlistTarget) []playlistEntry {
+	entries := make([]playlistEntry, 0, len(rows))
+
+	for _, row := range rows {
+		entries = append(entries, playlistEntry{
+			Location: target.location(row.Base, row.Path, row.ExtensionLowerCase),
+			Title:    row.Title,
+			Artist:   row.Artist,
+			Duration: row.Duration})
+	}
+
+	return entries
+}
+
+// smartplaylists save <name> <query>, show <name>, export <name>,
+// delete <name>, refresh, or list them
+func smartPlaylists(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	migrateQueryTables(db)
+	db.AutoMigrate(&SmartPlaylist{})
+	db.AutoMigrate(&SmartPlaylistItem{})
+
+	command := ""
+
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	if command == "refresh" {
+		refreshSmartPlaylists(db)
+		return
+	}
+
+	if command == "save" {
+		if len(args) < 3 {
+			fmt.Println(`Usage: smartplaylists save <name> "genre=techno AND bpm 124..128 ORDER BY random LIMIT 100"`)
+			os.Exit(1)
+		}
+
+		playlist, _, err := saveSmartPlaylist(db, args[1], strings.Join(args[2:], " "))
+
+		if err != nil {
+			fmt.Println("Could not save `" + args[1] + "`: " + err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Printf("Saved `%s`, %d files\n", playlist.Name, playlist.ItemCount)
+
+		return
+	}
+
+	if command == "show" || command == "export" || command == "delete" {
+		if len(args) < 2 {
+			fmt.Println("Usage: smartplaylists " + command + " <id or name>")
+			os.Exit(1)
+		}
+
+		playlist, err := findSmartPlaylist(db, args[1])
+
+		if err != nil {
+			fmt.Println("No smart playlist `" + args[1] + "`")
+			os.Exit(1)
+		}
+
+		switch command {
+		case "show":
+			rows, err := evaluateSmartPlaylist(db, &playlist)
+
+			if err != nil {
+				fmt.Println("Could not evaluate `" + playlist.Name + "`: " + err.Error())
+				os.Exit(1)
+			}
+
+			printQueryRows(rows)
+		case "export":
+			exportSmartPlaylist(db, playlist, args[2:])
+		case "delete":
+			db.Where(&SmartPlaylistItem{SmartPlaylistID: playlist.ID}).Delete(&SmartPlaylistItem{})
+			db.Delete(&playlist)
+		}
+
+		return
+	}
+
+	playlists := make([]SmartPlaylist, 0)
+	db.Order("name").Find(&playlists)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tFILES\tEVALUATED\tQUERY")
+
+	for _, playlist := range playlists {
+		query := playlist.Query
+
+		if len(playlist.Error) > 0 {
+			query += " (" + playlist.Error + ")"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", playlist.ID, playlist.Name, playlist.ItemCount, playlist.EvaluatedAt.Format("2006-01-02 15:04"), query)
+	}
+
+	w.Flush()
+}
+
+// smartplaylists export <name> [--format m3u8 --out file --absolute], the
+// files found by the last evaluation as a static playlist
+func exportSmartPlaylist(db *gorm.DB, playlist SmartPlaylist, args []string) {
+	flags := flag.NewFlagSet("smartplaylists export", flag.ExitOnError)
+	format := flags.String("format", "m3u8", "m3u, m3u8, pls or xspf")
+	out := flags.String("out", "", "write to this file instead of stdout")
+	absolute := flags.Bool("absolute", false, "absolute paths instead of relative to the playlist")
+	flags.Parse(args)
+
+	if playlist.EvaluatedAt.IsZero() {
+		if _, err := evaluateSmartPlaylist(db, &playlist); err != nil {
+			fmt.Println("Could not evaluate `" + playlist.Name + "`: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// relative to the current directory when writing to stdout
+	directory, _ := os.Getwd()
+
+	if len(*out) > 0 {
+		directory, _ = filepath.Abs(filepath.Dir(*out))
+	}
+
+	entries := queryRowEntries(findSmartPlaylistItems(db, playlist.ID), localPlaylistTarget(directory, *absolute))
+	b, err := renderPlaylist(*format, playlist.Name, entries)
+
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if len(*out) == 0 {
+		os.Stdout.Write(b)
+		return
+	}
+
+	if err := os.WriteFile(*out, b, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
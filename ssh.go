@@ -2,13 +2,11 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
-	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -34,69 +32,37 @@ func init() {
 }
 
 // Get private key into memory
-func getPrivateKey() []byte {
-	keyFile := conf.SSHKey
-
+func getPrivateKey(keyFile string) ([]byte, error) {
 	file, err := os.Open(keyFile)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer func() {
-		if err = file.Close(); err != nil {
-			log.Fatal(err)
-		}
-	}()
-
-	b, err := ioutil.ReadAll(file)
+	defer file.Close()
 
-	return b
+	return ioutil.ReadAll(file)
 }
 
-// create human-readable SSH-key strings
-func keyString(k ssh.PublicKey) string {
-	return k.Type() + " " + base64.StdEncoding.EncodeToString(k.Marshal()) // e.g. "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTY...."
-}
+// Connect to the backup server, through any jump hosts. Returns the
+// client for the backup server and the jump host connections under it.
+func getSSHClient() (*ssh.Client, []*ssh.Client, error) {
+	target := getSSHTarget()
 
-func trustedHostKeyCallback(trustedKey string) ssh.HostKeyCallback {
-
-	if trustedKey == "" {
-		return func(_ string, _ net.Addr, k ssh.PublicKey) error {
-			log.Printf("WARNING: SSH-key verification is *NOT* in effect: to fix, add this trustedKey: %q", keyString(k))
-			return nil
-		}
-	}
-
-	return func(_ string, _ net.Addr, k ssh.PublicKey) error {
-		ks := keyString(k)
-		if trustedKey != ks {
-			return fmt.Errorf("SSH-key verification: expected %q but got %q", trustedKey, ks)
-		}
+	via, hops, err := dialSSHJumps(getSSHJumpTargets(target))
 
-		return nil
+	if err != nil {
+		log.Println("Failed to dial jump host: " + err.Error())
+		return nil, nil, err
 	}
-}
-
-func getSSHClient() (*ssh.Client, error) {
-	server := conf.SSHServer + ":" + conf.SSHPort
-	user := conf.SSHUser
-
-	signer, _ := ssh.ParsePrivateKey(getPrivateKey())
-
-	clientConfig := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: trustedHostKeyCallback(conf.SSHHostKey)}
 
-	client, err := ssh.Dial("tcp", server, clientConfig)
+	client, err := dialSSHTarget(via, target)
 
 	if err != nil {
 		log.Println("Failed to dial: " + err.Error())
-		return nil, err
+		closeSSHClients(hops)
+		return nil, nil, err
 	}
 
-	return client, nil
+	return client, hops, nil
 }
 
 func waitForSSHClient() {
@@ -105,38 +71,69 @@ func waitForSSHClient() {
 		return
 	}
 
+	attempt := 0
+
 	for {
+		attempt++
+
 		log.Println("Connecting...")
 		// Connect to server
-		client, err := getSSHClient()
+		client, hops, err := getSSHClient()
 
 		if err != nil {
+			delay := backoffDelay(attempt, conf.RetryBaseDelay, conf.RetryMaxDelay)
 			log.Println("SSH Dial failed")
-			log.Println("Sleeping for 10s")
-			time.Sleep(10 * time.Second)
+			log.Println("Sleeping for " + delay.String())
+			time.Sleep(delay)
 			continue
 		}
 
 		log.Println("Connected!")
 
 		sshClient = client
+		sshJumpClients = hops
 
 		break
 	}
 }
 
-// Will keep trying forever
+// Drop a dead connection so that the next session reconnects
+func resetSSHClient() {
+	if sshClient == nil {
+		return
+	}
+
+	log.Println("Dropping SSH connection")
+
+	sshClient.Close()
+	sshClient = nil
+
+	closeSSHClients(sshJumpClients)
+	sshJumpClients = nil
+}
+
+// Will keep trying forever, reconnecting if the connection has dropped
 func getSSHSession() *ssh.Session {
-	waitForSSHClient()
+	attempt := 0
 
-	// try to get new session
-	session, err := sshClient.NewSession()
+	for {
+		attempt++
+
+		waitForSSHClient()
+
+		// try to get new session
+		session, err := sshClient.NewSession()
+
+		if err == nil {
+			return session
+		}
 
-	if err != nil {
 		log.Println("Failed to create session: " + err.Error())
-	}
 
-	return session
+		// The connection is probably stale, start again
+		resetSSHClient()
+		time.Sleep(backoffDelay(attempt, conf.RetryBaseDelay, conf.RetryMaxDelay))
+	}
 }
 
 func testSSH() {
@@ -168,30 +165,58 @@ func remoteRun(command string, session *ssh.Session) (string, error) {
 
 	stdOut := strings.TrimSpace(stdoutBuf.String())
 
+	err = classifySSHError(command, stdOut, err)
+
+	// Make sure the next session gets a fresh connection
+	if isConnectionError(err) {
+		resetSSHClient()
+	}
+
 	return stdOut, err
 }
 
-//
-func fileExistsOnRemoteServer(path string) bool {
+// Run a command in its own session, e.g err := remoteExec("mkdir -p /tmp/a")
+func remoteExec(command string) error {
 	session := getSSHSession()
 	defer session.Close()
 
-	command := "test -f " + shellescape.Quote(path)
-
 	_, err := remoteRun(command, session)
 
-	// non zero output, file does not exist
+	return err
+}
+
+// Run a command that answers yes or no with its exit status, e.g `test -f`.
+// Only a lost connection counts as an error.
+func remoteTest(command string) (bool, error) {
+	err := remoteExec(command)
+
+	// non zero output, the answer is no
+	if isRemoteCommandError(err) {
+		return false, nil
+	}
+
 	if err != nil {
-		return false
+		return false, err
 	}
 
-	// zero output, no errors, file exists
-	return true
+	// zero output, no errors, the answer is yes
+	return true, nil
+}
+
+// Check if file exists on remote server
+func fileExistsOnRemoteServer(path string) (bool, error) {
+	return remoteTest("test -f " + shellescape.Quote(path))
 }
 
 func fileMatchOnRemoteServer(localFullPath string, remoteFullPath string, file File, db *gorm.DB) (bool, error) {
+	exists, err := fileExistsOnRemoteServer(remoteFullPath)
+
+	if err != nil {
+		return false, err
+	}
+
 	// Check remote location for file, if it exists already
-	if fileExistsOnRemoteServer(remoteFullPath) {
+	if exists {
 		// Get an md5 hash of it
 		localMD5, err := hashFileMd5(localFullPath)
 
@@ -199,15 +224,15 @@ func fileMatchOnRemoteServer(localFullPath string, remoteFullPath string, file F
 			return false, err
 		}
 
-		remoteMD5, err := hashFileMD5Remote(remoteFullPath)
+		match, err := remoteFileMatchesMd5(remoteFullPath, localMD5)
 
 		if err != nil {
 			return false, err
 		}
 
 		// If local md5 matches remote md5
-		if localMD5 == remoteMD5 {
-			file.Md5 = remoteMD5
+		if match {
+			file.Md5 = localMD5
 			file.VerifiedAt = time.Now()
 			db.Save(&file)
 			return true, nil
@@ -217,100 +242,78 @@ func fileMatchOnRemoteServer(localFullPath string, remoteFullPath string, file F
 	return false, nil
 }
 
-// recursively create directories required
-func createDirectoryRecursiveRemote(path string) bool {
-	session := getSSHSession()
-	defer session.Close()
+// Does the file on the remote server exist and have this md5
+func remoteFileMatchesMd5(remoteFullPath string, md5 string) (bool, error) {
+	exists, err := fileExistsOnRemoteServer(remoteFullPath)
 
-	command := "mkdir -p " + shellescape.Quote(path)
+	if err != nil || !exists {
+		return false, err
+	}
 
-	_, err := remoteRun(command, session)
+	remoteMD5, err := hashFileMD5Remote(remoteFullPath)
 
-	// non zero output, file does not exist
 	if err != nil {
-		return false
+		return false, err
 	}
 
-	// zero output, no errors, file exists
-	return true
+	return remoteMD5 == md5, nil
 }
 
-// Check if directory exists on remote server
-func directoryExistsRemote(path string) bool {
-	session := getSSHSession()
-	defer session.Close()
-
-	command := "test -d " + shellescape.Quote(path)
-
-	_, err := remoteRun(command, session)
-
-	// non zero output, fail
-	if err != nil {
-		return false
-	}
+// recursively create directories required
+func createDirectoryRecursiveRemote(path string) error {
+	return remoteExec("mkdir -p " + shellescape.Quote(path))
+}
 
-	// zero output, success
-	return true
+// Check if directory exists on remote server
+func directoryExistsRemote(path string) (bool, error) {
+	return remoteTest("test -d " + shellescape.Quote(path))
 }
 
 // Create zero-byte file
-func createEmptyFileRemote(path string) bool {
-	session := getSSHSession()
-	defer session.Close()
+func createEmptyFileRemote(path string) error {
+	return remoteExec("touch " + shellescape.Quote(path))
+}
 
-	command := "touch " + shellescape.Quote(path)
+func createZeroFileOnRemoteServerIfNotExists(remoteFullPath string) error {
+	exists, err := fileExistsOnRemoteServer(remoteFullPath)
 
-	_, err := remoteRun(command, session)
+	// Check remote location for file, if it does exist there is nothing to do
+	if err != nil || exists {
+		return err
+	}
+
+	// Check if directory already exists
+	dirExists, err := directoryExistsRemote(filepath.Dir(remoteFullPath))
 
-	// non zero output, file does not exist
 	if err != nil {
-		return false
+		return err
 	}
 
-	// zero output, no errors, file exists
-	return true
-}
-
-func createZeroFileOnRemoteServerIfNotExists(remoteFullPath string) bool {
-	// Check remote location for file, if it does not exist
-	if !fileExistsOnRemoteServer(remoteFullPath) {
-		// Check if directory already exists
-		if directoryExistsRemote(filepath.Dir(remoteFullPath)) {
-			if createEmptyFileRemote(remoteFullPath) {
-				return true
-			}
-		}
-		// Try to create directories
-		if createDirectoryRecursiveRemote(filepath.Dir(remoteFullPath)) {
-			if createEmptyFileRemote(remoteFullPath) {
-				return true
-			}
+	// Try to create directories
+	if !dirExists {
+		if err := createDirectoryRecursiveRemote(filepath.Dir(remoteFullPath)); err != nil {
+			return err
 		}
 	}
 
-	return false
+	return createEmptyFileRemote(remoteFullPath)
+}
+
+func copyFileRemote(source string, destination string) error {
+	return remoteExec("cp " + shellescape.Quote(source) + " " + shellescape.Quote(destination))
 }
 
-func copyFileRemote(source string, destination string) bool {
+// Get the hostname of the remote server
+func getRemoteHostName() (string, error) {
 	session := getSSHSession()
 	defer session.Close()
 
-	command := "cp " + shellescape.Quote(source) + " " + shellescape.Quote(destination)
-
-	_, err := remoteRun(command, session)
-
-	// non zero output, failed
-	if err != nil {
-		return false
-	}
-
-	// zero output, success
-	return true
+	return remoteRun("hostname", session)
 }
 
 func copyFromOldFolderIfExists(file File, localFullPath string, remoteFullPath string, db *gorm.DB) (bool, error) {
 	// Get remote hostname
-	remoteHostName, err := remoteRun("hostname", getSSHSession())
+	remoteHostName, err := getRemoteHostName()
 
 	if err != nil {
 		log.Println("Could not get remote hostname.")
@@ -340,70 +343,116 @@ func copyFromOldFolderIfExists(file File, localFullPath string, remoteFullPath s
 		// Does local md5 match remote old path md5?
 		if fm {
 			// Create directories on remote server
-			createDirectoryRecursiveRemote(remoteFullPath)
+			if err := createDirectoryRecursiveRemote(filepath.Dir(remoteFullPath)); err != nil {
+				return false, err
+			}
+
 			// Copy file one remote from old location to new location
-			if copyFileRemote(remoteOldFullPath, remoteFullPath) {
-				// Copy success
-				return true, nil
+			if err := copyFileRemote(remoteOldFullPath, remoteFullPath); err != nil {
+				return false, err
 			}
+
+			// Copy success
+			return true, nil
+		}
+
+		return false, nil
+	}
+
+	// Not the same file, but the old folder may have the same recording in
+	// another format or with other tags, worth knowing before it's cleared.
+	// Only logged, copying it would leave a file at the new path that
+	// doesn't match the local one and it would be uploaded again anyway.
+	for _, match := range findSimilarRecordings(db, file.ID, remoteHostName, fingerprintMatchThreshold) {
+		if !strings.HasPrefix(match.Base+match.Path, conf.RemoteOldPath) {
+			continue
 		}
+
+		log.Printf("Old folder has the same recording as `%s` (%.3f)\n", match.Path, match.Similarity)
 	}
 
 	return false, nil
 }
 
+// Upload a file and check it arrived intact
 func uploadFile(localFullPath string, remoteFullPath string, file File, db *gorm.DB) (bool, error) {
+	err := uploadPath(localFullPath, remoteFullPath, file.FileSizeBytes)
+
+	if err != nil {
+		return false, err
+	}
+
+	return fileMatchOnRemoteServer(localFullPath, remoteFullPath, file, db)
+}
+
+// Copy a local file of a known size to the remote server
+func uploadPath(localFullPath string, remoteFullPath string, size int64) error {
 	// time.Duration is in nanoseconds, int64. 1 hour = 1 * 60 * 60 * 1000 * 1000 * 1000
 	var timeOut time.Duration = 10 * 60 * 1000 * 1000 * 1000 // 10 mins
 
+	// Make sure we have a live connection to hand to scp
+	waitForSSHClient()
+
 	scpClient, err := scp.NewClientBySSHWithTimeout(sshClient, timeOut)
 	if err != nil {
 		log.Println("Error creating new SSH session from existing connection", err)
+		resetSSHClient()
+		return &ConnectionError{Err: err}
 	}
 
+	// Close client connection after the file has been copied
+	defer scpClient.Close()
+
 	// Open a file
-	f, _ := os.Open(localFullPath)
+	f, err := os.Open(localFullPath)
+
+	if err != nil {
+		return err
+	}
+
+	// Close the file after it has been copied
+	defer f.Close()
 
-	if !createDirectoryRecursiveRemote(filepath.Dir(remoteFullPath)) {
+	if err := createDirectoryRecursiveRemote(filepath.Dir(remoteFullPath)); err != nil {
 		log.Println("Could not create remote directory " + filepath.Dir(remoteFullPath))
 
-		return false, nil
+		return err
 	}
 
 	log.Println("Uploading `" + filepath.Base(remoteFullPath) + "`")
 
-	// Close client connection after the file has been copied
-	defer scpClient.Close()
-
-	// Close the file after it has been copied
-	defer f.Close()
-
 	// Define chunk size in bytes
 	var chunkSize int64 = 100 * 1000 * 1000 // 100 mb
 
 	// File is larger than chunksize
-	if file.FileSizeBytes > chunkSize {
-		upload, err := uploadFileInChunks(localFullPath, remoteFullPath, file, chunkSize)
-		if upload {
-			return true, nil
+	if size > chunkSize {
+		upload, err := uploadFileInChunks(localFullPath, remoteFullPath, chunkSize)
+		if !upload {
+			log.Println("Error while uploading chunked file ", localFullPath)
 		}
 
-		log.Println("Error while uploading chunked file ", localFullPath)
-		return false, err
+		return err
 	}
 
 	// Usage: CopyFile(fileReader, remotePath, permission)
-	err = scpClient.Copy(f, shellescape.Quote(remoteFullPath), "0644", file.FileSizeBytes)
+	err = scpClient.Copy(f, shellescape.Quote(remoteFullPath), "0644", size)
 
 	if err != nil {
 		fmt.Println("Error while uploading whole file ", localFullPath)
-		return false, err
+
+		err = classifySSHError("scp", "", err)
+
+		if isConnectionError(err) {
+			resetSSHClient()
+		}
+
+		return err
 	}
 
-	return fileMatchOnRemoteServer(localFullPath, remoteFullPath, file, db)
+	return nil
 }
 
-func uploadFileInChunks(localFullPath string, remoteFullPath string, file File, chunkSize int64) (bool, error) {
+func uploadFileInChunks(localFullPath string, remoteFullPath string, chunkSize int64) (bool, error) {
 	random64 := randSeq(64)
 
 	pathPrefix := "/tmp/auralist.tmp." + random64 + ".part"
@@ -465,28 +514,12 @@ func uploadFileInChunks(localFullPath string, remoteFullPath string, file File,
 }
 
 func joinRemoteChunks(pathPrefix string, remoteFullPath string) error {
-	session := getSSHSession()
-	defer session.Close()
-
-	command := "cat " + pathPrefix + "* > " + shellescape.Quote(remoteFullPath)
-
-	_, err := remoteRun(command, session)
-
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return remoteExec("cat " + pathPrefix + "* > " + shellescape.Quote(remoteFullPath))
 }
 
 func deleteRemoteChunks(chunks []string) error {
 	for _, chunk := range chunks {
-		session := getSSHSession()
-		defer session.Close()
-
-		command := "rm " + shellescape.Quote(chunk)
-
-		_, err := remoteRun(command, session)
+		err := remoteExec("rm " + shellescape.Quote(chunk))
 
 		if err != nil {
 			return err
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	// Shared connection to ssh-agent, if there is one
+	sshAgent agent.ExtendedAgent
+
+	// Returned from the host key callback in trusthost to stop the handshake
+	errHostKeyCaptured = errors.New("host key captured")
+)
+
+// Parse a private key, decrypting it with the passphrase if it needs one
+func parsePrivateKey(pemBytes []byte, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+
+	if len(passphrase) == 0 {
+		return nil, errors.New("private key is encrypted, set a key passphrase in config.yml")
+	}
+
+	return ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+}
+
+// Load a private key, and its certificate if there is one
+func loadSigner(target sshTarget) (ssh.Signer, error) {
+	pemBytes, err := getPrivateKey(target.KeyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := parsePrivateKey(pemBytes, target.KeyPassphrase)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", target.KeyFile, err)
+	}
+
+	if len(target.CertFile) == 0 {
+		return signer, nil
+	}
+
+	certBytes, err := ioutil.ReadFile(target.CertFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", target.CertFile, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+
+	if !ok {
+		return nil, errors.New(target.CertFile + " is not a certificate")
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// Signers held by a running ssh-agent, nil if there isn't one
+func sshAgentSigners() []ssh.Signer {
+	if sshAgent == nil {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+
+		if len(socket) == 0 {
+			return nil
+		}
+
+		conn, err := net.Dial("unix", socket)
+
+		if err != nil {
+			log.Println("Could not connect to ssh-agent: " + err.Error())
+			return nil
+		}
+
+		sshAgent = agent.NewClient(conn)
+	}
+
+	signers, err := sshAgent.Signers()
+
+	if err != nil {
+		log.Println("Could not get keys from ssh-agent: " + err.Error())
+		return nil
+	}
+
+	return signers
+}
+
+// Every way we know how to log in to this server. The ssh package only
+// tries each method once, so all keys go into a single publickey method.
+func sshAuthMethods(target sshTarget) ([]ssh.AuthMethod, error) {
+	methods := make([]ssh.AuthMethod, 0)
+	signers := make([]ssh.Signer, 0)
+
+	if len(target.KeyFile) > 0 {
+		signer, err := loadSigner(target)
+
+		if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, signer)
+	}
+
+	signers = append(signers, sshAgentSigners()...)
+
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(target.Password) > 0 {
+		password := target.Password
+
+		methods = append(methods, ssh.Password(password))
+		methods = append(methods, ssh.KeyboardInteractive(
+			func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				// Assume every question is asking for the password
+				answers := make([]string, len(questions))
+
+				for i := range questions {
+					answers[i] = password
+				}
+
+				return answers, nil
+			}))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("no ssh auth methods, set a key, a password or start ssh-agent")
+	}
+
+	return methods, nil
+}
+
+// create human-readable SSH-key strings
+func keyString(k ssh.PublicKey) string {
+	return k.Type() + " " + base64.StdEncoding.EncodeToString(k.Marshal()) // e.g. "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTY...."
+}
+
+// Only accept a single pinned key
+func trustedHostKeyCallback(trustedKey string) ssh.HostKeyCallback {
+	return func(_ string, _ net.Addr, k ssh.PublicKey) error {
+		ks := keyString(k)
+		if trustedKey != ks {
+			return fmt.Errorf("SSH-key verification: expected %q but got %q", trustedKey, ks)
+		}
+
+		return nil
+	}
+}
+
+// Check host keys against known_hosts files. Hashed entries, wildcards and
+// @cert-authority lines are all handled by knownhosts. Hosts that aren't in
+// any of the files yet are refused with an UnknownHostError.
+func knownHostsCallback(files []string) (ssh.HostKeyCallback, error) {
+	existing := make([]string, 0)
+
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+
+	// Nothing has been trusted yet
+	if len(existing) == 0 {
+		return func(hostname string, _ net.Addr, k ssh.PublicKey) error {
+			return &UnknownHostError{Host: hostname, Key: k}
+		}, nil
+	}
+
+	callback, err := knownhosts.New(existing...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+		err := callback(hostname, remote, k)
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return &UnknownHostError{Host: hostname, Key: k}
+		}
+
+		return err
+	}, nil
+}
+
+// Ask known_hosts which key types it holds for an address, so that the
+// server offers one we can check rather than whatever it prefers
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, address string) []string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil
+	}
+
+	placeholder, err := ssh.NewPublicKey(pub)
+
+	if err != nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(address, &net.TCPAddr{}, placeholder), &keyErr) {
+		return nil
+	}
+
+	algorithms := make([]string, 0)
+
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, known.Key.Type())
+		}
+	}
+
+	return algorithms
+}
+
+// Build the client config for one server
+func sshClientConfig(target sshTarget) (*ssh.ClientConfig, error) {
+	auth, err := sshAuthMethods(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:    target.User,
+		Auth:    auth,
+		Timeout: 30 * time.Second}
+
+	// A pinned key in config.yml wins over known_hosts
+	if len(target.HostKey) > 0 {
+		clientConfig.HostKeyCallback = trustedHostKeyCallback(target.HostKey)
+
+		return clientConfig, nil
+	}
+
+	callback, err := knownHostsCallback(target.KnownHosts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig.HostKeyCallback = callback
+	clientConfig.HostKeyAlgorithms = knownHostKeyAlgorithms(callback, target.address())
+
+	return clientConfig, nil
+}
+
+// trusthost - connect to each jump host and then the backup server, show
+// their host keys and add them to known_hosts once confirmed
+func trustHost() {
+	target := getSSHTarget()
+	hosts := append(getSSHJumpTargets(target), target)
+
+	var via *ssh.Client
+	hops := make([]*ssh.Client, 0)
+
+	defer func() {
+		closeSSHClients(hops)
+	}()
+
+	for i, host := range hosts {
+		if !trustSSHTarget(via, host) {
+			return
+		}
+
+		// The backup server itself, nothing left to tunnel through
+		if i == len(hosts)-1 {
+			break
+		}
+
+		client, err := dialSSHTarget(via, host)
+
+		if err != nil {
+			panic(err) // could not connect to jump host
+		}
+
+		hops = append(hops, client)
+		via = client
+	}
+}
+
+// Get the host key a server presents, without logging in
+func captureHostKey(via *ssh.Client, target sshTarget) (ssh.PublicKey, net.Addr, error) {
+	var presented ssh.PublicKey
+	var remoteAddr net.Addr
+
+	clientConfig := &ssh.ClientConfig{
+		User: target.User,
+		HostKeyCallback: func(_ string, remote net.Addr, k ssh.PublicKey) error {
+			presented = k
+			remoteAddr = remote
+			return errHostKeyCaptured
+		},
+		Timeout: 30 * time.Second}
+
+	var err error
+
+	if via == nil {
+		_, err = ssh.Dial("tcp", target.address(), clientConfig)
+	} else {
+		var conn net.Conn
+		conn, err = via.Dial("tcp", target.address())
+
+		if err == nil {
+			_, _, _, err = ssh.NewClientConn(conn, target.address(), clientConfig)
+			conn.Close()
+		}
+	}
+
+	if presented == nil {
+		return nil, nil, err
+	}
+
+	return presented, remoteAddr, nil
+}
+
+// Show a server's host key and add it to known_hosts if confirmed. Returns
+// false if the key was not trusted.
+func trustSSHTarget(via *ssh.Client, target sshTarget) bool {
+	if len(target.HostKey) > 0 {
+		fmt.Printf("%s has a pinned host key in config.yml\n", target.address())
+		return true
+	}
+
+	presented, remoteAddr, err := captureHostKey(via, target)
+
+	if err != nil {
+		panic(err) // could not reach the server
+	}
+
+	fmt.Printf("%s presented a %s key\n", target.address(), presented.Type())
+	fmt.Printf("Fingerprint: %s\n", ssh.FingerprintSHA256(presented))
+
+	callback, err := knownHostsCallback(target.KnownHosts)
+
+	if err != nil {
+		panic(err) // could not read known_hosts
+	}
+
+	err = callback(target.address(), remoteAddr, presented)
+
+	if err == nil {
+		fmt.Printf("Already trusted.\n")
+		return true
+	}
+
+	var unknown *UnknownHostError
+	if !errors.As(err, &unknown) {
+		fmt.Printf("WARNING: this does NOT match the key in known_hosts: %v\n", err)
+		fmt.Printf("Someone could be intercepting the connection, only continue if you know the key changed.\n")
+	}
+
+	fmt.Printf("Trust this key? [y/N] ")
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		fmt.Printf("Not trusted.\n")
+		return false
+	}
+
+	file := target.KnownHosts[0]
+	host := knownhosts.Normalize(target.address())
+
+	if conf.SSHHashKnownHosts {
+		host = knownhosts.HashHostname(host)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		panic(err) // could not create ~/.ssh
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		panic(err) // could not open known_hosts
+	}
+
+	defer f.Close()
+
+	if _, err := f.WriteString(knownhosts.Line([]string{host}, presented) + "\n"); err != nil {
+		panic(err) // could not write known_hosts
+	}
+
+	fmt.Printf("Added to %s\n", file)
+
+	return true
+}
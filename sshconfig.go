@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// sshServerConfig is how an ssh server is described in config.yml
+type sshServerConfig struct {
+	Server        string `yaml:"server"` // hostname, ip or ~/.ssh/config Host alias
+	Port          string `yaml:"port"`
+	User          string `yaml:"user"`
+	Key           string `yaml:"key"`           // path to private key
+	KeyPassphrase string `yaml:"keyPassphrase"` // if the private key is encrypted
+	Password      string `yaml:"password"`      // password or keyboard-interactive auth
+	HostKey       string `yaml:"hostKey"`       // pin a single host key instead of using known_hosts
+}
+
+// sshTarget is everything needed to connect to one ssh server, once
+// ~/.ssh/config has been applied to what was set in config.yml
+type sshTarget struct {
+	Alias         string // name as written in config.yml, may be a Host alias
+	Host          string
+	Port          string
+	User          string
+	KeyFile       string
+	KeyPassphrase string
+	CertFile      string
+	Password      string
+	HostKey       string
+	KnownHosts    []string
+}
+
+// host:port to dial
+func (t sshTarget) address() string {
+	return net.JoinHostPort(t.Host, t.Port)
+}
+
+// Expand a leading ~ to the current user's home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, path[1:])
+}
+
+// Load the ssh config file, nil if there isn't one
+func loadSSHConfig() *ssh_config.Config {
+	f, err := os.Open(expandHome(conf.SSHConfigFile))
+
+	if err != nil {
+		return nil
+	}
+
+	defer f.Close()
+
+	cfg, err := ssh_config.Decode(f)
+
+	if err != nil {
+		log.Println("Could not parse " + conf.SSHConfigFile + ": " + err.Error())
+		return nil
+	}
+
+	return cfg
+}
+
+// Look up a single value for a Host alias, empty if unset
+func sshConfigValue(cfg *ssh_config.Config, alias string, key string) string {
+	if cfg == nil {
+		return ""
+	}
+
+	value, err := cfg.Get(alias, key)
+
+	if err != nil {
+		return ""
+	}
+
+	return value
+}
+
+// Resolve a server through ~/.ssh/config. Anything set in config.yml wins,
+// ~/.ssh/config fills in the gaps, e.g sshServer: "backup" with
+//
+//	Host backup
+//	    HostName backup.example.com
+//	    User sync
+//	    IdentityFile ~/.ssh/backup_ed25519
+func resolveSSHTarget(sc sshServerConfig) sshTarget {
+	cfg := loadSSHConfig()
+	server := sc.Server
+
+	target := sshTarget{
+		Alias:         server,
+		Host:          server,
+		Port:          sc.Port,
+		User:          sc.User,
+		KeyFile:       sc.Key,
+		KeyPassphrase: sc.KeyPassphrase,
+		Password:      sc.Password,
+		HostKey:       sc.HostKey}
+
+	if hostName := sshConfigValue(cfg, server, "HostName"); len(hostName) > 0 {
+		target.Host = hostName
+	}
+
+	if len(target.Port) == 0 {
+		target.Port = sshConfigValue(cfg, server, "Port")
+	}
+
+	if len(target.Port) == 0 {
+		target.Port = "22"
+	}
+
+	if len(target.User) == 0 {
+		target.User = sshConfigValue(cfg, server, "User")
+	}
+
+	if len(target.KeyFile) == 0 {
+		target.KeyFile = sshConfigValue(cfg, server, "IdentityFile")
+	}
+
+	target.KeyFile = expandHome(target.KeyFile)
+
+	target.CertFile = expandHome(sshConfigValue(cfg, server, "CertificateFile"))
+
+	// ssh looks for key-cert.pub next to the key
+	if len(target.CertFile) == 0 && len(target.KeyFile) > 0 {
+		if _, err := os.Stat(target.KeyFile + "-cert.pub"); err == nil {
+			target.CertFile = target.KeyFile + "-cert.pub"
+		}
+	}
+
+	target.KnownHosts = []string{expandHome(conf.SSHKnownHosts)}
+
+	if knownHosts := sshConfigValue(cfg, server, "UserKnownHostsFile"); len(knownHosts) > 0 {
+		target.KnownHosts = nil
+
+		for _, file := range strings.Fields(knownHosts) {
+			target.KnownHosts = append(target.KnownHosts, expandHome(file))
+		}
+	}
+
+	return target
+}
+
+// The backup server from config.yml
+func getSSHTarget() sshTarget {
+	return resolveSSHTarget(sshServerConfig{
+		Server:        conf.SSHServer,
+		Port:          conf.SSHPort,
+		User:          conf.SSHUser,
+		Key:           conf.SSHKey,
+		KeyPassphrase: conf.SSHKeyPassphrase,
+		Password:      conf.SSHPassword,
+		HostKey:       conf.SSHHostKey})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// Connections to the jump hosts that sshClient is tunnelled through, in dial order
+	sshJumpClients []*ssh.Client
+)
+
+// Parse a ProxyJump value, e.g "sync@bastion.example.com:2222,inner"
+func parseProxyJump(value string) []sshServerConfig {
+	jumps := make([]sshServerConfig, 0)
+
+	if len(value) == 0 || strings.ToLower(value) == "none" {
+		return jumps
+	}
+
+	for _, hop := range strings.Split(value, ",") {
+		hop = strings.TrimPrefix(strings.TrimSpace(hop), "ssh://")
+		jump := sshServerConfig{}
+
+		if at := strings.LastIndex(hop, "@"); at >= 0 {
+			jump.User = hop[:at]
+			hop = hop[at+1:]
+		}
+
+		host, port, err := net.SplitHostPort(hop)
+
+		if err != nil {
+			host = hop
+		}
+
+		jump.Server = host
+		jump.Port = port
+
+		jumps = append(jumps, jump)
+	}
+
+	return jumps
+}
+
+// Jump hosts to go through to reach the backup server, from sshJumpHosts in
+// config.yml or failing that ProxyJump in ~/.ssh/config
+func getSSHJumpTargets(target sshTarget) []sshTarget {
+	configs := conf.SSHJumpHosts
+
+	if len(configs) == 0 {
+		configs = parseProxyJump(sshConfigValue(loadSSHConfig(), target.Alias, "ProxyJump"))
+	}
+
+	jumps := make([]sshTarget, 0)
+
+	for _, jc := range configs {
+		jumps = append(jumps, resolveSSHTarget(jc))
+	}
+
+	return jumps
+}
+
+// Connect to a server, directly when via is nil, otherwise tunnelled
+// through the already connected client
+func dialSSHTarget(via *ssh.Client, target sshTarget) (*ssh.Client, error) {
+	clientConfig, err := sshClientConfig(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if via == nil {
+		return ssh.Dial("tcp", target.address(), clientConfig)
+	}
+
+	conn, err := via.Dial("tcp", target.address())
+
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, target.address(), clientConfig)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// Connect to every jump host in turn. Returns the connection to the last
+// one, or nil if there are no jump hosts.
+func dialSSHJumps(jumps []sshTarget) (*ssh.Client, []*ssh.Client, error) {
+	var via *ssh.Client
+	hops := make([]*ssh.Client, 0)
+
+	for _, jump := range jumps {
+		log.Println("Jumping through " + jump.address())
+
+		client, err := dialSSHTarget(via, jump)
+
+		if err != nil {
+			closeSSHClients(hops)
+			return nil, nil, err
+		}
+
+		hops = append(hops, client)
+		via = client
+	}
+
+	return via, hops, nil
+}
+
+// Close connections, innermost first
+func closeSSHClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+)
+
+// How a time range is encoded on the way out, ffmpeg codec and muxer
+type streamFormat struct {
+	Codec       []string
+	Muxer       string
+	ContentType string
+}
+
+var streamFormats = map[string]streamFormat{
+	"flac": {[]string{"-c:a", "flac"}, "flac", "audio/flac"},
+	"wav":  {[]string{"-c:a", "pcm_s16le"}, "wav", "audio/wav"},
+	"mp3":  {[]string{"-c:a", "libmp3lame", "-q:a", "0"}, "mp3", "audio/mpeg"},
+	"opus": {[]string{"-c:a", "libopus", "-b:a", "160k"}, "ogg", "audio/ogg"},
+}
+
+// ffmpeg arguments to cut start to end seconds out of a file, an end of 0
+// runs to the end of the file
+func streamArgs(path string, start float64, end float64, format streamFormat) []string {
+	args := []string{"-v", "error", "-nostdin"}
+
+	// seeking before the input is fast and still sample accurate when decoding
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start, 'f', 3, 64))
+	}
+
+	args = append(args, "-i", path)
+
+	if end > start {
+		args = append(args, "-t", strconv.FormatFloat(end-start, 'f', 3, 64))
+	}
+
+	args = append(args, "-map", "0:a:0", "-map_metadata", "-1")
+	args = append(args, format.Codec...)
+
+	return append(args, "-f", format.Muxer, "pipe:1")
+}
+
+// Stream part of an audio file through ffmpeg, ?format=flac|wav|mp3|opus
+func streamAudioRange(w http.ResponseWriter, r *http.Request, path string, start float64, end float64) {
+	name := r.URL.Query().Get("format")
+
+	if len(name) == 0 {
+		name = "flac"
+	}
+
+	format, ok := streamFormats[name]
+
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown format `" + name + "`"})
+		return
+	}
+
+	if start < 0 || (end > 0 && end <= start) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad time range"})
+		return
+	}
+
+	// killed if the client goes away
+	cmd := exec.CommandContext(r.Context(), "ffmpeg", streamArgs(path, start, end, format)...)
+	cmd.Stdout = w
+
+	w.Header().Set("Content-Type", format.ContentType)
+
+	if err := cmd.Start(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// headers have gone, all that is left is to stop writing
+	if err := cmd.Wait(); err != nil && r.Context().Err() == nil {
+		log.Println("Streaming `" + path + "` failed: " + err.Error())
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TagEdit is the undo journal, one row per file per tagedit run. Previous
+// has the value of every changed field before the edit, fields that weren't
+// set are missing from it.
+type TagEdit struct {
+	ID         uint
+	Batch      string `gorm:"index;size:16"`
+	FileID     uint   `gorm:"index"`
+	Path       string
+	Changes    string `gorm:"type:json"`
+	Previous   string `gorm:"type:json"`
+	Crc32After int64  // to tell if the file changed again before an undo
+	UndoOf     string `gorm:"index;size:16"` // batch this edit undid
+	UndoneBy   string `gorm:"index;size:16"` // batch that undid this edit
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// tagEditRequest picks files and says what to change, from the command
+// line or the HTTP API
+type tagEditRequest struct {
+	IDs    []uint            `json:"ids"`
+	Path   string            `json:"path"`  // path prefix, relative to searchDirectory
+	Match  map[string]string `json:"match"` // tag column = value, e.g album: Donk
+	Query  string            `json:"query"` // search query, e.g genre=donk year<2000
+	Set    map[string]string `json:"set"`
+	Clear  []string          `json:"clear"`
+	DryRun bool              `json:"dryRun"`
+}
+
+type tagEditFileResult struct {
+	FileID   uint              `json:"fileId"`
+	Path     string            `json:"path"`
+	Previous map[string]string `json:"previous"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type tagEditResult struct {
+	Batch  string              `json:"batch"`
+	DryRun bool                `json:"dryRun"`
+	Files  []tagEditFileResult `json:"files"`
+}
+
+// Tag columns that can be used to pick files
+var tagMatchColumns = map[string]string{
+	"title":         "title",
+	"artist":        "artist",
+	"album":         "album",
+	"albumartist":   "album_artist",
+	"composer":      "composer",
+	"year":          "year",
+	"genre":         "genre",
+	"label":         "label",
+	"catalognumber": "catalog_number",
+	"isrc":          "isrc",
+}
+
+// Turn the set and clear lists into changes, in a stable order
+func (req tagEditRequest) changes() ([]tagChange, error) {
+	changes := make([]tagChange, 0)
+
+	for name, value := range req.Set {
+		if _, ok := getTagField(name); !ok {
+			return nil, errors.New("unknown tag field `" + name + "`, choose from " + strings.Join(tagFieldNames(), ", "))
+		}
+
+		changes = append(changes, tagChange{Field: strings.ToLower(name), Value: value})
+	}
+
+	for _, name := range req.Clear {
+		if _, ok := getTagField(name); !ok {
+			return nil, errors.New("unknown tag field `" + name + "`, choose from " + strings.Join(tagFieldNames(), ", "))
+		}
+
+		changes = append(changes, tagChange{Field: strings.ToLower(name), Clear: true})
+	}
+
+	if len(changes) == 0 {
+		return nil, errors.New("nothing to change, use set and/or clear")
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+
+	return changes, nil
+}
+
+// Files on this host picked by the request. At least one of ids, path,
+// match or query has to be given so a typo can't retag the whole library.
+func selectTagEditFiles(db *gorm.DB, hostName string, req tagEditRequest) ([]File, error) {
+	files := make([]File, 0)
+
+	if len(req.IDs) == 0 && len(req.Path) == 0 && len(req.Match) == 0 && len(req.Query) == 0 {
+		return files, errors.New("choose some files with ids, path, match or query")
+	}
+
+	// The query picks ids, the rest narrows them down. Other hosts' files
+	// still drop out below even when the query names a host.
+	queryIDs := make([]uint, 0)
+
+	if len(req.Query) > 0 {
+		q, err := parseQuery(req.Query)
+
+		if err != nil {
+			return files, err
+		}
+
+		if len(q.Where.SQL) == 0 {
+			return files, errors.New("the query needs a condition")
+		}
+
+		for _, row := range runQuery(db, q.onHost(hostName)) {
+			queryIDs = append(queryIDs, row.ID)
+		}
+
+		if len(queryIDs) == 0 {
+			return files, nil
+		}
+	}
+
+	query := db.Model(&File{}).
+		Where("files.host_name = ?", hostName).
+		Where("files.extension_lower_case IN ?", tagWritableExtensions)
+
+	if len(req.IDs) > 0 {
+		query = query.Where("files.id IN ?", req.IDs)
+	}
+
+	if len(queryIDs) > 0 {
+		query = query.Where("files.id IN ?", queryIDs)
+	}
+
+	if len(req.Path) > 0 {
+		query = query.Where("files.path LIKE ?", escapeLike(req.Path)+"%")
+	}
+
+	if len(req.Match) > 0 {
+		query = query.Joins("JOIN tags ON tags.file_id = files.id")
+
+		for name, value := range req.Match {
+			column, ok := tagMatchColumns[strings.ToLower(name)]
+
+			if !ok {
+				return files, errors.New("can't match on `" + name + "`")
+			}
+
+			query = query.Where("tags."+column+" = ?", value)
+		}
+	}
+
+	err := query.Order("files.path").Find(&files).Error
+
+	return files, err
+}
+
+// After a write the file's hashes are out of date and the remote copy is
+// stale, so store the new crc and size and clear md5 to queue a sync
+func updateFileHashes(db *gorm.DB, file *File) error {
+	path := file.Base + file.Path
+
+	crc, err := hashFileCrc32(path)
+
+	if err != nil {
+		return err
+	}
+
+	size, err := getFileSizeInBytes(path)
+
+	if err != nil {
+		return err
+	}
+
+	file.Crc32 = crc
+	file.FileSizeBytes = size
+	file.Md5 = ""
+	file.VerifiedAt = time.Time{}
+
+	return db.Save(file).Error
+}
+
+// Write changes to one file and journal what was there before
+func editFileTags(db *gorm.DB, file File, changes []tagChange, batch string, undoOf string) (map[string]string, error) {
+	path := file.Base + file.Path
+
+	current, err := readTagFields(path, file.ExtensionLowerCase)
+
+	if err != nil {
+		return nil, err
+	}
+
+	previous := make(map[string]string)
+
+	for _, change := range changes {
+		if value, ok := current[change.Field]; ok {
+			previous[change.Field] = value
+		}
+	}
+
+	if err := writeTagFields(path, file.ExtensionLowerCase, changes); err != nil {
+		return previous, err
+	}
+
+	if err := updateFileHashes(db, &file); err != nil {
+		return previous, err
+	}
+
+	changesJSON, _ := json.Marshal(changes)
+	previousJSON, _ := json.Marshal(previous)
+
+	db.Create(&TagEdit{
+		Batch:      batch,
+		FileID:     file.ID,
+		Path:       file.Path,
+		Changes:    string(changesJSON),
+		Previous:   string(previousJSON),
+		Crc32After: file.Crc32,
+		UndoOf:     undoOf})
+
+	// pick up the new tags
+	parseFile(file, db)
+
+	return previous, nil
+}
+
+// Apply a request to every file it picks
+func runTagEdit(db *gorm.DB, req tagEditRequest) (tagEditResult, error) {
+	result := tagEditResult{Batch: randSeq(12), DryRun: req.DryRun, Files: []tagEditFileResult{}}
+
+	changes, err := req.changes()
+
+	if err != nil {
+		return result, err
+	}
+
+	hostName, err := os.Hostname()
+
+	if err != nil {
+		return result, err
+	}
+
+	files, err := selectTagEditFiles(db, hostName, req)
+
+	if err != nil {
+		return result, err
+	}
+
+	for _, file := range files {
+		fileResult := tagEditFileResult{FileID: file.ID, Path: file.Path}
+
+		if req.DryRun {
+			fileResult.Previous, err = readTagFields(file.Base+file.Path, file.ExtensionLowerCase)
+		} else {
+			fileResult.Previous, err = editFileTags(db, file, changes, result.Batch, "")
+		}
+
+		if err != nil {
+			fileResult.Error = err.Error()
+		}
+
+		result.Files = append(result.Files, fileResult)
+	}
+
+	return result, nil
+}
+
+// Put back the values a batch overwrote. The undo is journaled as a batch
+// of its own, so it can be undone too.
+func undoTagEdit(db *gorm.DB, batch string) (tagEditResult, error) {
+	result := tagEditResult{Batch: randSeq(12), Files: []tagEditFileResult{}}
+
+	edits := make([]TagEdit, 0)
+	db.Where(&TagEdit{Batch: batch}).Find(&edits)
+
+	if len(edits) == 0 {
+		return result, errors.New("no tag edits in batch `" + batch + "`")
+	}
+
+	hostName, err := os.Hostname()
+
+	if err != nil {
+		return result, err
+	}
+
+	for _, edit := range edits {
+		fileResult := tagEditFileResult{FileID: edit.FileID, Path: edit.Path}
+		result.Files = append(result.Files, fileResult)
+		last := &result.Files[len(result.Files)-1]
+
+		file := File{}
+
+		if err := db.First(&file, edit.FileID).Error; err != nil {
+			last.Error = err.Error()
+			continue
+		}
+
+		// only files on this machine can be written to
+		if file.HostName != hostName {
+			last.Error = "file is on " + file.HostName
+			continue
+		}
+
+		if len(edit.UndoneBy) > 0 {
+			last.Error = "already undone by batch " + edit.UndoneBy
+			continue
+		}
+
+		if file.Crc32 != edit.Crc32After {
+			last.Error = "file has changed since the edit"
+			continue
+		}
+
+		changes := make([]tagChange, 0)
+		previous := make(map[string]string)
+
+		json.Unmarshal([]byte(edit.Changes), &changes)
+		json.Unmarshal([]byte(edit.Previous), &previous)
+
+		for i, change := range changes {
+			value, ok := previous[change.Field]
+			changes[i] = tagChange{Field: change.Field, Value: value, Clear: !ok}
+		}
+
+		var err error
+
+		last.Previous, err = editFileTags(db, file, changes, result.Batch, batch)
+
+		if err != nil {
+			last.Error = err.Error()
+			continue
+		}
+
+		edit.UndoneBy = result.Batch
+		db.Save(&edit)
+	}
+
+	return result, nil
+}
+
+// Print a result as a table
+func printTagEditResult(result tagEditResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tPATH\tPREVIOUS\tERROR")
+
+	for _, file := range result.Files {
+		previous, _ := json.Marshal(file.Previous)
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", file.FileID, file.Path, previous, file.Error)
+	}
+
+	w.Flush()
+
+	if result.DryRun {
+		fmt.Printf("Dry run, %d files would be changed.\n", len(result.Files))
+	} else {
+		fmt.Printf("Batch %s, undo with: tagedit undo %s\n", result.Batch, result.Batch)
+	}
+}
+
+// List recent tagedit batches
+func printTagEditHistory(db *gorm.DB) {
+	type batchRow struct {
+		Batch     string
+		UndoOf    string
+		Files     int
+		CreatedAt time.Time
+	}
+
+	rows := make([]batchRow, 0)
+
+	db.Model(&TagEdit{}).
+		Select("batch, undo_of, count(*) as files, min(created_at) as created_at").
+		Group("batch, undo_of").
+		Order("created_at desc").
+		Limit(50).
+		Scan(&rows)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BATCH\tEDITED AT\tFILES\tUNDO OF")
+
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", row.Batch, row.CreatedAt.Format(time.RFC3339), row.Files, row.UndoOf)
+	}
+
+	w.Flush()
+}
+
+// repeatable command line flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Split field=value pairs into a map
+func parseKeyValues(pairs []string) (map[string]string, error) {
+	values := make(map[string]string)
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, errors.New("expected field=value, got `" + pair + "`")
+		}
+
+		values[strings.ToLower(strings.TrimSpace(parts[0]))] = parts[1]
+	}
+
+	return values, nil
+}
+
+// tagedit command
+func tagEdit(args []string) {
+	db, e := getDB()
+
+	if e != nil {
+		panic(e) // could not get database
+	}
+
+	db.AutoMigrate(&File{})
+	migrateQueryTables(db)
+	db.AutoMigrate(&ParseError{})
+	db.AutoMigrate(&Artwork{})
+	migrateFileArtwork(db)
+	db.AutoMigrate(&TagEdit{})
+
+	if len(args) > 0 && args[0] == "history" {
+		printTagEditHistory(db)
+		return
+	}
+
+	if len(args) > 1 && args[0] == "undo" {
+		result, err := undoTagEdit(db, args[1])
+
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		printTagEditResult(result)
+		return
+	}
+
+	var ids, sets, clears, matches stringList
+
+	flags := flag.NewFlagSet("tagedit", flag.ExitOnError)
+	flags.Var(&ids, "id", "file id, can be repeated or comma separated")
+	flags.Var(&sets, "set", "field=value to write, can be repeated")
+	flags.Var(&clears, "clear", "field to remove, can be repeated")
+	flags.Var(&matches, "match", "only files whose tag column=value, can be repeated")
+	path := flags.String("path", "", "only files under this path")
+	search := flags.String("query", "", "only files found by this search query")
+	dryRun := flags.Bool("dry-run", false, "show what would change without writing")
+	flags.Parse(args)
+
+	req := tagEditRequest{Path: *path, Query: *search, Clear: clears, DryRun: *dryRun}
+
+	for _, list := range ids {
+		for _, id := range strings.Split(list, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(id))
+
+			if err != nil {
+				fmt.Println("`" + id + "` isn't a file id")
+				os.Exit(1)
+			}
+
+			req.IDs = append(req.IDs, uint(n))
+		}
+	}
+
+	var err error
+
+	if req.Set, err = parseKeyValues(sets); err == nil {
+		req.Match, err = parseKeyValues(matches)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	result, err := runTagEdit(db, req)
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	printTagEditResult(result)
+}
@@ -1,61 +1,389 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	tag "github.com/dhowden/tag"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-// Tag parsed from mp3
+// Tag parsed from an audio file
 type Tag struct {
-	ID        uint
-	FileID    uint `gorm:"index"`
-	Title     string
-	Artist    string
-	Album     string
-	Year      string
-	Genre     string
-	Sum       string
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID                        uint
+	FileID                    uint   `gorm:"uniqueIndex:idx_tag_file"`
+	Format                    string `gorm:"size:16"` // ID3v2.4, VORBIS, MP4...
+	Title                     string
+	Artist                    string
+	Album                     string
+	AlbumArtist               string
+	Composer                  string
+	Year                      string
+	Genre                     string
+	TrackNumber               int
+	TrackTotal                int
+	DiscNumber                int
+	DiscTotal                 int
+	Comment                   string  `gorm:"type:text"`
+	Lyrics                    string  `gorm:"type:text"`
+	MusicBrainzRecordingID    string  `gorm:"index;size:36"`
+	MusicBrainzReleaseID      string  `gorm:"index;size:36"`
+	MusicBrainzReleaseGroupID string  `gorm:"index;size:36"`
+	MusicBrainzArtistID       string  `gorm:"index;size:255"` // can be several, separated by /
+	MusicBrainzAlbumArtistID  string  `gorm:"index;size:255"`
+	ISRC                      string  `gorm:"index;size:32"`
+	Label                     string  `gorm:"index;size:255"`
+	CatalogNumber             string  `gorm:"index;size:64"`
+	BPM                       float64 `gorm:"index"`
+	Key                       string  `gorm:"index;size:8"` // as tagged, e.g Am, F#m, 8A
+	Extra                     string  `gorm:"type:json"`    // every frame not stored in a column above
+	Sum                       string
+	SourceHash                string `gorm:"size:32"` // imohash of the file when it was parsed
+	CreatedAt                 time.Time
+	UpdatedAt                 time.Time
 }
 
-func parseTagsToDb(file File, db *gorm.DB) {
-	f, err := os.Open(file.Path)
+// A raw frame/comment/atom, named so the same field in different formats
+// can be found with the same lookup. ID3 TXXX frames and iTunes ---- atoms
+// are named after their description, e.g "musicbrainz album id".
+type rawTag struct {
+	Key   string      // key to store it under in Extra, e.g TXXX:CATALOGNUMBER
+	Name  string      // lower case lookup name, e.g catalognumber
+	Value interface{} // what was read
+}
+
+// Frames that are already stored in the standard columns, they don't need
+// to go in Extra too. ID3v2.2, ID3v2.3/4, MP4 and vorbis names.
+var standardTagNames = []string{
+	// title, artist, album, album artist, composer
+	"tt2", "tit2", "©nam", "title",
+	"tp1", "tpe1", "©art", "artist",
+	"tal", "talb", "©alb", "album",
+	"tp2", "tpe2", "aart", "albumartist", "album artist", "album_artist",
+	"tcm", "tcom", "©wrt", "composer",
+	// year, genre
+	"tye", "tyer", "tdrc", "tdat", "tdor", "©day", "date", "year",
+	"tco", "tcon", "©gen", "gnre", "genre",
+	// track and disc numbers
+	"trk", "trck", "trkn", "trkn_count", "tracknumber", "tracktotal", "totaltracks",
+	"tpa", "tpos", "disk", "disk_count", "discnumber", "disctotal", "totaldiscs",
+	// comment, lyrics, pictures
+	"com", "comm", "©cmt", "comment", "description",
+	"ult", "uslt", "©lyr", "lyrics", "unsyncedlyrics",
+	"pic", "apic", "covr", "metadata_block_picture",
+}
+
+// Where each of the extra columns can be found, in order of preference
+var (
+	recordingIDNames    = []string{"musicbrainz_trackid", "musicbrainz track id", "ufid:http://musicbrainz.org"}
+	releaseIDNames      = []string{"musicbrainz_albumid", "musicbrainz album id"}
+	releaseGroupIDNames = []string{"musicbrainz_releasegroupid", "musicbrainz release group id"}
+	artistIDNames       = []string{"musicbrainz_artistid", "musicbrainz artist id"}
+	albumArtistIDNames  = []string{"musicbrainz_albumartistid", "musicbrainz album artist id"}
+	isrcNames           = []string{"isrc", "tsrc", "trc"}
+	labelNames          = []string{"label", "organization", "publisher", "tpub", "tpb"}
+	catalogNumberNames  = []string{"catalognumber", "catalog number", "catalog #"}
+	bpmNames            = []string{"bpm", "tbpm", "tbp", "tmpo", "tempo"}
+	keyNames            = []string{"initialkey", "initial key", "key", "tkey", "tke"}
+)
+
+// Flatten the raw frames into something we can look fields up in
+func rawTags(m tag.Metadata) []rawTag {
+	raws := make([]rawTag, 0)
+
+	isID3 := strings.HasPrefix(string(m.Format()), "ID3")
+
+	for key, value := range m.Raw() {
+		// MP4 atom names start with 0xa9, which isn't valid UTF-8
+		if strings.HasPrefix(key, "\xa9") {
+			key = "©" + key[1:]
+		}
+
+		// ID3 appends _0, _1... to repeated frames
+		frame := key
+		if i := strings.Index(frame, "_"); isID3 && i > 0 {
+			frame = frame[:i]
+		}
+
+		raw := rawTag{Key: key, Name: strings.ToLower(frame), Value: value}
+
+		switch v := value.(type) {
+		case *tag.Comm:
+			// user defined text, named after its description
+			if frame == "TXXX" || frame == "TXX" {
+				raw.Key = frame + ":" + v.Description
+				raw.Name = strings.ToLower(v.Description)
+			}
+		case *tag.UFID:
+			raw.Key = frame + ":" + v.Provider
+			raw.Name = "ufid:" + strings.ToLower(v.Provider)
+		case *tag.Picture:
+			// artwork is handled separately, don't copy the image data
+			raw.Value = map[string]string{"mime": v.MIMEType, "type": v.Type, "description": v.Description}
+		}
+
+		raws = append(raws, raw)
+	}
+
+	return raws
+}
+
+// Turn a raw value into text
+func rawTagText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(strings.TrimRight(v, "\x00"))
+	case *tag.Comm:
+		return strings.TrimSpace(v.Text)
+	case *tag.UFID:
+		return strings.TrimSpace(string(v.Identifier))
+	case int:
+		return strconv.Itoa(v)
+	}
+
+	return ""
+}
+
+// First non-empty value for any of the names
+func findRawTag(raws []rawTag, names []string, used map[string]bool) string {
+	for _, name := range names {
+		for _, raw := range raws {
+			if raw.Name != name {
+				continue
+			}
+
+			if text := rawTagText(raw.Value); len(text) > 0 {
+				used[raw.Key] = true
+				return text
+			}
+		}
+	}
+
+	return ""
+}
+
+// Parse a BPM tag, e.g "128", "127.98", "128 BPM"
+func parseBPM(s string) float64 {
+	fields := strings.Fields(strings.ReplaceAll(s, ",", "."))
+
+	if len(fields) == 0 {
+		return 0
+	}
+
+	bpm, err := strconv.ParseFloat(fields[0], 64)
+
+	if err != nil {
+		return 0
+	}
+
+	return bpm
+}
+
+// Build a Tag from everything dhowden/tag could read
+func tagFromMetadata(m tag.Metadata) Tag {
+	year := ""
+
+	if m.Year() > 0 {
+		year = strconv.Itoa(m.Year())
+	}
+
+	trackNumber, trackTotal := m.Track()
+	discNumber, discTotal := m.Disc()
+
+	t := Tag{
+		Format:      string(m.Format()),
+		Title:       m.Title(),
+		Artist:      m.Artist(),
+		Album:       m.Album(),
+		AlbumArtist: m.AlbumArtist(),
+		Composer:    m.Composer(),
+		Year:        year,
+		Genre:       m.Genre(),
+		TrackNumber: trackNumber,
+		TrackTotal:  trackTotal,
+		DiscNumber:  discNumber,
+		DiscTotal:   discTotal,
+		Comment:     m.Comment(),
+		Lyrics:      m.Lyrics()}
+
+	raws := rawTags(m)
+	used := make(map[string]bool)
+
+	t.MusicBrainzRecordingID = findRawTag(raws, recordingIDNames, used)
+	t.MusicBrainzReleaseID = findRawTag(raws, releaseIDNames, used)
+	t.MusicBrainzReleaseGroupID = findRawTag(raws, releaseGroupIDNames, used)
+	t.MusicBrainzArtistID = findRawTag(raws, artistIDNames, used)
+	t.MusicBrainzAlbumArtistID = findRawTag(raws, albumArtistIDNames, used)
+	t.ISRC = findRawTag(raws, isrcNames, used)
+	t.Label = findRawTag(raws, labelNames, used)
+	t.CatalogNumber = findRawTag(raws, catalogNumberNames, used)
+	t.BPM = parseBPM(findRawTag(raws, bpmNames, used))
+	t.Key = findRawTag(raws, keyNames, used)
+
+	// Keep everything else so nothing is lost
+	extra := make(map[string]interface{})
+
+	for _, raw := range raws {
+		if used[raw.Key] || stringInSlice(raw.Name, standardTagNames) {
+			continue
+		}
+
+		extra[raw.Key] = raw.Value
+	}
+
+	t.Extra = "{}"
+
+	if b, err := json.Marshal(extra); err == nil {
+		t.Extra = string(b)
+	}
+
+	return t
+}
+
+// Read the tags of a file and insert or update its row. Files without any
+// tags (wav, aiff...) still get an empty row so they aren't parsed again.
+func parseTagsToDb(file File, sourceHash string, db *gorm.DB) error {
+	f, err := os.Open(file.Base + file.Path)
 
 	if err != nil {
-		panic(err) // deal with this soon...
+		return err
 	}
 
+	defer f.Close()
+
 	sum, err := tag.Sum(f)
 
 	if err != nil {
-		panic(err) // deal with this soon...
+		return err
+	}
+
+	// Sum leaves the file wherever the audio ended
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
 	}
 
-	// try tag read method 1
+	t := Tag{Extra: "{}"}
+
 	m, err := tag.ReadFrom(f)
 
 	if err == nil {
-		year := ""
+		fmt.Printf("%s - %s - %s\n", m.Artist(), m.Title(), m.Album())
+
+		t = tagFromMetadata(m)
+	} else if !errors.Is(err, tag.ErrNoTagsFound) {
+		return err
+	}
+
+	t.FileID = file.ID
+	t.Sum = sum
+	t.SourceHash = sourceHash
+
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}},
+		UpdateAll: true}).Create(&t).Error
+}
+
+// Has the file been parsed (or failed to parse) since it last changed
+func tagIsCurrent(db *gorm.DB, file File, sourceHash string) bool {
+	var count int64
+
+	db.Model(&Tag{}).Where(&Tag{FileID: file.ID, SourceHash: sourceHash}).Count(&count)
+
+	return count > 0 || parseErrorIsCurrent(db, file, "tags", sourceHash)
+}
 
-		if m.Year() > 0 {
-			year = strconv.Itoa(m.Year())
+// Parse the tags and stream properties of one file, recording what went wrong
+func parseFile(file File, db *gorm.DB) {
+	sourceHash, err := hashFileImo(file.Base + file.Path)
+
+	if err != nil {
+		log.Println("Could not read `" + file.Path + "`: " + err.Error())
+		recordParseError(db, file, "read", "", err)
+		return
+	}
+
+	clearParseError(db, file, "read")
+
+	// an unchanged file only goes through the stages that failed on an older
+	// version of it, a stage that failed on this one would fail again
+	changed := !tagIsCurrent(db, file, sourceHash)
+
+	if changed {
+		if err := parseTagsToDb(file, sourceHash, db); err != nil {
+			log.Println("Could not read tags of `" + file.Path + "`: " + err.Error())
+			recordParseError(db, file, "tags", sourceHash, err)
+		} else {
+			clearParseError(db, file, "tags")
 		}
+	}
 
-		fmt.Printf("%s - %s - %s\n", m.Artist(), m.Title(), m.Album())
+	if changed || hasStaleParseError(db, file, "properties", sourceHash) {
+		if err := parseAudioPropertiesToDb(file, db); err != nil {
+			log.Println("Could not read audio properties of `" + file.Path + "`: " + err.Error())
+			recordParseError(db, file, "properties", sourceHash, err)
+		} else {
+			clearParseError(db, file, "properties")
+		}
+	}
 
-		db.Create(&Tag{
-			FileID: file.ID,
-			Title:  m.Title(),
-			Artist: m.Artist(),
-			Album:  m.Album(),
-			Year:   year,
-			Genre:  m.Genre(),
-			Sum:    sum})
+	if changed || hasStaleParseError(db, file, "artwork", sourceHash) {
+		if err := parseArtworkToDb(file, db); err != nil {
+			log.Println("Could not read artwork of `" + file.Path + "`: " + err.Error())
+			recordParseError(db, file, "artwork", sourceHash, err)
+		} else {
+			clearParseError(db, file, "artwork")
+		}
 	}
 }
+
+// Parse every audio file on this host that is new or has changed, with one
+// worker per cpu, then link up any loose cover images, read cue sheets and
+// rip logs and regroup albums
+func parseFiles(db *gorm.DB, hostName string) {
+	jobs := make(chan File)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for file := range jobs {
+				parseFile(file, db)
+			}
+		}()
+	}
+
+	batch := make([]File, 0)
+
+	db.Where(&File{HostName: hostName}).
+		Where("extension_lower_case IN ?", audioExtensions).
+		FindInBatches(&batch, 500, func(tx *gorm.DB, n int) error {
+			for _, file := range batch {
+				jobs <- file
+			}
+
+			return nil
+		})
+
+	close(jobs)
+	wg.Wait()
+
+	linkSidecarArtwork(db, hostName)
+	parseCueSheets(db, hostName)
+	parseRipLogs(db, hostName)
+	parsePlaylists(db, hostName)
+	buildLibrary(db, hostName)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var errTagWriteUnsupported = errors.New("writing tags to this format isn't supported")
+
+// tagField is a field tagedit can set, and where it lives in each format.
+// ID3 text frames are named by id, TXXX:description and UFID:owner are user
+// frames, MP4 ----:mean:name atoms are iTunes freeform ones. The first
+// vorbis name is the one written, the others are removed along with it.
+type tagField struct {
+	Name   string
+	ID3    string
+	Vorbis []string
+	MP4    string
+}
+
+var tagFields = []tagField{
+	{"title", "TIT2", []string{"TITLE"}, "©nam"},
+	{"artist", "TPE1", []string{"ARTIST"}, "©ART"},
+	{"album", "TALB", []string{"ALBUM"}, "©alb"},
+	{"albumartist", "TPE2", []string{"ALBUMARTIST", "ALBUM ARTIST"}, "aART"},
+	{"composer", "TCOM", []string{"COMPOSER"}, "©wrt"},
+	{"year", "TDRC", []string{"DATE", "YEAR"}, "©day"},
+	{"genre", "TCON", []string{"GENRE"}, "©gen"},
+	{"track", "TRCK", []string{"TRACKNUMBER", "TRACKTOTAL", "TOTALTRACKS"}, "trkn"},
+	{"disc", "TPOS", []string{"DISCNUMBER", "DISCTOTAL", "TOTALDISCS"}, "disk"},
+	{"comment", "COMM", []string{"COMMENT", "DESCRIPTION"}, "©cmt"},
+	{"bpm", "TBPM", []string{"BPM"}, "tmpo"},
+	{"key", "TKEY", []string{"INITIALKEY", "KEY"}, "----:com.apple.iTunes:initialkey"},
+	{"isrc", "TSRC", []string{"ISRC"}, "----:com.apple.iTunes:ISRC"},
+	{"label", "TPUB", []string{"LABEL", "ORGANIZATION", "PUBLISHER"}, "----:com.apple.iTunes:LABEL"},
+	{"catalognumber", "TXXX:CATALOGNUMBER", []string{"CATALOGNUMBER"}, "----:com.apple.iTunes:CATALOGNUMBER"},
+	{"musicbrainz_recordingid", "UFID:http://musicbrainz.org", []string{"MUSICBRAINZ_TRACKID"}, "----:com.apple.iTunes:MusicBrainz Track Id"},
+	{"musicbrainz_releaseid", "TXXX:MusicBrainz Album Id", []string{"MUSICBRAINZ_ALBUMID"}, "----:com.apple.iTunes:MusicBrainz Album Id"},
+	{"musicbrainz_releasegroupid", "TXXX:MusicBrainz Release Group Id", []string{"MUSICBRAINZ_RELEASEGROUPID"}, "----:com.apple.iTunes:MusicBrainz Release Group Id"},
+	{"musicbrainz_artistid", "TXXX:MusicBrainz Artist Id", []string{"MUSICBRAINZ_ARTISTID"}, "----:com.apple.iTunes:MusicBrainz Artist Id"},
+	{"musicbrainz_albumartistid", "TXXX:MusicBrainz Album Artist Id", []string{"MUSICBRAINZ_ALBUMARTISTID"}, "----:com.apple.iTunes:MusicBrainz Album Artist Id"},
+	{"replaygain_track_gain", "TXXX:REPLAYGAIN_TRACK_GAIN", []string{"REPLAYGAIN_TRACK_GAIN"}, "----:com.apple.iTunes:replaygain_track_gain"},
+	{"replaygain_track_peak", "TXXX:REPLAYGAIN_TRACK_PEAK", []string{"REPLAYGAIN_TRACK_PEAK"}, "----:com.apple.iTunes:replaygain_track_peak"},
+	{"replaygain_album_gain", "TXXX:REPLAYGAIN_ALBUM_GAIN", []string{"REPLAYGAIN_ALBUM_GAIN"}, "----:com.apple.iTunes:replaygain_album_gain"},
+	{"replaygain_album_peak", "TXXX:REPLAYGAIN_ALBUM_PEAK", []string{"REPLAYGAIN_ALBUM_PEAK"}, "----:com.apple.iTunes:replaygain_album_peak"},
+	{"r128_track_gain", "TXXX:R128_TRACK_GAIN", []string{"R128_TRACK_GAIN"}, "----:com.apple.iTunes:R128_TRACK_GAIN"},
+	{"r128_album_gain", "TXXX:R128_ALBUM_GAIN", []string{"R128_ALBUM_GAIN"}, "----:com.apple.iTunes:R128_ALBUM_GAIN"},
+}
+
+// Extensions tagedit can write to
+var tagWritableExtensions = []string{"mp3", "flac", "m4a", "mp4"}
+
+// tagChange sets a field, or removes it when Clear is set
+type tagChange struct {
+	Field string `json:"field"`
+	Value string `json:"value,omitempty"`
+	Clear bool   `json:"clear,omitempty"`
+}
+
+func getTagField(name string) (tagField, bool) {
+	for _, field := range tagFields {
+		if field.Name == strings.ToLower(name) {
+			return field, true
+		}
+	}
+
+	return tagField{}, false
+}
+
+// Names of every field tagedit knows, for error messages
+func tagFieldNames() []string {
+	names := make([]string, len(tagFields))
+
+	for i, field := range tagFields {
+		names[i] = field.Name
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Split "3/12" into number and total
+func splitNumberTotal(value string) (string, string) {
+	parts := strings.SplitN(value, "/", 2)
+
+	if len(parts) == 1 {
+		return strings.TrimSpace(parts[0]), ""
+	}
+
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// Read the current value of every field set in a file. Fields that aren't
+// set are missing from the map.
+func readTagFields(path string, extension string) (map[string]string, error) {
+	switch strings.ToLower(extension) {
+	case "mp3":
+		return readID3Fields(path)
+	case "flac":
+		return readVorbisFields(path)
+	case "m4a", "mp4":
+		return readMP4Fields(path)
+	}
+
+	return nil, errTagWriteUnsupported
+}
+
+// Apply changes to the tags of a file
+func writeTagFields(path string, extension string, changes []tagChange) error {
+	switch strings.ToLower(extension) {
+	case "mp3":
+		return writeID3Fields(path, changes)
+	case "flac":
+		return writeVorbisFields(path, changes)
+	case "m4a", "mp4":
+		return writeMP4Fields(path, changes)
+	}
+
+	return errTagWriteUnsupported
+}
+
+// Replace a file with a new version, written to a temp file next to it and
+// renamed over the original so a failed write never leaves half a file
+func rewriteFile(path string, write func(w io.Writer) error) error {
+	stat, err := os.Stat(path)
+
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), ".tmp."+randSeq(16)+filepath.Ext(path))
+
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, stat.Mode().Perm())
+
+	if err != nil {
+		return err
+	}
+
+	err = write(out)
+
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Copy the rest of a file from an offset
+func copyFrom(w io.Writer, f *os.File, offset int64) error {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(w, f)
+
+	return err
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// syncProfile maps lossless source formats to a lossy target format, e.g
+//
+//	syncProfiles:
+//	  phone:
+//	    formats: ["flac", "wav", "aiff", "aif"]
+//	    format: "opus"
+//	    quality: "160"
+type syncProfile struct {
+	Formats   []string `yaml:"formats"`   // source extensions to transcode, everything else is copied as-is
+	Format    string   `yaml:"format"`    // opus, mp3, aac, or anything else when a command is set
+	Extension string   `yaml:"extension"` // target extension, defaults to format
+	Quality   string   `yaml:"quality"`   // passed to the encoder, e.g "160" for opus, "0" for mp3 V0
+	Command   string   `yaml:"command"`   // encoder, {input} {output} and {quality} are replaced
+}
+
+// Encoder commands used when a profile doesn't set its own. Tags and cover
+// art are carried across by the encoder: opusenc copies both from flac,
+// ffmpeg maps the metadata and the attached picture stream.
+var defaultEncoderCommands = map[string]string{
+	"opus": "opusenc --quiet --bitrate {quality} {input} {output}",
+	"mp3":  "ffmpeg -v error -y -i {input} -map 0:a -map 0:v? -c:v copy -map_metadata 0 -id3v2_version 3 -c:a libmp3lame -q:a {quality} {output}",
+	"aac":  "ffmpeg -v error -y -i {input} -map 0:a -map 0:v? -c:v copy -disposition:v attached_pic -map_metadata 0 -c:a aac -b:a {quality} -f ipod {output}",
+}
+
+// Extensions that differ from the format name, raw .aac (ADTS) can't hold
+// tags or cover art so aac goes in an mp4 container
+var defaultEncoderExtensions = map[string]string{
+	"aac": "m4a",
+}
+
+// Default quality per format, opus 160kbps, mp3 V0 and aac 256kbps
+var defaultEncoderQuality = map[string]string{
+	"opus": "160",
+	"mp3":  "0",
+	"aac":  "256k",
+}
+
+// Transcode is a lossy copy of a File made for a sync profile. Md5 is of the
+// transcoded artifact, the File row keeps the md5 of the source.
+type Transcode struct {
+	ID         uint
+	FileID     uint   `gorm:"uniqueIndex:idx_transcode_file_profile"`
+	Profile    string `gorm:"uniqueIndex:idx_transcode_file_profile;size:64"`
+	SourceMd5  string `gorm:"index;size:32"` // md5 of the source file when it was transcoded
+	CacheKey   string `gorm:"index;size:32"` // md5 of source md5 + encoder settings
+	CachePath  string // cache/transcode/ab/abcdef....opus
+	Md5        string `gorm:"index;size:32"`
+	SizeBytes  int64
+	RemotePath string
+	VerifiedAt time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// The profile chosen with syncProfile in config.yml
+func activeSyncProfile() (string, syncProfile, bool) {
+	name := strings.ToLower(conf.SyncProfile)
+
+	if len(name) == 0 {
+		return "", syncProfile{}, false
+	}
+
+	profile, ok := conf.SyncProfiles[name]
+
+	if !ok {
+		panic("syncProfile `" + name + "` is not in syncProfiles")
+	}
+
+	return name, profile, true
+}
+
+// Should files with this extension be transcoded
+func (p syncProfile) transcodes(extension string) bool {
+	return stringInSlice(strings.ToLower(extension), p.Formats)
+}
+
+// Target file extension
+func (p syncProfile) extension() string {
+	if len(p.Extension) > 0 {
+		return strings.ToLower(p.Extension)
+	}
+
+	if extension, ok := defaultEncoderExtensions[strings.ToLower(p.Format)]; ok {
+		return extension
+	}
+
+	return strings.ToLower(p.Format)
+}
+
+func (p syncProfile) quality() string {
+	if len(p.Quality) > 0 {
+		return p.Quality
+	}
+
+	return defaultEncoderQuality[strings.ToLower(p.Format)]
+}
+
+func (p syncProfile) command() string {
+	if len(p.Command) > 0 {
+		return p.Command
+	}
+
+	return defaultEncoderCommands[strings.ToLower(p.Format)]
+}
+
+// Build the encoder command line. Placeholders are replaced per argument
+// rather than going through a shell, so paths with spaces are safe.
+func (p syncProfile) encoderArgs(input string, output string) ([]string, error) {
+	fields := strings.Fields(p.command())
+
+	if len(fields) == 0 {
+		return nil, errors.New("no encoder command for format `" + p.Format + "`")
+	}
+
+	replacer := strings.NewReplacer(
+		"{input}", input,
+		"{output}", output,
+		"{quality}", p.quality())
+
+	args := make([]string, len(fields))
+
+	for i, field := range fields {
+		args[i] = replacer.Replace(field)
+	}
+
+	return args, nil
+}
+
+// Identifies the artifact, changes when the source or the encoder settings change
+func (p syncProfile) cacheKey(sourceMd5 string) string {
+	return HashStringMd5(sourceMd5 + "|" + p.extension() + "|" + p.quality() + "|" + p.command())
+}
+
+// Swap the extension on a path, donk.flac -> donk.opus
+func replaceExtension(path string, extension string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "." + extension
+}
+
+// Where an artifact lives in the local cache, split by the first two
+// characters so no single directory gets too big
+func transcodeCachePath(key string, extension string) string {
+	return filepath.Join("cache", "transcode", key[0:2], key+"."+extension)
+}
+
+// Run the encoder into a temp file then move it into the cache, so a
+// failed encode never leaves a half written artifact behind
+func encodeFile(profile syncProfile, input string, output string) error {
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+
+	// keep the extension so the encoder knows what to write
+	tmp := filepath.Join(filepath.Dir(output), ".tmp."+randSeq(16)+filepath.Ext(output))
+
+	args, err := profile.encoderArgs(input, tmp)
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("Transcoding `" + filepath.Base(input) + "`")
+
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+
+	return os.Rename(tmp, output)
+}
+
+// Get the transcoded artifact for a file, encoding it only if there isn't
+// already one in the cache for this source and these settings
+func getTranscode(db *gorm.DB, file File, name string, profile syncProfile, sourceMd5 string) (Transcode, error) {
+	transcode := Transcode{}
+
+	db.Where(&Transcode{FileID: file.ID, Profile: name}).FirstOrInit(&transcode)
+
+	key := profile.cacheKey(sourceMd5)
+	cachePath := transcodeCachePath(key, profile.extension())
+
+	// Up to date and still in the cache
+	if transcode.CacheKey == key && len(transcode.Md5) > 0 {
+		if _, err := os.Stat(transcode.CachePath); err == nil {
+			return transcode, nil
+		}
+	}
+
+	// Another file with the same audio may already have been encoded
+	if _, err := os.Stat(cachePath); err != nil {
+		if err := encodeFile(profile, file.Base+file.Path, cachePath); err != nil {
+			return transcode, err
+		}
+	}
+
+	md5, err := hashFileMd5(cachePath)
+
+	if err != nil {
+		return transcode, err
+	}
+
+	size, err := getFileSizeInBytes(cachePath)
+
+	if err != nil {
+		return transcode, err
+	}
+
+	transcode.FileID = file.ID
+	transcode.Profile = name
+	transcode.SourceMd5 = sourceMd5
+	transcode.CacheKey = key
+	transcode.CachePath = cachePath
+	transcode.Md5 = md5
+	transcode.SizeBytes = size
+	transcode.VerifiedAt = time.Time{}
+
+	db.Save(&transcode)
+
+	return transcode, nil
+}
+
+// Sync the transcoded version of a file instead of the file itself
+func syncTranscodedFile(file File, name string, profile syncProfile, db *gorm.DB) error {
+	localFullPath := file.Base + file.Path
+
+	sourceMd5, err := hashFileMd5(localFullPath)
+
+	if err != nil {
+		return &SyncError{Op: "hash", Path: localFullPath, Err: err}
+	}
+
+	transcode, err := getTranscode(db, file, name, profile, sourceMd5)
+
+	if err != nil {
+		return &SyncError{Op: "transcode", Path: localFullPath, Err: err}
+	}
+
+	relPath := replaceExtension(file.Path, profile.extension())
+	remoteFullPath := conf.RemotePath + relPath
+
+	if conf.EncryptRemote {
+		remoteFullPath, err = syncEncrypted(db, file, transcode.CachePath, relPath, transcode.Md5)
+	} else {
+		err = uploadTranscode(transcode, remoteFullPath)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	transcode.RemotePath = remoteFullPath
+	transcode.VerifiedAt = now
+	db.Save(&transcode)
+
+	file.Md5 = sourceMd5
+	file.VerifiedAt = now
+	db.Save(&file)
+
+	return nil
+}
+
+// Upload a transcoded file unless the remote already has it
+func uploadTranscode(transcode Transcode, remoteFullPath string) error {
+	log.Println("S: " + transcode.CachePath)
+	log.Println("D: " + remoteFullPath)
+
+	match, err := remoteFileMatchesMd5(remoteFullPath, transcode.Md5)
+
+	if err != nil {
+		return &SyncError{Op: "match", Path: transcode.CachePath, Err: err}
+	}
+
+	if match {
+		log.Println("Skipping file that already exists.")
+		return nil
+	}
+
+	if err := uploadPath(transcode.CachePath, remoteFullPath, transcode.SizeBytes); err != nil {
+		return &SyncError{Op: "upload", Path: transcode.CachePath, Err: err}
+	}
+
+	match, err = remoteFileMatchesMd5(remoteFullPath, transcode.Md5)
+
+	if err != nil {
+		return &SyncError{Op: "verify", Path: transcode.CachePath, Err: err}
+	}
+
+	if !match {
+		return &SyncError{Op: "verify", Path: transcode.CachePath, Err: errChecksumMismatch}
+	}
+
+	return nil
+}
@@ -12,6 +12,16 @@ func stringInSlice(a string, list []string) bool {
 	return false
 }
 
+// Does an int exist in a slice of ints
+func intInSlice(a int, list []int) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
 // trimLeftChars removes 'n' characters (runes) from string 's'
 func trimLeftChars(s string, n int) string {
 	m := 0
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// flacBlock is a metadata block, kept as raw bytes
+type flacBlock struct {
+	Type byte
+	Data []byte
+}
+
+// flacMetadata is everything before the audio in a flac file
+type flacMetadata struct {
+	Prefix     int64 // bytes before fLaC, usually an ID3 tag, kept as-is
+	Blocks     []flacBlock
+	AudioStart int64
+}
+
+// vorbisComments is the body of a VORBIS_COMMENT block
+type vorbisComments struct {
+	Vendor   string
+	Comments []string // NAME=value
+}
+
+func readFLACMetadata(f *os.File) (flacMetadata, error) {
+	meta := flacMetadata{}
+
+	header := make([]byte, 10)
+
+	if _, err := io.ReadFull(f, header); err != nil {
+		return meta, err
+	}
+
+	meta.Prefix = id3v2Size(header)
+
+	magic := make([]byte, 4)
+
+	if _, err := f.ReadAt(magic, meta.Prefix); err != nil || string(magic) != "fLaC" {
+		return meta, errUnknownContainer
+	}
+
+	if _, err := f.Seek(meta.Prefix+4, io.SeekStart); err != nil {
+		return meta, err
+	}
+
+	offset := meta.Prefix + 4
+
+	for {
+		blockHeader := make([]byte, 4)
+
+		if _, err := io.ReadFull(f, blockHeader); err != nil {
+			return meta, err
+		}
+
+		length := int(blockHeader[1])<<16 | int(blockHeader[2])<<8 | int(blockHeader[3])
+		block := flacBlock{Type: blockHeader[0] & 0x7F, Data: make([]byte, length)}
+
+		if _, err := io.ReadFull(f, block.Data); err != nil {
+			return meta, err
+		}
+
+		meta.Blocks = append(meta.Blocks, block)
+		offset += 4 + int64(length)
+
+		if blockHeader[0]&0x80 != 0 {
+			break
+		}
+	}
+
+	meta.AudioStart = offset
+
+	return meta, nil
+}
+
+func parseVorbisComments(b []byte) (vorbisComments, error) {
+	vc := vorbisComments{}
+	errShort := errors.New("short vorbis comment block")
+
+	if len(b) < 4 {
+		return vc, errShort
+	}
+
+	vendorLength := int(binary.LittleEndian.Uint32(b[0:4]))
+
+	if 8+vendorLength > len(b) || vendorLength < 0 {
+		return vc, errShort
+	}
+
+	vc.Vendor = string(b[4 : 4+vendorLength])
+	pos := 4 + vendorLength
+	count := int(binary.LittleEndian.Uint32(b[pos : pos+4]))
+	pos += 4
+
+	for i := 0; i < count; i++ {
+		if pos+4 > len(b) {
+			return vc, errShort
+		}
+
+		length := int(binary.LittleEndian.Uint32(b[pos : pos+4]))
+		pos += 4
+
+		if length < 0 || pos+length > len(b) {
+			return vc, errShort
+		}
+
+		vc.Comments = append(vc.Comments, string(b[pos:pos+length]))
+		pos += length
+	}
+
+	return vc, nil
+}
+
+func (vc vorbisComments) bytes() []byte {
+	b := make([]byte, 4, 64)
+	binary.LittleEndian.PutUint32(b, uint32(len(vc.Vendor)))
+	b = append(b, vc.Vendor...)
+
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, uint32(len(vc.Comments)))
+	b = append(b, count...)
+
+	for _, comment := range vc.Comments {
+		length := make([]byte, 4)
+		binary.LittleEndian.PutUint32(length, uint32(len(comment)))
+		b = append(b, length...)
+		b = append(b, comment...)
+	}
+
+	return b
+}
+
+// First value for any of the names, names are case insensitive
+func (vc vorbisComments) get(names ...string) (string, bool) {
+	for _, name := range names {
+		for _, comment := range vc.Comments {
+			parts := strings.SplitN(comment, "=", 2)
+
+			if len(parts) == 2 && strings.EqualFold(parts[0], name) {
+				return parts[1], true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// Remove every comment with one of the names
+func (vc *vorbisComments) remove(names ...string) {
+	comments := make([]string, 0, len(vc.Comments))
+
+	for _, comment := range vc.Comments {
+		name := strings.SplitN(comment, "=", 2)[0]
+		keep := true
+
+		for _, remove := range names {
+			if strings.EqualFold(name, remove) {
+				keep = false
+			}
+		}
+
+		if keep {
+			comments = append(comments, comment)
+		}
+	}
+
+	vc.Comments = comments
+}
+
+// The comments of a flac file, and which block they were in (-1 if none)
+func (meta flacMetadata) comments() (vorbisComments, int, error) {
+	for i, block := range meta.Blocks {
+		if block.Type == 4 {
+			vc, err := parseVorbisComments(block.Data)
+
+			return vc, i, err
+		}
+	}
+
+	return vorbisComments{Vendor: "auralist"}, -1, nil
+}
+
+func readVorbisFields(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	meta, err := readFLACMetadata(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	vc, _, err := meta.comments()
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+
+	for _, field := range tagFields {
+		// numbers and totals are separate comments
+		if field.Name == "track" || field.Name == "disc" {
+			number, ok := vc.get(field.Vorbis[0])
+
+			if !ok {
+				continue
+			}
+
+			if total, ok := vc.get(field.Vorbis[1:]...); ok && !strings.Contains(number, "/") {
+				number += "/" + total
+			}
+
+			values[field.Name] = number
+
+			continue
+		}
+
+		if value, ok := vc.get(field.Vorbis...); ok {
+			values[field.Name] = value
+		}
+	}
+
+	return values, nil
+}
+
+func writeVorbisFields(path string, changes []tagChange) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	meta, err := readFLACMetadata(f)
+
+	if err != nil {
+		return err
+	}
+
+	vc, index, err := meta.comments()
+
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		field, ok := getTagField(change.Field)
+
+		if !ok {
+			return errors.New("unknown tag field `" + change.Field + "`")
+		}
+
+		vc.remove(field.Vorbis...)
+
+		if change.Clear {
+			continue
+		}
+
+		if field.Name == "track" || field.Name == "disc" {
+			number, total := splitNumberTotal(change.Value)
+			vc.Comments = append(vc.Comments, field.Vorbis[0]+"="+number)
+
+			if len(total) > 0 {
+				vc.Comments = append(vc.Comments, field.Vorbis[1]+"="+total)
+			}
+
+			continue
+		}
+
+		vc.Comments = append(vc.Comments, field.Vorbis[0]+"="+change.Value)
+	}
+
+	block := flacBlock{Type: 4, Data: vc.bytes()}
+
+	if len(block.Data) >= 1<<24 {
+		return errors.New("vorbis comments too big for a flac metadata block")
+	}
+
+	if index >= 0 {
+		meta.Blocks[index] = block
+	} else {
+		// straight after STREAMINFO
+		meta.Blocks = append(meta.Blocks[:1], append([]flacBlock{block}, meta.Blocks[1:]...)...)
+	}
+
+	return rewriteFile(path, func(w io.Writer) error {
+		if meta.Prefix > 0 {
+			if _, err := io.Copy(w, io.NewSectionReader(f, 0, meta.Prefix)); err != nil {
+				return err
+			}
+		}
+
+		if _, err := w.Write([]byte("fLaC")); err != nil {
+			return err
+		}
+
+		for i, block := range meta.Blocks {
+			header := []byte{block.Type, byte(len(block.Data) >> 16), byte(len(block.Data) >> 8), byte(len(block.Data))}
+
+			if i == len(meta.Blocks)-1 {
+				header[0] |= 0x80
+			}
+
+			if _, err := w.Write(header); err != nil {
+				return err
+			}
+
+			if _, err := w.Write(block.Data); err != nil {
+				return err
+			}
+		}
+
+		return copyFrom(w, f, meta.AudioStart)
+	})
+}